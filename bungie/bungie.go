@@ -1,12 +1,17 @@
 package bungie
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"strings"
 
 	"github.com/rking788/destiny-gear-vendor/db"
 )
 
+// ErrItemNotFound is returned when there is no asset definition for an item hash.
+var ErrItemNotFound = errors.New("No item found with the specified item hash")
+
 func GetAssetDefinition(itemHash uint) (*GearAssetDefinition, error) {
 	db, err := db.GetAssetDBConnection()
 	if err != nil {
@@ -14,13 +19,21 @@ func GetAssetDefinition(itemHash uint) (*GearAssetDefinition, error) {
 	}
 
 	definition, err := db.GetAssetDefinition(itemHash)
-	if err != nil {
+	if err == sql.ErrNoRows {
+		return nil, ErrItemNotFound
+	} else if err != nil {
 		return nil, err
 	}
 
+	return ParseAssetDefinition(itemHash, definition)
+}
+
+// ParseAssetDefinition decodes the asset definition JSON stored in the DB for the item.
+func ParseAssetDefinition(itemHash uint, definition string) (*GearAssetDefinition, error) {
+
 	assetDefinition := &GearAssetDefinition{}
 	decoder := json.NewDecoder(strings.NewReader(definition))
-	err = decoder.Decode(assetDefinition)
+	err := decoder.Decode(assetDefinition)
 	if err != nil {
 		return nil, err
 	}
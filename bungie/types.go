@@ -1,6 +1,9 @@
 package bungie
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 )
 
@@ -70,6 +73,20 @@ type GearAssetDefinition struct {
 	Content []*GearContent `json:"content"`
 }
 
+// ContentVersion identifies the gear and content of the definition, it changes whenever the item
+// is changed in the manifest.
+func (def *GearAssetDefinition) ContentVersion() string {
+
+	// Map keys are encoded in order so the same content always has the same version
+	encoded, _ := json.Marshal(struct {
+		Gear    []string       `json:"gear"`
+		Content []*GearContent `json:"content"`
+	}{def.Gear, def.Content})
+	sum := sha1.Sum(encoded)
+
+	return hex.EncodeToString(sum[:8])
+}
+
 type GearContent struct {
 	Platform        string                 `json:"platform"`
 	Geometry        []string               `json:"geometry"`
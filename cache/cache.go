@@ -0,0 +1,420 @@
+// Package cache stores converted models on disk, addressed by everything that went into the
+// conversion: the item, the version of its content in the manifest, the format and the options.
+// Entries are evicted least recently used first once the cache grows past its size limit.
+package cache
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// metadataName is the file in every entry directory describing the entry.
+	metadataName = "entry.json"
+	// stagingPrefix starts the names of the directories conversions are written to before they
+	// are added to the cache.
+	stagingPrefix = ".staging-"
+	// lastUsedInterval is how stale the last use written to an entry's metadata can get. Uses
+	// are tracked in memory and only written out this often, so the order of the entries
+	// survives a restart without every cache hit writing to disk.
+	lastUsedInterval = time.Minute
+)
+
+// Key identifies a converted model. Version changes whenever the content of the item changes in
+// the manifest, so models written from older content are never returned.
+type Key struct {
+	Hash    uint   `json:"hash"`
+	Version string `json:"version"`
+	Format  string `json:"format"`
+	Options string `json:"options"`
+}
+
+// ID is the content address of the key, the entry is stored in a directory with this name.
+func (key Key) ID() string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%d/%s/%s/%s", key.Hash, key.Version, key.Format, key.Options)))
+	return hex.EncodeToString(sum[:])
+}
+
+// Entry describes a model stored in the cache along with any other files (textures, parts) that
+// were written with it.
+type Entry struct {
+	Key Key `json:"key"`
+	// Result is the name of the model file (or split manifest) in the entry directory.
+	Result    string    `json:"result"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"createdAt"`
+	LastUsed  time.Time `json:"lastUsed"`
+
+	dir     string
+	element *list.Element
+	// saved is the LastUsed stored in the metadata file.
+	saved time.Time
+}
+
+// Dir is the directory holding all of the files of the entry.
+func (entry Entry) Dir() string {
+	return entry.dir
+}
+
+// Path is the path of the model file of the entry.
+func (entry Entry) Path() string {
+	return filepath.Join(entry.dir, entry.Result)
+}
+
+// ETag identifies the contents of the entry for HTTP caching, a model written again for the same
+// key gets a new tag.
+func (entry Entry) ETag() string {
+	return fmt.Sprintf(`"%s-%x"`, entry.Key.ID()[:16], entry.CreatedAt.UnixNano())
+}
+
+// Stats describes how much is stored in a cache.
+type Stats struct {
+	Entries int   `json:"entries"`
+	Size    int64 `json:"size"`
+	MaxSize int64 `json:"maxSize"`
+}
+
+// Cache is a directory of converted models. It is safe to use from several goroutines, but only
+// one Cache should use a directory at a time.
+type Cache struct {
+	dir     string
+	maxSize int64
+
+	mutex   sync.Mutex
+	entries map[string]*Entry
+	// lru orders the entries from the most to the least recently used.
+	lru  *list.List
+	size int64
+}
+
+// Open loads the cache stored in dir, creating the directory if it doesn't exist yet. Anything
+// left behind by conversions that never finished is removed, other files and directories that
+// aren't cache entries are left alone. A maxSize of zero (or less) lets the cache grow without a
+// limit.
+func Open(dir string, maxSize int64) (*Cache, error) {
+
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	cache := &Cache{
+		dir:     dir,
+		maxSize: maxSize,
+		entries: make(map[string]*Entry),
+		lru:     list.New(),
+	}
+
+	loaded := make([]*Entry, 0, len(files))
+	for _, file := range files {
+		path := filepath.Join(dir, file.Name())
+		if !file.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(file.Name(), stagingPrefix) {
+			os.RemoveAll(path)
+			continue
+		}
+		if !isEntryID(file.Name()) {
+			continue
+		}
+
+		entry, err := readEntry(path)
+		if err != nil || entry.Key.ID() != file.Name() {
+			// Entries that were only partly written or removed
+			os.RemoveAll(path)
+			continue
+		}
+		loaded = append(loaded, entry)
+	}
+
+	sort.Slice(loaded, func(i, j int) bool {
+		return loaded[i].LastUsed.After(loaded[j].LastUsed)
+	})
+	for _, entry := range loaded {
+		entry.element = cache.lru.PushBack(entry)
+		cache.entries[entry.Key.ID()] = entry
+		cache.size += entry.Size
+	}
+
+	cache.mutex.Lock()
+	cache.evict("")
+	cache.mutex.Unlock()
+
+	return cache, nil
+}
+
+// Stage creates a new directory to write a conversion into, it is then added with Put. The
+// directory is in the cache directory so it can be renamed into place. It should be removed if
+// it isn't added, after a failed conversion for example.
+func (cache *Cache) Stage() (string, error) {
+	return ioutil.TempDir(cache.dir, stagingPrefix)
+}
+
+// Get returns the entry for the key if there is one, marking it as the most recently used. The
+// use is written to the entry's metadata at most once every lastUsedInterval.
+func (cache *Cache) Get(key Key) (Entry, bool) {
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	entry, ok := cache.entries[key.ID()]
+	if !ok {
+		return Entry{}, false
+	}
+
+	if _, err := os.Stat(entry.Path()); err != nil {
+		// Removed from under the cache
+		cache.remove(entry)
+		return Entry{}, false
+	}
+
+	entry.LastUsed = time.Now().UTC()
+	cache.lru.MoveToFront(entry.element)
+	if entry.LastUsed.Sub(entry.saved) >= lastUsedInterval {
+		if writeMetadata(entry.dir, entry) == nil {
+			entry.saved = entry.LastUsed
+		}
+	}
+
+	return *entry, true
+}
+
+// Lookup returns the entry for the key like Get, but without counting it as a use of the entry.
+func (cache *Cache) Lookup(key Key) (Entry, bool) {
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	entry, ok := cache.entries[key.ID()]
+	if !ok {
+		return Entry{}, false
+	}
+
+	return *entry, true
+}
+
+// Put adds the conversion written to the staging directory dir to the cache, result is the name
+// of the model file in it. Any entry already stored for the key is replaced, along with entries
+// for the same item written from a different version of its content. Least recently used entries
+// are evicted if the cache is now larger than its limit, the new entry is always kept.
+func (cache *Cache) Put(key Key, dir, result string) (Entry, error) {
+
+	if strings.ContainsRune(result, os.PathSeparator) {
+		return Entry{}, errors.New("The result must be a file in the top of the staging directory")
+	}
+	if _, err := os.Stat(filepath.Join(dir, result)); err != nil {
+		return Entry{}, err
+	}
+
+	size, err := dirSize(dir)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	now := time.Now().UTC()
+	entry := &Entry{
+		Key:       key,
+		Result:    result,
+		Size:      size,
+		CreatedAt: now,
+		LastUsed:  now,
+		saved:     now,
+	}
+	err = writeMetadata(dir, entry)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	id := key.ID()
+	for _, existing := range cache.entries {
+		if existing.Key == key || (existing.Key.Hash == key.Hash && existing.Key.Version != key.Version) {
+			cache.remove(existing)
+		}
+	}
+
+	entry.dir = filepath.Join(cache.dir, id)
+	err = os.Rename(dir, entry.dir)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	entry.element = cache.lru.PushFront(entry)
+	cache.entries[id] = entry
+	cache.size += entry.Size
+	cache.evict(id)
+
+	return *entry, nil
+}
+
+// Purge removes every entry that matches and returns how many were removed. A nil match removes
+// everything.
+func (cache *Cache) Purge(match func(Entry) bool) int {
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	purged := 0
+	for _, entry := range cache.entries {
+		if match == nil || match(*entry) {
+			cache.remove(entry)
+			purged++
+		}
+	}
+
+	return purged
+}
+
+// Stats reports the number and total size of the entries in the cache.
+func (cache *Cache) Stats() Stats {
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	return Stats{Entries: len(cache.entries), Size: cache.size, MaxSize: cache.maxSize}
+}
+
+// evict removes the least recently used entries, apart from the one with the ID keep, until the
+// cache fits in its size limit. The mutex must be held.
+func (cache *Cache) evict(keep string) {
+
+	if cache.maxSize <= 0 {
+		return
+	}
+
+	element := cache.lru.Back()
+	for cache.size > cache.maxSize && element != nil {
+		entry := element.Value.(*Entry)
+		element = element.Prev()
+		if entry.Key.ID() != keep {
+			cache.remove(entry)
+		}
+	}
+}
+
+// remove deletes the entry and its files. The mutex must be held.
+func (cache *Cache) remove(entry *Entry) {
+
+	delete(cache.entries, entry.Key.ID())
+	cache.lru.Remove(entry.element)
+	cache.size -= entry.Size
+
+	// The metadata goes first so a directory that can't be removed completely is cleaned up the
+	// next time the cache is opened
+	os.Remove(filepath.Join(entry.dir, metadataName))
+	os.RemoveAll(entry.dir)
+}
+
+// EntryFiles lists the names of the files stored along with the model at path, the Path of an
+// entry, including the model itself.
+func EntryFiles(path string) ([]string, error) {
+
+	files, err := ioutil.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		if !file.IsDir() && !strings.HasPrefix(file.Name(), metadataName) {
+			names = append(names, file.Name())
+		}
+	}
+
+	return names, nil
+}
+
+func readEntry(dir string) (*Entry, error) {
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, metadataName))
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &Entry{}
+	err = json.Unmarshal(data, entry)
+	if err != nil {
+		return nil, err
+	}
+	entry.dir = dir
+	entry.saved = entry.LastUsed
+
+	if _, err := os.Stat(entry.Path()); err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// isEntryID reports whether name is the ID of a key, the name of an entry directory.
+func isEntryID(name string) bool {
+
+	id, err := hex.DecodeString(name)
+	return err == nil && len(id) == sha1.Size && strings.ToLower(name) == name
+}
+
+// writeMetadata replaces the metadata file of the entry in dir. The file is written next to it
+// and renamed into place, so a crash part way through never leaves a broken entry behind.
+func writeMetadata(dir string, entry *Entry) error {
+
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(dir, metadataName+".")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(dir, metadataName))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
+}
+
+// dirSize is the total size of the files in the directory and everything below it.
+func dirSize(dir string) (int64, error) {
+
+	size := int64(0)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	return size, err
+}
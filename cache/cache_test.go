@@ -0,0 +1,220 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// putModel stages a model of the given size and adds it to the cache.
+func putModel(t *testing.T, cache *Cache, key Key, size int) Entry {
+
+	dir, err := cache.Stage()
+	if err != nil {
+		t.Fatalf("Failed to stage: %s", err.Error())
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "model.dae"), []byte(strings.Repeat("x", size)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := cache.Put(key, dir, "model.dae")
+	if err != nil {
+		t.Fatalf("Failed to put: %s", err.Error())
+	}
+	if fileExists(dir) {
+		t.Errorf("Expected the staging directory to be moved into the cache")
+	}
+
+	return entry
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func testCache(t *testing.T, maxSize int64) (*Cache, string) {
+
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := Open(dir, maxSize)
+	if err != nil {
+		t.Fatalf("Failed to open cache: %s", err.Error())
+	}
+
+	return cache, dir
+}
+
+func TestCacheGetPut(t *testing.T) {
+
+	cache, dir := testCache(t, 0)
+	defer os.RemoveAll(dir)
+
+	key := Key{Hash: 1, Version: "a", Format: "dae", Options: "{}"}
+	if _, ok := cache.Get(key); ok {
+		t.Fatal("Expected an empty cache")
+	}
+
+	putModel(t, cache, key, 10)
+	entry, ok := cache.Get(key)
+	if !ok {
+		t.Fatal("Expected the model to be cached")
+	}
+	if entry.Path() != filepath.Join(dir, key.ID(), "model.dae") || entry.Size != 10 {
+		t.Errorf("Unexpected entry %+v at %s", entry, entry.Path())
+	}
+
+	for _, other := range []Key{
+		{Hash: 2, Version: "a", Format: "dae", Options: "{}"},
+		{Hash: 1, Version: "a", Format: "stl", Options: "{}"},
+		{Hash: 1, Version: "a", Format: "dae", Options: `{"Split":true}`},
+	} {
+		if _, ok := cache.Get(other); ok {
+			t.Errorf("Expected no model for %+v", other)
+		}
+	}
+
+	// A new version of the content replaces the models written from the old one
+	newKey := key
+	newKey.Version = "b"
+	putModel(t, cache, newKey, 10)
+	if _, ok := cache.Get(key); ok || fileExists(entry.Dir()) {
+		t.Errorf("Expected the old version to be invalidated")
+	}
+
+	// Entries are loaded again when the cache is reopened
+	reopened, err := Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reopened.Get(newKey); !ok {
+		t.Errorf("Expected the model to still be cached after reopening")
+	}
+	if stats := reopened.Stats(); stats.Entries != 1 || stats.Size != 10 {
+		t.Errorf("Unexpected stats after reopening: %+v", stats)
+	}
+}
+
+func TestCacheOpenCleanup(t *testing.T) {
+
+	cache, dir := testCache(t, 0)
+	defer os.RemoveAll(dir)
+
+	key := Key{Hash: 1}
+	putModel(t, cache, key, 10)
+	staging, _ := cache.Stage()
+
+	// An entry that lost its metadata, and things that aren't part of the cache
+	broken := filepath.Join(dir, Key{Hash: 2}.ID())
+	os.Mkdir(broken, 0755)
+	for _, name := range []string{"models", "ABCDEF0123456789ABCDEF0123456789ABCDEF01"} {
+		os.Mkdir(filepath.Join(dir, name), 0755)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("keep"), 0644)
+
+	reopened, err := Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reopened.Get(key); !ok {
+		t.Errorf("Expected the model to still be cached")
+	}
+	if fileExists(staging) || fileExists(broken) {
+		t.Errorf("Expected the staging directory and broken entry to be removed")
+	}
+	for _, name := range []string{"models", "ABCDEF0123456789ABCDEF0123456789ABCDEF01", "notes.txt"} {
+		if !fileExists(filepath.Join(dir, name)) {
+			t.Errorf("Expected %s to be left alone", name)
+		}
+	}
+}
+
+func TestCacheGetSavesLastUse(t *testing.T) {
+
+	cache, dir := testCache(t, 0)
+	defer os.RemoveAll(dir)
+
+	key := Key{Hash: 1}
+	entry := putModel(t, cache, key, 10)
+	metadata := filepath.Join(entry.Dir(), metadataName)
+	saved, _ := ioutil.ReadFile(metadata)
+
+	// A use right after the entry was written is only kept in memory
+	used, _ := cache.Get(key)
+	if data, _ := ioutil.ReadFile(metadata); string(data) != string(saved) {
+		t.Errorf("Expected the metadata not to be rewritten on every use")
+	}
+
+	// Once the saved use is old enough it is written out
+	cache.entries[key.ID()].saved = used.LastUsed.Add(-lastUsedInterval)
+	used, _ = cache.Get(key)
+	stored, err := readEntry(entry.Dir())
+	if err != nil || !stored.LastUsed.Equal(used.LastUsed) {
+		t.Errorf("Expected the last use to be saved, got %v", stored)
+	}
+
+	files, _ := EntryFiles(entry.Path())
+	if len(files) != 1 || files[0] != "model.dae" {
+		t.Errorf("Expected only the model in the entry, got %v", files)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+
+	cache, dir := testCache(t, 25)
+	defer os.RemoveAll(dir)
+
+	keys := []Key{{Hash: 1}, {Hash: 2}, {Hash: 3}}
+	putModel(t, cache, keys[0], 10)
+	putModel(t, cache, keys[1], 10)
+
+	// Using the first model makes the second the least recently used
+	cache.Get(keys[0])
+	putModel(t, cache, keys[2], 10)
+
+	if _, ok := cache.Get(keys[1]); ok {
+		t.Errorf("Expected the least recently used model to be evicted")
+	}
+	for _, key := range []Key{keys[0], keys[2]} {
+		if _, ok := cache.Get(key); !ok {
+			t.Errorf("Expected %+v to still be cached", key)
+		}
+	}
+
+	// The newest model is kept even if it is bigger than the limit on its own
+	putModel(t, cache, Key{Hash: 4}, 30)
+	if stats := cache.Stats(); stats.Entries != 1 || stats.Size != 30 {
+		t.Errorf("Unexpected stats after adding a large model: %+v", stats)
+	}
+}
+
+func TestCachePurge(t *testing.T) {
+
+	cache, dir := testCache(t, 0)
+	defer os.RemoveAll(dir)
+
+	putModel(t, cache, Key{Hash: 1, Format: "dae"}, 1)
+	putModel(t, cache, Key{Hash: 1, Format: "stl"}, 1)
+	putModel(t, cache, Key{Hash: 2, Format: "dae"}, 1)
+
+	purged := cache.Purge(func(entry Entry) bool { return entry.Key.Hash == 1 })
+	if purged != 2 || cache.Stats().Entries != 1 {
+		t.Errorf("Expected the two models of the item to be purged, purged %d", purged)
+	}
+
+	if purged = cache.Purge(nil); purged != 1 {
+		t.Errorf("Expected everything else to be purged, purged %d", purged)
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 0 {
+		t.Errorf("Expected the cache directory to be empty, found %d files", len(files))
+	}
+}
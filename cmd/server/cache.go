@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rking788/destiny-gear-vendor/bungie"
+	"github.com/rking788/destiny-gear-vendor/cache"
+	"github.com/rking788/destiny-gear-vendor/graphics"
+)
+
+// outputCache holds the models converted by the server, it is opened when the server starts.
+var outputCache *cache.Cache
+
+// cacheKey identifies the model converted from the current content of the asset in the format
+// and with the options.
+func cacheKey(asset *bungie.GearAssetDefinition, format string, options graphics.Options) cache.Key {
+
+	encoded, _ := json.Marshal(options)
+	return cache.Key{
+		Hash:    asset.ID,
+		Version: asset.ContentVersion(),
+		Format:  format,
+		Options: string(encoded),
+	}
+}
+
+// cachedModel returns the cache entry of the model for the asset, converting it first if it isn't
+// in the cache yet. The progress of the conversion and any warnings are sent to reporter.
+func cachedModel(asset *bungie.GearAssetDefinition, format string, options graphics.Options, reporter graphics.Reporter) (cache.Entry, error) {
+
+	key := cacheKey(asset, format, options)
+	entry, shared, err := convertItem(asset.ID, key.ID(), reporter, func(reporter graphics.Reporter) (entry cache.Entry, err error) {
+		if entry, ok := outputCache.Get(key); ok {
+			cacheRequestsTotal.Inc("hit")
+			return entry, nil
+		}
+
+		cacheRequestsTotal.Inc("miss")
+		started := time.Now()
+		defer func() { observeConversion(format, started, err) }()
+		if format != "stl" {
+			processTextures(asset, reporter)
+		}
+
+		dir, err := outputCache.Stage()
+		if err != nil {
+			return cache.Entry{}, err
+		}
+		defer os.RemoveAll(dir)
+
+		path, err := convertModel(asset, dir, formatsFor(format), options, reporter)
+		if err != nil {
+			return cache.Entry{}, err
+		}
+
+		return outputCache.Put(key, dir, filepath.Base(path))
+	})
+	if shared {
+		// Waited on a conversion started by another request
+		cacheRequestsTotal.Inc("miss")
+	}
+
+	return entry, err
+}
+
+// GetCacheStats reports the number and size of the cached models.
+func GetCacheStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, outputCache.Stats())
+}
+
+// requireAdminToken only runs handler for requests sending the configured admin token as their
+// bearer token. Every request is refused when no admin token is configured.
+func requireAdminToken(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if cfg.AdminToken == "" {
+			writeError(w, http.StatusForbidden, "admin_disabled", "The admin routes are turned off, configure an admin token to use them")
+			return
+		}
+
+		authorization := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(authorization, "Bearer ")
+		if token == authorization || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gear-vendor"`)
+			writeError(w, http.StatusUnauthorized, "unauthorized", "A valid admin token is needed for this route")
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// PurgeCache removes every cached model, or only the models of one item when a hash is given.
+func PurgeCache(w http.ResponseWriter, r *http.Request) {
+
+	var match func(cache.Entry) bool
+	if hash, ok := mux.Vars(r)["hash"]; ok {
+		itemHash, err := strconv.ParseUint(hash, 10, 32)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request", "Invalid item hash provided")
+			return
+		}
+
+		match = func(entry cache.Entry) bool {
+			return entry.Key.Hash == uint(itemHash)
+		}
+	}
+
+	purged := outputCache.Purge(match)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"purged": purged,
+		"stats":  outputCache.Stats(),
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/rking788/destiny-gear-vendor/cache"
+)
+
+func TestPurgeCacheRequiresAdminToken(t *testing.T) {
+
+	var err error
+	previous := outputCache
+	outputCache, err = cache.Open(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("Failed to open the cache: %s", err.Error())
+	}
+	defer func() { outputCache = previous }()
+	defer func(token string) { cfg.AdminToken = token }(cfg.AdminToken)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/cache", requireAdminToken(PurgeCache)).Methods("DELETE")
+	router.HandleFunc("/cache/{hash}", requireAdminToken(PurgeCache)).Methods("DELETE")
+
+	tests := []struct {
+		token         string
+		authorization string
+		status        int
+		code          string
+	}{
+		{"", "", http.StatusForbidden, "admin_disabled"},
+		{"", "Bearer ", http.StatusForbidden, "admin_disabled"},
+		{"secret", "", http.StatusUnauthorized, "unauthorized"},
+		{"secret", "secret", http.StatusUnauthorized, "unauthorized"},
+		{"secret", "Bearer wrong", http.StatusUnauthorized, "unauthorized"},
+		{"secret", "Bearer secret", http.StatusOK, ""},
+	}
+
+	for _, test := range tests {
+		cfg.AdminToken = test.token
+		for _, path := range []string{"/cache", "/cache/1"} {
+			request := httptest.NewRequest("DELETE", path, nil)
+			if test.authorization != "" {
+				request.Header.Set("Authorization", test.authorization)
+			}
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, request)
+
+			body := apiError{}
+			json.Unmarshal(recorder.Body.Bytes(), &body)
+			if recorder.Code != test.status || body.Code != test.code {
+				t.Errorf("%s with %q and token %q: Expected=%d %s, Actual=%d %s", path, test.authorization, test.token, test.status, test.code, recorder.Code, recorder.Body.String())
+			}
+		}
+	}
+
+	request := httptest.NewRequest("DELETE", "/cache/abc", nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	if code := errorCode(recorder); recorder.Code != http.StatusBadRequest || code != "invalid_request" {
+		t.Errorf("Expected a JSON bad request for an invalid hash, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/rking788/destiny-gear-vendor/cache"
+	"github.com/rking788/destiny-gear-vendor/graphics"
+)
+
+var (
+	// conversions shares a single conversion between identical requests made at the same time.
+	conversions = newCoalescer()
+	// itemLocks makes sure only one conversion writes to the directory of an item at a time.
+	itemLocks = newKeyedMutex()
+)
+
+// convertItem runs convert for the item unless an identical conversion (with the same key, see
+// cacheKey) is already running, in which case it waits for that one and shares its result. The conversion
+// holds the lock for the item, so it never runs at the same time as any other conversion of the
+// same item. shared is true if the result came from another caller's conversion.
+//
+// convert reports to a reporter that passes the progress on to the reporter of every caller
+// sharing the conversion. Callers that join a running conversion are sent its latest progress
+// when they join, warnings from before then are only logged.
+func convertItem(id uint, key string, reporter graphics.Reporter, convert func(graphics.Reporter) (cache.Entry, error)) (entry cache.Entry, shared bool, err error) {
+	return conversions.do(key, reporter, func(reporter graphics.Reporter) (cache.Entry, error) {
+		unlock := itemLocks.lock(fmt.Sprintf("%d", id))
+		defer unlock()
+
+		return convert(reporter)
+	})
+}
+
+// coalescer runs a function once for all of the callers asking for the same key at the same
+// time, like golang.org/x/sync/singleflight.
+type coalescer struct {
+	mutex sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+type coalescedCall struct {
+	done     chan struct{}
+	reporter *fanoutReporter
+	entry    cache.Entry
+	err      error
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{calls: make(map[string]*coalescedCall)}
+}
+
+// do runs fn for the key, or waits for the call already running for it. shared is true for the
+// callers that waited on another caller's fn. fn reports to the reporters of every caller.
+func (c *coalescer) do(key string, reporter graphics.Reporter, fn func(graphics.Reporter) (cache.Entry, error)) (cache.Entry, bool, error) {
+
+	c.mutex.Lock()
+	if call, ok := c.calls[key]; ok {
+		call.reporter.add(reporter)
+		c.mutex.Unlock()
+		<-call.done
+		return call.entry, true, call.err
+	}
+
+	call := &coalescedCall{done: make(chan struct{}), reporter: &fanoutReporter{}}
+	call.reporter.add(reporter)
+	c.calls[key] = call
+	c.mutex.Unlock()
+
+	defer func() {
+		c.mutex.Lock()
+		delete(c.calls, key)
+		c.mutex.Unlock()
+		close(call.done)
+	}()
+
+	call.entry, call.err = fn(call.reporter)
+	return call.entry, false, call.err
+}
+
+// fanoutReporter passes the progress of a conversion on to the reporters of every caller
+// sharing it.
+type fanoutReporter struct {
+	mutex     sync.Mutex
+	reporters []graphics.Reporter
+	// last is the latest progress, it is sent to reporters added while the conversion runs.
+	last *progressUpdate
+}
+
+type progressUpdate struct {
+	stage       string
+	done, total int
+}
+
+// add starts passing the progress on to reporter, starting with the latest progress.
+func (fanout *fanoutReporter) add(reporter graphics.Reporter) {
+
+	fanout.mutex.Lock()
+	defer fanout.mutex.Unlock()
+
+	fanout.reporters = append(fanout.reporters, reporter)
+	if fanout.last != nil {
+		reporter.Progress(fanout.last.stage, fanout.last.done, fanout.last.total)
+	}
+}
+
+func (fanout *fanoutReporter) Progress(stage string, done, total int) {
+
+	fanout.mutex.Lock()
+	defer fanout.mutex.Unlock()
+
+	fanout.last = &progressUpdate{stage: stage, done: done, total: total}
+	for _, reporter := range fanout.reporters {
+		reporter.Progress(stage, done, total)
+	}
+}
+
+func (fanout *fanoutReporter) Warn(message string) {
+
+	fanout.mutex.Lock()
+	defer fanout.mutex.Unlock()
+
+	for _, reporter := range fanout.reporters {
+		reporter.Warn(message)
+	}
+}
+
+// keyedMutex is a set of mutexes created as they are needed for each key, and dropped again once
+// nothing is holding or waiting on them.
+type keyedMutex struct {
+	mutex sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	references int
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{locks: make(map[string]*keyedLock)}
+}
+
+// lock locks the mutex for the key and returns the function that unlocks it.
+func (k *keyedMutex) lock(key string) func() {
+
+	k.mutex.Lock()
+	lock, ok := k.locks[key]
+	if !ok {
+		lock = &keyedLock{}
+		k.locks[key] = lock
+	}
+	lock.references++
+	k.mutex.Unlock()
+
+	lock.Lock()
+
+	return func() {
+		lock.Unlock()
+
+		k.mutex.Lock()
+		lock.references--
+		if lock.references == 0 {
+			delete(k.locks, key)
+		}
+		k.mutex.Unlock()
+	}
+}
+
+// conversionDir is a temporary directory a conversion writes all of its files into. Nothing shows
+// up in the item directory until the files are moved over by commit, so a model found there is
+// always complete.
+type conversionDir struct {
+	path string
+}
+
+// newConversionDir creates a temporary directory for a conversion of the item. It is created
+// next to the item directories so the files can be renamed into place.
+func newConversionDir(id uint) (*conversionDir, error) {
+
+	path, err := ioutil.TempDir(cfg.Paths.Models, fmt.Sprintf(".%d-", id))
+	if err != nil {
+		return nil, err
+	}
+
+	return &conversionDir{path: path}, nil
+}
+
+// commit moves every file written by the conversion into outDir, replacing any older copies, and
+// returns the new path of the result. The result is moved last so it is only found once all of
+// the textures and parts it needs are in place.
+func (dir *conversionDir) commit(outDir, result string) (string, error) {
+
+	files, err := ioutil.ReadDir(dir.path)
+	if err != nil {
+		return "", err
+	}
+
+	resultName := filepath.Base(result)
+	for _, file := range files {
+		if file.Name() == resultName {
+			continue
+		}
+
+		err = os.Rename(filepath.Join(dir.path, file.Name()), filepath.Join(outDir, file.Name()))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = os.Rename(filepath.Join(dir.path, resultName), filepath.Join(outDir, resultName))
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s/%s", outDir, resultName), nil
+}
+
+// cleanup removes the directory along with anything that wasn't committed.
+func (dir *conversionDir) cleanup() {
+	os.RemoveAll(dir.path)
+}
+
+// writeFileAtomic writes the file next to path first and renames it into place, so readers never
+// see a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
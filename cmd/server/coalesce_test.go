@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rking788/destiny-gear-vendor/cache"
+	"github.com/rking788/destiny-gear-vendor/graphics"
+)
+
+func TestConvertItemCoalesces(t *testing.T) {
+
+	var calls int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	convert := func(graphics.Reporter) (cache.Entry, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+		}
+		<-release
+		return cache.Entry{Result: "model.dae"}, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]cache.Entry, 5)
+	shared := make([]bool, 5)
+	call := func(i int) {
+		defer wg.Done()
+		results[i], shared[i], _ = convertItem(1, "dae/1", logReporter{}, convert)
+	}
+
+	wg.Add(len(results))
+	go call(0)
+	<-started
+	for i := 1; i < len(results); i++ {
+		go call(i)
+	}
+
+	// Give the other callers a chance to join the running conversion before it finishes
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Fatalf("Expected a single conversion, got %d", calls)
+	}
+	for i, result := range results {
+		if result.Result != "model.dae" {
+			t.Errorf("Expected every caller to get the result, got %q", result.Result)
+		}
+		if shared[i] != (i != 0) {
+			t.Errorf("Expected only the first caller to run the conversion")
+		}
+	}
+}
+
+func TestConvertItemSharesProgress(t *testing.T) {
+
+	leader := &Job{updated: make(chan struct{}), done: make(chan struct{})}
+	waiter := &Job{updated: make(chan struct{}), done: make(chan struct{})}
+
+	reported := make(chan struct{})
+	joined := make(chan struct{})
+	convert := func(reporter graphics.Reporter) (cache.Entry, error) {
+		reporter.Progress("geometry", 1, 4)
+		close(reported)
+		<-joined
+		reporter.Progress("geometry", 2, 4)
+		reporter.Warn("Missing texture plate")
+		return cache.Entry{Result: "model.dae"}, nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		convertItem(1, "dae/progress", leader, convert)
+	}()
+	<-reported
+
+	go func() {
+		// Wait for the waiter to join the running conversion before letting it go on
+		for {
+			conversions.mutex.Lock()
+			reporters := len(conversions.calls["dae/progress"].reporter.reporters)
+			conversions.mutex.Unlock()
+			if reporters == 2 {
+				close(joined)
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	_, shared, _ := convertItem(1, "dae/progress", waiter, convert)
+	<-done
+
+	if !shared {
+		t.Fatalf("Expected the second caller to share the conversion")
+	}
+
+	// The waiter starts from the latest progress when it joins and then gets everything else
+	expected := []string{"progress geometry 1/4", "progress geometry 2/4", "warning Missing texture plate"}
+	for name, job := range map[string]*Job{"leader": leader, "waiter": waiter} {
+		events, _, _ := job.eventsSince(0)
+		actual := make([]string, 0, len(events))
+		for _, event := range events {
+			if event.Type == "progress" {
+				actual = append(actual, fmt.Sprintf("%s %s %d/%d", event.Type, event.Stage, event.Done, event.Total))
+			} else {
+				actual = append(actual, event.Type+" "+event.Message)
+			}
+		}
+		if strings.Join(actual, ", ") != strings.Join(expected, ", ") {
+			t.Errorf("Wrong events for the %s: Expected=%v, Actual=%v", name, expected, actual)
+		}
+	}
+}
+
+func TestKeyedMutexSerializesItems(t *testing.T) {
+
+	locks := newKeyedMutex()
+	var running, maxRunning int32
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := locks.lock("1")
+			defer unlock()
+
+			current := atomic.AddInt32(&running, 1)
+			if current > atomic.LoadInt32(&maxRunning) {
+				atomic.StoreInt32(&maxRunning, current)
+			}
+			atomic.AddInt32(&running, -1)
+		}()
+	}
+	wg.Wait()
+
+	if maxRunning != 1 {
+		t.Errorf("Expected one holder of the lock at a time, got %d", maxRunning)
+	}
+	if len(locks.locks) != 0 {
+		t.Errorf("Expected unused locks to be dropped, %d left", len(locks.locks))
+	}
+}
+
+func TestConversionDirCommit(t *testing.T) {
+
+	root, err := ioutil.TempDir("", "coalesce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	outDir := filepath.Join(root, "item")
+	os.Mkdir(outDir, 0755)
+	ioutil.WriteFile(filepath.Join(outDir, "model.dae"), []byte("old"), 0644)
+
+	dir := &conversionDir{path: filepath.Join(root, ".work")}
+	os.Mkdir(dir.path, 0755)
+	defer dir.cleanup()
+
+	ioutil.WriteFile(filepath.Join(dir.path, "model.dae"), []byte("new"), 0644)
+	ioutil.WriteFile(filepath.Join(dir.path, "texture.png"), []byte("png"), 0644)
+
+	path, err := dir.commit(outDir, filepath.Join(dir.path, "model.dae"))
+	if err != nil {
+		t.Fatalf("Failed to commit: %s", err.Error())
+	}
+	if path != filepath.Join(outDir, "model.dae") {
+		t.Errorf("Unexpected result path %s", path)
+	}
+
+	for name, expected := range map[string]string{"model.dae": "new", "texture.png": "png"} {
+		data, err := ioutil.ReadFile(filepath.Join(outDir, name))
+		if err != nil || string(data) != expected {
+			t.Errorf("Expected %s to contain %q, got %q (%v)", name, expected, data, err)
+		}
+	}
+}
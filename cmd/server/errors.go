@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/rking788/destiny-gear-vendor/bungie"
+)
+
+// errUnsupportedItem is wrapped by the errors for items that don't have any geometry that can be
+// converted, like emblems or shaders.
+var errUnsupportedItem = errors.New("The item has no geometry that can be converted")
+
+// upstreamError is a failure downloading the files of an item from Bungie.
+type upstreamError struct {
+	err error
+}
+
+func (e *upstreamError) Error() string {
+	return e.err.Error()
+}
+
+func (e *upstreamError) Unwrap() error {
+	return e.err
+}
+
+// checkSupported returns an error wrapping errUnsupportedItem if the item has nothing to convert.
+func checkSupported(asset *bungie.GearAssetDefinition) error {
+
+	if len(asset.Content) < 1 {
+		return fmt.Errorf("%w: no content in the asset definition for id(%d)", errUnsupportedItem, asset.ID)
+	} else if len(asset.Content[0].Geometry) < 1 {
+		return fmt.Errorf("%w: no geometry in the asset definition for id(%d)", errUnsupportedItem, asset.ID)
+	}
+
+	return nil
+}
+
+// apiError is the JSON body of a request that failed.
+type apiError struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeError replaces any headers describing the model with a JSON body describing the error.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+
+	w.Header().Del("Content-Disposition")
+	writeJSON(w, status, apiError{Status: status, Code: code, Message: message})
+}
+
+// writeConversionError reports err with the status code for the kind of failure: an unknown
+// item, an item that can't be converted, a failed download or a failed conversion.
+func writeConversionError(w http.ResponseWriter, err error) {
+
+	var upstream *upstreamError
+	switch {
+	case errors.Is(err, bungie.ErrItemNotFound):
+		writeError(w, http.StatusNotFound, "item_not_found", err.Error())
+	case errors.Is(err, errUnsupportedItem):
+		writeError(w, http.StatusUnprocessableEntity, "unsupported_item", err.Error())
+	case errors.As(err, &upstream):
+		writeError(w, http.StatusBadGateway, "upstream_failed", "Failed to download the item from Bungie: "+err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, "conversion_failed", "Something went wrong generating the model: "+err.Error())
+	}
+}
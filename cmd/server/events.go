@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/kpango/glg"
+)
+
+// EventKeepAlive is how often a comment is sent on an idle event stream so proxies don't close it.
+const EventKeepAlive = 15 * time.Second
+
+// logReporter is the graphics.Reporter for conversions nobody is following, the progress is only
+// logged. Warnings are already logged where they happen.
+type logReporter struct{}
+
+func (logReporter) Progress(stage string, done, total int) {
+	glg.Debugf("Conversion progress: %s %d/%d", stage, done, total)
+}
+
+func (logReporter) Warn(message string) {}
+
+// GetJobEvents streams the progress of a job as Server-Sent Events until the job finishes. Every
+// event is sent, starting from the beginning of the job or after the Last-Event-ID of a client
+// that is reconnecting. The event types are progress, warning, done and failed, the data is the
+// JSON JobEvent.
+func (queue *JobQueue) GetJobEvents(w http.ResponseWriter, r *http.Request) {
+
+	job := queue.Job(mux.Vars(r)["id"])
+	if job == nil {
+		writeError(w, http.StatusNotFound, "job_not_found", "No job found with the specified ID")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming_unsupported", "Events can't be streamed on this connection")
+		return
+	}
+
+	last, _ := strconv.Atoi(r.Header.Get("Last-Event-ID"))
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stop nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	for {
+		events, updated, finished := job.eventsSince(last)
+		for _, event := range events {
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+			last = event.ID
+		}
+		flusher.Flush()
+
+		if finished {
+			return
+		}
+
+		select {
+		case <-updated:
+		case <-time.After(EventKeepAlive):
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
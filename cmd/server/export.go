@@ -0,0 +1,275 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kpango/glg"
+	"github.com/rking788/destiny-gear-vendor/cache"
+	"github.com/rking788/destiny-gear-vendor/db"
+	"github.com/rking788/destiny-gear-vendor/graphics"
+)
+
+const (
+	// MaxExportItems is the most items that can be exported by a single request.
+	MaxExportItems = 500
+	// ExportManifestName is the name of the file in the root of an export describing which items
+	// were exported and why any of them failed.
+	ExportManifestName = "manifest.json"
+)
+
+// ExportRequest is the body of a request to export many items at once, either the items with the
+// listed hashes or all of the items in a category.
+type ExportRequest struct {
+	Hashes   []uint           `json:"hashes"`
+	Category string           `json:"category"`
+	Format   string           `json:"format"`
+	Options  graphics.Options `json:"options"`
+}
+
+// validate checks the request describes an export that can be run, the items are converted as
+// jobs so the same limits apply.
+func (request *ExportRequest) validate() error {
+
+	if len(request.Hashes) == 0 && request.Category == "" {
+		return errors.New("Forgot to specify the item hashes or a category to export")
+	}
+	if len(request.Hashes) > 0 && request.Category != "" {
+		return errors.New("Only one of the item hashes or a category can be exported")
+	}
+	if len(request.Hashes) > MaxExportItems {
+		return fmt.Errorf("Too many items requested, at most %d can be exported at a time", MaxExportItems)
+	}
+	if _, ok := db.ItemCategories[request.Category]; request.Category != "" && !ok {
+		return errors.New("Invalid category specified, expected weapon, armor, ghost or vehicle")
+	}
+
+	for _, hash := range request.Hashes {
+		job := &JobRequest{Hash: hash, Format: request.Format, Options: request.Options}
+		if err := job.validate(); err != nil {
+			return err
+		}
+	}
+	if len(request.Hashes) == 0 {
+		job := &JobRequest{Hash: 1, Format: request.Format, Options: request.Options}
+		return job.validate()
+	}
+
+	return nil
+}
+
+// hashes returns the hashes of the items to export, looking up the items in the category if one
+// was requested.
+func (request *ExportRequest) hashes() ([]uint, error) {
+
+	if request.Category == "" {
+		return request.Hashes, nil
+	}
+
+	assetDB, err := db.GetAssetDBConnection()
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := assetDB.SearchItems(db.ItemFilter{Category: request.Category, Limit: MaxExportItems + 1})
+	if err != nil {
+		return nil, err
+	}
+	if len(items) > MaxExportItems {
+		return nil, fmt.Errorf("The %s category has too many items, at most %d can be exported at a time", request.Category, MaxExportItems)
+	}
+
+	hashes := make([]uint, 0, len(items))
+	for _, item := range items {
+		hashes = append(hashes, item.Hash)
+	}
+
+	return hashes, nil
+}
+
+// ExportManifest describes the contents of an export archive.
+type ExportManifest struct {
+	Format    string        `json:"format"`
+	CreatedAt time.Time     `json:"createdAt"`
+	Items     []*ExportItem `json:"items"`
+}
+
+// ExportItem describes how the export of a single item went. The files are the paths in the
+// archive, all in a directory named after the item hash.
+type ExportItem struct {
+	Hash   uint      `json:"hash"`
+	Status JobStatus `json:"status"`
+	Job    string    `json:"job,omitempty"`
+	Files  []string  `json:"files,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// CreateExport converts every item in the JSON body on the job workers and streams back a zip
+// archive with a directory for each item, along with a manifest listing the items that failed.
+// Only a few of the jobs are queued at a time so the export doesn't hold up other jobs for long.
+func (queue *JobQueue) CreateExport(w http.ResponseWriter, r *http.Request) {
+
+	request := &ExportRequest{}
+	err := json.NewDecoder(r.Body).Decode(request)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Invalid export request: "+err.Error())
+		return
+	}
+
+	err = request.validate()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	hashes, err := request.hashes()
+	if err != nil {
+		glg.Errorf("Failed to find the items to export: %s", err.Error())
+		writeError(w, http.StatusInternalServerError, "lookup_failed", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=export-%s.zip", request.Format))
+
+	archive := zip.NewWriter(w)
+	manifest := &ExportManifest{
+		Format:    request.Format,
+		CreatedAt: time.Now().UTC(),
+		Items:     make([]*ExportItem, 0, len(hashes)),
+	}
+
+	// Jobs are written to the archive in the order they were requested, once they finish
+	window := cfg.Jobs.Workers
+	pending := make([]*Job, 0, window)
+	writeNext := func() error {
+		job := pending[0]
+		pending = pending[1:]
+
+		select {
+		case <-job.Done():
+		case <-r.Context().Done():
+			return r.Context().Err()
+		}
+
+		item, err := writeExportItem(archive, job)
+		manifest.Items = append(manifest.Items, item)
+		return err
+	}
+
+	for _, hash := range hashes {
+		jobRequest := &JobRequest{Hash: hash, Format: request.Format, Options: request.Options}
+		for {
+			if len(pending) >= window {
+				err = writeNext()
+				if err != nil {
+					glg.Errorf("Export stopped: %s", err.Error())
+					return
+				}
+			}
+
+			job, err := queue.Submit(jobRequest)
+			if err == nil {
+				pending = append(pending, job)
+				break
+			}
+
+			// The queue is full of other jobs, wait for one of ours to finish or for some space
+			// to free up before trying again
+			if len(pending) > 0 {
+				err = writeNext()
+				if err != nil {
+					glg.Errorf("Export stopped: %s", err.Error())
+					return
+				}
+				continue
+			}
+			select {
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+
+	for len(pending) > 0 {
+		err = writeNext()
+		if err != nil {
+			glg.Errorf("Export stopped: %s", err.Error())
+			return
+		}
+	}
+
+	manifestW, err := archive.Create(ExportManifestName)
+	if err == nil {
+		encoder := json.NewEncoder(manifestW)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(manifest)
+	}
+	if err == nil {
+		err = archive.Close()
+	}
+	if err != nil {
+		glg.Errorf("Failed to finish the export: %s", err.Error())
+	}
+}
+
+// writeExportItem adds the model and textures written by the finished job to the archive. An
+// error is only returned if the archive itself can't be written, failed jobs are recorded in the
+// returned item instead.
+func writeExportItem(archive *zip.Writer, job *Job) (*ExportItem, error) {
+
+	info, path := job.snapshot()
+	item := &ExportItem{Hash: info.Hash, Status: info.Status, Job: info.ID, Error: info.Error}
+	if info.Status != JobDone {
+		return item, nil
+	}
+
+	names, err := cache.EntryFiles(path)
+	if err != nil {
+		item.Status = JobFailed
+		item.Error = "The result has been evicted from the cache"
+		return item, nil
+	}
+
+	for _, name := range names {
+		archivePath := fmt.Sprintf("%d/%s", info.Hash, name)
+		err := addExportFile(archive, archivePath, filepath.Join(filepath.Dir(path), name))
+		if os.IsNotExist(err) {
+			// Evicted while the files were being added, the files that were added stay listed
+			item.Status = JobFailed
+			item.Error = "The result has been evicted from the cache"
+			return item, nil
+		} else if err != nil {
+			return item, err
+		}
+
+		item.Files = append(item.Files, archivePath)
+	}
+
+	return item, nil
+}
+
+func addExportFile(archive *zip.Writer, archivePath, path string) error {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w, err := archive.Create(archivePath)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, f)
+	return err
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreateExport(t *testing.T) {
+
+	dir := t.TempDir()
+	queue := NewJobQueue(2, 1, func(job *Job) (string, error) {
+		info, _ := job.snapshot()
+		if info.Hash == 2 {
+			return "", errors.New("conversion failed")
+		}
+
+		// Laid out like a cache entry, the metadata is left out of the export
+		itemDir := filepath.Join(dir, fmt.Sprintf("%d", info.Hash))
+		os.Mkdir(itemDir, 0755)
+		ioutil.WriteFile(filepath.Join(itemDir, "entry.json"), []byte("{}"), 0644)
+		ioutil.WriteFile(filepath.Join(itemDir, "texture.png"), []byte("png"), 0644)
+		path := filepath.Join(itemDir, "model.dae")
+		return path, ioutil.WriteFile(path, []byte(fmt.Sprintf("model %d", info.Hash)), 0644)
+	})
+
+	recorder := httptest.NewRecorder()
+	body := strings.NewReader(`{"hashes": [3, 2, 1, 4, 5], "format": "dae"}`)
+	queue.CreateExport(recorder, httptest.NewRequest("POST", "/exports", body))
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("Wrong response: %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(recorder.Body.Bytes()), int64(recorder.Body.Len()))
+	if err != nil {
+		t.Fatalf("Failed to read the archive: %s", err.Error())
+	}
+
+	files := map[string]string{}
+	for _, file := range archive.File {
+		f, _ := file.Open()
+		data, _ := ioutil.ReadAll(f)
+		f.Close()
+		files[file.Name] = string(data)
+	}
+
+	manifest := ExportManifest{}
+	err = json.Unmarshal([]byte(files[ExportManifestName]), &manifest)
+	if err != nil {
+		t.Fatalf("Failed to read the manifest: %s", err.Error())
+	}
+
+	order := []uint{3, 2, 1, 4, 5}
+	if len(manifest.Items) != len(order) {
+		t.Fatalf("Expected %d items in the manifest, got %d", len(order), len(manifest.Items))
+	}
+	for i, item := range manifest.Items {
+		if item.Hash != order[i] {
+			t.Errorf("Expected the items in the requested order, got %d at %d", item.Hash, i)
+		}
+
+		if item.Hash == 2 {
+			if item.Status != JobFailed || item.Error != "conversion failed" || len(item.Files) != 0 {
+				t.Errorf("Expected item 2 to fail, got %+v", item)
+			}
+			continue
+		}
+
+		expected := []string{fmt.Sprintf("%d/model.dae", item.Hash), fmt.Sprintf("%d/texture.png", item.Hash)}
+		if item.Status != JobDone || strings.Join(item.Files, ",") != strings.Join(expected, ",") {
+			t.Errorf("Unexpected item %+v", item)
+		}
+		if files[expected[0]] != fmt.Sprintf("model %d", item.Hash) {
+			t.Errorf("Wrong model for item %d: %q", item.Hash, files[expected[0]])
+		}
+	}
+
+	if len(files) != 4*2+1 {
+		t.Errorf("Expected two files for each exported item and the manifest, got %d", len(files))
+	}
+}
+
+func TestCreateExportFullQueue(t *testing.T) {
+
+	defer func(workers int) { cfg.Jobs.Workers = workers }(cfg.Jobs.Workers)
+	cfg.Jobs.Workers = 3
+
+	dir := t.TempDir()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	queue := NewJobQueue(1, 1, func(job *Job) (string, error) {
+		info, _ := job.snapshot()
+		if info.Hash == 100 {
+			close(started)
+			<-release
+		}
+
+		path := filepath.Join(dir, fmt.Sprintf("%d.dae", info.Hash))
+		return path, ioutil.WriteFile(path, []byte("model"), 0644)
+	})
+
+	// Another client's job takes up the only worker, so the export's first job fills the queue
+	if _, err := queue.Submit(&JobRequest{Hash: 100, Format: "dae"}); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	rejected := jobsRejectedTotal.Value()
+	recorder := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		body := strings.NewReader(`{"hashes": [1, 2], "format": "dae"}`)
+		queue.CreateExport(recorder, httptest.NewRequest("POST", "/exports", body))
+	}()
+
+	// The second job doesn't fit, the export has to wait on the first instead of retrying
+	time.Sleep(50 * time.Millisecond)
+	if retries := jobsRejectedTotal.Value() - rejected; retries > 1 {
+		t.Errorf("Expected the export to wait for its pending job, it was refused %v times", retries)
+	}
+
+	close(release)
+	<-done
+
+	archive, err := zip.NewReader(bytes.NewReader(recorder.Body.Bytes()), int64(recorder.Body.Len()))
+	if err != nil {
+		t.Fatalf("Failed to read the archive: %s", err.Error())
+	}
+	manifest := ExportManifest{}
+	for _, file := range archive.File {
+		if file.Name == ExportManifestName {
+			f, _ := file.Open()
+			json.NewDecoder(f).Decode(&manifest)
+			f.Close()
+		}
+	}
+	if len(manifest.Items) != 2 || manifest.Items[0].Status != JobDone || manifest.Items[1].Status != JobDone {
+		t.Errorf("Expected both items to be exported, got %+v", manifest.Items)
+	}
+}
+
+func TestExportRequestValidation(t *testing.T) {
+
+	for _, body := range []string{
+		`{"format": "dae"}`,
+		`{"hashes": [1], "category": "weapon", "format": "dae"}`,
+		`{"hashes": [1, 0], "format": "dae"}`,
+		`{"hashes": [1], "format": "obj"}`,
+		`{"category": "emblem", "format": "dae"}`,
+		`{"category": "weapon", "format": "dae", "options": {"Split": true}}`,
+	} {
+		request := &ExportRequest{}
+		json.Unmarshal([]byte(body), request)
+		if err := request.validate(); err == nil {
+			t.Errorf("Expected %s to be invalid", body)
+		}
+	}
+}
@@ -1,42 +1,80 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/kpango/glg"
 	"github.com/rking788/destiny-gear-vendor/bungie"
+	"github.com/rking788/destiny-gear-vendor/cache"
+	"github.com/rking788/destiny-gear-vendor/graphics"
 )
 
+// modelContentTypes are the MIME types models are served with in each of the supported formats.
+// USDA and USDC don't have registered types so they are served as plain text and binary data.
+var modelContentTypes = map[string]string{
+	"dae":  "model/vnd.collada+xml",
+	"stl":  "model/stl",
+	"usda": "text/plain; charset=utf-8",
+	"usdc": "application/octet-stream",
+	"usdz": "model/vnd.usdz+zip",
+}
+
 func GetAsset(w http.ResponseWriter, r *http.Request) {
 
 	params := mux.Vars(r)
 	hash, ok := params["hash"]
 	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Forgot to specify an item hash"))
+		writeError(w, http.StatusBadRequest, "invalid_request", "Forgot to specify an item hash")
 		return
 	}
 	format, ok := params["format"]
 	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Forgot to specify an asset format"))
+		writeError(w, http.StatusBadRequest, "invalid_request", "Forgot to specify an asset format")
+		return
+	}
+	// The usd format is served as a USDZ archive
+	if format == "usd" {
+		format = "usdz"
+	}
+	contentType, ok := modelContentTypes[format]
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Invalid asset format specified, expected dae, stl, usd, usda, usdc or usdz")
 		return
 	}
-	if format != "dae" && format != "stl" && format != "usd" {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Invalid asset format specified"))
+	if err := checkFormatEnabled(format); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
 		return
 	}
 
-	tempHash, err := strconv.ParseInt(hash, 10, 64)
+	tempHash, err := strconv.ParseUint(hash, 10, 32)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Invalid item hash provided"))
+		writeError(w, http.StatusBadRequest, "invalid_request", "Invalid item hash provided")
+		return
+	}
+
+	options := graphics.Options{}
+	if maxTriangles := r.URL.Query().Get("max-triangles"); maxTriangles != "" {
+		options.MaxTriangles, err = strconv.Atoi(maxTriangles)
+		if err != nil || options.MaxTriangles < 0 {
+			writeError(w, http.StatusBadRequest, "invalid_request", "Invalid max-triangles value provided")
+			return
+		}
+	}
+
+	options.Textures.Format, err = graphics.ParseTextureFormat(r.URL.Query().Get("texture-format"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Invalid texture-format value provided")
+		return
+	}
+	if err := options.Textures.Format.CheckModelFormat(format); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
 		return
 	}
 
@@ -44,34 +82,112 @@ func GetAsset(w http.ResponseWriter, r *http.Request) {
 
 	assetDefinition, err := bungie.GetAssetDefinition(uint(tempHash))
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte("No item found with the specified item hash"))
+		writeConversionError(w, err)
+		return
+	}
+	if err := checkSupported(assetDefinition); err != nil {
+		writeConversionError(w, err)
 		return
 	}
 
-	// Only include textures for DAE and USD formats
-	withTextures := (format == "dae" || format == "usd")
-	if withTextures {
-		processTextures(assetDefinition)
+	w.Header().Set("Content-Type", contentType)
+	filename := fmt.Sprintf("%s.%s", hash, format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+
+	if entry, ok := outputCache.Get(cacheKey(assetDefinition, format, options)); ok {
+		cacheRequestsTotal.Inc("hit")
+		serveModel(w, r, entry)
+		return
 	}
 
-	path := processGeometry(assetDefinition, (format == "stl"), (format == "dae"), format == "usda", format == "usdc", (format == "usdz"))
-	if path == "" {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Something went wrong generating the model"))
+	var entry cache.Entry
+	if format == "dae" || format == "stl" {
+		entry, err = streamedModel(assetDefinition, format, options)
+	} else {
+		entry, err = cachedModel(assetDefinition, format, options, logReporter{})
+	}
+	if err != nil {
+		glg.Errorf("Failed to write model for asset = %d: %s", assetDefinition.ID, err.Error())
+		writeConversionError(w, err)
 		return
 	}
 
-	contents, err := ioutil.ReadFile(path)
+	serveModel(w, r, entry)
+}
+
+// serveModel serves the model file of the cache entry, answering conditional and range requests
+// with its ETag and modification time.
+func serveModel(w http.ResponseWriter, r *http.Request, entry cache.Entry) {
+
+	modelF, err := os.Open(entry.Path())
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Failed to read the model file from disk"))
+		writeError(w, http.StatusInternalServerError, "conversion_failed", "Failed to read the model file from disk")
 		return
 	}
+	defer modelF.Close()
 
-	// This should be different if the format was specified as STL
-	w.Header().Set("Content-type", "model/vnd.collada+xml")
-	filename := fmt.Sprintf("%s.%s", hash, format)
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
-	http.ServeContent(w, r, format, time.Now(), bytes.NewReader(contents))
+	w.Header().Set("ETag", entry.ETag())
+	http.ServeContent(w, r, entry.Result, entry.CreatedAt, modelF)
+}
+
+// streamedModel returns the cache entry of a DAE or STL model, writing it through writeModel if
+// it isn't in the cache yet. The model is streamed into a staging file rather than straight into
+// the response, so a slow or disconnected client can't hold up or fail the conversion that
+// identical requests are waiting on.
+func streamedModel(asset *bungie.GearAssetDefinition, format string, options graphics.Options) (cache.Entry, error) {
+
+	name := fmt.Sprintf("%s.%s", modelName(asset.ID, options), format)
+	return writeCachedModel(asset.ID, cacheKey(asset, format, options), name, func(w io.Writer, dir string) error {
+		// Only include textures for DAE and USD formats
+		if format == "dae" {
+			processTextures(asset, logReporter{})
+		}
+
+		return writeModel(w, asset, format, options, dir)
+	})
+}
+
+// writeCachedModel adds the model written by write to the cache under key, unless it is already
+// cached. write is given the file to write the model to and the staging directory for anything
+// written next to it. Identical requests share a single conversion, see convertItem.
+func writeCachedModel(id uint, key cache.Key, name string, write func(w io.Writer, dir string) error) (cache.Entry, error) {
+
+	entry, shared, err := convertItem(id, key.ID(), logReporter{}, func(graphics.Reporter) (entry cache.Entry, err error) {
+		if entry, ok := outputCache.Get(key); ok {
+			// Another conversion of the item wrote it while this one waited for the lock
+			cacheRequestsTotal.Inc("hit")
+			return entry, nil
+		}
+
+		cacheRequestsTotal.Inc("miss")
+		started := time.Now()
+		defer func() { observeConversion(key.Format, started, err) }()
+
+		dir, err := outputCache.Stage()
+		if err != nil {
+			return cache.Entry{}, err
+		}
+		defer os.RemoveAll(dir)
+
+		cacheF, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return cache.Entry{}, err
+		}
+
+		err = write(cacheF, dir)
+		if closeErr := cacheF.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return cache.Entry{}, err
+		}
+
+		return outputCache.Put(key, dir, name)
+	})
+	if shared {
+		// Waited on a conversion started by another request
+		cacheRequestsTotal.Inc("miss")
+	}
+
+	return entry, err
 }
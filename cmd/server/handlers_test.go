@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rking788/destiny-gear-vendor/bungie"
+	"github.com/rking788/destiny-gear-vendor/cache"
+)
+
+func TestGetAssetBadRequests(t *testing.T) {
+
+	router := mux.NewRouter()
+	router.HandleFunc("/gear-vendor/{hash}/{format}", GetAsset).Methods("GET")
+
+	for _, path := range []string{
+		"/gear-vendor/1/obj",
+		"/gear-vendor/abc/dae",
+		"/gear-vendor/1/stl?max-triangles=-1",
+		"/gear-vendor/1/usdz?texture-format=gif",
+		"/gear-vendor/1/usdz?texture-format=ktx2",
+		"/gear-vendor/1/dae?texture-format=basis",
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+
+		body := apiError{}
+		err := json.Unmarshal(recorder.Body.Bytes(), &body)
+		if recorder.Code != http.StatusBadRequest || err != nil || body.Code != "invalid_request" {
+			t.Errorf("Expected a JSON bad request for %s, got %d: %s", path, recorder.Code, recorder.Body.String())
+		}
+	}
+}
+
+func TestWriteConversionError(t *testing.T) {
+
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{bungie.ErrItemNotFound, http.StatusNotFound, "item_not_found"},
+		{checkSupported(&bungie.GearAssetDefinition{ID: 1}), http.StatusUnprocessableEntity, "unsupported_item"},
+		{fmt.Errorf("wrapped: %w", &upstreamError{errors.New("bad response: 503")}), http.StatusBadGateway, "upstream_failed"},
+		{errors.New("Mismatched stride sizes found"), http.StatusInternalServerError, "conversion_failed"},
+	}
+
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		recorder.Header().Set("Content-Disposition", "attachment; filename=1.dae")
+		writeConversionError(recorder, test.err)
+
+		body := apiError{}
+		json.Unmarshal(recorder.Body.Bytes(), &body)
+		if recorder.Code != test.status || body.Status != test.status || body.Code != test.code {
+			t.Errorf("Expected %d %s for %q, got %d: %s", test.status, test.code, test.err, recorder.Code, recorder.Body.String())
+		}
+		if recorder.Header().Get("Content-Type") != "application/json" || recorder.Header().Get("Content-Disposition") != "" {
+			t.Errorf("Expected only JSON headers for an error, got %v", recorder.Header())
+		}
+	}
+}
+
+// droppedResponse is the response of a client that disconnected, every write fails.
+type droppedResponse struct {
+	header http.Header
+}
+
+func (response *droppedResponse) Header() http.Header { return response.header }
+func (response *droppedResponse) WriteHeader(int)     {}
+func (response *droppedResponse) Write([]byte) (int, error) {
+	return 0, errors.New("connection reset by peer")
+}
+
+func TestWriteCachedModelDroppedLeader(t *testing.T) {
+
+	var err error
+	previous := outputCache
+	outputCache, err = cache.Open(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("Failed to open the cache: %s", err.Error())
+	}
+	defer func() { outputCache = previous }()
+
+	var calls int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	key := cache.Key{Hash: 7, Version: "1", Format: "stl"}
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		entry, err := writeCachedModel(7, key, "7.stl", func(w io.Writer, dir string) error {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				close(started)
+			}
+			<-release
+			_, err := w.Write([]byte("solid model"))
+			return err
+		})
+		if err != nil {
+			writeConversionError(w, err)
+			return
+		}
+		serveModel(w, r, entry)
+	}
+
+	// The first request runs the conversion and its client goes away while it is running
+	ctx, cancel := context.WithCancel(context.Background())
+	leaderDone := make(chan struct{})
+	go func() {
+		defer close(leaderDone)
+		handler(&droppedResponse{header: http.Header{}}, httptest.NewRequest("GET", "/gear-vendor/7/stl", nil).WithContext(ctx))
+	}()
+	<-started
+
+	var wg sync.WaitGroup
+	recorders := make([]*httptest.ResponseRecorder, 3)
+	for i := range recorders {
+		recorders[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(recorder *httptest.ResponseRecorder) {
+			defer wg.Done()
+			handler(recorder, httptest.NewRequest("GET", "/gear-vendor/7/stl", nil))
+		}(recorders[i])
+	}
+
+	// Give the other requests a chance to join the running conversion before it finishes
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	close(release)
+	wg.Wait()
+	<-leaderDone
+
+	if calls != 1 {
+		t.Errorf("Expected a single conversion, got %d", calls)
+	}
+	for i, recorder := range recorders {
+		if recorder.Code != http.StatusOK || recorder.Body.String() != "solid model" {
+			t.Errorf("Request %d: Expected the model, got %d: %s", i, recorder.Code, recorder.Body.String())
+		}
+		if recorder.Header().Get("ETag") == "" || recorder.Header().Get("Last-Modified") == "" {
+			t.Errorf("Request %d: Expected an ETag and Last-Modified, got %v", i, recorder.Header())
+		}
+	}
+	if _, ok := outputCache.Lookup(key); !ok {
+		t.Errorf("Expected the model to be cached")
+	}
+}
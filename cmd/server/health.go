@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/rking788/destiny-gear-vendor/db"
+)
+
+// ReadinessTimeout is how long the readiness checks wait for the database to answer.
+const ReadinessTimeout = 2 * time.Second
+
+// usdTools are the programs USD models are packaged with, see packageUSDZ.
+var usdTools = []string{"usdcat", "zip", "zipalign"}
+
+// usdFormats are the formats that need the USD tools to be written.
+var usdFormats = map[string]bool{"usda": true, "usdc": true, "usdz": true}
+
+// errUSDDisabled is returned for requests for USD formats when they are turned off.
+var errUSDDisabled = errors.New("USD formats are turned off on this server")
+
+// checkFormatEnabled returns an error if the format can't be written by this server.
+func checkFormatEnabled(format string) error {
+	if cfg.DisableUSD && usdFormats[format] {
+		return errUSDDisabled
+	}
+	return nil
+}
+
+// outputDirs are the directories the server writes downloads and models to.
+func outputDirs() []string {
+	return []string{cfg.Cache.Dir, cfg.Paths.Textures, cfg.Paths.GeometryDownloads, cfg.Paths.TextureDownloads}
+}
+
+// Readiness is the result of the readiness checks, with the outcome of each check.
+type Readiness struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// GetHealth reports that the server is running, it doesn't check anything it depends on.
+func GetHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// GetReadiness reports whether the server can convert models: the database can be reached, the
+// output directories can be written to and the USD tools are installed, unless the USD formats
+// are turned off. It responds with 503 Service Unavailable if any of the checks fail.
+func GetReadiness(w http.ResponseWriter, r *http.Request) {
+
+	ctx, cancel := context.WithTimeout(r.Context(), ReadinessTimeout)
+	defer cancel()
+
+	readiness := checkReadiness(ctx)
+	status := http.StatusOK
+	if !readiness.Ready {
+		status = http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, status, readiness)
+}
+
+func checkReadiness(ctx context.Context) *Readiness {
+
+	readiness := &Readiness{Ready: true, Checks: make(map[string]string)}
+	record := func(name string, err error) {
+		// Only the first failure of a check is reported
+		if result, ok := readiness.Checks[name]; ok && result != "ok" {
+			return
+		}
+		if err != nil {
+			readiness.Ready = false
+			readiness.Checks[name] = err.Error()
+		} else {
+			readiness.Checks[name] = "ok"
+		}
+	}
+
+	assetDB, err := db.GetAssetDBConnection()
+	if err == nil {
+		err = assetDB.Ping(ctx)
+	}
+	record("database", err)
+
+	for _, dir := range outputDirs() {
+		record("output", checkWritable(dir))
+	}
+
+	if cfg.DisableUSD {
+		readiness.Checks["usd-tools"] = "not needed"
+	} else {
+		for _, tool := range usdTools {
+			record("usd-tools", checkTool(tool))
+		}
+	}
+
+	return readiness
+}
+
+// checkWritable makes sure a file can be created in the directory.
+func checkWritable(dir string) error {
+
+	f, err := ioutil.TempFile(dir, ".readiness-")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %s", dir, err.Error())
+	}
+	f.Close()
+
+	return os.Remove(f.Name())
+}
+
+func checkTool(name string) error {
+	if _, err := exec.LookPath(name); err != nil {
+		return fmt.Errorf("%s is not installed", name)
+	}
+	return nil
+}
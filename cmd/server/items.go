@@ -0,0 +1,207 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/kpango/glg"
+	"github.com/rking788/destiny-gear-vendor/bungie"
+	"github.com/rking788/destiny-gear-vendor/db"
+	"github.com/rking788/destiny-gear-vendor/graphics"
+)
+
+const (
+	// DefaultItemLimit is the number of items returned by a search if no limit is given.
+	DefaultItemLimit = 50
+	// MaxItemLimit is the most items a single search can return.
+	MaxItemLimit = 200
+)
+
+// itemTiers are the names of the tier_type values of items, as they are shown in the game.
+var itemTiers = map[string]int{
+	"common":    2,
+	"uncommon":  3,
+	"rare":      4,
+	"legendary": 5,
+	"exotic":    6,
+}
+
+// ItemInfo is what is reported to clients about an item.
+type ItemInfo struct {
+	Hash       uint   `json:"hash"`
+	Name       string `json:"name"`
+	Icon       string `json:"icon,omitempty"`
+	Tier       int    `json:"tier"`
+	TierName   string `json:"tierName,omitempty"`
+	Category   string `json:"category,omitempty"`
+	BucketHash uint   `json:"bucketHash"`
+	TypeName   string `json:"typeName,omitempty"`
+
+	// CachedFormats are the formats a model with the default options is already cached in, so
+	// it can be downloaded without waiting for a conversion.
+	CachedFormats []string `json:"cachedFormats"`
+}
+
+// ItemSearchResult is a page of items matching a search.
+type ItemSearchResult struct {
+	Items  []*ItemInfo `json:"items"`
+	Limit  int         `json:"limit"`
+	Offset int         `json:"offset"`
+}
+
+func newItemInfo(item *db.ItemDetails) *ItemInfo {
+
+	info := &ItemInfo{
+		Hash:          item.Hash,
+		Name:          item.Name,
+		Tier:          item.Tier,
+		Category:      item.Category(),
+		BucketHash:    item.BucketHash,
+		TypeName:      item.TypeName,
+		CachedFormats: []string{},
+	}
+	if item.Icon != "" {
+		info.Icon = bungie.UrlPrefix + item.Icon
+	}
+	for name, tier := range itemTiers {
+		if tier == item.Tier {
+			info.TierName = name
+		}
+	}
+
+	asset, err := bungie.ParseAssetDefinition(item.Hash, item.Definition)
+	if err != nil {
+		glg.Warnf("Failed to parse the asset definition for item(%d): %s", item.Hash, err.Error())
+		return info
+	}
+
+	for format := range modelContentTypes {
+		if _, ok := outputCache.Lookup(cacheKey(asset, format, graphics.Options{})); ok {
+			info.CachedFormats = append(info.CachedFormats, format)
+		}
+	}
+	sort.Strings(info.CachedFormats)
+
+	return info
+}
+
+// parseItemFilter reads the search parameters of the request.
+func parseItemFilter(r *http.Request) (db.ItemFilter, error) {
+
+	query := r.URL.Query()
+	filter := db.ItemFilter{
+		Name:     strings.TrimSpace(query.Get("q")),
+		Category: strings.ToLower(query.Get("category")),
+		Limit:    DefaultItemLimit,
+	}
+
+	if _, ok := db.ItemCategories[filter.Category]; filter.Category != "" && !ok {
+		return filter, errors.New("Invalid category specified, expected weapon, armor, ghost or vehicle")
+	}
+
+	if tier := strings.ToLower(query.Get("tier")); tier != "" {
+		var ok bool
+		if filter.Tier, ok = itemTiers[tier]; !ok {
+			var err error
+			filter.Tier, err = strconv.Atoi(tier)
+			if err != nil || filter.Tier <= 0 {
+				return filter, errors.New("Invalid tier specified, expected a tier name or number")
+			}
+		}
+	}
+
+	if bucket := query.Get("bucket"); bucket != "" {
+		bucketHash, err := strconv.ParseUint(bucket, 10, 32)
+		if err != nil {
+			return filter, errors.New("Invalid bucket hash specified")
+		}
+		filter.Bucket = uint(bucketHash)
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		var err error
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil || filter.Limit <= 0 || filter.Limit > MaxItemLimit {
+			return filter, fmt.Errorf("Invalid limit specified, expected 1 to %d", MaxItemLimit)
+		}
+	}
+
+	if offset := query.Get("offset"); offset != "" {
+		var err error
+		filter.Offset, err = strconv.Atoi(offset)
+		if err != nil || filter.Offset < 0 {
+			return filter, errors.New("Invalid offset specified")
+		}
+	}
+
+	return filter, nil
+}
+
+// SearchItems lists the items that models can be written for, filtered by name (q), category,
+// tier and bucket.
+func SearchItems(w http.ResponseWriter, r *http.Request) {
+
+	filter, err := parseItemFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	assetDB, err := db.GetAssetDBConnection()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "lookup_failed", "Failed to connect to the item database")
+		return
+	}
+
+	items, err := assetDB.SearchItems(filter)
+	if err != nil {
+		glg.Errorf("Failed to search items: %s", err.Error())
+		writeError(w, http.StatusInternalServerError, "lookup_failed", "Failed to search the items")
+		return
+	}
+
+	result := &ItemSearchResult{
+		Items:  make([]*ItemInfo, 0, len(items)),
+		Limit:  filter.Limit,
+		Offset: filter.Offset,
+	}
+	for _, item := range items {
+		result.Items = append(result.Items, newItemInfo(item))
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// GetItem describes a single item.
+func GetItem(w http.ResponseWriter, r *http.Request) {
+
+	hash, err := strconv.ParseUint(mux.Vars(r)["hash"], 10, 32)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Invalid item hash provided")
+		return
+	}
+
+	assetDB, err := db.GetAssetDBConnection()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "lookup_failed", "Failed to connect to the item database")
+		return
+	}
+
+	item, err := assetDB.GetItemDetails(uint(hash))
+	if err == sql.ErrNoRows {
+		writeConversionError(w, bungie.ErrItemNotFound)
+		return
+	} else if err != nil {
+		glg.Errorf("Failed to look up item(%d): %s", hash, err.Error())
+		writeError(w, http.StatusInternalServerError, "lookup_failed", "Failed to look up the item")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newItemInfo(item))
+}
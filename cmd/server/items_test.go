@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rking788/destiny-gear-vendor/db"
+)
+
+func TestParseItemFilter(t *testing.T) {
+
+	valid := map[string]db.ItemFilter{
+		"/items": {Limit: DefaultItemLimit},
+		"/items?q=+Ace+of+Spades&category=Weapon":  {Name: "Ace of Spades", Category: "weapon", Limit: DefaultItemLimit},
+		"/items?tier=exotic&bucket=4023194814":     {Tier: 6, Bucket: 4023194814, Limit: DefaultItemLimit},
+		"/items?tier=5&limit=10&offset=20":         {Tier: 5, Limit: 10, Offset: 20},
+		"/items?category=armor&q=50%25_off&tier=2": {Name: "50%_off", Category: "armor", Tier: 2, Limit: DefaultItemLimit},
+	}
+	for url, expected := range valid {
+		filter, err := parseItemFilter(httptest.NewRequest("GET", url, nil))
+		if err != nil || filter != expected {
+			t.Errorf("Expected %+v for %s, got %+v (%v)", expected, url, filter, err)
+		}
+	}
+
+	for _, url := range []string{
+		"/items?category=emblem",
+		"/items?tier=mythic",
+		"/items?tier=-1",
+		"/items?bucket=abc",
+		"/items?limit=0",
+		"/items?limit=1000",
+		"/items?offset=-5",
+	} {
+		if _, err := parseItemFilter(httptest.NewRequest("GET", url, nil)); err == nil {
+			t.Errorf("Expected an error for %s", url)
+		}
+	}
+}
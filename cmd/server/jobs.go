@@ -0,0 +1,459 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/kpango/glg"
+	"github.com/rking788/destiny-gear-vendor/bungie"
+	"github.com/rking788/destiny-gear-vendor/graphics"
+)
+
+// JobStatus is the state of a conversion job.
+type JobStatus string
+
+// The states a job moves through, it ends up either done or failed.
+const (
+	JobQueued  JobStatus = "queued"
+	JobRunning JobStatus = "running"
+	JobDone    JobStatus = "done"
+	JobFailed  JobStatus = "failed"
+)
+
+// JobRequest is the body of a request to start a conversion job.
+type JobRequest struct {
+	Hash    uint             `json:"hash"`
+	Format  string           `json:"format"`
+	Options graphics.Options `json:"options"`
+}
+
+// validate checks the request describes a conversion that can be run, normalizing the texture
+// format of the options.
+func (request *JobRequest) validate() error {
+
+	if request.Hash == 0 {
+		return errors.New("Forgot to specify an item hash")
+	}
+	if _, ok := modelContentTypes[request.Format]; !ok {
+		return errors.New("Invalid asset format specified, expected dae, stl, usda, usdc or usdz")
+	}
+	if err := checkFormatEnabled(request.Format); err != nil {
+		return err
+	}
+	if request.Options.Split {
+		return errors.New("Split models can't be requested as a job")
+	}
+
+	// The options come straight from the request body so everything is bounded before a
+	// conversion is queued with them. Format names like png are normalized to the constant.
+	format, err := graphics.ParseTextureFormat(string(request.Options.Textures.Format))
+	if err != nil {
+		return err
+	}
+	request.Options.Textures.Format = format
+	if err := request.Options.Validate(); err != nil {
+		return err
+	}
+	if err := request.Options.Textures.Format.CheckModelFormat(request.Format); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// JobInfo is what is reported to clients about a job.
+type JobInfo struct {
+	ID         string     `json:"id"`
+	Hash       uint       `json:"hash"`
+	Format     string     `json:"format"`
+	Status     JobStatus  `json:"status"`
+	Stage      string     `json:"stage,omitempty"`
+	Progress   float64    `json:"progress"`
+	Error      string     `json:"error,omitempty"`
+	Result     string     `json:"result,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+// JobEvent is a step in the progress of a job, or a problem that was worked around, as streamed
+// to clients by GetJobEvents. The type is progress, warning, done or failed.
+type JobEvent struct {
+	ID       int       `json:"id"`
+	Type     string    `json:"type"`
+	Stage    string    `json:"stage,omitempty"`
+	Done     int       `json:"done,omitempty"`
+	Total    int       `json:"total,omitempty"`
+	Progress float64   `json:"progress"`
+	Message  string    `json:"message,omitempty"`
+	Result   string    `json:"result,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// jobStages are the stages a conversion goes through, with the part of the overall progress of
+// the job each one covers.
+var jobStages = map[string][2]float64{
+	"definition":        {0, 0.05},
+	"download-textures": {0.05, 0.2},
+	"download-geometry": {0.2, 0.35},
+	"geometry":          {0.35, 0.7},
+	"writing":           {0.7, 0.8},
+	"textures":          {0.8, 1},
+}
+
+// Job is a conversion running in the background. The info and events are only read and written
+// with the mutex held.
+type Job struct {
+	info       JobInfo
+	options    graphics.Options
+	resultPath string
+	mutex      sync.Mutex
+
+	events []JobEvent
+	// updated is closed, and replaced, whenever an event is added.
+	updated chan struct{}
+	// done is closed once the job has finished.
+	done chan struct{}
+}
+
+// Progress records that done of the total steps of the stage have finished, it is called by the
+// conversion as a graphics.Reporter.
+func (job *Job) Progress(stage string, done, total int) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	progress := 0.0
+	if total > 0 {
+		progress = float64(done) / float64(total)
+	}
+	if bounds, ok := jobStages[stage]; ok {
+		progress = bounds[0] + progress*(bounds[1]-bounds[0])
+	}
+
+	job.info.Stage = stage
+	job.info.Progress = progress
+	job.addEvent(JobEvent{Type: "progress", Stage: stage, Done: done, Total: total})
+}
+
+// Warn records a problem the conversion worked around, like a missing texture.
+func (job *Job) Warn(message string) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	job.addEvent(JobEvent{Type: "warning", Stage: job.info.Stage, Message: message})
+}
+
+// addEvent adds the event with the current progress of the job and wakes up anything waiting for
+// it. The mutex must be held.
+func (job *Job) addEvent(event JobEvent) {
+
+	event.ID = len(job.events) + 1
+	event.Progress = job.info.Progress
+	event.Time = time.Now().UTC()
+	job.events = append(job.events, event)
+
+	close(job.updated)
+	job.updated = make(chan struct{})
+}
+
+// eventsSince returns the events after the one with the ID, along with a channel that is closed
+// when there are more. finished is set once the last event of the job has been added.
+func (job *Job) eventsSince(id int) (events []JobEvent, updated <-chan struct{}, finished bool) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	if id < 0 || id > len(job.events) {
+		id = len(job.events)
+	}
+	events = append([]JobEvent{}, job.events[id:]...)
+	finished = job.info.Status == JobDone || job.info.Status == JobFailed
+
+	return events, job.updated, finished
+}
+
+// Done returns a channel that is closed once the job has finished, successfully or not.
+func (job *Job) Done() <-chan struct{} {
+	return job.done
+}
+
+// snapshot returns a copy of the job info along with the path of the result, if there is one.
+func (job *Job) snapshot() (JobInfo, string) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	return job.info, job.resultPath
+}
+
+// ConvertFunc runs the conversion for a job and returns the path of the written model.
+type ConvertFunc func(job *Job) (string, error)
+
+// JobQueue runs conversion jobs on a fixed number of workers. Jobs wait in the queue until a
+// worker is free.
+type JobQueue struct {
+	convert ConvertFunc
+	queue   chan *Job
+
+	mutex sync.Mutex
+	jobs  map[string]*Job
+}
+
+// NewJobQueue starts the workers of a new queue that holds up to size waiting jobs.
+func NewJobQueue(workers, size int, convert ConvertFunc) *JobQueue {
+
+	queue := &JobQueue{
+		convert: convert,
+		queue:   make(chan *Job, size),
+		jobs:    make(map[string]*Job),
+	}
+
+	for i := 0; i < workers; i++ {
+		go queue.work()
+	}
+
+	return queue
+}
+
+// Submit queues a new job for the request. An error is returned if the queue is full.
+func (queue *JobQueue) Submit(request *JobRequest) (*Job, error) {
+
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+
+	job := &Job{
+		info: JobInfo{
+			ID:        id,
+			Hash:      request.Hash,
+			Format:    request.Format,
+			Status:    JobQueued,
+			CreatedAt: time.Now().UTC(),
+		},
+		options: request.Options,
+		updated: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	queue.prune()
+
+	select {
+	case queue.queue <- job:
+		queue.jobs[id] = job
+		return job, nil
+	default:
+		jobsRejectedTotal.Inc()
+		return nil, errors.New("Too many jobs are waiting, try again later")
+	}
+}
+
+// Job returns the job with the ID, or nil if there isn't one.
+func (queue *JobQueue) Job(id string) *Job {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	return queue.jobs[id]
+}
+
+// Count returns the number of jobs in the queue with the status.
+func (queue *JobQueue) Count(status JobStatus) int {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	count := 0
+	for _, job := range queue.jobs {
+		if info, _ := job.snapshot(); info.Status == status {
+			count++
+		}
+	}
+
+	return count
+}
+
+// prune forgets the jobs that finished longer than the configured retention ago. The mutex must
+// be held.
+func (queue *JobQueue) prune() {
+
+	cutoff := time.Now().Add(-cfg.Jobs.Retention.Duration)
+	for id, job := range queue.jobs {
+		info, _ := job.snapshot()
+		if info.FinishedAt != nil && info.FinishedAt.Before(cutoff) {
+			delete(queue.jobs, id)
+		}
+	}
+}
+
+func (queue *JobQueue) work() {
+	for job := range queue.queue {
+		queue.run(job)
+	}
+}
+
+// run converts the job, recording the result or the reason it failed. Panics in the conversion
+// fail the job instead of taking down the server.
+func (queue *JobQueue) run(job *Job) {
+
+	started := time.Now().UTC()
+	job.mutex.Lock()
+	job.info.Status = JobRunning
+	job.info.StartedAt = &started
+	job.mutex.Unlock()
+
+	var path string
+	var err error
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("Conversion panicked: %v", r)
+			}
+		}()
+		path, err = queue.convert(job)
+	}()
+
+	finished := time.Now().UTC()
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	defer close(job.done)
+
+	job.info.FinishedAt = &finished
+	if err != nil {
+		glg.Errorf("Job %s for item %d failed: %s", job.info.ID, job.info.Hash, err.Error())
+		job.info.Status = JobFailed
+		job.info.Error = err.Error()
+		job.addEvent(JobEvent{Type: "failed", Stage: job.info.Stage, Message: job.info.Error})
+		return
+	}
+
+	job.info.Status = JobDone
+	job.info.Stage = ""
+	job.info.Progress = 1
+	job.info.Result = fmt.Sprintf("/jobs/%s/result", job.info.ID)
+	job.resultPath = path
+	job.addEvent(JobEvent{Type: "done", Result: job.info.Result})
+}
+
+func newJobID() (string, error) {
+
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
+
+// convertJob downloads and converts the item for the job into the cache, the same way GetAsset
+// does.
+func convertJob(job *Job) (string, error) {
+
+	info, _ := job.snapshot()
+	job.Progress("definition", 0, 1)
+	assetDefinition, err := bungie.GetAssetDefinition(info.Hash)
+	if err != nil {
+		return "", fmt.Errorf("No item found with the specified item hash: %s", err.Error())
+	}
+	job.Progress("definition", 1, 1)
+
+	entry, err := cachedModel(assetDefinition, info.Format, job.options, job)
+	if err != nil {
+		return "", err
+	}
+
+	return entry.Path(), nil
+}
+
+// CreateJob starts a conversion job for the item, format and options in the JSON body. The job
+// is returned with a 202 status and a Location header pointing at the job.
+func (queue *JobQueue) CreateJob(w http.ResponseWriter, r *http.Request) {
+
+	request := &JobRequest{}
+	err := json.NewDecoder(r.Body).Decode(request)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Invalid job request: "+err.Error())
+		return
+	}
+
+	err = request.validate()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	job, err := queue.Submit(request)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, "queue_full", err.Error())
+		return
+	}
+
+	info, _ := job.snapshot()
+	w.Header().Set("Location", "/jobs/"+info.ID)
+	writeJSON(w, http.StatusAccepted, info)
+}
+
+// GetJob reports the status, progress and any error of a job.
+func (queue *JobQueue) GetJob(w http.ResponseWriter, r *http.Request) {
+
+	job := queue.Job(mux.Vars(r)["id"])
+	if job == nil {
+		writeError(w, http.StatusNotFound, "job_not_found", "No job found with the specified ID")
+		return
+	}
+
+	info, _ := job.snapshot()
+	writeJSON(w, http.StatusOK, info)
+}
+
+// GetJobResult streams the model written by a finished job.
+func (queue *JobQueue) GetJobResult(w http.ResponseWriter, r *http.Request) {
+
+	job := queue.Job(mux.Vars(r)["id"])
+	if job == nil {
+		writeError(w, http.StatusNotFound, "job_not_found", "No job found with the specified ID")
+		return
+	}
+
+	info, path := job.snapshot()
+	switch info.Status {
+	case JobFailed:
+		writeError(w, http.StatusInternalServerError, "conversion_failed", "The job failed: "+info.Error)
+		return
+	case JobQueued, JobRunning:
+		writeJSON(w, http.StatusConflict, info)
+		return
+	}
+
+	modelF, err := os.Open(path)
+	if os.IsNotExist(err) {
+		writeError(w, http.StatusGone, "result_evicted", "The result has been evicted from the cache, start a new job")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "conversion_failed", "Failed to read the model file from disk")
+		return
+	}
+	defer modelF.Close()
+
+	filename := fmt.Sprintf("%d.%s", info.Hash, info.Format)
+	w.Header().Set("Content-Type", modelContentTypes[info.Format])
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+	http.ServeContent(w, r, filename, *info.FinishedAt, modelF)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func testJobRouter(queue *JobQueue) *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/jobs", queue.CreateJob).Methods("POST")
+	router.HandleFunc("/jobs/{id}", queue.GetJob).Methods("GET")
+	router.HandleFunc("/jobs/{id}/result", queue.GetJobResult).Methods("GET")
+
+	return router
+}
+
+// waitForJob polls the job until it finishes.
+func waitForJob(t *testing.T, router http.Handler, id string) JobInfo {
+
+	for i := 0; i < 100; i++ {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", "/jobs/"+id, nil))
+
+		info := JobInfo{}
+		err := json.Unmarshal(recorder.Body.Bytes(), &info)
+		if err != nil {
+			t.Fatalf("Failed to decode job: %s", err.Error())
+		}
+		if info.Status == JobDone || info.Status == JobFailed {
+			return info
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("Job %s never finished", id)
+	return JobInfo{}
+}
+
+// errorCode is the code of the JSON error in the response, empty if it isn't one.
+func errorCode(recorder *httptest.ResponseRecorder) string {
+
+	if recorder.Header().Get("Content-Type") != "application/json" {
+		return ""
+	}
+
+	body := apiError{}
+	json.Unmarshal(recorder.Body.Bytes(), &body)
+	return body.Code
+}
+
+func TestJobs(t *testing.T) {
+
+	dir := t.TempDir()
+	queue := NewJobQueue(1, 10, func(job *Job) (string, error) {
+		info, _ := job.snapshot()
+		switch info.Hash {
+		case 1:
+			path := filepath.Join(dir, "model.stl")
+			return path, ioutil.WriteFile(path, []byte("solid destiny\nendsolid destiny\n"), 0644)
+		case 2:
+			return "", errors.New("conversion failed")
+		}
+		panic("unexpected item")
+	})
+	router := testJobRouter(queue)
+
+	tests := []struct {
+		hash         string
+		status       JobStatus
+		resultStatus int
+	}{
+		{"1", JobDone, http.StatusOK},
+		{"2", JobFailed, http.StatusInternalServerError},
+		{"3", JobFailed, http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		body := strings.NewReader(`{"hash": ` + test.hash + `, "format": "stl", "options": {"maxTriangles": 10}}`)
+		router.ServeHTTP(recorder, httptest.NewRequest("POST", "/jobs", body))
+		if recorder.Code != http.StatusAccepted {
+			t.Fatalf("Wrong status creating job: Expected=%d, Actual=%d", http.StatusAccepted, recorder.Code)
+		}
+
+		created := JobInfo{}
+		json.Unmarshal(recorder.Body.Bytes(), &created)
+		if recorder.Header().Get("Location") != "/jobs/"+created.ID {
+			t.Errorf("Wrong location: %s", recorder.Header().Get("Location"))
+		}
+
+		info := waitForJob(t, router, created.ID)
+		if info.Status != test.status {
+			t.Errorf("Item %s: Wrong job status: Expected=%s, Actual=%s (%s)", test.hash, test.status, info.Status, info.Error)
+		}
+
+		recorder = httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", "/jobs/"+created.ID+"/result", nil))
+		if recorder.Code != test.resultStatus {
+			t.Errorf("Item %s: Wrong result status: Expected=%d, Actual=%d", test.hash, test.resultStatus, recorder.Code)
+		}
+		if test.status == JobDone && !strings.HasPrefix(recorder.Body.String(), "solid destiny") {
+			t.Errorf("Item %s: Wrong result: %s", test.hash, recorder.Body.String())
+		}
+	}
+}
+
+func TestJobRequestValidation(t *testing.T) {
+
+	queue := NewJobQueue(0, 1, nil)
+	router := testJobRouter(queue)
+
+	for _, body := range []string{
+		`not json`,
+		`{"format": "stl"}`,
+		`{"hash": 1, "format": "obj"}`,
+		`{"hash": 1, "format": "dae", "options": {"textures": {"format": "gif"}}}`,
+		`{"hash": 1, "format": "dae", "options": {"precision": 100000}}`,
+		`{"hash": 1, "format": "dae", "options": {"smoothingAngle": 270}}`,
+		`{"hash": 1, "format": "dae", "options": {"triangleRatio": 2}}`,
+		`{"hash": 1, "format": "stl", "options": {"printPrep": {"maxHoleEdges": 100000000}}}`,
+		`{"hash": 1, "format": "stl", "options": {"printPrep": {"decalDistance": -1}}}`,
+		`{"hash": 1, "format": "dae", "options": {"textures": {"maxSize": 1000000}}}`,
+		`{"hash": 1, "format": "dae", "options": {"textures": {"gearstack": {"aoChannel": "x", "metalnessBits": 5}}}}`,
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("POST", "/jobs", strings.NewReader(body)))
+		if code := errorCode(recorder); recorder.Code != http.StatusBadRequest || code != "invalid_request" {
+			t.Errorf("%s: Wrong error: Expected=%d invalid_request, Actual=%d %s", body, http.StatusBadRequest, recorder.Code, code)
+		}
+	}
+
+	// Nothing is working on the queue, so the second job doesn't fit
+	for i, expected := range []int{http.StatusAccepted, http.StatusServiceUnavailable} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("POST", "/jobs", strings.NewReader(`{"hash": 1, "format": "stl"}`)))
+		if recorder.Code != expected {
+			t.Errorf("Job %d: Wrong status: Expected=%d, Actual=%d", i, expected, recorder.Code)
+		}
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("POST", "/jobs", strings.NewReader(`{"hash": 1, "format": "stl"}`)))
+	if code := errorCode(recorder); code != "queue_full" {
+		t.Errorf("Wrong error for a full queue: %s", code)
+	}
+
+	for _, path := range []string{"/jobs/missing", "/jobs/missing/result"} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		if code := errorCode(recorder); recorder.Code != http.StatusNotFound || code != "job_not_found" {
+			t.Errorf("%s: Wrong error for a missing job: Expected=%d job_not_found, Actual=%d %s", path, http.StatusNotFound, recorder.Code, code)
+		}
+	}
+}
+
+func TestJobEvents(t *testing.T) {
+
+	dir := t.TempDir()
+	release := make(chan struct{})
+	queue := NewJobQueue(1, 10, func(job *Job) (string, error) {
+		<-release
+		job.Progress("geometry", 1, 2)
+		job.Warn("Unknown primitive type 99, skipping part 2")
+		job.Progress("geometry", 2, 2)
+
+		path := filepath.Join(dir, "model.stl")
+		return path, ioutil.WriteFile(path, []byte("solid destiny\nendsolid destiny\n"), 0644)
+	})
+	router := testJobRouter(queue)
+	router.HandleFunc("/jobs/{id}/events", queue.GetJobEvents).Methods("GET")
+
+	job, err := queue.Submit(&JobRequest{Hash: 1, Format: "stl"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, _ := job.snapshot()
+
+	// The stream is opened before the job starts and is closed once it finishes
+	recorder := httptest.NewRecorder()
+	streamed := make(chan struct{})
+	go func() {
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", "/jobs/"+info.ID+"/events", nil))
+		close(streamed)
+	}()
+	close(release)
+
+	select {
+	case <-streamed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The event stream never finished")
+	}
+
+	if recorder.Header().Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Wrong content type: %s", recorder.Header().Get("Content-Type"))
+	}
+
+	expected := []string{
+		"id: 1\nevent: progress\n",
+		"id: 2\nevent: warning\n",
+		"id: 3\nevent: progress\n",
+		"id: 4\nevent: done\n",
+	}
+	body := recorder.Body.String()
+	for _, prefix := range expected {
+		if !strings.Contains(body, prefix) {
+			t.Errorf("Missing event %q in:\n%s", prefix, body)
+		}
+	}
+	if !strings.Contains(body, `"progress":0.7`) || !strings.Contains(body, `"result":"/jobs/`+info.ID+`/result"`) {
+		t.Errorf("Expected the overall progress and result in the events:\n%s", body)
+	}
+
+	// Reconnecting clients only get the events they missed
+	request := httptest.NewRequest("GET", "/jobs/"+info.ID+"/events", nil)
+	request.Header.Set("Last-Event-ID", "3")
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	if body := recorder.Body.String(); !strings.HasPrefix(body, "id: 4\nevent: done\n") || strings.Count(body, "id: ") != 1 {
+		t.Errorf("Expected only the last event after reconnecting:\n%s", body)
+	}
+}
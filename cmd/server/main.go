@@ -3,8 +3,10 @@ package main
 import (
 	"archive/zip"
 	"bytes"
+	"crypto/sha1"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -13,11 +15,16 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/kpango/glg"
 	"github.com/rking788/destiny-gear-vendor/bungie"
+	"github.com/rking788/destiny-gear-vendor/cache"
+	"github.com/rking788/destiny-gear-vendor/config"
+	"github.com/rking788/destiny-gear-vendor/db"
 	"github.com/rking788/destiny-gear-vendor/graphics"
 )
 
@@ -34,19 +41,65 @@ import (
 	"Shader": "/common/destiny2_content/geometry/platform/mobile/shaders"
 **/
 
-const (
-	ModelPathPrefix         = "./output/gear.scnassets/"
-	ModelNamePrefix         = ModelPathPrefix
-	TexturePathPrefix       = "./output/"
-	LocalGeometryBasePath   = "./local_tools/geom/geometry/"
-	LocalTextureBasePath    = "./local_tools/geom/textures/"
-	RenderMeshesBasePath    = "./local_tools/"
-	AssetDefinitionBasePath = "./local_tools/"
-)
+// cfg holds the settings of the server and CLI, it is loaded from the config file, environment
+// and flags when the program starts.
+var cfg = config.Default()
+
+// Command describes the models the CLI should write.
+type Command struct {
+	Hash uint
+	// All, Weapons, Ghosts and Vehicles select groups of items to convert instead of a single
+	// item hash.
+	All      bool
+	Weapons  bool
+	Ghosts   bool
+	Vehicles bool
+	Formats  Formats
+	// Geometry and Textures select whether the models are written and the textures unpacked.
+	Geometry bool
+	Textures bool
+	Options  graphics.Options
+}
 
-var (
-	BungieApiKey = os.Getenv("BUNGIE_API_KEY")
-)
+// Formats are the model formats requested from a conversion. Only one model is written, USD
+// formats are preferred over DAE and DAE over STL.
+type Formats struct {
+	STL  bool
+	DAE  bool
+	USDA bool
+	USDC bool
+	USDZ bool
+}
+
+// formatsFor requests only the format with the file extension.
+func formatsFor(format string) Formats {
+	return Formats{
+		STL:  format == "stl",
+		DAE:  format == "dae",
+		USDA: format == "usda",
+		USDC: format == "usdc",
+		USDZ: format == "usdz",
+	}
+}
+
+// checkTextureFormat returns an error if any of the requested formats can't use textures in the
+// texture format.
+func (formats Formats) checkTextureFormat(format graphics.TextureFormat) error {
+	for model, requested := range map[string]bool{"dae": formats.DAE, "usdz": formats.USDZ} {
+		if requested {
+			if err := format.CheckModelFormat(model); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// usd reports whether any of the USD formats were requested.
+func (formats Formats) usd() bool {
+	return formats.USDA || formats.USDC || formats.USDZ
+}
 
 func main() {
 
@@ -65,57 +118,184 @@ func main() {
 	withUSDZ := flag.Bool("usdz", false, "Write the model for the specified Destiny gear in USDZ format")
 	withGeom := flag.Bool("geom", false, "Indicates that geometries should be parsed and written")
 	withTextures := flag.Bool("textures", false, "Indicates that textures should be processed")
-	flag.Parse()
+	upAxis := flag.String("up-axis", "", "The up axis (y or z) of the written model, defaults to the convention of the output format")
+	handedness := flag.String("handedness", "", "The handedness (left or right) of the written model, defaults to right")
+	pivot := flag.String("pivot", "", "Move the origin of the written model to the \"center\" of its bounds or the \"ground\" plane")
+	withMetadata := flag.Bool("metadata", false, "Write a JSON file describing the model bounds next to the model")
+	smoothingAngle := flag.Float64("smoothing-angle", 0, "Recompute smooth normals, keeping edges sharper than this many degrees hard")
+	maxTriangles := flag.Int("max-triangles", 0, "Simplify the model down to at most this many triangles")
+	withPrintPrep := flag.Bool("print-prep", false, "Repair STL models for 3D printing (merge vertices, fill small holes, drop decals)")
+	maxTextureSize := flag.Int("max-texture-size", 0, "Scale textures down so neither side is larger than this many pixels")
+	withPOTTextures := flag.Bool("pot-textures", false, "Scale textures to the nearest power of two size")
+	withGrayscaleTextures := flag.Bool("grayscale-textures", false, "Write the AO, metalness, roughness and emissive maps as single channel PNGs")
+	withORM := flag.Bool("orm", false, "Pack the AO, roughness and metalness maps into a single ORM texture")
+	textureFormat := flag.String("texture-format", "", "The file format (png, ktx2 or basis) to write textures in, defaults to the format of the source textures. KTX2 textures only work with USDA and USDC models")
+	gearstackOptionsPath := flag.String("gearstack-options", "", "A JSON file describing how to decode the gearstack textures, see graphics.GearstackOptions")
+	withAtlas := flag.Bool("atlas", false, "Pack all of the texture plates into one atlas so the model has a single material")
+	withSplit := flag.Bool("split", false, "Write every mesh as its own model file along with a JSON manifest of the parts")
+	precision := flag.Int("precision", 0, "The number of decimal places to write vertex data with, defaults to 6 and -1 writes the shortest exact value")
+
+	loaded, err := config.Load(flag.CommandLine, os.Args[1:], os.LookupEnv)
+	if err != nil {
+		glg.Errorf("Invalid configuration: %s", err.Error())
+		return
+	}
+	cfg = loaded
+	db.DatabaseURL = cfg.DatabaseURL
 
 	fmt.Printf("IsCLI: %v\n", *isCLI)
 
 	if *isCLI {
-		// TODO: This should combine all this configuration into some kind of
-		// struct or something.
-		executeCommand(*itemHash, *withAllAssets, *withWeapons, *withGhosts, *withVehicles, *withSTL, *withDAE, *withUSDA, *withUSDC, *withUSDZ, *withGeom, *withTextures)
+		options, err := parseModelOptions(*upAxis, *handedness, *pivot)
+		if err != nil {
+			glg.Error(err)
+			return
+		}
+
+		options.WriteMetadata = *withMetadata
+		options.SmoothingAngle = *smoothingAngle
+		options.MaxTriangles = *maxTriangles
+		options.Split = *withSplit
+		options.Atlas = *withAtlas
+		options.Precision = *precision
+		options.Textures = graphics.TextureOptions{
+			MaxSize:    *maxTextureSize,
+			PowerOfTwo: *withPOTTextures,
+			Grayscale:  *withGrayscaleTextures,
+			PackORM:    *withORM,
+		}
+		options.Textures.Format, err = graphics.ParseTextureFormat(*textureFormat)
+		if err != nil {
+			glg.Error(err)
+			return
+		}
+		if *gearstackOptionsPath != "" {
+			gearstackOptions, err := graphics.LoadGearstackOptions(*gearstackOptionsPath)
+			if err != nil {
+				glg.Errorf("Failed to load gearstack options: %s", err.Error())
+				return
+			}
+			options.Textures.Gearstack = &gearstackOptions
+		}
+		if *withPrintPrep {
+			printPrep := graphics.DefaultPrintPrepOptions()
+			options.PrintPrep = &printPrep
+		}
+		if err := options.Validate(); err != nil {
+			glg.Error(err)
+			return
+		}
+
+		formats := Formats{
+			STL:  *withSTL,
+			DAE:  *withDAE,
+			USDA: *withUSDA,
+			USDC: *withUSDC,
+			USDZ: *withUSDZ,
+		}
+		if err := formats.checkTextureFormat(options.Textures.Format); err != nil {
+			glg.Error(err)
+			return
+		}
+
+		executeCommand(&Command{
+			Hash:     *itemHash,
+			All:      *withAllAssets,
+			Weapons:  *withWeapons,
+			Ghosts:   *withGhosts,
+			Vehicles: *withVehicles,
+			Formats:  formats,
+			Geometry: *withGeom,
+			Textures: *withTextures,
+			Options:  options,
+		})
 		return
 	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
+	if cfg.Port == "" {
 		fmt.Println("Forgot to specify a port")
 		return
 	}
 
+	outputCache, err = cache.Open(cfg.Cache.Dir, cfg.Cache.MaxSize)
+	if err != nil {
+		glg.Errorf("Failed to open the model cache: %s", err.Error())
+		return
+	}
+
 	// If running in web server mode, setup the routes and start the server
 	router := mux.NewRouter()
 	router.HandleFunc("/gear-vendor/{hash}/{format}", GetAsset).Methods("GET")
+	router.HandleFunc("/items", SearchItems).Methods("GET")
+	router.HandleFunc("/items/{hash}", GetItem).Methods("GET")
+
+	jobs := NewJobQueue(cfg.Jobs.Workers, cfg.Jobs.QueueSize, convertJob)
+	serverMetrics.Register(queueMetrics(jobs)...)
+	router.HandleFunc("/jobs", jobs.CreateJob).Methods("POST")
+	router.HandleFunc("/jobs/{id}", jobs.GetJob).Methods("GET")
+	router.HandleFunc("/jobs/{id}/result", jobs.GetJobResult).Methods("GET")
+	router.HandleFunc("/jobs/{id}/events", jobs.GetJobEvents).Methods("GET")
+	router.HandleFunc("/exports", jobs.CreateExport).Methods("POST")
+
+	router.HandleFunc("/cache", GetCacheStats).Methods("GET")
+	router.HandleFunc("/cache", requireAdminToken(PurgeCache)).Methods("DELETE")
+	router.HandleFunc("/cache/{hash}", requireAdminToken(PurgeCache)).Methods("DELETE")
+
+	router.HandleFunc("/healthz", GetHealth).Methods("GET")
+	router.HandleFunc("/readyz", GetReadiness).Methods("GET")
+	router.HandleFunc("/metrics", GetMetrics).Methods("GET")
+
+	glg.Error(http.ListenAndServe(":"+cfg.Port, router))
+}
+
+// parseModelOptions builds the graphics options used when writing models from the
+// values provided on the command line.
+func parseModelOptions(upAxis, handedness, pivot string) (graphics.Options, error) {
+	options := graphics.Options{}
+
+	axis, err := graphics.ParseAxis(upAxis)
+	if err != nil {
+		return options, err
+	}
+	options.CoordinateSystem.UpAxis = axis
 
-	glg.Error(http.ListenAndServe(":"+port, router))
+	options.CoordinateSystem.Handedness, err = graphics.ParseHandedness(handedness)
+	if err != nil {
+		return options, err
+	}
+
+	options.Pivot, err = graphics.ParsePivot(pivot)
+	if err != nil {
+		return options, err
+	}
+
+	return options, nil
 }
 
-func executeCommand(hash uint, withAllAssets, withWeapons, withGhosts, withVehicles, withSTL, withDAE, withUSDA, withUSDC, withUSDZ, withGeom, withTextures bool) {
-	fmt.Printf("WithSTL: %v\n", withSTL)
-	fmt.Printf("WithDAE: %v\n", withDAE)
-	fmt.Printf("WithUSDA: %v\n", withUSDA)
-	fmt.Printf("WithUSDC: %v\n", withUSDC)
-	fmt.Printf("WithUSDZ: %v\n", withUSDZ)
+// executeCommand writes the models (and textures) requested on the command line.
+func executeCommand(command *Command) {
+	fmt.Printf("Formats: %+v\n", command.Formats)
 
-	if hash == 0 && withAllAssets == false && withWeapons == false {
+	if command.Hash == 0 && command.All == false && command.Weapons == false {
 		glg.Error("Forgot to provide an item hash!")
 		return
 	}
 
-	if withSTL == false && withDAE == false && withUSDA == false && withUSDC == false && withUSDZ == false {
+	if command.Formats == (Formats{}) {
 		glg.Error("No output format specified!")
 		return
 	}
 
 	var assetDefinitions []*bungie.GearAssetDefinition
-	if withAllAssets {
+	if command.All {
 		var err error
 		assetDefinitions, err = bungie.GetAllAssetDefinitions()
 		if err != nil {
 			glg.Errorf("Error requesting asset definitions for all items: %s", err.Error())
 			return
 		}
-	} else if hash != 0 {
-		assetDefinition, err := bungie.GetAssetDefinition(hash)
+	} else if command.Hash != 0 {
+		assetDefinition, err := bungie.GetAssetDefinition(command.Hash)
 		if err != nil {
 			glg.Errorf("Error requesting asset definition from the DB: %s", err.Error())
 			return
@@ -125,7 +305,7 @@ func executeCommand(hash uint, withAllAssets, withWeapons, withGhosts, withVehic
 	} else {
 		assetDefinitions = make([]*bungie.GearAssetDefinition, 0, 20)
 
-		if withWeapons {
+		if command.Weapons {
 			defs, err := bungie.GetWeaponAssetDefinitions()
 			if err != nil {
 				glg.Errorf("Error requesting weapon asset definitions: %s", err.Error())
@@ -134,7 +314,7 @@ func executeCommand(hash uint, withAllAssets, withWeapons, withGhosts, withVehic
 			assetDefinitions = append(assetDefinitions, defs...)
 		}
 
-		if withGhosts {
+		if command.Ghosts {
 			ghosts, err := bungie.GetGhostAssetDefinitions()
 			if err != nil {
 				glg.Errorf("Error requesting ghost asset definitions: %s", err.Error())
@@ -143,7 +323,7 @@ func executeCommand(hash uint, withAllAssets, withWeapons, withGhosts, withVehic
 			assetDefinitions = append(assetDefinitions, ghosts...)
 		}
 
-		if withVehicles {
+		if command.Vehicles {
 			vehicles, err := bungie.GetVehicleAssetDefinitions()
 			if err != nil {
 				glg.Errorf("Error requesting vehicle asset definitions: %s", err.Error())
@@ -160,11 +340,11 @@ func executeCommand(hash uint, withAllAssets, withWeapons, withGhosts, withVehic
 		writeAssetDefinition(assetDefinition)
 		writeGearDescription(assetDefinition)
 
-		if withTextures {
-			processTextures(assetDefinition)
+		if command.Textures {
+			processTextures(assetDefinition, logReporter{})
 		}
-		if withGeom {
-			processGeometry(assetDefinition, withSTL, withDAE, withUSDA, withUSDC, withUSDZ)
+		if command.Geometry {
+			processGeometry(assetDefinition, command.Formats, command.Options)
 		}
 	}
 }
@@ -177,14 +357,29 @@ func fileExists(path string) bool {
 	return true
 }
 
+// modelName is the file name (without an extension) of the model written for an item. Models
+// written with anything other than the default options get a suffix so they are never served
+// in place of the default model, or the other way around.
+func modelName(id uint, options graphics.Options) string {
+
+	encoded, _ := json.Marshal(options)
+	defaults, _ := json.Marshal(graphics.Options{})
+	if bytes.Equal(encoded, defaults) {
+		return fmt.Sprintf("%d", id)
+	}
+
+	sum := sha1.Sum(encoded)
+	return fmt.Sprintf("%d-%x", id, sum[:4])
+}
+
 func writeAssetDefinition(def *bungie.GearAssetDefinition) {
-	fullPath := AssetDefinitionBasePath + fmt.Sprintf("%d-asset-def.json", def.ID)
+	fullPath := filepath.Join(cfg.Paths.Tools, fmt.Sprintf("%d-asset-def.json", def.ID))
 	if fileExists(fullPath) {
 		glg.Info("Found cached asset definition")
 		return
 	}
 
-	outF, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE, 0644)
+	outF, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		glg.Errorf("Failed to open asset definition file: %s", err.Error())
 	}
@@ -194,7 +389,7 @@ func writeAssetDefinition(def *bungie.GearAssetDefinition) {
 }
 
 func writeGearDescription(def *bungie.GearAssetDefinition) {
-	fullPath := AssetDefinitionBasePath + fmt.Sprintf("%d-gear-%s", def.ID, def.Gear[0])
+	fullPath := filepath.Join(cfg.Paths.Tools, fmt.Sprintf("%d-gear-%s", def.ID, def.Gear[0]))
 	if fileExists(fullPath) {
 		glg.Info("Found cached gear description")
 		return
@@ -205,7 +400,7 @@ func writeGearDescription(def *bungie.GearAssetDefinition) {
 	gearURL := bungie.UrlPrefix + bungie.GearPrefix + def.Gear[0]
 	fmt.Printf("Requesting gear URL : %s\n", gearURL)
 	req, _ := http.NewRequest("GET", bungie.UrlPrefix+bungie.GearPrefix+def.Gear[0], nil)
-	req.Header.Set("X-API-Key", BungieApiKey)
+	req.Header.Set("X-API-Key", cfg.BungieAPIKey)
 	response, err := client.Do(req)
 	if err != nil {
 		glg.Errorf("Could not download gear description: %s", err.Error())
@@ -219,120 +414,252 @@ func writeGearDescription(def *bungie.GearAssetDefinition) {
 	}
 	defer response.Body.Close()
 
-	err = ioutil.WriteFile(fullPath, responseBytes, 0644)
+	err = writeFileAtomic(fullPath, responseBytes)
 	if err != nil {
 		glg.Errorf("Failed to write asset description locally: %s", err.Error())
 		return
 	}
 }
 
-func processGeometry(asset *bungie.GearAssetDefinition, withSTL, withDAE, withUSDA, withUSDC, withUSDZ bool) string {
-
-	stlOutputPath := fmt.Sprintf("%s/%d.stl", ModelPathPrefix, asset.ID)
-	daeOutputPath := fmt.Sprintf("%s/%d.dae", ModelPathPrefix, asset.ID)
+func processGeometry(asset *bungie.GearAssetDefinition, formats Formats, options graphics.Options) string {
 
-	if withDAE && fileExists(daeOutputPath) {
-		glg.Infof(fmt.Sprintf("Cached DAE model already exists: %s", daeOutputPath))
-		return daeOutputPath
-	} else if withSTL && fileExists(stlOutputPath) {
-		glg.Infof(fmt.Sprintf("Cached STL model already exists: %s", stlOutputPath))
-		return stlOutputPath
+	outDir := itemDir(asset.ID)
+	stlOutputPath := modelPath(asset.ID, "stl", options)
+	daeOutputPath := modelPath(asset.ID, "dae", options)
+	// Split models are described by their manifest, the parts are listed inside it
+	resultPath := func(path string) string {
+		if options.Split {
+			return graphics.ManifestPath(path)
+		}
+		return path
 	}
 
-	geometries := make([]*bungie.DestinyGeometry, 0, 12)
-	if len(asset.Content) < 1 {
-		glg.Errorf("*** ERROR *** No content in the asset definition for id(%d) ****\n", asset.ID)
-		return ""
+	if formats.DAE && fileExists(resultPath(daeOutputPath)) {
+		glg.Infof(fmt.Sprintf("Cached DAE model already exists: %s", resultPath(daeOutputPath)))
+		return resultPath(daeOutputPath)
+	} else if formats.STL && fileExists(resultPath(stlOutputPath)) {
+		glg.Infof(fmt.Sprintf("Cached STL model already exists: %s", resultPath(stlOutputPath)))
+		return resultPath(stlOutputPath)
 	}
 
-	for geomIndex, geometryFile := range asset.Content[0].Geometry {
+	createItemDir(outDir)
 
-		geometryPath := LocalGeometryBasePath + geometryFile
+	// Everything is written to a temporary directory first and only moved into the item
+	// directory once the whole model has been written
+	workDir, err := newConversionDir(asset.ID)
+	if err != nil {
+		glg.Errorf("Error creating the conversion directory: %s", err.Error())
+		return ""
+	}
+	defer workDir.cleanup()
 
-		if !fileExists(geometryPath) {
-			glg.Info("Downloading geometry file... ")
+	path, err := convertModel(asset, workDir.path, formats, options, logReporter{})
+	if err != nil {
+		glg.Error(err)
+		return ""
+	}
 
-			client := http.Client{}
-			req, _ := http.NewRequest("GET", bungie.UrlPrefix+bungie.GeometryPrefix+geometryFile, nil)
-			req.Header.Set("X-API-Key", BungieApiKey)
-			response, err := client.Do(req)
+	path, err = workDir.commit(outDir, path)
+	if err != nil {
+		glg.Errorf("Error moving the model into place: %s", err.Error())
+		return ""
+	}
 
-			if response == nil || err != nil {
-				glg.Errorf("Failed to request geometryFile: %s error: %s", geometryFile, err.Error())
-			}
+	return path
+}
 
-			if response.StatusCode != 200 {
-				glg.Errorf("Failed to download geometry for hash(%d), bad response: %d\n", asset.ID, response.StatusCode)
-				return ""
-			}
+// convertModel writes the model for the asset, along with its textures, into dir and returns the
+// path of the model (or the manifest of a split model). Only the first of the requested formats
+// is written. The progress of the conversion is sent to reporter.
+func convertModel(asset *bungie.GearAssetDefinition, dir string, formats Formats, options graphics.Options, reporter graphics.Reporter) (string, error) {
 
-			bodyBytes, _ := ioutil.ReadAll(response.Body)
-			response.Body.Close()
-			ioutil.WriteFile(geometryPath, bodyBytes, 0644)
-		} else {
-			glg.Info("Found cached geometry file...")
+	name := modelName(asset.ID, options)
+	// Split models are described by their manifest, the parts are listed inside it
+	resultPath := func(path string) string {
+		if options.Split {
+			return graphics.ManifestPath(path)
 		}
-
-		glg.Infof("Parsing geometry file... %s", geometryFile)
-		geometry := parseGeometryFile(asset, geomIndex, geometryPath)
-		geometries = append(geometries, geometry)
+		return path
 	}
 
-	outDir := fmt.Sprintf("%s/%d", ModelPathPrefix, asset.ID)
-	if !fileExists(outDir) {
-		err := os.Mkdir(outDir, os.ModePerm)
-		if err != nil {
-			glg.Errorf("Error creating item subdirectory: %s", err.Error())
-		}
+	geometries, err := loadGeometries(asset, reporter)
+	if err != nil {
+		return "", err
 	}
 
-	if withUSDA || withUSDC || withUSDZ {
+	if formats.usd() {
 		glg.Info("Writing USD model...")
-		path := fmt.Sprintf("%s/%d.usda", outDir, asset.ID)
-		usdWriter := &graphics.USDWriter{Path: path, TexturePath: outDir}
+		path := fmt.Sprintf("%s/%s.usda", dir, name)
+		usdWriter := &graphics.USDWriter{Path: path, TexturePath: dir, TextureSourcePath: cfg.Paths.Textures, Options: options, Reporter: reporter}
 
 		err := usdWriter.WriteModel(geometries)
 		if err != nil {
-			glg.Errorf("Failed to write model for asset = %d: %v", asset.ID, err)
-			return ""
+			return "", fmt.Errorf("Failed to write model for asset = %d: %v", asset.ID, err)
 		}
 
-		path, err = createUSDZ(outDir, asset.ID, withUSDA, withUSDC, withUSDZ)
+		if options.Split {
+			path, err = createSplitUSDZ(dir, name, formats)
+		} else {
+			path, err = createUSDZ(dir, name, formats)
+		}
 		if err != nil {
-			glg.Errorf("Error creating USDZ file: %s", err.Error())
-			return ""
+			return "", fmt.Errorf("Error creating USDZ file: %s", err.Error())
 		}
 
-		return path
+		// The USDA and USDC files are only kept next to the archive when they were requested
+		if !options.Split && !formats.USDZ && formats.USDC {
+			path = strings.TrimSuffix(path, ".usdz") + ".usdc"
+		} else if !options.Split && !formats.USDZ && formats.USDA {
+			path = strings.TrimSuffix(path, ".usdz") + ".usda"
+		}
+
+		return path, nil
 	}
 
-	if withDAE {
+	if formats.DAE {
 		glg.Info("Writing DAE model...")
-		path := fmt.Sprintf("%s/%d.dae", outDir, asset.ID)
-		daeWriter := &graphics.DAEWriter{Path: path, TexturePath: outDir}
+		path := fmt.Sprintf("%s/%s.dae", dir, name)
+		daeWriter := &graphics.DAEWriter{Path: path, TexturePath: dir, TextureSourcePath: cfg.Paths.Textures, Options: options, ItemHash: asset.ID, Reporter: reporter}
 		err := daeWriter.WriteModels(geometries)
 		if err != nil {
-			glg.Errorf("Error trying to write the DAE model file!!: %s", err.Error())
-			return ""
+			return "", fmt.Errorf("Error trying to write the DAE model file!!: %s", err.Error())
 		}
 
-		return path
+		return resultPath(path), nil
 	}
 
-	if withSTL {
+	if formats.STL {
 		glg.Info("Writing STL model...")
-		path := fmt.Sprintf("%s/%d.stl", outDir, asset.ID)
-		stlWriter := &graphics.STLWriter{Path: path}
+		path := fmt.Sprintf("%s/%s.stl", dir, name)
+		stlWriter := &graphics.STLWriter{Path: path, Options: options, Reporter: reporter}
 		err := stlWriter.WriteModels(geometries)
 		if err != nil {
-			glg.Errorf("Error trying to write the STL model file!!: %s", err.Error())
-			return ""
+			return "", fmt.Errorf("Error trying to write the STL model file!!: %s", err.Error())
+		}
+		if stlWriter.Report != nil && stlWriter.Report.NonManifoldEdges > 0 {
+			glg.Warnf("STL model still has %d non-manifold edges", stlWriter.Report.NonManifoldEdges)
 		}
 
-		return path
+		return resultPath(path), nil
+	}
+
+	return "", errors.New("No model format requested")
+}
+
+// writeModel writes the DAE or STL model for the asset straight to w instead of a file. The
+// textures used by a DAE model are still written as files to textureDir.
+func writeModel(w io.Writer, asset *bungie.GearAssetDefinition, format string, options graphics.Options, textureDir string) error {
+
+	geometries, err := loadGeometries(asset, logReporter{})
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "dae":
+		daeWriter := &graphics.DAEWriter{TexturePath: textureDir, TextureSourcePath: cfg.Paths.Textures, Options: options, ItemHash: asset.ID}
+		return daeWriter.WriteModelsTo(w, geometries)
+	case "stl":
+		stlWriter := &graphics.STLWriter{Options: options}
+		err = stlWriter.WriteModelsTo(w, geometries)
+		if stlWriter.Report != nil && stlWriter.Report.NonManifoldEdges > 0 {
+			glg.Warnf("STL model still has %d non-manifold edges", stlWriter.Report.NonManifoldEdges)
+		}
+		return err
+	}
+
+	return fmt.Errorf("Models can't be streamed in the %s format", format)
+}
+
+// itemDir is the directory the models and textures for an item are written to.
+func itemDir(id uint) string {
+	return filepath.Join(cfg.Paths.Models, fmt.Sprintf("%d", id))
+}
+
+// modelPath is the path a model for the item is cached at in the given format (file extension).
+func modelPath(id uint, format string, options graphics.Options) string {
+	return fmt.Sprintf("%s/%s.%s", itemDir(id), modelName(id, options), format)
+}
+
+func createItemDir(outDir string) {
+	if !fileExists(outDir) {
+		err := os.Mkdir(outDir, os.ModePerm)
+		if err != nil {
+			glg.Errorf("Error creating item subdirectory: %s", err.Error())
+		}
+	}
+}
+
+// loadGeometries reads the geometry files of the asset, downloading any that aren't cached yet.
+func loadGeometries(asset *bungie.GearAssetDefinition, reporter graphics.Reporter) ([]*bungie.DestinyGeometry, error) {
+
+	geometries := make([]*bungie.DestinyGeometry, 0, 12)
+	if err := checkSupported(asset); err != nil {
+		return nil, err
+	}
+
+	for geomIndex, geometryFile := range asset.Content[0].Geometry {
+
+		geometryPath := filepath.Join(cfg.Paths.GeometryDownloads, geometryFile)
+
+		if !fileExists(geometryPath) {
+			glg.Info("Downloading geometry file... ")
+
+			bodyBytes, status, err := downloadCDN("geometry", bungie.UrlPrefix+bungie.GeometryPrefix+geometryFile)
+			if err != nil {
+				return nil, &upstreamError{fmt.Errorf("Failed to download geometryFile: %s error: %v", geometryFile, err)}
+			}
+			if status != 200 {
+				return nil, &upstreamError{fmt.Errorf("Failed to download geometry for hash(%d), bad response: %d", asset.ID, status)}
+			}
+			writeFileAtomic(geometryPath, bodyBytes)
+		} else {
+			glg.Info("Found cached geometry file...")
+		}
+
+		glg.Infof("Parsing geometry file... %s", geometryFile)
+		geometry := parseGeometryFile(asset, geomIndex, geometryPath)
+		geometries = append(geometries, geometry)
+		reporter.Progress("download-geometry", geomIndex+1, len(asset.Content[0].Geometry))
+	}
+
+	return geometries, nil
+}
+
+// downloadCDN requests the file at url from the Bungie CDN, recording how long it took and how
+// many bytes were received for the kind of file (geometry or texture). The body is only returned
+// for successful responses, the status code is returned either way.
+func downloadCDN(kind, url string) ([]byte, int, error) {
+
+	started := time.Now()
+	defer func() {
+		cdnDownloadDuration.Observe(time.Since(started).Seconds(), kind)
+	}()
+
+	client := http.Client{}
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("X-API-Key", cfg.BungieAPIKey)
+	response, err := client.Do(req)
+	if err != nil {
+		cdnDownloadsTotal.Inc(kind, "error")
+		return nil, 0, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		cdnDownloadsTotal.Inc(kind, strconv.Itoa(response.StatusCode))
+		return nil, response.StatusCode, nil
 	}
 
-	return ""
+	bodyBytes, err := ioutil.ReadAll(response.Body)
+	cdnDownloadBytes.Add(float64(len(bodyBytes)), kind)
+	if err != nil {
+		cdnDownloadsTotal.Inc(kind, "error")
+		return nil, response.StatusCode, err
+	}
+	cdnDownloadsTotal.Inc(kind, strconv.Itoa(response.StatusCode))
+
+	return bodyBytes, response.StatusCode, nil
 }
 
 func convertASCIIToBinary(path string) error {
@@ -344,10 +671,10 @@ func convertASCIIToBinary(path string) error {
 	return err
 }
 
-func zipUSDZ(dir string, id uint, texturePaths []string, outPath string) error {
+func zipUSDZ(dir, name string, texturePaths []string, outPath string) error {
 
 	// the converted USDC model
-	usdc := fmt.Sprintf("%s/%d.usdc", dir, id)
+	usdc := fmt.Sprintf("%s/%s.usdc", dir, name)
 
 	included := make([]string, 0, 15)
 	included = append(included, usdc)
@@ -427,10 +754,10 @@ func zipUSDZ(dir string, id uint, texturePaths []string, outPath string) error {
 // 	return z.Archive(included, outPath)
 // }
 
-func zipUSDZExec(dir string, id uint, texturePaths []string, outPath string) error {
+func zipUSDZExec(dir, name string, texturePaths []string, outPath string) error {
 	glg.Infof("Zipping files to location: %s", outPath)
 
-	usdc := fmt.Sprintf("%s/%d.usdc", dir, id)
+	usdc := fmt.Sprintf("%s/%s.usdc", dir, name)
 	included := append([]string(nil), usdc)
 	included = append(included, texturePaths...)
 
@@ -460,14 +787,57 @@ func alignUSDZ(unalignedUSDZPath, alignedUSDZPath string) error {
 	return err
 }
 
-func createUSDZ(dir string, id uint, withUSDA, withUSDC, withUSDZ bool) (string, error) {
+func createUSDZ(dir, name string, formats Formats) (string, error) {
+	return packageUSDZ(dir, name, formats, false)
+}
+
+// createSplitUSDZ packages every part of a split USD model into its own USDZ file. The textures
+// are shared by all of the parts so they are only cleaned up after the last one is packaged.
+// The manifest is updated to point at the USDZ files and its path is returned.
+func createSplitUSDZ(dir, name string, formats Formats) (string, error) {
 
-	usdaPath := fmt.Sprintf("%s/%d.usda", dir, id)
+	manifestPath := graphics.ManifestPath(fmt.Sprintf("%s/%s.usda", dir, name))
+	manifestBytes, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return "", err
+	}
+
+	manifest := &graphics.SplitManifest{}
+	err = json.Unmarshal(manifestBytes, manifest)
+	if err != nil {
+		return "", err
+	}
+
+	for i, part := range manifest.Parts {
+		partName := strings.TrimSuffix(part.File, filepath.Ext(part.File))
+		keepTextures := i < len(manifest.Parts)-1
+		path, err := packageUSDZ(dir, partName, formats, keepTextures)
+		if err != nil {
+			return "", err
+		}
+
+		if !formats.USDA {
+			manifest.Parts[i].File = filepath.Base(path)
+		}
+	}
+	manifest.Format = "usdz"
+
+	manifestBytes, err = json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	return manifestPath, ioutil.WriteFile(manifestPath, manifestBytes, 0644)
+}
+
+func packageUSDZ(dir, name string, formats Formats, keepTextures bool) (string, error) {
+
+	usdaPath := fmt.Sprintf("%s/%s.usda", dir, name)
 	err := convertASCIIToBinary(usdaPath)
 	if err != nil {
 		return "", err
 	}
-	if !withUSDA {
+	if !formats.USDA {
 		defer os.Remove(usdaPath)
 	}
 
@@ -483,7 +853,7 @@ func createUSDZ(dir string, id uint, withUSDA, withUSDC, withUSDZ bool) (string,
 		return "", err
 	}
 	texturePaths = append(texturePaths, pngs...)
-	if !withUSDA && !withUSDC {
+	if !formats.USDA && !formats.USDC && !keepTextures {
 		// Cleanup textures if they will not be used after they are zipped up
 		defer func(paths []string) {
 			for _, f := range paths {
@@ -492,15 +862,15 @@ func createUSDZ(dir string, id uint, withUSDA, withUSDC, withUSDZ bool) (string,
 		}(texturePaths)
 	}
 
-	unalignedUSDZPath := fmt.Sprintf("%s/%d-unaligned.zip", dir, id)
-	alignedUSDZPath := fmt.Sprintf("%s/%d.usdz", dir, id)
-	//err = zipUSDZ(dir, id, texturePaths, unalignedUSDZPath)
+	unalignedUSDZPath := fmt.Sprintf("%s/%s-unaligned.zip", dir, name)
+	alignedUSDZPath := fmt.Sprintf("%s/%s.usdz", dir, name)
+	//err = zipUSDZ(dir, name, texturePaths, unalignedUSDZPath)
 	//err = zipUSDZArchiver(dir, id, texturePaths, unalignedUSDZPath)
-	err = zipUSDZExec(dir, id, texturePaths, unalignedUSDZPath)
+	err = zipUSDZExec(dir, name, texturePaths, unalignedUSDZPath)
 	if err != nil {
 		return "", err
 	}
-	if !withUSDC {
+	if !formats.USDC {
 		defer os.Remove(strings.Replace(usdaPath, "usda", "usdc", -1))
 	}
 
@@ -513,34 +883,34 @@ func createUSDZ(dir string, id uint, withUSDA, withUSDC, withUSDZ bool) (string,
 	return alignedUSDZPath, nil
 }
 
-func processTextures(asset *bungie.GearAssetDefinition) {
+// processTextures downloads and unpacks the texture files of the asset. Textures that can't be
+// downloaded are reported as warnings, the model is still written without them.
+func processTextures(asset *bungie.GearAssetDefinition, reporter graphics.Reporter) {
 	if len(asset.Content) <= 0 {
 		return
 	}
 
-	for _, textureFile := range asset.Content[0].Textures {
-		texturePath := LocalTextureBasePath + textureFile
+	textureFiles := asset.Content[0].Textures
+	for i, textureFile := range textureFiles {
+		texturePath := filepath.Join(cfg.Paths.TextureDownloads, textureFile)
 		if _, err := os.Stat(texturePath); os.IsNotExist(err) {
 
 			glg.Infof("Downloading texture file... %s", textureFile)
 
-			client := http.Client{}
-			req, _ := http.NewRequest("GET", bungie.UrlPrefix+bungie.TexturePrefix+textureFile, nil)
-			req.Header.Set("X-API-Key", BungieApiKey)
-			response, err := client.Do(req)
-
-			if response == nil || err != nil {
-				glg.Errorf("Error downloading textureFile: %s error: %s", textureFile, err.Error())
+			bodyBytes, status, err := downloadCDN("texture", bungie.UrlPrefix+bungie.TexturePrefix+textureFile)
+			if err != nil {
+				glg.Errorf("Error downloading textureFile: %s error: %v", textureFile, err)
+				reporter.Warn(fmt.Sprintf("Failed to download texture %s, it will be missing from the model", textureFile))
 				continue
 			}
 
-			if response.StatusCode != 200 {
+			if status != 200 {
+				glg.Errorf("Failed to download textureFile: %s, bad response: %d", textureFile, status)
+				reporter.Warn(fmt.Sprintf("Failed to download texture %s (status %d), it will be missing from the model", textureFile, status))
 				continue
 			}
 
-			bodyBytes, _ := ioutil.ReadAll(response.Body)
-			response.Body.Close()
-			ioutil.WriteFile(LocalTextureBasePath+textureFile, bodyBytes, 0644)
+			writeFileAtomic(texturePath, bodyBytes)
 		} else {
 			glg.Infof("Found cached texture file... %s", textureFile)
 		}
@@ -552,13 +922,15 @@ func processTextures(asset *bungie.GearAssetDefinition) {
 		// Write all images to disk after parsing
 		for _, file := range destinyTexture.Files {
 
-			textureOutputPath := TexturePathPrefix + file.Name + file.Extension
+			textureOutputPath := filepath.Join(cfg.Paths.Textures, file.Name+file.Extension)
 			if _, err := os.Stat(textureOutputPath); os.IsNotExist(err) {
-				ioutil.WriteFile(textureOutputPath, file.Data, 0644)
+				writeFileAtomic(textureOutputPath, file.Data)
 			} else {
 				glg.Info("Cached texture file found")
 			}
 		}
+
+		reporter.Progress("download-textures", i+1, len(textureFiles))
 	}
 }
 
@@ -631,8 +1003,8 @@ func parseGeometryFile(asset *bungie.GearAssetDefinition, index int, path string
 	}
 
 	safeGeomName := strings.Replace(filepath.Base(path), ".", "", -1)
-	err = ioutil.WriteFile(fmt.Sprintf(RenderMeshesBasePath+"%d-%d-%s-meshes.json",
-		asset.ID, index, safeGeomName), geom.MeshesBytes, 0644)
+	err = ioutil.WriteFile(filepath.Join(cfg.Paths.Tools, fmt.Sprintf("%d-%d-%s-meshes.json",
+		asset.ID, index, safeGeomName)), geom.MeshesBytes, 0644)
 	if err != nil {
 		glg.Errorf("Failed to write render meshes: %s", err.Error())
 	}
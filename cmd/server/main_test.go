@@ -8,7 +8,7 @@ import (
 
 func TestCreateUSDZ(t *testing.T) {
 
-	_, err := createUSDZ("../../output/gear.scnassets/2069224589/", 2069224589)
+	_, err := createUSDZ("../../output/gear.scnassets/2069224589/", "2069224589", Formats{USDZ: true})
 	if err != nil {
 		t.Errorf("Failed with error: %s", err.Error())
 	}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/kpango/glg"
+	"github.com/rking788/destiny-gear-vendor/cache"
+	"github.com/rking788/destiny-gear-vendor/metrics"
+)
+
+var (
+	conversionsTotal = metrics.NewCounter("gear_vendor_conversions_total",
+		"Models converted, by format and whether the conversion succeeded.", "format", "result")
+	conversionDuration = metrics.NewHistogram("gear_vendor_conversion_duration_seconds",
+		"How long converting a model took, including downloading its files.",
+		[]float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}, "format")
+
+	jobsRejectedTotal = metrics.NewCounter("gear_vendor_jobs_rejected_total",
+		"Jobs refused because too many jobs were already waiting.")
+
+	cacheRequestsTotal = metrics.NewCounter("gear_vendor_cache_requests_total",
+		"Requests for models, by whether they were served from the cache (hit) or had to be converted (miss).", "result")
+
+	cdnDownloadsTotal = metrics.NewCounter("gear_vendor_cdn_downloads_total",
+		"Files downloaded from the Bungie CDN, by kind and response status.", "kind", "status")
+	cdnDownloadBytes = metrics.NewCounter("gear_vendor_cdn_download_bytes_total",
+		"Bytes downloaded from the Bungie CDN, by kind.", "kind")
+	cdnDownloadDuration = metrics.NewHistogram("gear_vendor_cdn_download_duration_seconds",
+		"How long downloading a file from the Bungie CDN took, by kind.",
+		[]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}, "kind")
+
+	// serverMetrics are served by GetMetrics, metrics that need the job queue are added when it
+	// is created.
+	serverMetrics = newServerMetrics()
+)
+
+func newServerMetrics() *metrics.Registry {
+
+	registry := metrics.NewRegistry()
+	registry.Register(
+		conversionsTotal,
+		conversionDuration,
+		jobsRejectedTotal,
+		cacheRequestsTotal,
+		metrics.NewGaugeFunc("gear_vendor_cache_hit_ratio",
+			"The share of requests for models served from the cache since the server started.", cacheHitRatio),
+		metrics.NewGaugeFunc("gear_vendor_cache_entries",
+			"Models stored in the cache.", func() float64 { return float64(cacheStats().Entries) }),
+		metrics.NewGaugeFunc("gear_vendor_cache_size_bytes",
+			"Bytes taken up by the models stored in the cache.", func() float64 { return float64(cacheStats().Size) }),
+		cdnDownloadsTotal,
+		cdnDownloadBytes,
+		cdnDownloadDuration,
+	)
+
+	return registry
+}
+
+// queueMetrics are the gauges describing the jobs in the queue.
+func queueMetrics(queue *JobQueue) []metrics.Collector {
+	return []metrics.Collector{
+		metrics.NewGaugeFunc("gear_vendor_job_queue_depth",
+			"Jobs waiting for a worker.", func() float64 { return float64(queue.Count(JobQueued)) }),
+		metrics.NewGaugeFunc("gear_vendor_jobs_running",
+			"Jobs being converted by a worker.", func() float64 { return float64(queue.Count(JobRunning)) }),
+	}
+}
+
+// cacheStats are the stats of the output cache, which is empty until the cache has been opened.
+func cacheStats() cache.Stats {
+	if outputCache == nil {
+		return cache.Stats{}
+	}
+	return outputCache.Stats()
+}
+
+func cacheHitRatio() float64 {
+	hits := cacheRequestsTotal.Value("hit")
+	total := hits + cacheRequestsTotal.Value("miss")
+	if total == 0 {
+		return 0
+	}
+	return hits / total
+}
+
+// observeConversion records a conversion of a model in the format that started at started and
+// finished with err.
+func observeConversion(format string, started time.Time, err error) {
+
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+
+	conversionsTotal.Inc(format, result)
+	conversionDuration.Observe(time.Since(started).Seconds(), format)
+}
+
+// GetMetrics serves the metrics of the server in the Prometheus text format.
+func GetMetrics(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	err := serverMetrics.Write(w)
+	if err != nil {
+		glg.Errorf("Failed to write the metrics: %s", err.Error())
+	}
+}
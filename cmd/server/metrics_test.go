@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestGetMetrics(t *testing.T) {
+
+	observeConversion("usdz", time.Now().Add(-3*time.Second), nil)
+	observeConversion("usdz", time.Now(), errors.New("usdcat failed"))
+	cacheRequestsTotal.Inc("hit")
+
+	router := mux.NewRouter()
+	router.HandleFunc("/metrics", GetMetrics).Methods("GET")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	if !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("Wrong content type: %s", recorder.Header().Get("Content-Type"))
+	}
+
+	body := recorder.Body.String()
+	for _, line := range []string{
+		`gear_vendor_conversions_total{format="usdz",result="failure"} 1`,
+		`gear_vendor_conversions_total{format="usdz",result="success"} 1`,
+		`gear_vendor_conversion_duration_seconds_bucket{format="usdz",le="2.5"} 1`,
+		`gear_vendor_conversion_duration_seconds_count{format="usdz"} 2`,
+		"# TYPE gear_vendor_cache_hit_ratio gauge",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Missing %q in the metrics:\n%s", line, body)
+		}
+	}
+}
+
+func TestCheckFormatEnabled(t *testing.T) {
+
+	defer func(disabled bool) { cfg.DisableUSD = disabled }(cfg.DisableUSD)
+
+	cfg.DisableUSD = true
+	if checkFormatEnabled("usdz") != errUSDDisabled || checkFormatEnabled("stl") != nil {
+		t.Errorf("Expected only the USD formats to be turned off")
+	}
+	if err := (&JobRequest{Hash: 1, Format: "usda"}).validate(); err != errUSDDisabled {
+		t.Errorf("Expected jobs for USD formats to be refused, got %v", err)
+	}
+
+	cfg.DisableUSD = false
+	if checkFormatEnabled("usdz") != nil {
+		t.Errorf("Expected the USD formats to be available")
+	}
+}
@@ -3,70 +3,251 @@ package main
 import (
 	"errors"
 	"flag"
+	"fmt"
+	"image"
 	"image/jpeg"
 	_ "image/jpeg"
 	"image/png"
 	_ "image/png"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 
 	"github.com/kpango/glg"
 	"github.com/rking788/destiny-gear-vendor/graphics"
 )
 
 func main() {
-	inPath := flag.String("path", "", "The path to the file that should be separated out into the individual physically based rendering components.")
-	namePrefix := flag.String("prefix", "", "The prefix of the output files that will be written")
+	inPath := flag.String("path", "", "The path to the file that should be separated out into the individual physically based rendering components."+
+		" This can also be a directory or a glob pattern matching several gearstack files.")
+	namePrefix := flag.String("prefix", "", "The prefix of the output files that will be written, only used for a single file")
+	outDir := flag.String("out", "", "The directory the textures are written to when processing several files, defaults to next to each gearstack")
+	workers := flag.Int("workers", runtime.NumCPU(), "The number of gearstack files to process at the same time")
+	withORM := flag.Bool("orm", false, "Also write a packed ORM (occlusion, roughness, metalness) texture")
+	withHistograms := flag.Bool("histograms", false, "Print a histogram of the values in each output texture")
+	optionsPath := flag.String("options", "", "A JSON file describing how to decode the gearstack, see graphics.GearstackOptions")
 
 	flag.Parse()
 
-	if *inPath == "" || *namePrefix == "" {
-		glg.Errorf("Forgot to specify a path to the gearstack file or a name prefix")
+	if *inPath == "" {
+		glg.Errorf("Forgot to specify a path to the gearstack file")
+		return
+	}
+	if *workers < 1 {
+		glg.Errorf("Invalid number of workers %d, at least one is needed", *workers)
 		return
 	}
 
-	pbr, err := graphics.ExplodeGearstack(*inPath)
+	options := graphics.DefaultGearstackOptions()
+	if *optionsPath != "" {
+		var err error
+		options, err = graphics.LoadGearstackOptions(*optionsPath)
+		if err != nil {
+			glg.Errorf("Error loading gearstack options: %s", err.Error())
+			return
+		}
+	}
+
+	paths, err := gearstackPaths(*inPath)
 	if err != nil {
-		glg.Errorf("Error expanding gearstack file: %s", err.Error())
+		glg.Errorf("Error finding gearstack files: %s", err.Error())
 		return
 	}
 
-	format := "jpeg"
-	if strings.HasSuffix(*inPath, "png") {
-		format = "png"
+	if len(paths) == 1 && *namePrefix != "" {
+		explode(paths[0], *namePrefix, options, *withORM, *withHistograms)
+		return
+	} else if len(paths) == 0 {
+		glg.Errorf("No gearstack files found at %s", *inPath)
+		return
+	}
+
+	jobs := make(chan string)
+	wg := sync.WaitGroup{}
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range jobs {
+				explode(path, outputPrefix(path, *outDir), options, *withORM, *withHistograms)
+			}
+		}()
+	}
+
+	for _, path := range paths {
+		jobs <- path
 	}
-	writeTextures(pbr, format, *namePrefix)
+	close(jobs)
+	wg.Wait()
 }
 
-func writeTextures(pbr *graphics.PBRTextureCollection, format, prefix string) error {
+// outputSuffixes are the endings of the names of the textures written by texplode.
+var outputSuffixes = []string{"_ao", "_metalness", "_roughness", "_emissive", "_orm"}
 
-	metalF, err := os.OpenFile(prefix+"_metalness."+format, os.O_WRONLY|os.O_CREATE, 0644)
+// gearstackPaths returns the gearstack files at path, which can be a single file, a directory
+// or a glob pattern. Only PNG and JPEG files with gearstack in their name are picked up from a
+// directory or pattern, so the other texture plates and the textures written by an earlier run
+// are skipped.
+func gearstackPaths(path string) ([]string, error) {
+
+	info, err := os.Stat(path)
+	if err == nil && !info.IsDir() {
+		return []string{path}, nil
+	} else if err == nil {
+		path = filepath.Join(path, "*")
+	}
+
+	matches, err := filepath.Glob(path)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(matches))
+	for _, match := range matches {
+		if isGearstack(match) {
+			paths = append(paths, match)
+		}
 	}
-	defer metalF.Close()
-	roughnessF, err := os.OpenFile(prefix+"_roughness."+format, os.O_WRONLY|os.O_CREATE, 0644)
+
+	return paths, nil
+}
+
+func isGearstack(path string) bool {
+
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != ".png" && ext != ".jpg" && ext != ".jpeg" {
+		return false
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)))
+	for _, suffix := range outputSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return false
+		}
+	}
+
+	return strings.Contains(name, "gearstack")
+}
+
+// outputPrefix is the prefix of the textures written for the gearstack at path.
+func outputPrefix(path, outDir string) string {
+
+	prefix := strings.TrimSuffix(path, filepath.Ext(path))
+	if outDir != "" {
+		prefix = filepath.Join(outDir, filepath.Base(prefix))
+	}
+
+	return prefix
+}
+
+func explode(path, prefix string, options graphics.GearstackOptions, withORM, withHistograms bool) {
+
+	pbr, err := graphics.ExplodeGearstackWithOptions(path, options)
 	if err != nil {
-		return err
+		glg.Errorf("Error expanding gearstack file %s: %s", path, err.Error())
+		return
+	}
+
+	format := "jpeg"
+	if strings.HasSuffix(path, "png") {
+		format = "png"
 	}
-	defer roughnessF.Close()
-	aoF, err := os.OpenFile(prefix+"_ao."+format, os.O_WRONLY|os.O_CREATE, 0644)
+
+	err = writeTextures(pbr, format, prefix, withORM)
+	if err != nil {
+		glg.Errorf("Error writing textures for %s: %s", path, err.Error())
+		return
+	}
+
+	if withHistograms {
+		// Build the whole report first so the output from different workers isn't interleaved
+		report := &strings.Builder{}
+		fmt.Fprintf(report, "%s\n", path)
+		writeHistogram(report, "ao", pbr.AmbientOcclusion)
+		writeHistogram(report, "metalness", pbr.Metalness)
+		writeHistogram(report, "roughness", pbr.Roughness)
+		writeHistogram(report, "emissive", pbr.Emissive)
+		fmt.Print(report.String())
+	}
+}
+
+func writeTextures(pbr *graphics.PBRTextureCollection, format, prefix string, withORM bool) error {
+
+	textures := map[string]image.Image{
+		"metalness": pbr.Metalness,
+		"roughness": pbr.Roughness,
+		"ao":        pbr.AmbientOcclusion,
+		"emissive":  pbr.Emissive,
+	}
+
+	for name, img := range textures {
+		err := writeTexture(img, prefix+"_"+name+"."+format, format)
+		if err != nil {
+			return err
+		}
+	}
+
+	if withORM {
+		// The channels are packed so this is always written losslessly
+		return writeTexture(graphics.PackORM(pbr.AmbientOcclusion, pbr.Roughness, pbr.Metalness), prefix+"_orm.png", "png")
+	}
+
+	return nil
+}
+
+func writeTexture(img image.Image, path, format string) error {
+
+	outF, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
-	defer aoF.Close()
+	defer outF.Close()
 
 	if format == "png" {
-		png.Encode(metalF, pbr.Metalness)
-		png.Encode(roughnessF, pbr.Roughness)
-		png.Encode(aoF, pbr.AmbientOcclusion)
+		return png.Encode(outF, img)
 	} else if format == "jpeg" {
-		jpeg.Encode(metalF, pbr.Metalness, nil)
-		jpeg.Encode(roughnessF, pbr.Roughness, nil)
-		jpeg.Encode(aoF, pbr.AmbientOcclusion, nil)
-	} else {
-		return errors.New("Unknown image format " + format)
+		return jpeg.Encode(outF, img, nil)
 	}
 
-	return nil
+	return errors.New("Unknown image format " + format)
+}
+
+// histogramBuckets is the number of ranges the 0-255 values are counted in.
+const histogramBuckets = 8
+
+// writeHistogram writes the distribution of the values in the (grayscale) texture, along with
+// the smallest, largest and average value.
+func writeHistogram(w *strings.Builder, name string, img image.Image) {
+
+	counts := [histogramBuckets]int{}
+	min, max, total := 255, 0, 0
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, _, _, _ := img.At(x, y).RGBA()
+			value := int(r >> 8)
+			counts[value*histogramBuckets/256]++
+			total += value
+			if value < min {
+				min = value
+			}
+			if value > max {
+				max = value
+			}
+		}
+	}
+
+	pixels := b.Dx() * b.Dy()
+	if pixels == 0 {
+		fmt.Fprintf(w, "  %-10s empty\n", name)
+		return
+	}
+
+	fmt.Fprintf(w, "  %-10s min=%3d max=%3d mean=%6.2f |", name, min, max, float64(total)/float64(pixels))
+	for _, count := range counts {
+		fmt.Fprintf(w, " %5.1f%%", 100*float64(count)/float64(pixels))
+	}
+	fmt.Fprintf(w, "\n")
 }
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestGearstackPaths(t *testing.T) {
+
+	dir := t.TempDir()
+	for _, name := range []string{
+		"1234_gearstack.png", "5678_Gearstack.JPG", "1234_diffuse.png", "1234_normal.jpg",
+		"1234_gearstack_ao.png", "1234_gearstack_metalness.png", "1234_gearstack_orm.png",
+		"1234_gearstack.json",
+	} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte{}, 0644)
+	}
+
+	expected := []string{filepath.Join(dir, "1234_gearstack.png"), filepath.Join(dir, "5678_Gearstack.JPG")}
+	for _, path := range []string{dir, filepath.Join(dir, "*.*")} {
+		paths, err := gearstackPaths(path)
+		if err != nil {
+			t.Fatalf("Failed to find the gearstacks in %s: %s", path, err.Error())
+		}
+		if !reflect.DeepEqual(paths, expected) {
+			t.Errorf("Wrong gearstacks for %s: Expected=%v, Actual=%v", path, expected, paths)
+		}
+	}
+
+	// A file named on its own is used whatever it is called
+	single := filepath.Join(dir, "1234_diffuse.png")
+	if paths, err := gearstackPaths(single); err != nil || !reflect.DeepEqual(paths, []string{single}) {
+		t.Errorf("Expected the file to be used as it is, got %v %v", paths, err)
+	}
+}
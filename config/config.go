@@ -0,0 +1,343 @@
+// Package config loads the settings of the server and CLI. Settings start out with their
+// defaults and are then overridden, in order, by a JSON config file, environment variables and
+// command line flags, so a flag always wins over the environment and the environment over the
+// file.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// FileFlag is the flag naming the config file to load.
+	FileFlag = "config"
+	// FileEnv is the environment variable naming the config file to load, the flag takes
+	// precedence over it.
+	FileEnv = "GEAR_VENDOR_CONFIG"
+)
+
+// Config is every setting of the server and CLI.
+type Config struct {
+	// Port is the port the server listens on, it is only needed when running the server.
+	Port         string `json:"port"`
+	DatabaseURL  string `json:"databaseURL"`
+	BungieAPIKey string `json:"bungieAPIKey"`
+	Paths        Paths  `json:"paths"`
+	Cache        Cache  `json:"cache"`
+	Jobs         Jobs   `json:"jobs"`
+	// DisableUSD turns off the USD formats, for servers run without the USD tools installed.
+	DisableUSD bool `json:"disableUSD"`
+	// AdminToken has to be sent as a bearer token to use the admin routes, like purging the
+	// model cache. The admin routes are refused when it is empty.
+	AdminToken string `json:"adminToken"`
+}
+
+// Paths are the directories files are downloaded and written to.
+type Paths struct {
+	// Models is where the CLI writes a directory of models for each item.
+	Models string `json:"models"`
+	// Textures is where the textures unpacked from the downloaded texture files are written.
+	Textures string `json:"textures"`
+	// GeometryDownloads and TextureDownloads keep the files downloaded from the Bungie CDN.
+	GeometryDownloads string `json:"geometryDownloads"`
+	TextureDownloads  string `json:"textureDownloads"`
+	// Tools is where the CLI writes asset definitions and render meshes for debugging.
+	Tools string `json:"tools"`
+}
+
+// Cache configures where the server caches converted models.
+type Cache struct {
+	// Dir can't be or overlap with any of the directories in Paths the cache could clobber, since
+	// it cleans up anything it finds in there that looks like an entry.
+	Dir string `json:"dir"`
+	// MaxSize is the number of bytes the cached models can take up before the least recently
+	// used ones are evicted, zero lets the cache grow without a limit.
+	MaxSize int64 `json:"maxSize"`
+}
+
+// Jobs configures the background conversion jobs of the server.
+type Jobs struct {
+	// Workers is the number of jobs that run at the same time, conversions use a lot of memory
+	// for big items so this is kept small.
+	Workers int `json:"workers"`
+	// QueueSize is the number of jobs that can wait for a worker before new jobs are refused.
+	QueueSize int `json:"queueSize"`
+	// Retention is how long finished jobs are kept around for their status and result.
+	Retention Duration `json:"retention"`
+}
+
+// Duration is a time.Duration written as a string like "1h30m" in config files.
+type Duration struct {
+	time.Duration
+}
+
+// MarshalJSON writes the duration as a string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON reads a duration string.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+
+	var value string
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return errors.New("Durations must be strings like \"1h30m\"")
+	}
+
+	d.Duration, err = time.ParseDuration(value)
+	return err
+}
+
+// Default returns the settings used when nothing else is configured.
+func Default() *Config {
+	return &Config{
+		Paths: Paths{
+			Models:            "./output/gear.scnassets/",
+			Textures:          "./output/",
+			GeometryDownloads: "./local_tools/geom/geometry/",
+			TextureDownloads:  "./local_tools/geom/textures/",
+			Tools:             "./local_tools/",
+		},
+		Cache: Cache{
+			Dir:     "./model-cache/",
+			MaxSize: 10 << 30,
+		},
+		Jobs: Jobs{
+			Workers:   2,
+			QueueSize: 100,
+			Retention: Duration{time.Hour},
+		},
+	}
+}
+
+// setting is a value that can be set from the environment or a flag.
+type setting struct {
+	flag    string
+	env     string
+	usage   string
+	boolean bool
+	set     func(config *Config, value string) error
+}
+
+var settings = []setting{
+	stringSetting("port", "PORT", "The port the server listens on", func(c *Config) *string { return &c.Port }),
+	stringSetting("database-url", "DATABASE_URL", "The connection string of the asset database", func(c *Config) *string { return &c.DatabaseURL }),
+	stringSetting("bungie-api-key", "BUNGIE_API_KEY", "The API key sent with requests to the Bungie CDN", func(c *Config) *string { return &c.BungieAPIKey }),
+	stringSetting("model-dir", "GEAR_VENDOR_MODEL_DIR", "The directory the CLI writes models to", func(c *Config) *string { return &c.Paths.Models }),
+	stringSetting("texture-dir", "GEAR_VENDOR_TEXTURE_DIR", "The directory unpacked textures are written to", func(c *Config) *string { return &c.Paths.Textures }),
+	stringSetting("geometry-download-dir", "GEAR_VENDOR_GEOMETRY_DOWNLOAD_DIR", "The directory downloaded geometry files are kept in", func(c *Config) *string { return &c.Paths.GeometryDownloads }),
+	stringSetting("texture-download-dir", "GEAR_VENDOR_TEXTURE_DOWNLOAD_DIR", "The directory downloaded texture files are kept in", func(c *Config) *string { return &c.Paths.TextureDownloads }),
+	stringSetting("tools-dir", "GEAR_VENDOR_TOOLS_DIR", "The directory the CLI writes asset definitions and render meshes to", func(c *Config) *string { return &c.Paths.Tools }),
+	stringSetting("admin-token", "GEAR_VENDOR_ADMIN_TOKEN", "The bearer token needed for the admin routes, they are refused without one", func(c *Config) *string { return &c.AdminToken }),
+	stringSetting("cache-dir", "GEAR_VENDOR_CACHE_DIR", "The directory the server caches converted models in", func(c *Config) *string { return &c.Cache.Dir }),
+	{
+		flag: "cache-max-size", env: "GEAR_VENDOR_CACHE_MAX_SIZE", usage: "The number of bytes the model cache can grow to, 0 for no limit",
+		set: func(c *Config, v string) (err error) {
+			c.Cache.MaxSize, err = strconv.ParseInt(v, 10, 64)
+			return err
+		},
+	},
+	intSetting("job-workers", "GEAR_VENDOR_JOB_WORKERS", "The number of conversion jobs that run at the same time", func(c *Config) *int { return &c.Jobs.Workers }),
+	intSetting("job-queue-size", "GEAR_VENDOR_JOB_QUEUE_SIZE", "The number of jobs that can wait for a worker", func(c *Config) *int { return &c.Jobs.QueueSize }),
+	{
+		flag: "job-retention", env: "GEAR_VENDOR_JOB_RETENTION", usage: "How long finished jobs are kept, like 1h30m",
+		set: func(c *Config, v string) (err error) {
+			c.Jobs.Retention.Duration, err = time.ParseDuration(v)
+			return err
+		},
+	},
+	{
+		flag: "disable-usd", env: "DISABLE_USD", usage: "Turn off the USD formats when the USD tools aren't installed", boolean: true,
+		set: func(c *Config, v string) (err error) {
+			c.DisableUSD, err = strconv.ParseBool(v)
+			return err
+		},
+	},
+}
+
+func stringSetting(name, env, usage string, field func(*Config) *string) setting {
+	return setting{flag: name, env: env, usage: usage, set: func(c *Config, v string) error {
+		*field(c) = v
+		return nil
+	}}
+}
+
+func intSetting(name, env, usage string, field func(*Config) *int) setting {
+	return setting{flag: name, env: env, usage: usage, set: func(c *Config, v string) (err error) {
+		*field(c), err = strconv.Atoi(v)
+		return err
+	}}
+}
+
+// flagValue records the value of a flag so it can be applied after the config file and
+// environment have been loaded.
+type flagValue struct {
+	value string
+	bool  bool
+}
+
+func (f *flagValue) String() string     { return f.value }
+func (f *flagValue) Set(v string) error { f.value = v; return nil }
+func (f *flagValue) IsBoolFlag() bool   { return f.bool }
+
+// Load registers a flag for every setting on flags, parses args with them and returns the
+// resulting config. The config file is named by the -config flag or the GEAR_VENDOR_CONFIG
+// environment variable, lookupEnv is usually os.LookupEnv. Flags the caller registered on flags
+// before calling Load are parsed along with the settings.
+func Load(flags *flag.FlagSet, args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+
+	path := flags.String(FileFlag, "", "A JSON file to load settings from, they are overridden by the environment and flags")
+	values := make(map[string]*flagValue, len(settings))
+	for _, s := range settings {
+		value := &flagValue{bool: s.boolean}
+		values[s.flag] = value
+		flags.Var(value, s.flag, fmt.Sprintf("%s (environment variable %s)", s.usage, s.env))
+	}
+
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	config := Default()
+	if *path == "" {
+		*path, _ = lookupEnv(FileEnv)
+	}
+	if *path != "" {
+		err = config.loadFile(*path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range settings {
+		if value, ok := lookupEnv(s.env); ok && value != "" {
+			if err := s.set(config, value); err != nil {
+				return nil, fmt.Errorf("Invalid value for %s: %s", s.env, err.Error())
+			}
+		}
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if err == nil && f.Name == s.flag {
+				if setErr := s.set(config, values[s.flag].value); setErr != nil {
+					err = fmt.Errorf("Invalid value for -%s: %s", s.flag, setErr.Error())
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return config, config.Validate()
+}
+
+func (config *Config) loadFile(path string) error {
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+	case ".yaml", ".yml", ".toml":
+		return fmt.Errorf("Only JSON config files are supported, can't load %s", path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Failed to open the config file: %s", err.Error())
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(config)
+	if err != nil {
+		return fmt.Errorf("Failed to read the config file %s: %s", path, err.Error())
+	}
+
+	return nil
+}
+
+// Validate checks every setting has a usable value.
+func (config *Config) Validate() error {
+
+	if config.Port != "" {
+		port, err := strconv.Atoi(config.Port)
+		if err != nil || port <= 0 || port > 65535 {
+			return fmt.Errorf("Invalid port %q, expected a number from 1 to 65535", config.Port)
+		}
+	}
+
+	for name, dir := range map[string]string{
+		"models":            config.Paths.Models,
+		"textures":          config.Paths.Textures,
+		"geometryDownloads": config.Paths.GeometryDownloads,
+		"textureDownloads":  config.Paths.TextureDownloads,
+		"tools":             config.Paths.Tools,
+		"cache":             config.Cache.Dir,
+	} {
+		if dir == "" {
+			return fmt.Errorf("The %s directory can't be empty", name)
+		}
+	}
+
+	for name, dir := range map[string]string{
+		"models":            config.Paths.Models,
+		"textures":          config.Paths.Textures,
+		"geometryDownloads": config.Paths.GeometryDownloads,
+		"textureDownloads":  config.Paths.TextureDownloads,
+	} {
+		overlaps, err := overlappingDirs(config.Cache.Dir, dir)
+		if err != nil {
+			return err
+		}
+		if overlaps {
+			return fmt.Errorf("The cache directory %s can't be, contain or be inside the %s directory %s", config.Cache.Dir, name, dir)
+		}
+	}
+
+	if config.Cache.MaxSize < 0 {
+		return errors.New("Invalid cache max size, expected 0 (no limit) or more bytes")
+	}
+	if config.Jobs.Workers < 1 {
+		return errors.New("Invalid number of job workers, at least one is needed")
+	}
+	if config.Jobs.QueueSize < 1 {
+		return errors.New("Invalid job queue size, at least one job has to be able to wait")
+	}
+	if config.Jobs.Retention.Duration <= 0 {
+		return errors.New("Invalid job retention, it has to be longer than zero")
+	}
+
+	return nil
+}
+
+// overlappingDirs reports whether the directories are the same or one of them is inside the other.
+func overlappingDirs(a, b string) (bool, error) {
+
+	a, err := filepath.Abs(a)
+	if err != nil {
+		return false, err
+	}
+	b, err = filepath.Abs(b)
+	if err != nil {
+		return false, err
+	}
+
+	return isWithin(a, b) || isWithin(b, a), nil
+}
+
+// isWithin reports whether the absolute path dir is parent or a directory inside it.
+func isWithin(dir, parent string) bool {
+	rel, err := filepath.Rel(parent, dir)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,117 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testEnv(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "server.json")
+	err := ioutil.WriteFile(path, []byte(`{
+		"port": "8000",
+		"cache": {"dir": "/data/file-cache", "maxSize": 1024},
+		"jobs": {"workers": 4, "retention": "30m"}
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flags := flag.NewFlagSet("server", flag.ContinueOnError)
+	isCLI := flags.Bool("cli", false, "")
+	config, err := Load(flags, []string{"-cli", "-cache-dir", "/data/flag-cache", "-disable-usd"}, testEnv(map[string]string{
+		FileEnv:                   path,
+		"GEAR_VENDOR_CACHE_DIR":   "/data/env-cache",
+		"GEAR_VENDOR_JOB_WORKERS": "8",
+		"GEAR_VENDOR_ADMIN_TOKEN": "secret",
+		"PORT":                    "",
+	}))
+	if err != nil {
+		t.Fatalf("Failed to load: %s", err.Error())
+	}
+
+	if !*isCLI {
+		t.Errorf("Expected the flags of the caller to be parsed too")
+	}
+	if config.Cache.Dir != "/data/flag-cache" {
+		t.Errorf("Expected the flag to win over the environment and file, got %s", config.Cache.Dir)
+	}
+	if config.Jobs.Workers != 8 {
+		t.Errorf("Expected the environment to win over the file, got %d workers", config.Jobs.Workers)
+	}
+	if config.Port != "8000" || config.Cache.MaxSize != 1024 || config.Jobs.Retention.Duration != 30*time.Minute {
+		t.Errorf("Expected the file settings to be loaded, got %+v", config)
+	}
+	if config.Jobs.QueueSize != 100 || config.Paths.Models != Default().Paths.Models {
+		t.Errorf("Expected the defaults for anything not set, got %+v", config)
+	}
+	if config.AdminToken != "secret" {
+		t.Errorf("Expected the admin token from the environment, got %q", config.AdminToken)
+	}
+	if !config.DisableUSD {
+		t.Errorf("Expected the boolean flag to be set without a value")
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+
+	dir := t.TempDir()
+	unknown := filepath.Join(dir, "unknown.json")
+	ioutil.WriteFile(unknown, []byte(`{"cache": {"path": "/data"}}`), 0644)
+
+	tests := []struct {
+		args []string
+		env  map[string]string
+	}{
+		{[]string{"-port", "http"}, nil},
+		{[]string{"-job-workers", "0"}, nil},
+		{[]string{"-job-retention", "1 hour"}, nil},
+		{nil, map[string]string{"GEAR_VENDOR_CACHE_MAX_SIZE": "-1"}},
+		{nil, map[string]string{"GEAR_VENDOR_CACHE_DIR": "", "GEAR_VENDOR_JOB_QUEUE_SIZE": "many"}},
+		{[]string{"-cache-dir", ""}, nil},
+		// The cache can't overlap with the directories it could clobber
+		{[]string{"-cache-dir", "./output/gear.scnassets"}, nil},
+		{[]string{"-cache-dir", "./output/cache/"}, nil},
+		{[]string{"-cache-dir", "./output/gear.scnassets/../"}, nil},
+		{[]string{"-cache-dir", "./local_tools"}, nil},
+		{nil, map[string]string{"GEAR_VENDOR_CACHE_DIR": "/data/cache", "GEAR_VENDOR_TEXTURE_DOWNLOAD_DIR": "/data/cache/textures"}},
+		{[]string{"-cache-dir", "/data", "-model-dir", "/data/../data/"}, nil},
+		{[]string{"-config", unknown}, nil},
+		{[]string{"-config", filepath.Join(dir, "server.yaml")}, nil},
+		{[]string{"-config", filepath.Join(dir, "missing.json")}, nil},
+	}
+
+	for _, test := range tests {
+		flags := flag.NewFlagSet("server", flag.ContinueOnError)
+		flags.SetOutput(ioutil.Discard)
+		if _, err := Load(flags, test.args, testEnv(test.env)); err == nil {
+			t.Errorf("Expected an error for %v %v", test.args, test.env)
+		}
+	}
+}
+
+func TestValidateCacheDir(t *testing.T) {
+
+	// Siblings that only share a prefix with the other directories are fine
+	for _, dir := range []string{"./model-cache", "./output-cache", "/var/cache/gear-vendor"} {
+		config := Default()
+		config.Cache.Dir = dir
+		if err := config.Validate(); err != nil {
+			t.Errorf("Expected %s to be a valid cache directory: %s", dir, err.Error())
+		}
+	}
+
+	if err := Default().Validate(); err != nil {
+		t.Errorf("Expected the defaults to be valid: %s", err.Error())
+	}
+}
@@ -1,8 +1,10 @@
 package db
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"strings"
 
 	"database/sql"
 
@@ -17,11 +19,15 @@ type AssetDB struct {
 
 var assetDB *AssetDB
 
+// DatabaseURL is the connection string of the asset database, it has to be set before the first
+// connection is made to use anything other than the DATABASE_URL environment variable.
+var DatabaseURL = os.Getenv("DATABASE_URL")
+
 // initAssetDatabase is in charge of preparing any Statements that will be commonly used as well
 // as setting up the database connection pool.
 func initAssetDatabase() error {
 
-	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	db, err := sql.Open("postgres", DatabaseURL)
 	if err != nil {
 		fmt.Println("DB errror: ", err.Error())
 		return err
@@ -50,6 +56,11 @@ func GetAssetDBConnection() (*AssetDB, error) {
 	return assetDB, nil
 }
 
+// Ping checks the database can still be reached.
+func (db *AssetDB) Ping(ctx context.Context) error {
+	return db.Database.PingContext(ctx)
+}
+
 func (db *AssetDB) GetAssetDefinition(id uint) (string, error) {
 
 	json := ""
@@ -203,3 +214,140 @@ func (db *AssetDB) GetIconLookup() (map[string]*Item, error) {
 
 	return result, nil
 }
+
+// ItemCategories are the categories items can be searched by, along with the inventory buckets
+// (bucket_type_hash) of the items in each one.
+var ItemCategories = map[string][]uint{
+	"weapon":  {1498876634, 2465295065, 953998645},
+	"armor":   {3448274439, 3551918588, 14239492, 20886954, 1585787867},
+	"ghost":   {4023194814},
+	"vehicle": {284967655, 2025709351},
+}
+
+// ItemDetails describes an item that has an asset definition, so a model can be written for it.
+type ItemDetails struct {
+	Hash       uint
+	Name       string
+	Icon       string
+	Tier       int
+	BucketHash uint
+	TypeName   string
+	// Definition is the asset definition JSON of the item.
+	Definition string
+}
+
+// Category is the category (see ItemCategories) the item belongs to, or an empty string if it
+// isn't in any of them.
+func (item *ItemDetails) Category() string {
+
+	if item.TypeName == "weapon ornament" {
+		return "weapon"
+	}
+
+	for category, buckets := range ItemCategories {
+		for _, bucket := range buckets {
+			if bucket == item.BucketHash {
+				return category
+			}
+		}
+	}
+
+	return ""
+}
+
+// ItemFilter narrows down the items returned by SearchItems, fields left empty don't filter
+// anything.
+type ItemFilter struct {
+	// Name matches items with the text anywhere in their name, ignoring case.
+	Name     string
+	Category string
+	Tier     int
+	Bucket   uint
+
+	Limit  int
+	Offset int
+}
+
+const itemDetailsQuery = "SELECT items.item_hash, items.item_name, COALESCE(items.icon, ''), items.tier_type, " +
+	"items.bucket_type_hash, COALESCE(items.item_type_name, ''), assets.json FROM items, assets " +
+	"WHERE assets.id = items.item_hash"
+
+// SearchItems returns the items with asset definitions that match the filter, ordered by name.
+func (db *AssetDB) SearchItems(filter ItemFilter) ([]*ItemDetails, error) {
+
+	query := itemDetailsQuery
+	args := make([]interface{}, 0, 8)
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if filter.Name != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(filter.Name)
+		query += " AND items.item_name ILIKE " + arg("%"+escaped+"%")
+	}
+	if filter.Category != "" {
+		buckets, ok := ItemCategories[filter.Category]
+		if !ok {
+			return nil, fmt.Errorf("Unknown item category: %s", filter.Category)
+		}
+
+		placeholders := make([]string, 0, len(buckets))
+		for _, bucket := range buckets {
+			placeholders = append(placeholders, arg(bucket))
+		}
+		condition := "items.bucket_type_hash IN (" + strings.Join(placeholders, ", ") + ")"
+		if filter.Category == "weapon" {
+			condition += " OR items.item_type_name = 'weapon ornament'"
+		}
+		query += " AND (" + condition + ")"
+	}
+	if filter.Tier != 0 {
+		query += " AND items.tier_type = " + arg(filter.Tier)
+	}
+	if filter.Bucket != 0 {
+		query += " AND items.bucket_type_hash = " + arg(filter.Bucket)
+	}
+
+	query += " ORDER BY items.item_name, items.item_hash"
+	if filter.Limit > 0 {
+		query += " LIMIT " + arg(filter.Limit)
+	}
+	if filter.Offset > 0 {
+		query += " OFFSET " + arg(filter.Offset)
+	}
+
+	rows, err := db.Database.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]*ItemDetails, 0, 50)
+	for rows.Next() {
+		item, err := scanItemDetails(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+
+	return result, rows.Err()
+}
+
+// GetItemDetails returns the item with the hash, sql.ErrNoRows is returned if there is no item
+// with an asset definition for it.
+func (db *AssetDB) GetItemDetails(hash uint) (*ItemDetails, error) {
+	return scanItemDetails(db.Database.QueryRow(itemDetailsQuery+" AND items.item_hash = $1", hash))
+}
+
+func scanItemDetails(row interface{ Scan(...interface{}) error }) (*ItemDetails, error) {
+
+	item := &ItemDetails{}
+	err := row.Scan(&item.Hash, &item.Name, &item.Icon, &item.Tier, &item.BucketHash, &item.TypeName, &item.Definition)
+	if err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
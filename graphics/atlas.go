@@ -0,0 +1,157 @@
+package graphics
+
+import (
+	"image"
+	"image/draw"
+	"math"
+	"sort"
+)
+
+// atlasPadding is the gap in pixels left between the plates packed into an atlas so filtering
+// doesn't bleed one plate into the next.
+const atlasPadding = 4
+
+// atlasSlot is where a texture plate was placed in the atlas.
+type atlasSlot struct {
+	plateIndex int
+	rect       image.Rectangle
+}
+
+// buildAtlas packs all of the texture plates of every channel (diffuse, normal and gearstack)
+// into a single atlas per channel and rewrites the texture coordinates of every mesh to point at
+// the plate it was using inside the atlas. Afterwards every mesh uses plate 0, so the model is
+// written with a single material. Texture coordinates need to still be in the Destiny frame
+// (top left origin) and ones that wrap outside of 0-1 will sample the neighbouring plates.
+func buildAtlas(processed *processedOutput) {
+
+	indices := make([]int, 0, len(processed.texturePlates))
+	for i := range processed.texturePlates {
+		if processed.texturePlates[i] != nil || processed.normalTexturePlates[i] != nil || processed.gearstackTexturePlates[i] != nil {
+			indices = append(indices, i)
+		}
+	}
+	if len(indices) < 2 {
+		// Already a single material
+		return
+	}
+
+	slots, size := packPlates(processed, indices)
+	slotByIndex := make(map[int]image.Rectangle, len(slots))
+	for _, slot := range slots {
+		slotByIndex[slot.plateIndex] = slot.rect
+	}
+
+	for mesh, texcoords := range processed.texcoords {
+		if mesh >= len(processed.plateIndices) {
+			continue
+		}
+
+		rect, ok := slotByIndex[processed.plateIndices[mesh]]
+		if !ok {
+			continue
+		}
+
+		for i := 0; i+1 < len(texcoords); i += 2 {
+			texcoords[i] = float32((float64(rect.Min.X) + float64(texcoords[i])*float64(rect.Dx())) / float64(size.X))
+			texcoords[i+1] = float32((float64(rect.Min.Y) + float64(texcoords[i+1])*float64(rect.Dy())) / float64(size.Y))
+		}
+		processed.plateIndices[mesh] = 0
+	}
+
+	processed.texturePlates = atlasPlates(processed.texturePlates, "diffuse", slots, size)
+	processed.normalTexturePlates = atlasPlates(processed.normalTexturePlates, "normal", slots, size)
+	processed.gearstackTexturePlates = atlasPlates(processed.gearstackTexturePlates, "gearstack", slots, size)
+	processed.pbrTextures = [10]*PBRTextureCollection{}
+}
+
+// plateSize is the largest size of the plate at index in any of the channels.
+func plateSize(processed *processedOutput, index int) image.Point {
+
+	size := image.Point{}
+	for _, plate := range []*texturePlate{processed.texturePlates[index], processed.normalTexturePlates[index], processed.gearstackTexturePlates[index]} {
+		if plate == nil {
+			continue
+		}
+
+		bounds := plate.data.Bounds()
+		size.X = int(math.Max(float64(size.X), float64(bounds.Dx())))
+		size.Y = int(math.Max(float64(size.Y), float64(bounds.Dy())))
+	}
+
+	return size
+}
+
+// packPlates places the plates into rows, tallest first, in an atlas roughly as wide as it is
+// tall. The slots and the size of the atlas are returned.
+func packPlates(processed *processedOutput, indices []int) ([]atlasSlot, image.Point) {
+
+	sizes := make(map[int]image.Point, len(indices))
+	area := 0
+	widest := 0
+	for _, index := range indices {
+		size := plateSize(processed, index)
+		sizes[index] = size
+		area += (size.X + atlasPadding) * (size.Y + atlasPadding)
+		widest = int(math.Max(float64(widest), float64(size.X)))
+	}
+
+	sort.SliceStable(indices, func(i, j int) bool {
+		return sizes[indices[i]].Y > sizes[indices[j]].Y
+	})
+
+	width := int(math.Max(float64(widest), math.Ceil(math.Sqrt(float64(area)))))
+
+	slots := make([]atlasSlot, 0, len(indices))
+	x, y, rowHeight, atlasWidth := 0, 0, 0, 0
+	for _, index := range indices {
+		size := sizes[index]
+		if x > 0 && x+size.X > width {
+			x = 0
+			y += rowHeight + atlasPadding
+			rowHeight = 0
+		}
+
+		slots = append(slots, atlasSlot{index, image.Rect(x, y, x+size.X, y+size.Y)})
+		atlasWidth = int(math.Max(float64(atlasWidth), float64(x+size.X)))
+		rowHeight = int(math.Max(float64(rowHeight), float64(size.Y)))
+		x += size.X + atlasPadding
+	}
+
+	return slots, image.Point{atlasWidth, y + rowHeight}
+}
+
+// atlasPlates draws the plates of one channel into their slots of the atlas. Plates missing
+// from the channel are filled with the default image for the channel.
+func atlasPlates(plates [10]*texturePlate, plateType string, slots []atlasSlot, size image.Point) [10]*texturePlate {
+
+	atlas := &texturePlate{
+		size: [2]int{size.X, size.Y},
+		data: defaultImageForPlateType(plateType, [2]int{size.X, size.Y}),
+	}
+
+	for _, slot := range slots {
+		plate := plates[slot.plateIndex]
+		if plate == nil {
+			draw.Draw(atlas.data, slot.rect, defaultImageForPlateType(plateType, [2]int{slot.rect.Dx(), slot.rect.Dy()}), image.ZP, draw.Src)
+			continue
+		}
+
+		if atlas.name == "" {
+			atlas.name = "atlas-" + plate.name
+			atlas.tag = plate.tag
+		}
+
+		var img image.Image = plate.data
+		if img.Bounds().Dx() != slot.rect.Dx() || img.Bounds().Dy() != slot.rect.Dy() {
+			img = resample(img, slot.rect.Dx(), slot.rect.Dy())
+		}
+		draw.Draw(atlas.data, slot.rect, img, img.Bounds().Min, draw.Src)
+	}
+
+	result := [10]*texturePlate{}
+	if atlas.name != "" {
+		result[0] = atlas
+	}
+
+	return result
+}
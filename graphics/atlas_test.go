@@ -0,0 +1,127 @@
+package graphics
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"testing"
+)
+
+func solidPlate(name string, width, height int, c color.Color) *texturePlate {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.ZP, draw.Src)
+
+	return &texturePlate{name: name, size: [2]int{width, height}, data: img}
+}
+
+func TestPackPlates(t *testing.T) {
+
+	processed := &processedOutput{}
+	processed.texturePlates[0] = solidPlate("a", 8, 4, color.Black)
+	processed.texturePlates[1] = solidPlate("b", 4, 4, color.Black)
+	// The largest size in any channel is used
+	processed.texturePlates[3] = solidPlate("c", 2, 2, color.Black)
+	processed.normalTexturePlates[3] = solidPlate("c-normal", 6, 12, color.Black)
+
+	slots, size := packPlates(processed, []int{0, 1, 3})
+	if len(slots) != 3 {
+		t.Fatalf("Expected a slot for every plate, got %d", len(slots))
+	}
+	if slots[0].plateIndex != 3 || slots[0].rect.Size() != (image.Point{6, 12}) {
+		t.Errorf("Expected the tallest plate first at its largest size, got %+v", slots[0])
+	}
+
+	atlas := image.Rect(0, 0, size.X, size.Y)
+	for i, slot := range slots {
+		if !slot.rect.In(atlas) {
+			t.Errorf("Slot %+v is outside of the %v atlas", slot, size)
+		}
+		for _, other := range slots[i+1:] {
+			if slot.rect.Inset(-atlasPadding / 2).Overlaps(other.rect.Inset(-atlasPadding / 2)) {
+				t.Errorf("Slots %v and %v are closer than the padding", slot.rect, other.rect)
+			}
+		}
+	}
+}
+
+func TestBuildAtlas(t *testing.T) {
+
+	red := color.RGBA{255, 0, 0, 255}
+	blue := color.RGBA{0, 0, 255, 255}
+	processed := &processedOutput{
+		texcoords: [][]float32{
+			{0, 0, 1, 1, 0.5, 0.5},
+			{0, 0, 1, 1, 0.5, 0.5},
+		},
+		plateIndices: []int{0, 2},
+	}
+	processed.texturePlates[0] = solidPlate("first_diffuse.jpg", 16, 16, red)
+	processed.texturePlates[2] = solidPlate("second_diffuse.jpg", 8, 8, blue)
+	processed.normalTexturePlates[0] = solidPlate("first_normal.jpg", 16, 16, red)
+	processed.pbrTextures[0] = &PBRTextureCollection{}
+
+	buildAtlas(processed)
+
+	if processed.plateIndices[0] != 0 || processed.plateIndices[1] != 0 {
+		t.Errorf("Expected every mesh to use the atlas, got %v", processed.plateIndices)
+	}
+	for i := 1; i < len(processed.texturePlates); i++ {
+		if processed.texturePlates[i] != nil || processed.normalTexturePlates[i] != nil {
+			t.Errorf("Expected only the atlas plate to be left, found one at %d", i)
+		}
+	}
+	if processed.gearstackTexturePlates[0] != nil || processed.pbrTextures[0] != nil {
+		t.Errorf("Expected no gearstack atlas without any gearstack plates")
+	}
+
+	atlas := processed.texturePlates[0]
+	if atlas.name != "atlas-first_diffuse.jpg" {
+		t.Errorf("Wrong atlas name: %s", atlas.name)
+	}
+	size := atlas.data.Bounds().Size()
+	if atlas.size != [2]int{size.X, size.Y} {
+		t.Errorf("Wrong atlas size: %v for a %v image", atlas.size, size)
+	}
+
+	// Every corner and the center of each mesh's texture coordinates now land inside its plate
+	sample := func(img image.Image, u, v float32) color.RGBA {
+		x := int(math.Min(float64(u)*float64(size.X), float64(size.X-1)))
+		y := int(math.Min(float64(v)*float64(size.Y), float64(size.Y-1)))
+		return color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+	}
+	for mesh, expected := range []color.RGBA{red, blue} {
+		texcoords := processed.texcoords[mesh]
+		// The last coordinate is the center, the corners are on the edge of the plate so they are
+		// sampled a little towards the center
+		centerU, centerV := texcoords[4], texcoords[5]
+		for i := 0; i+1 < len(texcoords); i += 2 {
+			u := texcoords[i] + (centerU-texcoords[i])*0.05
+			v := texcoords[i+1] + (centerV-texcoords[i+1])*0.05
+			if c := sample(atlas.data, u, v); c != expected {
+				t.Errorf("Mesh %d texcoord %d samples %v, expected %v", mesh, i/2, c, expected)
+			}
+		}
+	}
+
+	// The second plate has no normal map so its slot gets the flat normal
+	normals := processed.normalTexturePlates[0]
+	texcoords := processed.texcoords[1]
+	if c := sample(normals.data, texcoords[4], texcoords[5]); c != (color.RGBA{128, 128, 255, 255}) {
+		t.Errorf("Expected the default normal for the missing plate, got %v", c)
+	}
+}
+
+func TestBuildAtlasSinglePlate(t *testing.T) {
+
+	texcoords := []float32{0, 0, 1, 1}
+	processed := &processedOutput{texcoords: [][]float32{texcoords}, plateIndices: []int{4}}
+	plate := solidPlate("only_diffuse.jpg", 4, 4, color.White)
+	processed.texturePlates[4] = plate
+
+	buildAtlas(processed)
+
+	if processed.texturePlates[4] != plate || processed.plateIndices[0] != 4 || texcoords[2] != 1 {
+		t.Errorf("Expected a model with a single plate to be left alone")
+	}
+}
@@ -0,0 +1,160 @@
+package graphics
+
+import (
+	"fmt"
+	"math"
+)
+
+// BoundingBox is the axis-aligned box enclosing a set of positions.
+type BoundingBox struct {
+	Min [3]float64 `json:"min"`
+	Max [3]float64 `json:"max"`
+}
+
+// Pivot describes where the origin of a written model should be placed.
+type Pivot string
+
+const (
+	// PivotOriginal keeps the origin from the game data, which is the grip for most weapons.
+	PivotOriginal Pivot = ""
+	// PivotCenter moves the origin to the center of the bounding box.
+	PivotCenter Pivot = "center"
+	// PivotGround centers the model horizontally and rests it on the ground plane.
+	PivotGround Pivot = "ground"
+)
+
+// ParsePivot converts a user provided pivot name into a Pivot.
+func ParsePivot(name string) (Pivot, error) {
+	switch Pivot(name) {
+	case PivotOriginal, PivotCenter, PivotGround:
+		return Pivot(name), nil
+	case "original":
+		return PivotOriginal, nil
+	}
+
+	return "", fmt.Errorf("unsupported pivot: %s", name)
+}
+
+func emptyBoundingBox() BoundingBox {
+	return BoundingBox{
+		Min: [3]float64{math.Inf(1), math.Inf(1), math.Inf(1)},
+		Max: [3]float64{math.Inf(-1), math.Inf(-1), math.Inf(-1)},
+	}
+}
+
+// IsEmpty is true if the bounding box does not contain any points.
+func (b BoundingBox) IsEmpty() bool {
+	return b.Min[0] > b.Max[0]
+}
+
+// Center is the point in the middle of the bounding box.
+func (b BoundingBox) Center() [3]float64 {
+	return [3]float64{
+		(b.Min[0] + b.Max[0]) / 2.0,
+		(b.Min[1] + b.Max[1]) / 2.0,
+		(b.Min[2] + b.Max[2]) / 2.0,
+	}
+}
+
+// Size is the length of the bounding box along each axis.
+func (b BoundingBox) Size() [3]float64 {
+	return [3]float64{b.Max[0] - b.Min[0], b.Max[1] - b.Min[1], b.Max[2] - b.Min[2]}
+}
+
+// extend grows the bounding box to include a flat list of xyz positions.
+func (b *BoundingBox) extend(positions []float64) {
+	for i := 0; i+2 < len(positions); i += 3 {
+		for axis := 0; axis < 3; axis++ {
+			b.Min[axis] = math.Min(b.Min[axis], positions[i+axis])
+			b.Max[axis] = math.Max(b.Max[axis], positions[i+axis])
+		}
+	}
+}
+
+// overlapsTriangle is true if the bounding box of the triangle overlaps this one.
+func (b BoundingBox) overlapsTriangle(triangle [3][3]float64) bool {
+	for axis := 0; axis < 3; axis++ {
+		low := math.Min(triangle[0][axis], math.Min(triangle[1][axis], triangle[2][axis]))
+		high := math.Max(triangle[0][axis], math.Max(triangle[1][axis], triangle[2][axis]))
+		if high < b.Min[axis] || low > b.Max[axis] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// scaled returns the bounding box with every coordinate multiplied by scale.
+func (b BoundingBox) scaled(scale float64) BoundingBox {
+	if b.IsEmpty() {
+		return b
+	}
+
+	for axis := 0; axis < 3; axis++ {
+		b.Min[axis] *= scale
+		b.Max[axis] *= scale
+	}
+
+	return b
+}
+
+// orZero replaces an empty bounding box with one at the origin so it can be safely serialized.
+func (b BoundingBox) orZero() BoundingBox {
+	if b.IsEmpty() {
+		return BoundingBox{}
+	}
+
+	return b
+}
+
+func meshBounds(positions []float64) BoundingBox {
+	bounds := emptyBoundingBox()
+	bounds.extend(positions)
+
+	return bounds
+}
+
+// modelBounds computes the bounding box of every mesh in the processed output.
+func modelBounds(processed *processedOutput) BoundingBox {
+	bounds := emptyBoundingBox()
+	for _, positions := range processed.positionVertices {
+		bounds.extend(positions)
+	}
+
+	return bounds
+}
+
+// placePivot translates all of the processed positions so the origin ends up where the pivot
+// option requests. The bounding box of the translated model is returned.
+func placePivot(processed *processedOutput, pivot Pivot, upAxis Axis) BoundingBox {
+
+	bounds := modelBounds(processed)
+	if pivot == PivotOriginal || bounds.IsEmpty() {
+		return bounds
+	}
+
+	center := bounds.Center()
+	offset := [3]float64{-center[0], -center[1], -center[2]}
+	if pivot == PivotGround {
+		up := 1
+		if upAxis == ZUp {
+			up = 2
+		}
+		offset[up] = -bounds.Min[up]
+	}
+
+	for _, positions := range processed.positionVertices {
+		for i := 0; i+2 < len(positions); i += 3 {
+			positions[i] += offset[0]
+			positions[i+1] += offset[1]
+			positions[i+2] += offset[2]
+		}
+	}
+
+	for axis := 0; axis < 3; axis++ {
+		bounds.Min[axis] += offset[axis]
+		bounds.Max[axis] += offset[axis]
+	}
+
+	return bounds
+}
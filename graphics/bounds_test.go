@@ -0,0 +1,122 @@
+package graphics
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParsePivot(t *testing.T) {
+
+	tests := map[string]Pivot{"": PivotOriginal, "original": PivotOriginal, "center": PivotCenter, "ground": PivotGround}
+	for name, expected := range tests {
+		pivot, err := ParsePivot(name)
+		if err != nil || pivot != expected {
+			t.Errorf("Wrong pivot for %q: Expected=%q, Actual=%q, err=%v", name, expected, pivot, err)
+		}
+	}
+
+	if _, err := ParsePivot("grip"); err == nil {
+		t.Errorf("Expected an error for an unknown pivot")
+	}
+}
+
+func TestModelBounds(t *testing.T) {
+
+	processed := &processedOutput{
+		positionVertices: [][]float64{
+			{0, 0, 0, 2, 1, 0, 0, 1, 4},
+			{-1, 3, 1},
+			{},
+		},
+	}
+
+	bounds := modelBounds(processed)
+	expected := BoundingBox{Min: [3]float64{-1, 0, 0}, Max: [3]float64{2, 3, 4}}
+	if bounds != expected {
+		t.Errorf("Wrong bounds: Expected=%v, Actual=%v", expected, bounds)
+	}
+	if bounds.Size() != [3]float64{3, 3, 4} || bounds.Center() != [3]float64{0.5, 1.5, 2} {
+		t.Errorf("Wrong extents: Size=%v, Center=%v", bounds.Size(), bounds.Center())
+	}
+
+	empty := modelBounds(&processedOutput{})
+	if !empty.IsEmpty() || empty.orZero() != (BoundingBox{}) || !empty.scaled(2).IsEmpty() {
+		t.Errorf("Expected an empty bounding box for a model without positions, got %v", empty)
+	}
+}
+
+func TestPlacePivot(t *testing.T) {
+
+	positions := func() [][]float64 {
+		return [][]float64{{1, 2, 3, 3, 6, 5}}
+	}
+
+	tests := []struct {
+		pivot    Pivot
+		upAxis   Axis
+		expected []float64
+		bounds   BoundingBox
+	}{
+		{PivotOriginal, YUp, []float64{1, 2, 3, 3, 6, 5},
+			BoundingBox{Min: [3]float64{1, 2, 3}, Max: [3]float64{3, 6, 5}}},
+		{PivotCenter, YUp, []float64{-1, -2, -1, 1, 2, 1},
+			BoundingBox{Min: [3]float64{-1, -2, -1}, Max: [3]float64{1, 2, 1}}},
+		{PivotGround, YUp, []float64{-1, 0, -1, 1, 4, 1},
+			BoundingBox{Min: [3]float64{-1, 0, -1}, Max: [3]float64{1, 4, 1}}},
+		{PivotGround, ZUp, []float64{-1, -2, 0, 1, 2, 2},
+			BoundingBox{Min: [3]float64{-1, -2, 0}, Max: [3]float64{1, 2, 2}}},
+	}
+
+	for _, test := range tests {
+		processed := &processedOutput{positionVertices: positions()}
+		bounds := placePivot(processed, test.pivot, test.upAxis)
+
+		if !reflect.DeepEqual(processed.positionVertices[0], test.expected) {
+			t.Errorf("Wrong positions for %q %s: Expected=%v, Actual=%v", test.pivot, test.upAxis, test.expected, processed.positionVertices[0])
+		}
+		if bounds != test.bounds {
+			t.Errorf("Wrong bounds for %q %s: Expected=%v, Actual=%v", test.pivot, test.upAxis, test.bounds, bounds)
+		}
+	}
+}
+
+func TestWriteModelMetadata(t *testing.T) {
+
+	processed := &processedOutput{
+		positionVertices: [][]float64{
+			{0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 1, 0, 0, 0, 1},
+			{0, 0, 0, 1, 0, 0, 0, 0, 1},
+		},
+	}
+	bounds := modelBounds(processed).scaled(2)
+	metadata := newModelMetadata("usdz", processed, defaultUSDCoordinateSystem, PivotGround, bounds)
+
+	modelPath := filepath.Join(t.TempDir(), "1234.usdz")
+	if err := writeModelMetadata(modelPath, metadata); err != nil {
+		t.Fatalf("Failed to write the metadata: %s", err.Error())
+	}
+
+	contents, err := ioutil.ReadFile(filepath.Join(filepath.Dir(modelPath), "1234.json"))
+	if err != nil {
+		t.Fatalf("Expected the sidecar next to the model: %s", err.Error())
+	}
+
+	read := &ModelMetadata{}
+	if err := json.Unmarshal(contents, read); err != nil {
+		t.Fatalf("Failed to parse the metadata: %s", err.Error())
+	}
+
+	expected := &ModelMetadata{
+		Format:    "usdz",
+		UpAxis:    YUp,
+		Pivot:     PivotGround,
+		Triangles: 3,
+		Bounds:    BoundingBox{Min: [3]float64{0, 0, 0}, Max: [3]float64{2, 2, 2}},
+	}
+	if !reflect.DeepEqual(read, expected) {
+		t.Errorf("Wrong metadata: Expected=%+v, Actual=%+v", expected, read)
+	}
+}
@@ -0,0 +1,210 @@
+package graphics
+
+import (
+	"fmt"
+)
+
+// Axis names one of the coordinate axes of a model.
+type Axis string
+
+// Handedness describes the orientation of the third axis relative to the other two.
+type Handedness string
+
+// UVOrigin describes which corner of a texture the texture coordinate (0, 0) refers to.
+type UVOrigin string
+
+const (
+	// YUp is the convention used by Collada, glTF, Unity and Quick Look.
+	YUp Axis = "Y"
+	// ZUp is the convention used by Destiny, Blender, Unreal and most slicers.
+	ZUp Axis = "Z"
+
+	RightHanded Handedness = "right"
+	LeftHanded  Handedness = "left"
+
+	// UVTopLeft means texture rows are addressed from the top of the image (DirectX style).
+	UVTopLeft UVOrigin = "top-left"
+	// UVBottomLeft means texture rows are addressed from the bottom of the image (OpenGL style).
+	UVBottomLeft UVOrigin = "bottom-left"
+)
+
+// CoordinateSystem describes the frame that vertex data and texture coordinates are
+// expressed in. Empty fields are filled in with the defaults of whichever writer
+// is using the coordinate system.
+type CoordinateSystem struct {
+	UpAxis     Axis
+	Handedness Handedness
+	UVOrigin   UVOrigin
+}
+
+var (
+	// DestinyCoordinateSystem is the frame that the decoded Bungie geometry uses.
+	DestinyCoordinateSystem = CoordinateSystem{UpAxis: ZUp, Handedness: RightHanded, UVOrigin: UVTopLeft}
+
+	// Default output frames for each of the writers. USD and Collada default to Y up since that
+	// is what Quick Look, Unity and most importers expect without relying on the up axis metadata.
+	// STL has nowhere to store an up axis and slicers all assume Z up.
+	defaultUSDCoordinateSystem = CoordinateSystem{UpAxis: YUp, Handedness: RightHanded, UVOrigin: UVBottomLeft}
+	defaultDAECoordinateSystem = CoordinateSystem{UpAxis: YUp, Handedness: RightHanded, UVOrigin: UVBottomLeft}
+	defaultSTLCoordinateSystem = CoordinateSystem{UpAxis: ZUp, Handedness: RightHanded, UVOrigin: UVBottomLeft}
+)
+
+// ParseAxis converts a user provided axis name ("y", "Z", ...) into an Axis.
+func ParseAxis(name string) (Axis, error) {
+	switch name {
+	case "y", "Y":
+		return YUp, nil
+	case "z", "Z":
+		return ZUp, nil
+	case "":
+		return "", nil
+	}
+
+	return "", fmt.Errorf("unsupported up axis: %s", name)
+}
+
+// ParseHandedness converts a user provided handedness name ("left", "right") into a Handedness.
+func ParseHandedness(name string) (Handedness, error) {
+	switch Handedness(name) {
+	case RightHanded, LeftHanded, "":
+		return Handedness(name), nil
+	}
+
+	return "", fmt.Errorf("unsupported handedness: %s", name)
+}
+
+// withDefaults returns a copy of the coordinate system with any empty fields taken from def.
+func (cs CoordinateSystem) withDefaults(def CoordinateSystem) CoordinateSystem {
+	if cs.UpAxis == "" {
+		cs.UpAxis = def.UpAxis
+	}
+	if cs.Handedness == "" {
+		cs.Handedness = def.Handedness
+	}
+	if cs.UVOrigin == "" {
+		cs.UVOrigin = def.UVOrigin
+	}
+
+	return cs
+}
+
+// toYUpRightHanded converts a vector from this frame into a right handed, Y up frame. Left handed
+// frames are treated as the mirror image of the right handed frame along their depth axis
+// (Z for Y up, Y for Z up).
+func (cs CoordinateSystem) toYUpRightHanded(v [3]float64) [3]float64 {
+	x, y, z := v[0], v[1], v[2]
+
+	if cs.UpAxis == ZUp {
+		if cs.Handedness == LeftHanded {
+			y = -y
+		}
+		return [3]float64{x, z, -y}
+	}
+
+	if cs.Handedness == LeftHanded {
+		z = -z
+	}
+	return [3]float64{x, y, z}
+}
+
+// fromYUpRightHanded is the inverse of toYUpRightHanded.
+func (cs CoordinateSystem) fromYUpRightHanded(v [3]float64) [3]float64 {
+	x, y, z := v[0], v[1], v[2]
+
+	if cs.UpAxis == ZUp {
+		result := [3]float64{x, -z, y}
+		if cs.Handedness == LeftHanded {
+			result[1] = -result[1]
+		}
+		return result
+	}
+
+	if cs.Handedness == LeftHanded {
+		z = -z
+	}
+	return [3]float64{x, y, z}
+}
+
+// axisConversion converts vectors and texture coordinates between two coordinate systems.
+type axisConversion struct {
+	from, to CoordinateSystem
+
+	// flipWinding is true when the conversion mirrors the geometry, in which case the vertex order
+	// of every triangle needs to be reversed to keep the faces pointing outwards.
+	flipWinding bool
+	// flipV is true when the texture coordinate origins are on opposite edges of the image.
+	flipV bool
+}
+
+func newAxisConversion(from, to CoordinateSystem) axisConversion {
+	return axisConversion{
+		from:        from,
+		to:          to,
+		flipWinding: from.Handedness != to.Handedness,
+		flipV:       from.UVOrigin != to.UVOrigin,
+	}
+}
+
+func (c axisConversion) isIdentity() bool {
+	return c.from == c.to
+}
+
+func (c axisConversion) vector(v [3]float64) [3]float64 {
+	return c.to.fromYUpRightHanded(c.from.toYUpRightHanded(v))
+}
+
+// convertCoordinateSystem transforms the positions, normals and texture coordinates of the
+// processed output in place from one frame to another.
+func convertCoordinateSystem(processed *processedOutput, from, to CoordinateSystem) {
+
+	conversion := newAxisConversion(from, to)
+	if conversion.isIdentity() {
+		return
+	}
+
+	for i := range processed.positionVertices {
+		convertVectors(processed.positionVertices[i], conversion)
+		convertVectors(processed.normalValues[i], conversion)
+
+		texcoords := processed.texcoords[i]
+		if conversion.flipV {
+			for t := 1; t < len(texcoords); t += 2 {
+				texcoords[t] = 1.0 - texcoords[t]
+			}
+		}
+
+		if conversion.flipWinding {
+			reverseTriangleWinding(processed.positionVertices[i], 3)
+			reverseTriangleWinding(processed.normalValues[i], 3)
+			reverseTriangleWinding32(texcoords, 2)
+		}
+	}
+}
+
+// convertVectors converts a flat list of xyz triples in place.
+func convertVectors(values []float64, conversion axisConversion) {
+	for i := 0; i+2 < len(values); i += 3 {
+		v := conversion.vector([3]float64{values[i], values[i+1], values[i+2]})
+		values[i], values[i+1], values[i+2] = v[0], v[1], v[2]
+	}
+}
+
+// reverseTriangleWinding swaps the second and third vertex of every triangle in a flat
+// list of vertex attributes with the given number of components per vertex.
+func reverseTriangleWinding(values []float64, components int) {
+	stride := components * 3
+	for tri := 0; tri+stride <= len(values); tri += stride {
+		for c := 0; c < components; c++ {
+			values[tri+components+c], values[tri+2*components+c] = values[tri+2*components+c], values[tri+components+c]
+		}
+	}
+}
+
+func reverseTriangleWinding32(values []float32, components int) {
+	stride := components * 3
+	for tri := 0; tri+stride <= len(values); tri += stride {
+		for c := 0; c < components; c++ {
+			values[tri+components+c], values[tri+2*components+c] = values[tri+2*components+c], values[tri+components+c]
+		}
+	}
+}
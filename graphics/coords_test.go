@@ -0,0 +1,114 @@
+package graphics
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseAxis(t *testing.T) {
+
+	tests := map[string]Axis{"y": YUp, "Y": YUp, "z": ZUp, "Z": ZUp, "": ""}
+	for name, expected := range tests {
+		axis, err := ParseAxis(name)
+		if err != nil || axis != expected {
+			t.Errorf("Wrong axis for %q: Expected=%s, Actual=%s, err=%v", name, expected, axis, err)
+		}
+	}
+
+	if _, err := ParseAxis("x"); err == nil {
+		t.Errorf("Expected an error for the x axis")
+	}
+}
+
+func TestParseHandedness(t *testing.T) {
+
+	for _, name := range []string{"right", "left", ""} {
+		handedness, err := ParseHandedness(name)
+		if err != nil || handedness != Handedness(name) {
+			t.Errorf("Wrong handedness for %q: Actual=%s, err=%v", name, handedness, err)
+		}
+	}
+
+	if _, err := ParseHandedness("Right"); err == nil {
+		t.Errorf("Expected an error for an unknown handedness")
+	}
+}
+
+func TestConvertCoordinateSystem(t *testing.T) {
+
+	processed := &processedOutput{
+		positionVertices: [][]float64{{1, 2, 3, 4, 5, 6, 7, 8, 9}},
+		normalValues:     [][]float64{{0, 0, 1, 0, 0, 1, 0, 0, 1}},
+		texcoords:        [][]float32{{0, 0, 1, 0.25, 0, 1}},
+	}
+
+	convertCoordinateSystem(processed, DestinyCoordinateSystem, defaultUSDCoordinateSystem)
+
+	// Z up becomes Y up, with the old Y axis pointing into the screen
+	expectedPositions := []float64{1, 3, -2, 4, 6, -5, 7, 9, -8}
+	if !reflect.DeepEqual(processed.positionVertices[0], expectedPositions) {
+		t.Errorf("Wrong positions: Expected=%v, Actual=%v", expectedPositions, processed.positionVertices[0])
+	}
+	expectedNormals := []float64{0, 1, 0, 0, 1, 0, 0, 1, 0}
+	if !reflect.DeepEqual(processed.normalValues[0], expectedNormals) {
+		t.Errorf("Wrong normals: Expected=%v, Actual=%v", expectedNormals, processed.normalValues[0])
+	}
+	expectedTexcoords := []float32{0, 1, 1, 0.75, 0, 0}
+	if !reflect.DeepEqual(processed.texcoords[0], expectedTexcoords) {
+		t.Errorf("Wrong texcoords: Expected=%v, Actual=%v", expectedTexcoords, processed.texcoords[0])
+	}
+}
+
+func TestConvertCoordinateSystemHandedness(t *testing.T) {
+
+	processed := &processedOutput{
+		positionVertices: [][]float64{{0, 0, 0, 1, 0, 0, 0, 1, 0}},
+		normalValues:     [][]float64{{0, 0, 1, 0, 0, 1, 0, 0, 1}},
+		texcoords:        [][]float32{{0, 0, 1, 0, 0, 1}},
+	}
+
+	from := CoordinateSystem{UpAxis: YUp, Handedness: RightHanded, UVOrigin: UVBottomLeft}
+	to := CoordinateSystem{UpAxis: YUp, Handedness: LeftHanded, UVOrigin: UVBottomLeft}
+	convertCoordinateSystem(processed, from, to)
+
+	// Mirroring along Z flips the normals and reverses the winding to keep the faces outwards
+	expectedPositions := []float64{0, 0, 0, 0, 1, 0, 1, 0, 0}
+	if !reflect.DeepEqual(processed.positionVertices[0], expectedPositions) {
+		t.Errorf("Wrong positions: Expected=%v, Actual=%v", expectedPositions, processed.positionVertices[0])
+	}
+	expectedNormals := []float64{0, 0, -1, 0, 0, -1, 0, 0, -1}
+	if !reflect.DeepEqual(processed.normalValues[0], expectedNormals) {
+		t.Errorf("Wrong normals: Expected=%v, Actual=%v", expectedNormals, processed.normalValues[0])
+	}
+	expectedTexcoords := []float32{0, 0, 0, 1, 1, 0}
+	if !reflect.DeepEqual(processed.texcoords[0], expectedTexcoords) {
+		t.Errorf("Wrong texcoords: Expected=%v, Actual=%v", expectedTexcoords, processed.texcoords[0])
+	}
+}
+
+func TestConvertCoordinateSystemIdentity(t *testing.T) {
+
+	positions := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9}
+	processed := &processedOutput{
+		positionVertices: [][]float64{positions},
+		normalValues:     [][]float64{{}},
+		texcoords:        [][]float32{{}},
+	}
+
+	convertCoordinateSystem(processed, defaultSTLCoordinateSystem, defaultSTLCoordinateSystem)
+	if !reflect.DeepEqual(positions, []float64{1, 2, 3, 4, 5, 6, 7, 8, 9}) {
+		t.Errorf("Expected the positions to be left alone, got %v", positions)
+	}
+}
+
+func TestReverseTriangleWinding(t *testing.T) {
+
+	// Two triangles, the trailing values don't make up a full triangle and are left alone
+	values := []float64{0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6}
+	reverseTriangleWinding(values, 2)
+
+	expected := []float64{0, 0, 2, 2, 1, 1, 3, 3, 5, 5, 4, 4, 6, 6}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("Wrong winding: Expected=%v, Actual=%v", expected, values)
+	}
+}
@@ -1,9 +1,10 @@
 package graphics
 
 import (
-	"bytes"
+	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 	"time"
@@ -14,15 +15,91 @@ import (
 	"github.com/rking788/destiny-gear-vendor/bungie"
 )
 
+// geometriesPlaceholder marks where the streamed geometry library goes in the document.
+const geometriesPlaceholder = "library_geometries"
+
 // A DAEWriter is responsible for writing the parsed object geometry to a Collada (.dae) file.
 type DAEWriter struct {
 	Path        string
 	TexturePath string
+	Options     Options
+
+	// TextureSourcePath is the directory the textures unpacked from the texture files of the
+	// item are read from. DefaultTextureSourcePath is used when it is empty.
+	TextureSourcePath string
+
+	// TextureSink receives the textures used by the model. The textures are written to
+	// TexturePath when it is nil.
+	TextureSink TextureSink
+
+	// ItemHash is the hash of the item being written, it is used to build unique IDs for the
+	// elements in the document.
+	ItemHash uint
+
+	// Reporter is told how far along writing the model is and about any parts or textures that
+	// had to be skipped. It can be nil.
+	Reporter Reporter
 }
 
 // WriteModels will write the specified models into a single Collada (.dae) file.
 func (dae *DAEWriter) WriteModels(geoms []*bungie.DestinyGeometry) error {
 
+	processed, bounds, err := dae.process(geoms)
+	if err != nil {
+		return err
+	}
+
+	if dae.Options.Split {
+		err = writeSplit(processed, dae.Path, "dae", dae.coordinateSystem(), 1,
+			func(part *processedOutput, path string) (int, error) {
+				return len(part.positionVertices[0]) / 9, dae.writeXML(part, path)
+			})
+	} else {
+		err = dae.writeXML(processed, dae.Path)
+	}
+	if err != nil {
+		return err
+	}
+	processed.progress("writing", 1, 1)
+	writeTextures(processed, dae.textureSink(), dae.textureOptions())
+
+	if dae.Options.WriteMetadata {
+		metadata := newModelMetadata("dae", processed, dae.coordinateSystem(), dae.Options.Pivot, bounds)
+		return writeModelMetadata(dae.Path, metadata)
+	}
+
+	return nil
+}
+
+// WriteModelsTo writes the specified models to w as a single Collada document, Path is not
+// used. The Split and WriteMetadata options need a path so they aren't supported.
+func (dae *DAEWriter) WriteModelsTo(w io.Writer, geoms []*bungie.DestinyGeometry) error {
+
+	if dae.Options.Split {
+		return errors.New("Split models can only be written to a path")
+	}
+
+	processed, _, err := dae.process(geoms)
+	if err != nil {
+		return err
+	}
+
+	err = dae.writeXMLTo(processed, w)
+	if err != nil {
+		return err
+	}
+
+	processed.progress("writing", 1, 1)
+	return writeTextures(processed, dae.textureSink(), dae.textureOptions())
+}
+
+// process decodes and post-processes the geometries, returning the bounds of the model.
+func (dae *DAEWriter) process(geoms []*bungie.DestinyGeometry) (*processedOutput, BoundingBox, error) {
+
+	if err := dae.Options.Textures.Format.CheckModelFormat("dae"); err != nil {
+		return nil, BoundingBox{}, err
+	}
+
 	geomCount := len(geoms)
 	processed := &processedOutput{
 		positionVertices: make([][]float64, 0, geomCount),
@@ -35,58 +112,115 @@ func (dae *DAEWriter) WriteModels(geoms []*bungie.DestinyGeometry) error {
 
 	glg.Infof("Writing models for %d geometries", len(geoms))
 
-	for _, geom := range geoms {
+	processed.reporter = dae.Reporter
+	processed.textureDir = dae.TextureSourcePath
+	for i, geom := range geoms {
 		err := processGeometry(geom, processed)
 		if err != nil {
 			glg.Errorf("Failed to process Bungie geometry object: %s", err.Error())
-			return err
+			return nil, BoundingBox{}, err
 		}
+		processed.progress("geometry", i+1, len(geoms))
 	}
 
 	glg.Warnf("Positions count = %d;;;Plate indices count = %d", len(processed.positionVertices), len(processed.plateIndices))
-	dae.writeXML(processed)
-	writeTextures(processed, dae.TexturePath)
+	bounds := postProcess(processed, dae.Options, dae.coordinateSystem())
 
-	return nil
+	return processed, bounds, nil
+}
+
+// textureOptions are the options the textures of the model are written with. COLLADA can't
+// select a channel of a texture, so the ambient occlusion, roughness and metalness maps are
+// always written separately even when PackORM is set.
+func (dae *DAEWriter) textureOptions() TextureOptions {
+	options := dae.Options.Textures
+	options.PackORM = false
+
+	return options
+}
+
+// textureSink is where the textures of the model are written.
+func (dae *DAEWriter) textureSink() TextureSink {
+	if dae.TextureSink != nil {
+		return dae.TextureSink
+	}
+
+	return DirTextureSink(dae.TexturePath)
 }
 
-func (dae *DAEWriter) writeXML(processed *processedOutput) error {
+func (dae *DAEWriter) writeXML(processed *processedOutput, path string) error {
+
+	// Check before creating the file so nothing is left behind
+	err := processed.validate()
+	if err != nil {
+		return err
+	}
 
-	if len(processed.positionVertices) <= 0 {
-		return errors.New("Empty position vertices, nothing to do here")
-	} else if len(processed.positionVertices) != len(processed.normalValues) ||
-		len(processed.positionVertices) != len(processed.texcoords) {
-		return errors.New("Mismatched number of position, normals, or texcoords")
+	// Write this to a file now
+	outF, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		glg.Error(err)
+		return err
+	}
+	defer outF.Close()
+
+	err = dae.writeXMLTo(processed, outF)
+	if err != nil {
+		return err
+	}
+
+	return outF.Close()
+}
+
+func (dae *DAEWriter) writeXMLTo(processed *processedOutput, w io.Writer) error {
+
+	err := processed.validate()
+	if err != nil {
+		return err
 	}
 
 	doc, colladaRoot := NewColladaDoc()
 
-	writeAssetElement(colladaRoot)
+	writeAssetElement(colladaRoot, dae.coordinateSystem().UpAxis)
 
-	writeLibraryImagesElement(colladaRoot, processed.texturePlates)
+	writeLibraryImagesElement(colladaRoot, processed, dae.textureOptions())
 
-	writeLibraryEffects(colladaRoot, processed.texturePlates)
+	writeLibraryEffects(colladaRoot, processed, dae.textureOptions())
 
 	writeLibraryMaterials(colladaRoot, processed.texturePlates)
 
-	geometryIDs := writeLibraryGeometries(colladaRoot, processed)
+	// Only a placeholder for the geometries is added to the document, they are streamed into
+	// its place when the document is written.
+	colladaRoot.CreateElement("library_geometries").CreateComment(geometriesPlaceholder)
 
+	geometryIDs := geometryIDs(processed, dae.ItemHash)
 	writeLibraryVisualScenes(colladaRoot, geometryIDs, processed)
 
 	doc.Indent(2)
-	//doc.WriteTo(os.Stdout)
-
-	// Write this to a file now
-	outF, err := os.OpenFile(dae.Path, os.O_RDWR|os.O_CREATE, 0644)
+	text, err := doc.WriteToString()
 	if err != nil {
-		glg.Error(err)
 		return err
 	}
-	defer outF.Close()
 
-	doc.WriteTo(outF)
+	marker := "<!--" + geometriesPlaceholder + "-->"
+	placeholder := strings.Index(text, marker)
+	if placeholder == -1 {
+		return errors.New("Missing geometries placeholder in the document")
+	}
+	head := text[:strings.LastIndex(text[:placeholder], "\n")+1]
+	tail := strings.TrimPrefix(text[placeholder+len(marker):], "\n")
 
-	return nil
+	buffered := bufio.NewWriterSize(w, writeBufferSize)
+	buffered.WriteString(head)
+	writeLibraryGeometries(buffered, processed, geometryIDs, dae.Options.precision())
+	buffered.WriteString(tail)
+
+	return buffered.Flush()
+}
+
+// coordinateSystem is the frame the model will be written in.
+func (dae *DAEWriter) coordinateSystem() CoordinateSystem {
+	return dae.Options.CoordinateSystem.withDefaults(defaultDAECoordinateSystem)
 }
 
 // NewColladaDoc will open a new XML document and write the correct header metadata and
@@ -101,34 +235,54 @@ func NewColladaDoc() (*etree.Document, *etree.Element) {
 	return doc, colladaRoot
 }
 
-func writeAssetElement(parent *etree.Element) {
+func writeAssetElement(parent *etree.Element, upAxis Axis) {
 	asset := parent.CreateElement("asset")
 	asset.CreateElement("contributor").CreateElement("publishing_tool").CreateCharData("Destiny DAE Generator")
 
 	timestamp := time.Now().UTC().Format(time.RFC3339)
 	asset.CreateElement("created").CreateCharData(timestamp)
 	asset.CreateElement("modified").CreateCharData(timestamp)
-	asset.CreateElement("up_axis").CreateCharData("Y_UP")
+	asset.CreateElement("up_axis").CreateCharData(string(upAxis) + "_UP")
 }
 
-func writeLibraryImagesElement(parent *etree.Element, plates [10]*texturePlate) {
+func writeLibraryImagesElement(parent *etree.Element, processed *processedOutput, options TextureOptions) {
 
 	libImages := parent.CreateElement("library_images")
 
-	for i, plate := range plates {
+	writeImage := func(id, name string) {
+		img := libImages.CreateElement("image")
+		img.CreateAttr("id", id)
+		img.CreateElement("init_from").CreateCharData(name)
+	}
+
+	for i, plate := range processed.texturePlates {
 		if plate == nil {
 			continue
 		}
-		img := libImages.CreateElement("image")
 		libraryImagesID := fmt.Sprintf("image%d", i)
-		img.CreateAttr("id", libraryImagesID)
 		plate.libraryImagesID = libraryImagesID
+		writeImage(libraryImagesID, options.fileName(plate.name))
+
+		if normal := processed.normalTexturePlates[i]; normal != nil {
+			normal.libraryImagesID = fmt.Sprintf("normal_image%d", i)
+			writeImage(normal.libraryImagesID, options.fileName(normal.name))
+		}
 
-		initFrom := img.CreateElement("init_from")
-		initFrom.CreateCharData(fmt.Sprintf("%s", plate.name))
+		if gearstack := processed.gearstackTexturePlates[i]; gearstack != nil {
+			names := gearstack.pbrTextureNames(options)
+			writeImage(pbrImageID("ao", i), names.ao)
+			writeImage(pbrImageID("metalness", i), names.metalness)
+			writeImage(pbrImageID("roughness", i), names.roughness)
+			writeImage(pbrImageID("emissive", i), names.emissive)
+		}
 	}
 }
 
+// pbrImageID is the ID of the image element for one of the PBR maps of the plate at index.
+func pbrImageID(kind string, index int) string {
+	return fmt.Sprintf("%s_image%d", kind, index)
+}
+
 func writeLibraryMaterials(parent *etree.Element, plates [10]*texturePlate) {
 
 	libraryMaterials := parent.CreateElement("library_materials")
@@ -147,277 +301,216 @@ func writeLibraryMaterials(parent *etree.Element, plates [10]*texturePlate) {
 	}
 }
 
-func writeLibraryEffects(parent *etree.Element, plates [10]*texturePlate) {
+func writeLibraryEffects(parent *etree.Element, processed *processedOutput, options TextureOptions) {
 	libraryEffects := parent.CreateElement("library_effects")
 
-	/**
-	 * Lambert1 effects
-	 **/
-
-	for i, plate := range plates {
+	for i, plate := range processed.texturePlates {
 		if plate == nil {
 			continue
 		}
 
-		lambertEffect := libraryEffects.CreateElement("effect")
+		effect := libraryEffects.CreateElement("effect")
 		libraryEffectID := fmt.Sprintf("effect_lambert%d", i)
-		lambertEffect.CreateAttr("id", libraryEffectID)
+		effect.CreateAttr("id", libraryEffectID)
 		plate.libraryEffectsID = libraryEffectID
 
-		lambertProfileCommon := lambertEffect.CreateElement("profile_COMMON")
-
-		imageSurfaceSourceID := fmt.Sprintf("ID2_image%d_surface", i)
-		imgSurfNewParam := lambertProfileCommon.CreateElement("newparam")
-		imgSurfNewParam.CreateAttr("sid", imageSurfaceSourceID)
+		profileCommon := effect.CreateElement("profile_COMMON")
 
-		surface := imgSurfNewParam.CreateElement("surface")
-		surface.CreateAttr("type", "2D")
-		surface.CreateElement("init_from").CreateCharData(plate.libraryImagesID)
+		// Samplers for every texture used by the effect, these need to come before the technique
+		diffuseSampler := writeSampler(profileCommon, fmt.Sprintf("ID2_image%d", i), plate.libraryImagesID)
 
-		imageSID := fmt.Sprintf("ID2_image%d", i)
-		imageNewParam := lambertProfileCommon.CreateElement("newparam")
-		imageNewParam.CreateAttr("sid", imageSID)
-
-		sampler2D := imageNewParam.CreateElement("sampler2D")
-		sampler2D.CreateElement("source").CreateCharData(imageSurfaceSourceID)
-		sampler2D.CreateElement("wrap_s").CreateCharData("WRAP")
-		sampler2D.CreateElement("wrap_t").CreateCharData("WRAP")
-		sampler2D.CreateElement("minfilter").CreateCharData("LINEAR")
-		sampler2D.CreateElement("magfilter").CreateCharData("LINEAR")
-		sampler2D.CreateElement("mipfilter").CreateCharData("LINEAR")
+		normalSampler := ""
+		if normal := processed.normalTexturePlates[i]; normal != nil {
+			normalSampler = writeSampler(profileCommon, fmt.Sprintf("normal_image%d_sampler", i), normal.libraryImagesID)
+		}
 
-		lambertTechnique := lambertProfileCommon.CreateElement("technique")
-		lambertTechnique.CreateAttr("sid", "common")
+		pbrSamplers := map[string]string{}
+		if processed.gearstackTexturePlates[i] != nil {
+			pbrSamplers["occlusion"] = writeSampler(profileCommon, fmt.Sprintf("ao_image%d_sampler", i), pbrImageID("ao", i))
+			pbrSamplers["roughness"] = writeSampler(profileCommon, fmt.Sprintf("roughness_image%d_sampler", i), pbrImageID("roughness", i))
+			pbrSamplers["metallic"] = writeSampler(profileCommon, fmt.Sprintf("metalness_image%d_sampler", i), pbrImageID("metalness", i))
+			pbrSamplers["emission"] = writeSampler(profileCommon, fmt.Sprintf("emissive_image%d_sampler", i), pbrImageID("emissive", i))
+		}
 
-		blinn := lambertTechnique.CreateElement("blinn")
-		blinnAmbient := blinn.CreateElement("ambient")
-		blinnAmbient.CreateElement("color").CreateCharData("1 1 1 1")
+		technique := profileCommon.CreateElement("technique")
+		technique.CreateAttr("sid", "common")
 
-		blinnDiffuse := blinn.CreateElement("diffuse")
+		lambert := technique.CreateElement("lambert")
+		if emission, ok := pbrSamplers["emission"]; ok {
+			writeTextureParam(lambert.CreateElement("emission"), emission)
+		}
 
+		diffuse := lambert.CreateElement("diffuse")
 		if includeTextures {
-			diffuseTexture := blinnDiffuse.CreateElement("texture")
-			diffuseTexture.CreateAttr("texture", imageSID)
-			diffuseTexture.CreateAttr("texcoord", "CHANNEL2")
+			writeTextureParam(diffuse, diffuseSampler)
 		} else {
-			blinnDiffuse.CreateElement("color").CreateCharData("1 0.7 0.5 1")
+			diffuse.CreateElement("color").CreateCharData("1 0.7 0.5 1")
 		}
-		blinnSpecular := blinn.CreateElement("specular")
-		blinnSpecular.CreateElement("color").CreateCharData("0.496564 0.496564 0.496564 1")
 
-		blinnShininess := blinn.CreateElement("shininess")
-		blinnShininess.CreateElement("float").CreateCharData("0.022516")
+		if normalSampler == "" && len(pbrSamplers) == 0 {
+			continue
+		}
 
-		blinnReflective := blinn.CreateElement("reflective")
-		blinnReflective.CreateElement("color").CreateCharData("0 0 0 1")
+		// Normal maps and the PBR maps aren't part of the common profile. The FCOLLADA and
+		// OpenCOLLADA extensions are understood by most importers (Blender, Assimp, 3ds Max, Maya).
+		extra := technique.CreateElement("extra")
+		for _, profile := range []string{"FCOLLADA", "OpenCOLLADA3dsMax"} {
+			extraTechnique := extra.CreateElement("technique")
+			extraTechnique.CreateAttr("profile", profile)
+
+			if normalSampler != "" {
+				bump := extraTechnique.CreateElement("bump")
+				bump.CreateAttr("bumptype", "NORMALMAP")
+				writeTextureParam(bump, normalSampler)
+			}
 
-		blinnTransparent := blinn.CreateElement("transparent")
-		blinnTransparent.CreateAttr("opaque", "A_ONE")
-		blinnTransparent.CreateElement("color").CreateCharData("0.998203 1 1 1")
+			for _, name := range []string{"metallic", "roughness", "occlusion"} {
+				if sampler, ok := pbrSamplers[name]; ok {
+					writeTextureParam(extraTechnique.CreateElement(name), sampler)
+				}
+			}
+		}
+	}
+}
 
-		blinnTransparency := blinn.CreateElement("transparency")
-		blinnTransparency.CreateElement("float").CreateCharData("1")
+// writeSampler adds the surface and sampler parameters for the image to the effect profile and
+// returns the sampler SID to reference from texture elements.
+func writeSampler(profile *etree.Element, samplerSID, imageID string) string {
 
-		blinnIndexOfRefraction := blinn.CreateElement("index_of_refraction")
-		blinnIndexOfRefraction.CreateElement("float").CreateCharData("1")
+	surfaceSID := samplerSID + "_surface"
+	surfaceParam := profile.CreateElement("newparam")
+	surfaceParam.CreateAttr("sid", surfaceSID)
 
-		lambertExtra := lambertEffect.CreateElement("extra")
-		lambertExtraTech := lambertExtra.CreateElement("technique")
-		lambertExtraTech.CreateElement("litPerPixel").CreateCharData("1")
-		lambertExtraTech.CreateElement("ambient_diffuse_lock").CreateCharData("1")
+	surface := surfaceParam.CreateElement("surface")
+	surface.CreateAttr("type", "2D")
+	surface.CreateElement("init_from").CreateCharData(imageID)
 
-		lambertExtraIntensities := lambertExtraTech.CreateElement("intensities")
-		emission := lambertExtraIntensities.CreateElement("emission")
-		emission.CreateElement("float").CreateCharData("0.5")
-	}
-}
+	samplerParam := profile.CreateElement("newparam")
+	samplerParam.CreateAttr("sid", samplerSID)
 
-func writeLibraryGeometries(parent *etree.Element, processed *processedOutput) []string {
+	sampler2D := samplerParam.CreateElement("sampler2D")
+	sampler2D.CreateElement("source").CreateCharData(surfaceSID)
+	sampler2D.CreateElement("wrap_s").CreateCharData("WRAP")
+	sampler2D.CreateElement("wrap_t").CreateCharData("WRAP")
+	sampler2D.CreateElement("minfilter").CreateCharData("LINEAR")
+	sampler2D.CreateElement("magfilter").CreateCharData("LINEAR")
+	sampler2D.CreateElement("mipfilter").CreateCharData("LINEAR")
 
-	libGeometries := parent.CreateElement("library_geometries")
+	return samplerSID
+}
+
+func writeTextureParam(parent *etree.Element, samplerSID string) {
+	texture := parent.CreateElement("texture")
+	texture.CreateAttr("texture", samplerSID)
+	texture.CreateAttr("texcoord", "CHANNEL2")
+}
 
-	geometryIDs := make([]string, 0, len(processed.positionVertices))
+// geometryIDs returns the ID of the geometry element for each mesh. IDs need to be valid XML
+// names, so they can't start with the item hash.
+func geometryIDs(processed *processedOutput, itemHash uint) []string {
 
-	includedIndices := []int{}
+	ids := make([]string, 0, len(processed.positionVertices))
 	for i := range processed.positionVertices {
+		ids = append(ids, fmt.Sprintf("item%d-mesh%d", itemHash, i))
+	}
 
-		// NOTE: This is only for debugging and in the case where it's helpful to
-		// break up the whole item into individual geometries.
-		if len(includedIndices) != 0 {
+	return ids
+}
 
-			found := false
-			for _, index := range includedIndices {
-				if index == i {
-					found = true
-				}
-			}
+// writeLibraryGeometries streams the geometry library, indented to sit inside the document
+// written by etree. The vertex data is far too large to build up as etree char data.
+func writeLibraryGeometries(w *bufio.Writer, processed *processedOutput, geometryIDs []string, precision int) {
 
-			if !found {
-				glg.Debug("continuing")
-				continue
-			}
-		}
+	out := newNumberWriter(w, precision)
+
+	for i, geometryID := range geometryIDs {
 
-		geometryID := fmt.Sprintf("3054293897-0_%d_1", i*3+1)
-		posSourceID := fmt.Sprintf("geometrySource%d", i*3+1)
-		posFloatArrayID := fmt.Sprintf("ID%d-array", i*3+2)
-		normalsSourceID := fmt.Sprintf("geometrySource%d", i*3+2)
-		normalsFloatArrayID := fmt.Sprintf("ID%d-array", i*3+2)
-		texcoordSourceID := fmt.Sprintf("geometrySource%d", i*3+3)
-		texcoordFloatArrayID := fmt.Sprintf("ID%d-array", i*3+3)
-		posVerticesID := fmt.Sprintf("%s-vertices", posSourceID)
+		posSourceID := fmt.Sprintf("%s-positions", geometryID)
+		normalsSourceID := fmt.Sprintf("%s-normals", geometryID)
+		texcoordSourceID := fmt.Sprintf("%s-texcoords", geometryID)
+		posVerticesID := fmt.Sprintf("%s-vertices", geometryID)
 
 		currentPositions := processed.positionVertices[i]
 		currentNormals := processed.normalValues[i]
 		currentTexcoords := processed.texcoords[i]
 
 		positionCount := len(currentPositions)
-		//normalCount := len(currentNormals)
-		texcoordCount := len(currentTexcoords)
 
-		posWriter := bytes.NewBufferString("")
-		normalWriter := bytes.NewBufferString("")
-		trianglesWriter := bytes.NewBufferString("")
-		texcoordWriter := bytes.NewBufferString("")
-
-		// TODO: Step3, this should not flatten out the 2D slices, it should put each slice
-		// into their own string
 		glg.Debugf("Pos list length = %d", len(currentPositions))
-		for i, pos := range currentPositions {
-			posWriter.WriteString(fmt.Sprintf("%f ", pos))
-			trianglesWriter.WriteString(fmt.Sprintf("%d ", i))
-		}
-
-		glg.Debugf("Wrote %d positions to the DAE file", len(currentPositions))
-
-		for _, norm := range currentNormals {
-			normalWriter.WriteString(fmt.Sprintf("%f ", norm))
-		}
-
-		for _, coord := range currentTexcoords {
-			texcoordWriter.WriteString(fmt.Sprintf("%.6f ", coord))
-		}
 
 		// TODO: This should actually be read from the DestinyGeometry type
-		geometry := libGeometries.CreateElement("geometry")
-		geometry.CreateAttr("id", geometryID)
-		geometry.CreateAttr("name", geometryID)
-
-		mesh := geometry.CreateElement("mesh")
-
-		posSource := mesh.CreateElement("source")
-		posSource.CreateAttr("id", posSourceID)
-
-		posFloatArray := posSource.CreateElement("float_array")
-		posFloatArray.CreateAttr("id", posFloatArrayID)
-		posFloatArray.CreateAttr("count", fmt.Sprintf("%d", positionCount))
-		posFloatArray.CreateCharData(strings.TrimSpace(posWriter.String()))
-
-		techniqueCommon := posSource.CreateElement("technique_common")
-		accessor := techniqueCommon.CreateElement("accessor")
-		accessor.CreateAttr("source", fmt.Sprintf("#%s", posFloatArrayID))
-		accessor.CreateAttr("count", fmt.Sprintf("%d", positionCount/3))
-		accessor.CreateAttr("stride", "3")
-
-		xParam := accessor.CreateElement("param")
-		xParam.CreateAttr("name", "X")
-		xParam.CreateAttr("type", "float")
-		yParam := accessor.CreateElement("param")
-		yParam.CreateAttr("name", "Y")
-		yParam.CreateAttr("type", "float")
-		zParam := accessor.CreateElement("param")
-		zParam.CreateAttr("name", "Z")
-		zParam.CreateAttr("type", "float")
-
-		normalsSource := mesh.CreateElement("source")
-		normalsSource.CreateAttr("id", normalsSourceID)
-
-		normFloatArray := normalsSource.CreateElement("float_array")
-		normFloatArray.CreateAttr("id", normalsFloatArrayID)
-		normFloatArray.CreateAttr("count", fmt.Sprintf("%d", positionCount))
-		normFloatArray.CreateCharData(strings.TrimSpace(normalWriter.String()))
-
-		normTechniqueCommon := normalsSource.CreateElement("technique_common")
-		normAccessor := normTechniqueCommon.CreateElement("accessor")
-		normAccessor.CreateAttr("source", fmt.Sprintf("#%s", normalsFloatArrayID))
-		normAccessor.CreateAttr("count", fmt.Sprintf("%d", positionCount/3))
-		normAccessor.CreateAttr("stride", "3")
-
-		normXParam := normAccessor.CreateElement("param")
-		normXParam.CreateAttr("name", "X")
-		normXParam.CreateAttr("type", "float")
-		normYParam := normAccessor.CreateElement("param")
-		normYParam.CreateAttr("name", "Y")
-		normYParam.CreateAttr("type", "float")
-		normZParam := normAccessor.CreateElement("param")
-		normZParam.CreateAttr("name", "Y")
-		normZParam.CreateAttr("type", "float")
-
+		out.writeString("    <geometry id=\"" + geometryID + "\" name=\"" + geometryID + "\">\n")
+		out.writeString("      <mesh>\n")
+
+		writeSource(out, posSourceID, len(currentPositions), 3, []string{"X", "Y", "Z"}, func() {
+			out.writeFloats(currentPositions)
+		})
+		writeSource(out, normalsSourceID, len(currentNormals), 3, []string{"X", "Y", "Z"}, func() {
+			out.writeFloats(currentNormals)
+		})
 		if includeTextures {
-			texcoordSource := mesh.CreateElement("source")
-			texcoordSource.CreateAttr("id", texcoordSourceID)
-
-			texcoordFloatArray := texcoordSource.CreateElement("float_array")
-			texcoordFloatArray.CreateAttr("id", texcoordFloatArrayID)
-			texcoordFloatArray.CreateAttr("count", fmt.Sprintf("%d", texcoordCount))
-			texcoordFloatArray.CreateCharData(strings.TrimSpace(texcoordWriter.String()))
-
-			texcoordTechCommon := texcoordSource.CreateElement("technique_common")
-			texcoordAccessor := texcoordTechCommon.CreateElement("accessor")
-			texcoordAccessor.CreateAttr("source", fmt.Sprintf("#%s", texcoordFloatArrayID))
-			texcoordAccessor.CreateAttr("count", fmt.Sprintf("%d", texcoordCount/2))
-			texcoordAccessor.CreateAttr("stride", "2")
-
-			sParam := texcoordAccessor.CreateElement("param")
-			sParam.CreateAttr("name", "S")
-			sParam.CreateAttr("type", "float")
-
-			tParam := texcoordAccessor.CreateElement("param")
-			tParam.CreateAttr("name", "T")
-			tParam.CreateAttr("type", "float")
+			writeSource(out, texcoordSourceID, len(currentTexcoords), 2, []string{"S", "T"}, func() {
+				out.writeFloat32s(currentTexcoords)
+			})
 		}
 
 		// Vertices
-		verticesElem := mesh.CreateElement("vertices")
-		verticesElem.CreateAttr("id", posVerticesID)
-
-		positionInput := verticesElem.CreateElement("input")
-		positionInput.CreateAttr("semantic", "POSITION")
-		positionInput.CreateAttr("source", fmt.Sprintf("#%s", posSourceID))
-
-		normalsInput := verticesElem.CreateElement("input")
-		normalsInput.CreateAttr("semantic", "NORMAL")
-		normalsInput.CreateAttr("source", fmt.Sprintf("#%s", normalsSourceID))
+		out.writeString("        <vertices id=\"" + posVerticesID + "\">\n")
+		out.writeString("          <input semantic=\"POSITION\" source=\"#" + posSourceID + "\"/>\n")
+		out.writeString("          <input semantic=\"NORMAL\" source=\"#" + normalsSourceID + "\"/>\n")
+		out.writeString("        </vertices>\n")
 
 		// Triangles
 		// 3 points per vertex, 3 vertices per triangle
 		triangleCount := ((positionCount / 3) / 3)
-		triangles := mesh.CreateElement("triangles")
-		triangles.CreateAttr("count", fmt.Sprintf("%d", triangleCount))
-		triangles.CreateAttr("material", geometryID)
-
-		vertexInput := triangles.CreateElement("input")
-		vertexInput.CreateAttr("semantic", "VERTEX")
-		vertexInput.CreateAttr("offset", "0")
-		vertexInput.CreateAttr("source", fmt.Sprintf("#%s", posVerticesID))
+		out.writeString("        <triangles count=\"")
+		out.writeInt(triangleCount)
+		out.writeString("\" material=\"" + geometryID + "\">\n")
+		out.writeString("          <input semantic=\"VERTEX\" offset=\"0\" source=\"#" + posVerticesID + "\"/>\n")
 
-		normalInput := triangles.CreateElement("input")
-		normalInput.CreateAttr("semantic", "NORMAL")
-		normalInput.CreateAttr("offset", "0")
-		normalInput.CreateAttr("source", fmt.Sprintf("#%s", normalsSourceID))
+		// The normals are already part of the vertices
+		if includeTextures {
+			out.writeString("          <input semantic=\"TEXCOORD\" offset=\"0\" source=\"#" + texcoordSourceID + "\" set=\"1\"/>\n")
+		}
 
-		texcoordInput := triangles.CreateElement("input")
-		texcoordInput.CreateAttr("semantic", "TEXCOORD")
-		texcoordInput.CreateAttr("offset", "0")
-		texcoordInput.CreateAttr("source", fmt.Sprintf("#%s", texcoordSourceID))
-		texcoordInput.CreateAttr("set", "1")
+		// Every vertex is unique so the triangles just reference them in order
+		out.writeString("          <p>")
+		out.writeSequence(triangleCount*3, " ")
+		out.writeString("</p>\n")
+		out.writeString("        </triangles>\n")
 
-		triangles.CreateElement("p").CreateCharData(trianglesWriter.String())
+		out.writeString("      </mesh>\n")
+		out.writeString("    </geometry>\n")
 
-		geometryIDs = append(geometryIDs, geometryID)
+		glg.Debugf("Wrote %d positions to the DAE file", len(currentPositions))
 	}
+}
 
-	return geometryIDs
+// writeSource writes a source element holding a float array of count values, read by an
+// accessor with the named params.
+func writeSource(out *numberWriter, sourceID string, count, stride int, params []string, writeValues func()) {
+
+	arrayID := sourceID + "-array"
+
+	out.writeString("        <source id=\"" + sourceID + "\">\n")
+	out.writeString("          <float_array id=\"" + arrayID + "\" count=\"")
+	out.writeInt(count)
+	out.writeString("\">")
+	writeValues()
+	out.writeString("</float_array>\n")
+
+	out.writeString("          <technique_common>\n")
+	out.writeString("            <accessor source=\"#" + arrayID + "\" count=\"")
+	out.writeInt(count / stride)
+	out.writeString("\" stride=\"")
+	out.writeInt(stride)
+	out.writeString("\">\n")
+	for _, param := range params {
+		out.writeString("              <param name=\"" + param + "\" type=\"float\"/>\n")
+	}
+	out.writeString("            </accessor>\n")
+	out.writeString("          </technique_common>\n")
+	out.writeString("        </source>\n")
 }
 
 func writeLibraryVisualScenes(parent *etree.Element, geometryIDs []string, processed *processedOutput) {
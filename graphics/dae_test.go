@@ -0,0 +1,235 @@
+package graphics
+
+import (
+	"bytes"
+	"image"
+	"math/rand"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/beevik/etree"
+	"github.com/kpango/glg"
+)
+
+// ncName matches the XML names allowed for IDs and SIDs.
+var ncName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.\-]*$`)
+
+// testProcessed is a model with two meshes using two texture plates.
+func testProcessed() *processedOutput {
+
+	processed := &processedOutput{
+		positionVertices: [][]float64{
+			{0, 0, 0, 1, 0, 0, 0, 1, 0},
+			{0, 0, 1, 1, 0, 1, 0, 1, 1, 1, 1, 1, 0, 1, 1, 1, 0, 1},
+		},
+		normalValues: [][]float64{
+			{0, 0, 1, 0, 0, 1, 0, 0, 1},
+			{0, 0, 1, 0, 0, 1, 0, 0, 1, 0, 0, 1, 0, 0, 1, 0, 0, 1},
+		},
+		texcoords: [][]float32{
+			{0, 0, 1, 0, 0, 1},
+			{0, 0, 1, 0, 0, 1, 1, 1, 0, 1, 1, 0},
+		},
+		plateIndices: []int{0, 1},
+	}
+	for i, tag := range []string{"first", "second"} {
+		processed.texturePlates[i] = &texturePlate{name: tag + "_diffuse.jpeg", data: image.NewRGBA(image.Rect(0, 0, 4, 4))}
+		processed.normalTexturePlates[i] = &texturePlate{name: tag + "_normal.jpeg", data: image.NewRGBA(image.Rect(0, 0, 4, 4))}
+		processed.gearstackTexturePlates[i] = &texturePlate{name: tag + "_gearstack.png", data: image.NewRGBA(image.Rect(0, 0, 4, 4))}
+	}
+
+	return processed
+}
+
+func TestDAEStructure(t *testing.T) {
+
+	buffer := &bytes.Buffer{}
+	dae := &DAEWriter{ItemHash: 3054293897}
+	err := dae.writeXMLTo(testProcessed(), buffer)
+	if err != nil {
+		t.Fatalf("Failed to write DAE: %s", err.Error())
+	}
+
+	doc := etree.NewDocument()
+	_, err = doc.ReadFrom(buffer)
+	if err != nil {
+		t.Fatalf("Failed to read DAE: %s", err.Error())
+	}
+
+	// Every ID is unique and a valid XML name
+	ids := map[string]bool{}
+	for _, element := range doc.FindElements("//*[@id]") {
+		id := element.SelectAttrValue("id", "")
+		if ids[id] {
+			t.Errorf("Duplicate ID: %s", id)
+		}
+		if !ncName.MatchString(id) {
+			t.Errorf("Invalid ID: %s", id)
+		}
+		ids[id] = true
+	}
+
+	// Every URL reference points at an element in the document
+	for _, element := range doc.FindElements("//*") {
+		for _, attr := range element.Attr {
+			if (attr.Key == "url" || attr.Key == "source" || attr.Key == "target") && !ids[strings.TrimPrefix(attr.Value, "#")] {
+				t.Errorf("Reference to a missing element: %s=%s", attr.Key, attr.Value)
+			}
+		}
+	}
+
+	if geometries := doc.FindElements("//geometry"); len(geometries) != 2 {
+		t.Fatalf("Wrong geometry count: Expected=2, Actual=%d", len(geometries))
+	}
+	if id := doc.FindElement("//geometry").SelectAttrValue("id", ""); id != "item3054293897-mesh0" {
+		t.Errorf("Wrong geometry ID: %s", id)
+	}
+
+	// Array and accessor counts match the data
+	for _, source := range doc.FindElements("//mesh/source") {
+		array := source.FindElement("float_array")
+		accessor := source.FindElement("technique_common/accessor")
+		values := strings.Fields(array.Text())
+		count, _ := strconv.Atoi(array.SelectAttrValue("count", ""))
+		accessorCount, _ := strconv.Atoi(accessor.SelectAttrValue("count", ""))
+		stride, _ := strconv.Atoi(accessor.SelectAttrValue("stride", ""))
+		if count != len(values) {
+			t.Errorf("%s: Wrong float_array count: Expected=%d, Actual=%d", source.SelectAttrValue("id", ""), len(values), count)
+		}
+		if accessorCount*stride != count {
+			t.Errorf("%s: Accessor doesn't cover the array: %d*%d != %d", source.SelectAttrValue("id", ""), accessorCount, stride, count)
+		}
+
+		names := map[string]bool{}
+		for _, param := range accessor.SelectElements("param") {
+			name := param.SelectAttrValue("name", "")
+			if names[name] {
+				t.Errorf("%s: Duplicate param name: %s", source.SelectAttrValue("id", ""), name)
+			}
+			names[name] = true
+		}
+	}
+
+	// Triangles reference every vertex once and only use each semantic once
+	for _, triangles := range doc.FindElements("//triangles") {
+		count, _ := strconv.Atoi(triangles.SelectAttrValue("count", ""))
+		indices := strings.Fields(triangles.FindElement("p").Text())
+		if len(indices) != count*3 {
+			t.Errorf("Wrong number of triangle indices: Expected=%d, Actual=%d", count*3, len(indices))
+		}
+
+		semantics := map[string]bool{}
+		inputs := append(triangles.SelectElements("input"), triangles.Parent().FindElements("vertices/input")...)
+		for _, input := range inputs {
+			semantic := input.SelectAttrValue("semantic", "")
+			if semantics[semantic] {
+				t.Errorf("Semantic used more than once: %s", semantic)
+			}
+			semantics[semantic] = true
+		}
+	}
+}
+
+func TestDAETextureSink(t *testing.T) {
+
+	for _, options := range []TextureOptions{{}, {PackORM: true, Grayscale: true}, {MaxSize: 2}} {
+		processed := testProcessed()
+		buffer := &bytes.Buffer{}
+		sink := NewMemoryTextureSink()
+		dae := &DAEWriter{Options: Options{Textures: options}, TextureSink: sink}
+		err := dae.writeXMLTo(processed, buffer)
+		if err != nil {
+			t.Fatalf("Failed to write DAE: %s", err.Error())
+		}
+		err = writeTextures(processed, dae.textureSink(), dae.textureOptions())
+		if err != nil {
+			t.Fatalf("Failed to write textures: %s", err.Error())
+		}
+
+		doc := etree.NewDocument()
+		_, err = doc.ReadFrom(buffer)
+		if err != nil {
+			t.Fatalf("Failed to read DAE: %s", err.Error())
+		}
+
+		// Every image in the document was written to the sink, and COLLADA can't pick a channel
+		// so no two images share a file
+		images := doc.FindElements("//image/init_from")
+		files := make(map[string]bool)
+		for _, initFrom := range images {
+			if data, ok := sink.File(initFrom.Text()); !ok || len(data) == 0 {
+				t.Errorf("%+v: Missing texture %s, written: %v", options, initFrom.Text(), sink.Names())
+			}
+			if files[initFrom.Text()] {
+				t.Errorf("%+v: Texture %s is used by more than one image", options, initFrom.Text())
+			}
+			files[initFrom.Text()] = true
+		}
+		if len(images) == 0 {
+			t.Errorf("%+v: No images in the document", options)
+		}
+	}
+}
+
+func TestDAERejectsKTX2Textures(t *testing.T) {
+
+	for _, format := range []TextureFormat{TextureFormatKTX2, TextureFormatBasis} {
+		dae := &DAEWriter{Options: Options{Textures: TextureOptions{Format: format}}, TextureSink: NewMemoryTextureSink()}
+		if err := dae.WriteModelsTo(&bytes.Buffer{}, nil); err == nil {
+			t.Errorf("Expected %s textures to be refused for DAE models", format)
+		}
+	}
+}
+
+// benchmarkModel builds a model the size of a large ship or vehicle, split over a few meshes.
+func benchmarkModel() *processedOutput {
+
+	const meshCount, trianglesPerMesh = 4, 50000
+
+	rng := rand.New(rand.NewSource(1))
+	processed := &processedOutput{}
+	for m := 0; m < meshCount; m++ {
+		positions := make([]float64, trianglesPerMesh*9)
+		normals := make([]float64, trianglesPerMesh*9)
+		texcoords := make([]float32, trianglesPerMesh*6)
+		for i := range positions {
+			positions[i] = rng.Float64()*2 - 1
+			normals[i] = rng.Float64()*2 - 1
+		}
+		for i := range texcoords {
+			texcoords[i] = rng.Float32()
+		}
+
+		processed.positionVertices = append(processed.positionVertices, positions)
+		processed.normalValues = append(processed.normalValues, normals)
+		processed.texcoords = append(processed.texcoords, texcoords)
+		processed.plateIndices = append(processed.plateIndices, 0)
+	}
+	processed.texturePlates[0] = &texturePlate{name: "diffuse.jpeg", data: image.NewRGBA(image.Rect(0, 0, 4, 4))}
+	processed.normalTexturePlates[0] = &texturePlate{name: "normal.jpeg", data: image.NewRGBA(image.Rect(0, 0, 4, 4))}
+	processed.gearstackTexturePlates[0] = &texturePlate{name: "gearstack.png", data: image.NewRGBA(image.Rect(0, 0, 4, 4))}
+
+	return processed
+}
+
+func BenchmarkDAEWrite(b *testing.B) {
+
+	glg.Get().SetMode(glg.NONE)
+	defer glg.Get().SetMode(glg.STD)
+
+	processed := benchmarkModel()
+	path := filepath.Join(b.TempDir(), "model.dae")
+	dae := &DAEWriter{Path: path}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := dae.writeXML(processed, path)
+		if err != nil {
+			b.Fatalf("Failed to write DAE: %s", err.Error())
+		}
+	}
+}
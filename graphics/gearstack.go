@@ -0,0 +1,158 @@
+package graphics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// Channel is a color channel of an image: "r", "g", "b" or "a".
+type Channel string
+
+// Color channels of an image.
+const (
+	ChannelRed   Channel = "r"
+	ChannelGreen Channel = "g"
+	ChannelBlue  Channel = "b"
+	ChannelAlpha Channel = "a"
+)
+
+func (c Channel) index() (int, error) {
+	switch c {
+	case ChannelRed:
+		return 0, nil
+	case ChannelGreen:
+		return 1, nil
+	case ChannelBlue:
+		return 2, nil
+	case ChannelAlpha:
+		return 3, nil
+	}
+
+	return 0, fmt.Errorf("Unknown channel: %s", c)
+}
+
+// GearstackOptions describes how the physically based rendering values are packed into the
+// channels of a gearstack texture. Bungie's slides only give a rough description of the layout
+// so these can be tuned for item classes that don't decode well with the defaults.
+type GearstackOptions struct {
+	// AOChannel holds the ambient occlusion. The default is red.
+	AOChannel Channel `json:"aoChannel"`
+	// InvertAO flips the ambient occlusion values, the gearstack appears to store them inverted
+	// compared to what renderers expect (mostly white). The default is true.
+	InvertAO bool `json:"invertAO"`
+
+	// SmoothnessChannel holds the smoothness. The default is green.
+	SmoothnessChannel Channel `json:"smoothnessChannel"`
+	// InvertSmoothness converts the smoothness into the roughness used by renderers. The default
+	// is true.
+	InvertSmoothness bool `json:"invertSmoothness"`
+
+	// EmissiveChannel holds the emissive mask. The default is blue.
+	EmissiveChannel Channel `json:"emissiveChannel"`
+	// EmissiveThreshold is the largest value that is not emissive. The values above it are
+	// stretched over the full emissive range. The default is 40.
+	EmissiveThreshold uint8 `json:"emissiveThreshold"`
+
+	// MetalnessChannel holds the metalness. The default is alpha.
+	MetalnessChannel Channel `json:"metalnessChannel"`
+	// MetalnessLowBit and MetalnessBits select the bits of the channel holding the metalness.
+	// From the slides "In the alpha channel we give metalness 32 values", which is taken to mean
+	// the low 5 bits. The defaults are 0 and 5.
+	MetalnessLowBit uint `json:"metalnessLowBit"`
+	MetalnessBits   uint `json:"metalnessBits"`
+	// InvertMetalness flips the metalness values. The default is false.
+	InvertMetalness bool `json:"invertMetalness"`
+}
+
+// DefaultGearstackOptions returns the gearstack layout used for all items unless other options
+// are provided.
+func DefaultGearstackOptions() GearstackOptions {
+	return GearstackOptions{
+		AOChannel:         ChannelRed,
+		InvertAO:          true,
+		SmoothnessChannel: ChannelGreen,
+		InvertSmoothness:  true,
+		EmissiveChannel:   ChannelBlue,
+		EmissiveThreshold: 40,
+		MetalnessChannel:  ChannelAlpha,
+		MetalnessLowBit:   0,
+		MetalnessBits:     5,
+		InvertMetalness:   false,
+	}
+}
+
+// LoadGearstackOptions reads gearstack options from a JSON file. Any fields missing from the
+// file keep their default values.
+func LoadGearstackOptions(path string) (GearstackOptions, error) {
+
+	options := DefaultGearstackOptions()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return options, err
+	}
+
+	err = json.Unmarshal(data, &options)
+	if err != nil {
+		return options, err
+	}
+
+	return options, options.validate()
+}
+
+func (options GearstackOptions) validate() error {
+
+	for _, c := range []Channel{options.AOChannel, options.SmoothnessChannel, options.EmissiveChannel, options.MetalnessChannel} {
+		if _, err := c.index(); err != nil {
+			return err
+		}
+	}
+
+	if options.MetalnessBits < 1 || options.MetalnessLowBit+options.MetalnessBits > 8 {
+		return fmt.Errorf("Invalid metalness bit range: low bit %d, %d bits", options.MetalnessLowBit, options.MetalnessBits)
+	}
+
+	return nil
+}
+
+// decodeAO returns the ambient occlusion value from the channel value.
+func (options GearstackOptions) decodeAO(value uint8) uint8 {
+	if options.InvertAO {
+		return 255 - value
+	}
+
+	return value
+}
+
+// decodeRoughness returns the roughness value from the smoothness channel value.
+func (options GearstackOptions) decodeRoughness(value uint8) uint8 {
+	if options.InvertSmoothness {
+		return 255 - value
+	}
+
+	return value
+}
+
+// decodeEmissive returns the emissive value from the channel value.
+func (options GearstackOptions) decodeEmissive(value uint8) uint8 {
+	if value <= options.EmissiveThreshold {
+		return 0
+	}
+
+	return uint8(int(value-options.EmissiveThreshold) * 255 / (255 - int(options.EmissiveThreshold)))
+}
+
+// decodeMetalness returns the metalness value from the channel value. The selected bits are
+// divided by the number of values they can hold (32 for the default 5 bits), the way metalness
+// has always been decoded, so the most metallic value comes out slightly below 255.
+func (options GearstackOptions) decodeMetalness(value uint8) uint8 {
+
+	values := uint(1) << options.MetalnessBits
+	masked := (uint(value) >> options.MetalnessLowBit) & (values - 1)
+	metalness := uint8((float64(masked) / float64(values)) * 255.0)
+	if options.InvertMetalness {
+		return 255 - metalness
+	}
+
+	return metalness
+}
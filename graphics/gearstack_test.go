@@ -0,0 +1,154 @@
+package graphics
+
+import (
+	"flag"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "Update the golden images in testdata")
+
+// testGearstack builds a gearstack with a different gradient in every channel so every value of
+// each channel is decoded somewhere in the image.
+func testGearstack() image.Image {
+
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(x * 4),
+				G: uint8(y * 4),
+				B: uint8((x + y) * 2),
+				A: uint8(x*4) ^ uint8(y),
+			})
+		}
+	}
+
+	return img
+}
+
+func TestExplodePBRTextureGolden(t *testing.T) {
+
+	custom := DefaultGearstackOptions()
+	custom.AOChannel = ChannelGreen
+	custom.InvertAO = false
+	custom.SmoothnessChannel = ChannelRed
+	custom.EmissiveThreshold = 0
+	custom.MetalnessLowBit = 3
+	custom.MetalnessBits = 5
+	custom.InvertMetalness = true
+
+	tests := []struct {
+		name    string
+		options GearstackOptions
+	}{
+		{"default", DefaultGearstackOptions()},
+		{"custom", custom},
+	}
+
+	for _, test := range tests {
+		pbr, err := ExplodePBRTextureWithOptions(testGearstack(), test.options)
+		if err != nil {
+			t.Fatalf("%s: Failed with error: %s", test.name, err.Error())
+		}
+
+		maps := map[string]image.Image{
+			"ao":        pbr.AmbientOcclusion,
+			"metalness": pbr.Metalness,
+			"roughness": pbr.Roughness,
+			"emissive":  pbr.Emissive,
+		}
+		for kind, img := range maps {
+			path := filepath.Join("testdata", "gearstack-"+test.name+"-"+kind+".png")
+			if *update {
+				writeGolden(t, path, img)
+				continue
+			}
+
+			compareGolden(t, path, img)
+		}
+	}
+}
+
+func TestGearstackEmissiveThreshold(t *testing.T) {
+
+	options := DefaultGearstackOptions()
+	for _, test := range []struct{ in, out uint8 }{{0, 0}, {39, 0}, {40, 0}, {41, 1}, {255, 255}} {
+		if actual := options.decodeEmissive(test.in); actual != test.out {
+			t.Errorf("Wrong emissive for %d: Expected=%d, Actual=%d", test.in, test.out, actual)
+		}
+	}
+}
+
+func TestGearstackMetalnessScale(t *testing.T) {
+
+	// The low 5 bits are divided by 32, the high bits are ignored
+	options := DefaultGearstackOptions()
+	for _, test := range []struct{ in, out uint8 }{{0, 0}, {1, 7}, {16, 127}, {31, 247}, {0xE0 | 31, 247}} {
+		if actual := options.decodeMetalness(test.in); actual != test.out {
+			t.Errorf("Wrong metalness for %d: Expected=%d, Actual=%d", test.in, test.out, actual)
+		}
+	}
+}
+
+func TestGearstackOptionsValidate(t *testing.T) {
+
+	options := DefaultGearstackOptions()
+	options.MetalnessChannel = "x"
+	if options.validate() == nil {
+		t.Error("Expected an error for an unknown channel")
+	}
+
+	options = DefaultGearstackOptions()
+	options.MetalnessLowBit = 4
+	options.MetalnessBits = 5
+	if options.validate() == nil {
+		t.Error("Expected an error for a bit range outside of the channel")
+	}
+}
+
+func writeGolden(t *testing.T, path string, img image.Image) {
+
+	outF, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Failed to create golden image: %s", err.Error())
+	}
+	defer outF.Close()
+
+	err = png.Encode(outF, img)
+	if err != nil {
+		t.Fatalf("Failed to write golden image: %s", err.Error())
+	}
+}
+
+func compareGolden(t *testing.T, path string, img image.Image) {
+
+	inF, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open golden image, run with -update to create it: %s", err.Error())
+	}
+	defer inF.Close()
+
+	golden, err := png.Decode(inF)
+	if err != nil {
+		t.Fatalf("Failed to decode golden image %s: %s", path, err.Error())
+	}
+
+	if golden.Bounds().Size() != img.Bounds().Size() {
+		t.Fatalf("%s: Wrong size: Expected=%v, Actual=%v", path, golden.Bounds().Size(), img.Bounds().Size())
+	}
+
+	for y := 0; y < img.Bounds().Dy(); y++ {
+		for x := 0; x < img.Bounds().Dx(); x++ {
+			expected := color.NRGBAModel.Convert(golden.At(golden.Bounds().Min.X+x, golden.Bounds().Min.Y+y))
+			actual := color.NRGBAModel.Convert(img.At(img.Bounds().Min.X+x, img.Bounds().Min.Y+y))
+			if expected != actual {
+				t.Fatalf("%s: Wrong pixel at (%d, %d): Expected=%v, Actual=%v", path, x, y, expected, actual)
+			}
+		}
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"image/draw"
 	"image/jpeg"
 	"image/png"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -19,13 +20,9 @@ import (
 	"github.com/tidwall/gjson"
 )
 
-const (
-	invertAO = true
-	// invertSmoothness is a flag indicating whether the smoothness attribute stored
-	// in the gearstack should be inverted into (hopefully?) roughness.
-	invertSmoothness = true
-	invertMetalness  = false
-)
+// DefaultTextureSourcePath is the directory the textures unpacked from the texture files of an
+// item are read from when a writer doesn't set one.
+const DefaultTextureSourcePath = "./output/"
 
 func processGeometry(geom *bungie.DestinyGeometry, output *processedOutput) error {
 	result := gjson.Parse(string(geom.MeshesBytes))
@@ -42,14 +39,17 @@ func processGeometry(geom *bungie.DestinyGeometry, output *processedOutput) erro
 	meshArray := meshes.Array()
 	glg.Infof("Found %d meshes", len(meshArray))
 
-	for _, meshInterface := range meshArray {
+	for meshIndex, meshInterface := range meshArray {
 
 		mesh := meshInterface.Map()
 
+		partCount := len(output.positionVertices)
 		err := processMesh(mesh, output, geom.GetFileByName)
 		if err != nil {
 			return err
 		}
+
+		output.nameParts(geom.Name, meshIndex, partCount)
 	}
 
 	// Process textures
@@ -65,7 +65,7 @@ func processGeometry(geom *bungie.DestinyGeometry, output *processedOutput) erro
 	if len(platesArray) > 1 {
 		panic("Found more than 1 texture plate in this render.json")
 	} else if len(platesArray) <= 0 {
-		glg.Warnf("Found 0 plates in this render file")
+		output.warn("Found 0 texture plates for %s, it will be written without textures", geom.Name)
 		return nil
 	}
 
@@ -136,8 +136,13 @@ func processTexturePlate(plateName string, texturePlateJSON map[string]gjson.Res
 		return nil
 	}
 
-	matches, err := filepath.Glob("./output/" + textureTagName + ".*")
-	glg.Info("looking for texture with glob ./output/" + textureTagName + ".*")
+	textureDir := output.textureDir
+	if textureDir == "" {
+		textureDir = DefaultTextureSourcePath
+	}
+	pattern := filepath.Join(textureDir, textureTagName+".*")
+	matches, err := filepath.Glob(pattern)
+	glg.Info("looking for texture with glob " + pattern)
 	if len(matches) > 1 {
 		err = errors.New("Found more than one matching texture file name " + textureTagName)
 		glg.Error(err)
@@ -292,15 +297,7 @@ func processMesh(mesh map[string]gjson.Result, output *processedOutput, fileProv
 	}
 
 	// Parse the index buffer
-	indexBuffer := make([]int16, 0)
-	indexBufferBytes := fileProvider(mesh["index_buffer"].Get("file_name").String()).Data
-
-	for i := 0; i < len(indexBufferBytes); i += 2 {
-
-		var index int16
-		binary.Read(bytes.NewBuffer(indexBufferBytes[i:i+2]), binary.LittleEndian, &index)
-		indexBuffer = append(indexBuffer, index)
-	}
+	indexBuffer := parseIndexBuffer(fileProvider(mesh["index_buffer"].Get("file_name").String()).Data)
 
 	parts := mesh["stage_part_list"].Array()
 	glg.Infof("Found %d stage parts", len(parts))
@@ -342,85 +339,45 @@ func processMesh(mesh map[string]gjson.Result, output *processedOutput, fileProv
 	return nil
 }
 
-func processPart(part map[string]gjson.Result, partIndex int, indexBuffer []int16, positionsVb, normalsVb [][]float64, innerTexcoordsVb, adjustmentsVb [][]float32, texcoordOffsets, texcoordScales [2]float64, output *processedOutput) error {
+func processPart(part map[string]gjson.Result, partIndex int, indexBuffer []uint16, positionsVb, normalsVb [][]float64, innerTexcoordsVb, adjustmentsVb [][]float32, texcoordOffsets, texcoordScales [2]float64, output *processedOutput) error {
 
 	start := int(part["start_index"].Float())
 	count := int(part["index_count"].Float())
 
-	pos := make([]float64, 0, 1024)
-	norm := make([]float64, 0, 1024)
-	texcoords := make([]float32, 0, 1024)
-
 	// PrimitiveType, 3=TRIANGLES, 5=TRIANGLE_STRIP
-	// https://stackoverflow.com/questions/3485034/convert-triangle-strips-to-triangles
-
-	// Process indexBuffer in sets of 3
 	primitiveType := int(part["primitive_type"].Float())
-	increment := 3
-
-	if primitiveType == 5 {
-		// Process indexBuffer as triangle strip
-		increment = 1
-		count -= 2
-	} else if primitiveType != 3 {
-		glg.Warn("Unknown primitive type, skipping this part...")
+	triangles, err := triangulate(indexBuffer, start, count, primitiveType)
+	if err == errUnknownPrimitive {
+		output.warn("Unknown primitive type %d, skipping part %d", primitiveType, partIndex)
 		// Don't throw an error, just return nil so this part is skipped. continue
 		// on to the next part
 		return nil
+	} else if err != nil {
+		glg.Errorf("*** ERROR: %s: start=%d, count=%d, len=%d", err.Error(), start, count, len(indexBuffer))
+		return err
 	}
 
-	// Construct and write this mesh header
-	for j := 0; j < count; j += increment {
-
-		// Skip if any two of the indexBuffer match (ignoring lines or points)
-		if indexBuffer[start+j+0] == indexBuffer[start+j+1] ||
-			indexBuffer[start+j+0] == indexBuffer[start+j+2] ||
-			indexBuffer[start+j+1] == indexBuffer[start+j+2] {
-			continue
-		}
-
-		tri := [3]int{0, 1, 2}
-		if (primitiveType == 3) || ((j & 1) == 1) {
-			tri = [3]int{2, 1, 0}
-		}
-
-		for k := 0; k < 3; k++ {
-			v := [4]float64{}
-			n := [4]float64{}
-			for l := 0; l < 4; l++ {
-				index := start + j + tri[k]
-				if index >= len(indexBuffer) {
-					// TODO: These should be converted to uint16 so the indices don't seem to be out of bounds
-					glg.Errorf("*** ERROR: Current Index is outside the bounds of the index buffer: Want=%d, Actual=%d", index, len(indexBuffer))
-					return errors.New("Current index outside bounds of indx buffer")
-					//continue
-				} else if uint(indexBuffer[index]) >= uint(len(positionsVb)) {
-					// TODO: These should be converted to uint16 so the indices don't seem to be out of bounds
-					glg.Errorf("*** ERROR: Current index buffer value is outside the bounds of the positions array: Want=%d, Actual=%d", indexBuffer[index], len(positionsVb))
-					return errors.New("Current index buffer value is outside the bounds of the positions array")
-					//continue
-				}
-
-				positionIndex := uint(indexBuffer[index])
-				if l >= len(positionsVb[positionIndex]) {
+	pos := make([]float64, 0, len(triangles)*9)
+	norm := make([]float64, 0, len(triangles)*9)
+	texcoords := make([]float32, 0, len(triangles)*6)
 
-					// TODO: These should be converted to uint16 so the indices don't seem to be out of bounds
-					glg.Errorf("*** ERROR: Triangle index is outside the bounds of the current position array.")
-					return errors.New("Current Triangle index outside teh bounds of the current position array")
-					//continue
-				}
+	for _, triangle := range triangles {
+		for _, index := range triangle {
+			if int(index) >= len(positionsVb) || int(index) >= len(innerTexcoordsVb) {
+				glg.Errorf("*** ERROR: Current index buffer value is outside the bounds of the positions array: Want=%d, Actual=%d", index, len(positionsVb))
+				return errors.New("Current index buffer value is outside the bounds of the positions array")
+			}
 
-				v[l] = positionsVb[positionIndex][l]
-				n[l] = normalsVb[positionIndex][l]
+			v := positionsVb[index]
+			n := normalsVb[index]
+			if len(v) < 3 || len(n) < 3 {
+				glg.Errorf("*** ERROR: Vertex %d has too few components", index)
+				return errors.New("Vertex has too few components")
 			}
 
 			tex := [2]float32{}
-
 			for l := 0; l < 2; l++ {
-
-				texcoordIndex := indexBuffer[start+j+tri[k]]
-
-				tex[l] = transformTexcoord(innerTexcoordsVb[texcoordIndex], l, texcoordOffsets[l], texcoordScales[l])
+				tex[l] = transformTexcoord(innerTexcoordsVb[index], l, texcoordOffsets[l], texcoordScales[l])
 			}
 
 			// Positions, Normals, Texture coordinates for the processed "part"
@@ -502,6 +459,12 @@ func parseVertex32(data []byte, vertexType string, offset int, stride int) [][]f
 // ExplodeGearstack will open the gearstack image at the provided path
 // and break it up into the separate physically based rendering (PBR) components.
 func ExplodeGearstack(path string) (*PBRTextureCollection, error) {
+	return ExplodeGearstackWithOptions(path, DefaultGearstackOptions())
+}
+
+// ExplodeGearstackWithOptions is the same as ExplodeGearstack but decodes the gearstack with the
+// provided channel layout.
+func ExplodeGearstackWithOptions(path string, options GearstackOptions) (*PBRTextureCollection, error) {
 	inF, err := os.OpenFile(path, os.O_RDONLY, 0644)
 	if err != nil {
 		glg.Errorf("Failed to open the specified file: %s", err.Error())
@@ -516,7 +479,7 @@ func ExplodeGearstack(path string) (*PBRTextureCollection, error) {
 	}
 	glg.Debugf("Decoded image with fmt: %s", fmt)
 
-	pbr, err := ExplodePBRTexture(img)
+	pbr, err := ExplodePBRTextureWithOptions(img, options)
 	if err != nil {
 		glg.Errorf("Could not expand image into separate pbr textures: %s", err.Error())
 		return nil, err
@@ -527,20 +490,29 @@ func ExplodeGearstack(path string) (*PBRTextureCollection, error) {
 }
 
 // ExplodePBRTexture will separate the gearstack provided as an image.Image into the individual
-// PBR components (ambient occlusion, metalness, roughness).
+// PBR components (ambient occlusion, metalness, roughness, emissive) using the default layout.
 func ExplodePBRTexture(img image.Image) (*PBRTextureCollection, error) {
+	return ExplodePBRTextureWithOptions(img, DefaultGearstackOptions())
+}
+
+// ExplodePBRTextureWithOptions will separate the gearstack provided as an image.Image into the
+// individual PBR components, reading each one as described by the options.
+func ExplodePBRTextureWithOptions(img image.Image, options GearstackOptions) (*PBRTextureCollection, error) {
+
+	err := options.validate()
+	if err != nil {
+		return nil, err
+	}
+	aoChannel, _ := options.AOChannel.index()
+	smoothnessChannel, _ := options.SmoothnessChannel.index()
+	emissiveChannel, _ := options.EmissiveChannel.index()
+	metalnessChannel, _ := options.MetalnessChannel.index()
 
 	metalnessImg := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
 	roughnessImg := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
 	aoImg := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
 	emissiveImg := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
 
-	black := color.RGBA{0, 0, 0, 255}
-	draw.Draw(metalnessImg, metalnessImg.Bounds(), image.NewUniform(black), image.ZP, draw.Src)
-	draw.Draw(roughnessImg, roughnessImg.Bounds(), image.NewUniform(black), image.ZP, draw.Src)
-	draw.Draw(aoImg, aoImg.Bounds(), image.NewUniform(black), image.ZP, draw.Src)
-	draw.Draw(emissiveImg, emissiveImg.Bounds(), image.NewUniform(black), image.ZP, draw.Src)
-
 	result := &PBRTextureCollection{
 		Metalness:        metalnessImg,
 		Roughness:        roughnessImg,
@@ -552,42 +524,17 @@ func ExplodePBRTexture(img image.Image) (*PBRTextureCollection, error) {
 	width := img.Bounds().Dx()
 	height := img.Bounds().Dy()
 
-	for x := origin.X; x < (origin.X + width); x++ {
-		for y := origin.Y; y < (origin.Y + height); y++ {
-			ao, smoothness, b, a := img.At(x, y).RGBA()
-
-			// Ambient occlusion
-			// I have no clue about this but i think it needs to be inverted to mostly white
-			// (that is what the examples show at least)
-			finalAO := uint8(ao)
-			if invertAO {
-				finalAO = 255 - uint8(ao)
-			}
-			setPixel(result.AmbientOcclusion, finalAO, x, y)
-
-			// Metalness
-			// from the slides "In the alpha channel we give metalness 32 values", i take this
-			// to mean that metalness is contained in values 0-31 or the lower 5 bits.
-			normalized := float64(a&0xFF) / float64(0xFF)
-			masked := uint8((normalized * 0xFF)) & 0x1F
-			metalness := uint8((float64(masked) / 32.0) * 255.0)
-			if invertMetalness {
-				metalness = 255 - metalness
-			}
-			setPixel(result.Metalness, metalness, x, y)
-
-			normalizedEmissive := float64(uint8(b)-40) / (255.0 - 40.0)
-			emissive := uint8(255.0 * normalizedEmissive)
-			setPixel(result.Emissive, emissive, x, y)
-
-			// Roughness
-			originalSmoothness := uint8(smoothness & 0x00FF)
-			if invertSmoothness {
-				originalSmoothness = 255 - originalSmoothness
-			}
-			setPixel(result.Roughness, originalSmoothness, x, y)
-
-			//glg.Debugf("ao=0x%x, smoothness=0x%x, maskedMetalness=0x%x, metalness=0x%x", ao, smoothness, masked, metalness)
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			// The alpha channel holds data rather than transparency, so the color channels need
+			// to be read without being premultiplied by it.
+			c := color.NRGBAModel.Convert(img.At(origin.X+x, origin.Y+y)).(color.NRGBA)
+			channels := [4]uint8{c.R, c.G, c.B, c.A}
+
+			setPixel(result.AmbientOcclusion, options.decodeAO(channels[aoChannel]), x, y)
+			setPixel(result.Metalness, options.decodeMetalness(channels[metalnessChannel]), x, y)
+			setPixel(result.Emissive, options.decodeEmissive(channels[emissiveChannel]), x, y)
+			setPixel(result.Roughness, options.decodeRoughness(channels[smoothnessChannel]), x, y)
 		}
 	}
 
@@ -599,14 +546,35 @@ func setPixel(img draw.Image, val uint8, x, y int) {
 	img.Set(x, y, color.RGBA{val, val, val, 255})
 }
 
-func writeTextures(processed *processedOutput, pathPrefix string) error {
+func writeTextures(processed *processedOutput, sink TextureSink, options TextureOptions) error {
+
+	total := 0
+	for i := range processed.texturePlates {
+		for _, plate := range []*texturePlate{processed.texturePlates[i], processed.normalTexturePlates[i], processed.gearstackTexturePlates[i]} {
+			if plate != nil {
+				total++
+			}
+		}
+	}
+	done := 0
+	plateWritten := func(plate *texturePlate, err error) {
+		if err != nil {
+			processed.warn("Failed to write texture %s: %s", plate.name, err.Error())
+		}
+		done++
+		processed.progress("textures", done, total)
+	}
 
 	for _, plate := range processed.texturePlates {
-		writeTexturePlate(plate, pathPrefix)
+		if plate != nil {
+			plateWritten(plate, writeTexturePlate(plate, sink, options, true, false))
+		}
 	}
 
 	for _, plate := range processed.normalTexturePlates {
-		writeTexturePlate(plate, pathPrefix)
+		if plate != nil {
+			plateWritten(plate, writeTexturePlate(plate, sink, options, false, true))
+		}
 	}
 
 	for i, plate := range processed.gearstackTexturePlates {
@@ -615,81 +583,106 @@ func writeTextures(processed *processedOutput, pathPrefix string) error {
 		}
 
 		// writeTexturePlate(plate)
-		pbr, err := ExplodePBRTexture(plate.data)
+		gearstackOptions := DefaultGearstackOptions()
+		if options.Gearstack != nil {
+			gearstackOptions = *options.Gearstack
+		}
+		pbr, err := ExplodePBRTextureWithOptions(plate.data, gearstackOptions)
 		if err != nil {
-			glg.Errorf("Error trying to expand gearstack texture: %s", err.Error())
+			processed.warn("Failed to expand gearstack texture %s, writing it without PBR textures: %s", plate.name, err.Error())
+			plateWritten(plate, nil)
 			continue
 		}
 
 		glg.Infof("Setting pbr texture of index: %d", i)
 		processed.pbrTextures[i] = pbr
 
-		aoName := strings.Replace(plate.name, "gearstack", "AO", -1)
-		metalnessName := strings.Replace(plate.name, "gearstack", "metalness", -1)
-		roughnessName := strings.Replace(plate.name, "gearstack", "roughness", -1)
-		emissiveName := strings.Replace(plate.name, "gearstack", "emissive", -1)
+		names := plate.pbrTextureNames(options)
+		ao := prepareTexture(pbr.AmbientOcclusion, options)
+		metalness := prepareTexture(pbr.Metalness, options)
+		roughness := prepareTexture(pbr.Roughness, options)
+		emissive := prepareTexture(pbr.Emissive, options)
+		if options.Grayscale {
+			ao, metalness, roughness, emissive = toGray(ao), toGray(metalness), toGray(roughness), toGray(emissive)
+		}
+
+		if options.PackORM {
+			err = writeTexture(PackORM(ao, roughness, metalness), sink, names.ao, options, false, false)
+		} else {
+			err = firstError(
+				writeTexture(ao, sink, names.ao, options, false, false),
+				writeTexture(metalness, sink, names.metalness, options, false, false),
+				writeTexture(roughness, sink, names.roughness, options, false, false))
+		}
+		plateWritten(plate, firstError(err, writeTexture(emissive, sink, names.emissive, options, true, false)))
+	}
 
-		writeTextureFile(pbr.AmbientOcclusion, pathPrefix, aoName)
-		writeTextureFile(pbr.Metalness, pathPrefix, metalnessName)
-		writeTextureFile(pbr.Roughness, pathPrefix, roughnessName)
-		writeTextureFile(pbr.Emissive, pathPrefix, emissiveName)
+	return nil
+}
+
+// firstError returns the first of the errors that isn't nil.
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func writeTexturePlate(plate *texturePlate, pathPrefix string) error {
+func writeTexturePlate(plate *texturePlate, sink TextureSink, options TextureOptions, srgb, normalMap bool) error {
 	if plate == nil {
 		return nil
 	}
 
-	return writeTextureFile(plate.data, pathPrefix, plate.name)
+	return writeTexture(prepareTexture(plate.data, options), sink, options.fileName(plate.name), options, srgb, normalMap)
 }
 
-func writeTextureFile(img draw.Image, pathPrefix, name string) error {
+// writeTexture writes the image to the sink in the texture format from the options. srgb should
+// be set for color textures and normalMap for normal maps so compressed textures are encoded
+// correctly.
+func writeTexture(img image.Image, sink TextureSink, name string, options TextureOptions, srgb, normalMap bool) error {
 
-	// Write this to a file now
-	filePath := pathPrefix + "/" + name
-	format := "jpeg"
-	if strings.HasSuffix(name, "png") {
-		format = "png"
-	}
-	glg.Infof("Writing texture file, with format=%s, to: %s", format, filePath)
-	outF, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE, 0644)
+	outF, err := sink.Create(name)
 	if err != nil {
 		glg.Error(err)
 		return err
 	}
+	defer outF.Close()
 
-	flipped := flipVertically(img)
-
-	if format == "png" {
-		err = png.Encode(outF, flipped)
-	} else {
-		err = jpeg.Encode(outF, flipped, nil)
+	switch options.Format {
+	case TextureFormatKTX2:
+		glg.Infof("Writing KTX2 texture file: %s", name)
+		err = EncodeKTX2(outF, img, srgb)
+	case TextureFormatBasis:
+		glg.Infof("Writing Basis texture file: %s", name)
+		err = encodeBasis(outF, img, srgb, normalMap)
+	default:
+		err = encodeTextureFile(outF, img, name)
 	}
 	if err != nil {
 		glg.Error(err)
 		return err
 	}
-	outF.Close()
 
-	return nil
+	return outF.Close()
 }
 
-func flipVertically(img image.Image) image.Image {
-	dst := image.NewRGBA(img.Bounds())
+// encodeTextureFile writes the image as a PNG or JPEG depending on the extension of name.
+func encodeTextureFile(w io.Writer, img image.Image, name string) error {
 
-	origin := img.Bounds().Min
-	width := img.Bounds().Dx()
-	height := img.Bounds().Dy()
+	format := "jpeg"
+	if strings.HasSuffix(name, "png") {
+		format = "png"
+	}
+	glg.Infof("Writing texture file, with format=%s: %s", format, name)
 
-	for x := origin.X; x < (origin.X + width); x++ {
-		for y := origin.Y; y < (origin.Y + height); y++ {
-			newY := height - y
-			dst.Set(x, newY, img.At(x, y))
-		}
+	// Textures are written exactly as they are stored by Bungie, the texture coordinates are
+	// converted to the origin of the output format instead (see convertCoordinateSystem).
+	if format == "png" {
+		return png.Encode(w, img)
 	}
 
-	return dst
+	return jpeg.Encode(w, img, nil)
 }
@@ -0,0 +1,69 @@
+package graphics
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestProcessTexturePlate(t *testing.T) {
+
+	// The textures are read from the directory set on the writer, not from ./output
+	dir := filepath.Join(t.TempDir(), "textures")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("Failed to create the texture directory: %s", err.Error())
+	}
+
+	red := color.RGBA{255, 0, 0, 255}
+	texture := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	for i := 0; i < len(texture.Pix); i += 4 {
+		copy(texture.Pix[i:], []uint8{red.R, red.G, red.B, red.A})
+	}
+	f, err := os.Create(filepath.Join(dir, "1234_tex.png"))
+	if err != nil {
+		t.Fatalf("Failed to create the texture: %s", err.Error())
+	}
+	if err := png.Encode(f, texture); err != nil {
+		t.Fatalf("Failed to write the texture: %s", err.Error())
+	}
+	f.Close()
+
+	plateJSON := gjson.Parse(`{"plate_set": {"diffuse": {
+		"plate_index": 1,
+		"plate_size": [4, 4],
+		"texture_placements": [{
+			"texture_tag_name": "1234_tex",
+			"texture_size_x": 2, "texture_size_y": 2,
+			"position_x": 2, "position_y": 0
+		}]
+	}}}`).Map()
+
+	output := &processedOutput{textureDir: dir}
+	if err := processTexturePlate("diffuse", plateJSON, output); err != nil {
+		t.Fatalf("Failed to build the plate: %s", err.Error())
+	}
+
+	plate := output.texturePlates[1]
+	if plate == nil {
+		t.Fatalf("Expected a diffuse plate at index 1")
+	}
+	if plate.name != "1234_tex_diffuse.png" || plate.size != [2]int{4, 4} {
+		t.Errorf("Wrong plate: name=%s, size=%v", plate.name, plate.size)
+	}
+	for _, test := range []struct {
+		x, y     int
+		expected color.RGBA
+	}{
+		{3, 1, red},
+		{0, 0, color.RGBA{0, 0, 0, 255}},
+	} {
+		if c := color.RGBAModel.Convert(plate.data.At(test.x, test.y)); c != test.expected {
+			t.Errorf("Wrong color at %d,%d: Expected=%v, Actual=%v", test.x, test.y, test.expected, c)
+		}
+	}
+}
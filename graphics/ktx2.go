@@ -0,0 +1,273 @@
+package graphics
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// TextureFormat is the file format the textures of a model are written in.
+type TextureFormat string
+
+const (
+	// TextureFormatSource writes textures as PNG or JPEG, matching the source plates.
+	TextureFormatSource TextureFormat = ""
+	// TextureFormatKTX2 writes uncompressed KTX2 textures with a full mip chain.
+	TextureFormatKTX2 TextureFormat = "ktx2"
+	// TextureFormatBasis writes KTX2 textures supercompressed with Basis Universal. This requires
+	// the basisu command line tool.
+	TextureFormatBasis TextureFormat = "basis"
+)
+
+// ParseTextureFormat converts a texture format name (png, ktx2 or basis) to a TextureFormat.
+func ParseTextureFormat(name string) (TextureFormat, error) {
+	switch name {
+	case "", "png", "jpeg", "source":
+		return TextureFormatSource, nil
+	case "ktx2":
+		return TextureFormatKTX2, nil
+	case "basis":
+		return TextureFormatBasis, nil
+	}
+
+	return TextureFormatSource, fmt.Errorf("Unknown texture format: %s", name)
+}
+
+// CheckModelFormat returns an error if models in the given format (file extension) can't use
+// textures in this format. Collada viewers and USDZ packages only read PNG and JPEG textures,
+// KTX2 textures can only be referenced from USDA and USDC files.
+func (format TextureFormat) CheckModelFormat(model string) error {
+	if format != TextureFormatSource && (model == "dae" || model == "usdz") {
+		return fmt.Errorf("%s textures can't be used in %s models", format, model)
+	}
+
+	return nil
+}
+
+// Vulkan formats used for the texel data, from the vkFormat enum.
+const (
+	vkFormatR8Unorm       = 9
+	vkFormatR8SRGB        = 15
+	vkFormatR8G8B8A8Unorm = 37
+	vkFormatR8G8B8A8SRGB  = 43
+)
+
+// Values from the Khronos Data Format Specification used in the data format descriptor.
+const (
+	khrDFVersion          = 2
+	khrDFModelRGBSDA      = 1
+	khrDFPrimariesBT709   = 1
+	khrDFTransferLinear   = 1
+	khrDFTransferSRGB     = 2
+	khrDFChannelAlpha     = 15
+	khrDFSampleLinearFlag = 0x10
+)
+
+var ktx2Identifier = []byte{0xAB, 0x4B, 0x54, 0x58, 0x20, 0x32, 0x30, 0xBB, 0x0D, 0x0A, 0x1A, 0x0A}
+
+// EncodeKTX2 writes img to w as an uncompressed KTX2 texture including a full mip chain.
+// Grayscale images are stored with a single 8 bit channel and everything else as 8 bit RGBA.
+// Color textures (diffuse, emissive) should be stored as sRGB, data textures (normal maps,
+// ambient occlusion, metalness and roughness) should not.
+func EncodeKTX2(w io.Writer, img image.Image, srgb bool) error {
+
+	_, gray := img.(*image.Gray)
+	channels := 4
+	vkFormat := vkFormatR8G8B8A8Unorm
+	if gray && srgb {
+		channels, vkFormat = 1, vkFormatR8SRGB
+	} else if gray {
+		channels, vkFormat = 1, vkFormatR8Unorm
+	} else if srgb {
+		vkFormat = vkFormatR8G8B8A8SRGB
+	}
+
+	levels := mipmaps(img)
+	dfd := ktx2DataFormatDescriptor(channels, srgb)
+	kvd := ktx2KeyValueData([][2]string{{"KTXwriter", "destiny-gear-vendor"}})
+
+	// File layout: header, level index, DFD, KVD then the mip levels from smallest to largest
+	const headerLength = 80
+	levelIndexLength := 24 * len(levels)
+	dfdOffset := headerLength + levelIndexLength
+	kvdOffset := dfdOffset + len(dfd)
+	dataOffset := align(kvdOffset+len(kvd), 4)
+
+	levelData := make([][]byte, len(levels))
+	levelOffsets := make([]int, len(levels))
+	offset := dataOffset
+	for i := len(levels) - 1; i >= 0; i-- {
+		levelData[i] = texelData(levels[i], gray)
+		levelOffsets[i] = offset
+		offset = align(offset+len(levelData[i]), 4)
+	}
+
+	buf := bufio.NewWriter(w)
+	buf.Write(ktx2Identifier)
+	writeUint32s(buf,
+		uint32(vkFormat),
+		1, // typeSize
+		uint32(img.Bounds().Dx()),
+		uint32(img.Bounds().Dy()),
+		0, // pixelDepth
+		0, // layerCount
+		1, // faceCount
+		uint32(len(levels)),
+		0, // supercompressionScheme
+		uint32(dfdOffset), uint32(len(dfd)),
+		uint32(kvdOffset), uint32(len(kvd)),
+	)
+	// No supercompression global data
+	binary.Write(buf, binary.LittleEndian, [2]uint64{0, 0})
+
+	for i := range levels {
+		length := uint64(len(levelData[i]))
+		binary.Write(buf, binary.LittleEndian, [3]uint64{uint64(levelOffsets[i]), length, length})
+	}
+
+	buf.Write(dfd)
+	buf.Write(kvd)
+
+	written := kvdOffset + len(kvd)
+	for i := len(levels) - 1; i >= 0; i-- {
+		buf.Write(make([]byte, levelOffsets[i]-written))
+		buf.Write(levelData[i])
+		written = levelOffsets[i] + len(levelData[i])
+	}
+
+	return buf.Flush()
+}
+
+// ktx2DataFormatDescriptor builds a basic data format descriptor for 8 bit per channel R or
+// RGBA texel data.
+func ktx2DataFormatDescriptor(channels int, srgb bool) []byte {
+
+	blockSize := 24 + 16*channels
+	dfd := &bytes.Buffer{}
+
+	transfer := uint8(khrDFTransferLinear)
+	if srgb {
+		transfer = khrDFTransferSRGB
+	}
+
+	writeUint32s(dfd, uint32(4+blockSize), 0)
+	binary.Write(dfd, binary.LittleEndian, [2]uint16{khrDFVersion, uint16(blockSize)})
+	dfd.Write([]byte{
+		khrDFModelRGBSDA, khrDFPrimariesBT709, transfer, 0, // flags: straight alpha
+		0, 0, 0, 0, // texel block is 1x1x1
+		uint8(channels), 0, 0, 0, 0, 0, 0, 0, // bytes per plane
+	})
+
+	for c := 0; c < channels; c++ {
+		channelType := uint8(c)
+		if c == 3 {
+			channelType = khrDFChannelAlpha
+			if srgb {
+				// Alpha is never sRGB encoded
+				channelType |= khrDFSampleLinearFlag
+			}
+		}
+
+		binary.Write(dfd, binary.LittleEndian, uint16(c*8))
+		dfd.Write([]byte{7, channelType, 0, 0, 0, 0})
+		writeUint32s(dfd, 0, 255)
+	}
+
+	return dfd.Bytes()
+}
+
+// ktx2KeyValueData encodes the key/value pairs stored in the file. The pairs need to be sorted
+// by key.
+func ktx2KeyValueData(values [][2]string) []byte {
+
+	kvd := &bytes.Buffer{}
+	for _, pair := range values {
+		entry := append(append([]byte(pair[0]), 0), append([]byte(pair[1]), 0)...)
+		writeUint32s(kvd, uint32(len(entry)))
+		kvd.Write(entry)
+		kvd.Write(make([]byte, align(len(entry), 4)-len(entry)))
+	}
+
+	return kvd.Bytes()
+}
+
+// texelData returns the pixels of img as tightly packed 8 bit R or RGBA rows.
+func texelData(img image.Image, gray bool) []byte {
+
+	b := img.Bounds()
+	if gray {
+		g := toGray(img)
+		data := make([]byte, 0, b.Dx()*b.Dy())
+		for y := 0; y < b.Dy(); y++ {
+			data = append(data, g.Pix[y*g.Stride:y*g.Stride+b.Dx()]...)
+		}
+		return data
+	}
+
+	rgba := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, b.Min, draw.Src)
+
+	return rgba.Pix
+}
+
+// encodeBasis writes img to w as a Basis Universal supercompressed KTX2 texture with the
+// basisu command line tool.
+func encodeBasis(w io.Writer, img image.Image, srgb, normalMap bool) error {
+
+	// basisu only works with files
+	dir, err := ioutil.TempDir("", "basis")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "input.png")
+	output := filepath.Join(dir, "output.ktx2")
+	inF, err := os.Create(input)
+	if err != nil {
+		return err
+	}
+	err = png.Encode(inF, img)
+	inF.Close()
+	if err != nil {
+		return err
+	}
+
+	args := []string{"-ktx2", "-mipmap", "-file", input, "-output_file", output}
+	if normalMap {
+		args = append(args, "-normal_map")
+	} else if !srgb {
+		args = append(args, "-linear")
+	}
+
+	result, err := exec.Command("basisu", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("basisu failed: %s: %s", err.Error(), string(result))
+	}
+
+	outF, err := os.Open(output)
+	if err != nil {
+		return err
+	}
+	defer outF.Close()
+
+	_, err = io.Copy(w, outF)
+	return err
+}
+
+func writeUint32s(w io.Writer, values ...uint32) {
+	binary.Write(w, binary.LittleEndian, values)
+}
+
+func align(offset, alignment int) int {
+	return (offset + alignment - 1) / alignment * alignment
+}
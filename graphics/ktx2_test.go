@@ -0,0 +1,171 @@
+package graphics
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// ktx2Header is the fixed size part of a KTX2 file after the identifier.
+type ktx2Header struct {
+	VkFormat               uint32
+	TypeSize               uint32
+	PixelWidth             uint32
+	PixelHeight            uint32
+	PixelDepth             uint32
+	LayerCount             uint32
+	FaceCount              uint32
+	LevelCount             uint32
+	SupercompressionScheme uint32
+	DFDOffset, DFDLength   uint32
+	KVDOffset, KVDLength   uint32
+	SGDOffset, SGDLength   uint64
+}
+
+type ktx2Level struct {
+	Offset, Length, UncompressedLength uint64
+}
+
+func readKTX2(t *testing.T, data []byte) (ktx2Header, []ktx2Level) {
+	t.Helper()
+
+	if !bytes.HasPrefix(data, ktx2Identifier) {
+		t.Fatalf("Missing the KTX2 identifier")
+	}
+
+	r := bytes.NewReader(data[len(ktx2Identifier):])
+	header := ktx2Header{}
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		t.Fatalf("Failed to read the header: %s", err.Error())
+	}
+	levels := make([]ktx2Level, header.LevelCount)
+	if err := binary.Read(r, binary.LittleEndian, levels); err != nil {
+		t.Fatalf("Failed to read the level index: %s", err.Error())
+	}
+
+	return header, levels
+}
+
+func TestEncodeKTX2(t *testing.T) {
+
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 2))
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 4; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 60), uint8(y * 200), 30, 255})
+		}
+	}
+
+	out := &bytes.Buffer{}
+	if err := EncodeKTX2(out, img, true); err != nil {
+		t.Fatalf("Failed to encode: %s", err.Error())
+	}
+	data := out.Bytes()
+
+	header, levels := readKTX2(t, data)
+	expected := ktx2Header{
+		VkFormat:    vkFormatR8G8B8A8SRGB,
+		TypeSize:    1,
+		PixelWidth:  4,
+		PixelHeight: 2,
+		FaceCount:   1,
+		LevelCount:  3,
+		DFDOffset:   80 + 3*24,
+		DFDLength:   4 + 24 + 16*4,
+	}
+	expected.KVDOffset = expected.DFDOffset + expected.DFDLength
+	expected.KVDLength = header.KVDLength
+	if header != expected {
+		t.Errorf("Wrong header:\nExpected=%+v\nActual=%+v", expected, header)
+	}
+
+	// The data format descriptor describes 4 sRGB channels, with a linear alpha
+	dfd := data[header.DFDOffset : header.DFDOffset+header.DFDLength]
+	if total := binary.LittleEndian.Uint32(dfd); total != header.DFDLength {
+		t.Errorf("Wrong DFD size: %d", total)
+	}
+	if dfd[14] != khrDFTransferSRGB || dfd[20] != 4 {
+		t.Errorf("Wrong DFD transfer function %d or bytes per plane %d", dfd[14], dfd[20])
+	}
+	if alpha := dfd[28+3*16+3]; alpha != khrDFChannelAlpha|khrDFSampleLinearFlag {
+		t.Errorf("Expected a linear alpha channel, got %x", alpha)
+	}
+
+	// The key/value data holds the writer
+	kvd := data[header.KVDOffset : header.KVDOffset+header.KVDLength]
+	if !bytes.Contains(kvd, []byte("KTXwriter\x00destiny-gear-vendor\x00")) {
+		t.Errorf("Missing the writer in the key/value data: %q", kvd)
+	}
+
+	// Levels are stored smallest first, each aligned and sized for its dimensions
+	sizes := [][2]int{{4, 2}, {2, 1}, {1, 1}}
+	end := uint64(len(data))
+	for i, level := range levels {
+		if level.Length != uint64(sizes[i][0]*sizes[i][1]*4) || level.UncompressedLength != level.Length {
+			t.Errorf("Wrong length for level %d: %+v", i, level)
+		}
+		if level.Offset%4 != 0 || level.Offset < uint64(header.KVDOffset+header.KVDLength) {
+			t.Errorf("Wrong offset for level %d: %d", i, level.Offset)
+		}
+		if i > 0 && level.Offset >= levels[i-1].Offset {
+			t.Errorf("Expected level %d to be stored before level %d", i, i-1)
+		}
+		if level.Offset+level.Length > end {
+			t.Errorf("Level %d runs past the end of the file", i)
+		}
+	}
+	if levels[0].Offset+levels[0].Length != end {
+		t.Errorf("Expected the full size level to be stored last")
+	}
+
+	base := data[levels[0].Offset : levels[0].Offset+levels[0].Length]
+	if !bytes.Equal(base, img.Pix) {
+		t.Errorf("Wrong texels in the first level:\nExpected=%v\nActual=%v", img.Pix, base)
+	}
+}
+
+func TestEncodeKTX2Gray(t *testing.T) {
+
+	img := image.NewGray(image.Rect(0, 0, 3, 3))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 20)
+	}
+
+	out := &bytes.Buffer{}
+	if err := EncodeKTX2(out, img, false); err != nil {
+		t.Fatalf("Failed to encode: %s", err.Error())
+	}
+	data := out.Bytes()
+
+	header, levels := readKTX2(t, data)
+	if header.VkFormat != vkFormatR8Unorm || header.LevelCount != 2 || header.DFDLength != 4+24+16 {
+		t.Errorf("Wrong header for a grayscale texture: %+v", header)
+	}
+	if dfd := data[header.DFDOffset:]; dfd[14] != khrDFTransferLinear || dfd[20] != 1 {
+		t.Errorf("Wrong DFD transfer function %d or bytes per plane %d", dfd[14], dfd[20])
+	}
+	if base := data[levels[0].Offset : levels[0].Offset+levels[0].Length]; !bytes.Equal(base, img.Pix) {
+		t.Errorf("Wrong texels in the first level: %v", base)
+	}
+	if levels[1].Length != 1 {
+		t.Errorf("Expected a 1x1 last level, got %d bytes", levels[1].Length)
+	}
+}
+
+func TestCheckModelFormat(t *testing.T) {
+
+	for _, model := range []string{"dae", "usdz", "usda", "usdc", "stl"} {
+		if err := TextureFormatSource.CheckModelFormat(model); err != nil {
+			t.Errorf("Expected source textures to work with %s: %s", model, err.Error())
+		}
+	}
+
+	for _, format := range []TextureFormat{TextureFormatKTX2, TextureFormatBasis} {
+		for model, allowed := range map[string]bool{"dae": false, "usdz": false, "usda": true, "usdc": true} {
+			if err := format.CheckModelFormat(model); (err == nil) != allowed {
+				t.Errorf("Wrong result for %s textures in %s models: %v", format, model, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package graphics
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ModelMetadata describes a written model so clients can place it without parsing the model
+// file itself. It is written as a JSON sidecar next to the model when requested.
+type ModelMetadata struct {
+	Format    string      `json:"format"`
+	UpAxis    Axis        `json:"upAxis"`
+	Pivot     Pivot       `json:"pivot,omitempty"`
+	Triangles int         `json:"triangles"`
+	Bounds    BoundingBox `json:"bounds"`
+}
+
+// metadataPath is the location of the JSON sidecar for the model at the given path.
+func metadataPath(modelPath string) string {
+	return strings.TrimSuffix(modelPath, filepath.Ext(modelPath)) + ".json"
+}
+
+func newModelMetadata(format string, processed *processedOutput, frame CoordinateSystem, pivot Pivot, bounds BoundingBox) *ModelMetadata {
+	triangles := 0
+	for _, positions := range processed.positionVertices {
+		triangles += len(positions) / 9
+	}
+
+	return &ModelMetadata{
+		Format:    format,
+		UpAxis:    frame.UpAxis,
+		Pivot:     pivot,
+		Triangles: triangles,
+		Bounds:    bounds.orZero(),
+	}
+}
+
+// writeModelMetadata writes the metadata as JSON next to the model at modelPath.
+func writeModelMetadata(modelPath string, metadata *ModelMetadata) error {
+
+	outF, err := os.OpenFile(metadataPath(modelPath), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer outF.Close()
+
+	encoder := json.NewEncoder(outF)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(metadata)
+}
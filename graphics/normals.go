@@ -0,0 +1,108 @@
+package graphics
+
+import (
+	"math"
+)
+
+// processNormals cleans up the decoded vertex normals of every mesh. The short4 normals are
+// stored unnormalized so they are scaled to unit length, their direction is kept as decoded even
+// where it disagrees with the winding of the triangle. Triangles reversed while unrolling strips
+// need no flipping either: triangulate keeps the winding of each strip exactly and every corner
+// carries the normal of its own vertex. If smoothingAngle is set the normals are
+// recomputed from the faces instead, smoothing across edges where the faces meet at less than
+// smoothingAngle degrees and keeping the edges above it hard.
+func processNormals(processed *processedOutput, smoothingAngle float64) {
+
+	for i, positions := range processed.positionVertices {
+		if i >= len(processed.normalValues) || len(processed.normalValues[i]) != len(positions) {
+			// STL output doesn't carry any normals
+			continue
+		}
+
+		normals := processed.normalValues[i]
+		if smoothingAngle > 0 {
+			smoothNormals(positions, normals, smoothingAngle)
+		} else {
+			normalizeNormals(positions, normals)
+		}
+	}
+}
+
+// normalizeNormals scales every normal to unit length. Zero length normals are replaced with the
+// normal of the face they belong to.
+func normalizeNormals(positions, normals []float64) {
+
+	for i := 0; i+8 < len(normals); i += 9 {
+		for k := 0; k < 3; k++ {
+			n := [3]float64{normals[i+k*3], normals[i+k*3+1], normals[i+k*3+2]}
+			length := vectorLength(n)
+			if length == 0 {
+				n = triangleFaceNormal(positions, i)
+				length = vectorLength(n)
+			}
+			if length == 0 {
+				continue
+			}
+
+			normals[i+k*3] = n[0] / length
+			normals[i+k*3+1] = n[1] / length
+			normals[i+k*3+2] = n[2] / length
+		}
+	}
+}
+
+// smoothNormals recomputes the normals from the faces. Each corner is given the area weighted
+// average of the faces sharing its position that are within angle degrees of its own face.
+func smoothNormals(positions, normals []float64, angle float64) {
+
+	triangleCount := len(positions) / 9
+	faceNormals := make([][3]float64, triangleCount)
+	corners := make(map[[3]float64][]int)
+	for t := 0; t < triangleCount; t++ {
+		// Left unnormalized so larger faces have more weight
+		faceNormals[t] = triangleFaceNormal(positions, t*9)
+		for k := 0; k < 3; k++ {
+			p := [3]float64{positions[t*9+k*3], positions[t*9+k*3+1], positions[t*9+k*3+2]}
+			corners[p] = append(corners[p], t)
+		}
+	}
+
+	minCos := math.Cos(angle * math.Pi / 180.0)
+	for t := 0; t < triangleCount; t++ {
+		own := faceNormals[t]
+		ownLength := vectorLength(own)
+
+		for k := 0; k < 3; k++ {
+			p := [3]float64{positions[t*9+k*3], positions[t*9+k*3+1], positions[t*9+k*3+2]}
+
+			sum := [3]float64{}
+			for _, other := range corners[p] {
+				n := faceNormals[other]
+				length := vectorLength(n)
+				if other != t && (ownLength == 0 || length == 0 || dot(own, n)/(ownLength*length) < minCos) {
+					continue
+				}
+
+				sum = [3]float64{sum[0] + n[0], sum[1] + n[1], sum[2] + n[2]}
+			}
+
+			if length := vectorLength(sum); length > 0 {
+				sum = [3]float64{sum[0] / length, sum[1] / length, sum[2] / length}
+			}
+
+			normals[t*9+k*3] = sum[0]
+			normals[t*9+k*3+1] = sum[1]
+			normals[t*9+k*3+2] = sum[2]
+		}
+	}
+}
+
+// triangleFaceNormal is the unnormalized normal of the triangle starting at offset in a flat
+// list of xyz positions.
+func triangleFaceNormal(positions []float64, offset int) [3]float64 {
+	return faceNormal(
+		[3]float64{positions[offset], positions[offset+1], positions[offset+2]},
+		[3]float64{positions[offset+3], positions[offset+4], positions[offset+5]},
+		[3]float64{positions[offset+6], positions[offset+7], positions[offset+8]},
+	)
+}
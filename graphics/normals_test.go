@@ -0,0 +1,119 @@
+package graphics
+
+import (
+	"math"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func assertNormal(t *testing.T, name string, normals []float64, offset int, expected [3]float64) {
+	t.Helper()
+	for k := 0; k < 3; k++ {
+		if math.Abs(normals[offset+k]-expected[k]) > 1e-9 {
+			t.Errorf("%s: Wrong normal: Expected=%v, Actual=%v", name, expected, normals[offset:offset+3])
+			return
+		}
+	}
+}
+
+func TestProcessNormals(t *testing.T) {
+
+	// A triangle facing +z, with a normal that is too long, one that is missing and one that
+	// points away from the winding
+	positions := []float64{0, 0, 0, 1, 0, 0, 0, 1, 0}
+	normals := []float64{0, 0, 4, 0, 0, 0, 0, 0, -2}
+	processed := &processedOutput{
+		positionVertices: [][]float64{positions},
+		normalValues:     [][]float64{normals},
+	}
+
+	processNormals(processed, 0)
+
+	assertNormal(t, "unnormalized", normals, 0, [3]float64{0, 0, 1})
+	assertNormal(t, "missing", normals, 3, [3]float64{0, 0, 1})
+	// The decoded direction is kept, the winding may be the part that is wrong
+	assertNormal(t, "opposite the winding", normals, 6, [3]float64{0, 0, -1})
+}
+
+// TestProcessNormalsStripParts checks the normals of the triangles reversed while unrolling a
+// strip still agree with their faces, without being flipped.
+func TestProcessNormalsStripParts(t *testing.T) {
+
+	// The zig-zag strip from TestTriangulateStripOrientation, every face points down and so does
+	// every decoded normal
+	positionsVb := make([][]float64, 0, 10)
+	normalsVb := make([][]float64, 0, 10)
+	texcoordsVb := make([][]float32, 0, 10)
+	indices := make([]uint16, 0, 12)
+	for i := 0; i < 5; i++ {
+		positionsVb = append(positionsVb, []float64{float64(i), 0, 0}, []float64{float64(i), 1, 0})
+		normalsVb = append(normalsVb, []float64{0, 0, -3}, []float64{0, 0, -3})
+		texcoordsVb = append(texcoordsVb, []float32{0, 0}, []float32{0, 0})
+		indices = append(indices, uint16(i*2), uint16(i*2+1))
+	}
+	indices = append(indices[:6], append([]uint16{indices[5], indices[5]}, indices[6:]...)...)
+
+	part := gjson.Parse(`{"start_index": 0, "index_count": 12, "primitive_type": 5}`).Map()
+	processed := &processedOutput{}
+	err := processPart(part, 0, indices, positionsVb, normalsVb, texcoordsVb, nil, [2]float64{}, [2]float64{1, 1}, processed)
+	if err != nil {
+		t.Fatalf("Failed to process the part: %s", err.Error())
+	}
+
+	processNormals(processed, 0)
+
+	positions, normals := processed.positionVertices[0], processed.normalValues[0]
+	if len(positions) != 7*9 {
+		t.Fatalf("Wrong triangle count: Expected=7, Actual=%d", len(positions)/9)
+	}
+	for i := 0; i < len(positions); i += 9 {
+		face := triangleFaceNormal(positions, i)
+		for k := 0; k < 3; k++ {
+			assertNormal(t, "strip corner", normals, i+k*3, [3]float64{0, 0, -1})
+			if dot(face, [3]float64{normals[i+k*3], normals[i+k*3+1], normals[i+k*3+2]}) <= 0 {
+				t.Errorf("Normal of triangle %d points away from its face %v", i/9, face)
+			}
+		}
+	}
+}
+
+func TestProcessNormalsSkipsMeshesWithoutNormals(t *testing.T) {
+
+	processed := &processedOutput{
+		positionVertices: [][]float64{{0, 0, 0, 1, 0, 0, 0, 1, 0}},
+		normalValues:     [][]float64{{}},
+	}
+
+	processNormals(processed, 30)
+	if len(processed.normalValues[0]) != 0 {
+		t.Errorf("Expected no normals to be added")
+	}
+}
+
+func TestSmoothNormals(t *testing.T) {
+
+	// Two triangles sharing the edge along the x axis, one flat on the ground facing +z and one
+	// folded up by 90 degrees facing +y
+	positions := []float64{
+		0, 0, 0, 1, 0, 0, 0, 1, 0,
+		1, 0, 0, 0, 0, 0, 0, 0, 1,
+	}
+
+	hard := make([]float64, len(positions))
+	smoothNormals(positions, hard, 45)
+	assertNormal(t, "hard edge ground", hard, 0, [3]float64{0, 0, 1})
+	assertNormal(t, "hard edge ground", hard, 3, [3]float64{0, 0, 1})
+	assertNormal(t, "hard edge wall", hard, 9, [3]float64{0, 1, 0})
+	assertNormal(t, "hard edge wall", hard, 12, [3]float64{0, 1, 0})
+
+	smooth := make([]float64, len(positions))
+	smoothNormals(positions, smooth, 120)
+	diagonal := [3]float64{0, math.Sqrt2 / 2, math.Sqrt2 / 2}
+	// The shared corners average both faces, the others only see their own face
+	assertNormal(t, "smooth shared corner", smooth, 0, diagonal)
+	assertNormal(t, "smooth shared corner", smooth, 3, diagonal)
+	assertNormal(t, "smooth shared corner", smooth, 9, diagonal)
+	assertNormal(t, "smooth ground corner", smooth, 6, [3]float64{0, 0, 1})
+	assertNormal(t, "smooth wall corner", smooth, 15, [3]float64{0, 1, 0})
+}
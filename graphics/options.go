@@ -0,0 +1,102 @@
+package graphics
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// MaxPrecision is the largest number of decimal places vertex data can be written with,
+	// more than a float64 can hold.
+	MaxPrecision = 17
+
+	// MaxTextureSize is the largest size textures can be limited to, larger than any plate.
+	MaxTextureSize = 16384
+)
+
+// Options controls the post-processing applied to a model before it is written. The zero value
+// writes the geometry as it was decoded, in the default frame of the writer being used.
+type Options struct {
+	// CoordinateSystem is the frame the model should be written in. Any fields left empty
+	// fall back to the default for the writer.
+	CoordinateSystem CoordinateSystem
+
+	// Pivot moves the origin of the model, for example to rest it on the ground plane
+	// for augmented reality placement.
+	Pivot Pivot
+
+	// SmoothingAngle recomputes smooth vertex normals from the faces when it is set. Edges where
+	// the faces meet at a larger angle (in degrees) are kept hard. Zero keeps the decoded normals,
+	// they are still normalized and missing ones are filled in from the faces.
+	SmoothingAngle float64
+
+	// MaxTriangles reduces the model to at most this many triangles with a quadric error metric
+	// simplifier. Zero keeps every triangle.
+	MaxTriangles int
+
+	// TriangleRatio reduces the model to this fraction of its triangles. Zero keeps every triangle.
+	TriangleRatio float64
+
+	// PrintPrep repairs the model for 3D printing before it is written. It is only used by
+	// the STLWriter and is skipped when nil.
+	PrintPrep *PrintPrepOptions
+
+	// Textures controls the size and layout of the textures written next to the model.
+	Textures TextureOptions
+
+	// Atlas packs the texture plates of every channel into a single atlas and remaps the texture
+	// coordinates, so the model is written with a single material.
+	Atlas bool
+
+	// Split writes every mesh of the model as its own file, named with PartPath, along with a
+	// manifest describing the parts (see ManifestPath) instead of a single model file.
+	Split bool
+
+	// Precision is the number of decimal places vertex data is written with in text formats.
+	// Zero uses DefaultPrecision and a negative value writes the shortest representation that
+	// reads back to the exact value.
+	Precision int
+
+	// WriteMetadata requests a JSON sidecar (see ModelMetadata) next to the written model.
+	WriteMetadata bool
+}
+
+// Validate returns an error if any of the options is out of range. Options from untrusted
+// requests need to be validated before they are used since large values make the writers
+// allocate without bound.
+func (options Options) Validate() error {
+
+	if _, err := ParseAxis(string(options.CoordinateSystem.UpAxis)); err != nil {
+		return err
+	}
+	if _, err := ParseHandedness(string(options.CoordinateSystem.Handedness)); err != nil {
+		return err
+	}
+	if uv := options.CoordinateSystem.UVOrigin; uv != "" && uv != UVTopLeft && uv != UVBottomLeft {
+		return fmt.Errorf("unsupported texture coordinate origin: %s", uv)
+	}
+	if _, err := ParsePivot(string(options.Pivot)); err != nil {
+		return err
+	}
+
+	if !(options.SmoothingAngle >= 0 && options.SmoothingAngle <= 180) {
+		return fmt.Errorf("smoothing angle must be between 0 and 180 degrees: %f", options.SmoothingAngle)
+	}
+	if options.MaxTriangles < 0 {
+		return errors.New("max triangles can't be negative")
+	}
+	if !(options.TriangleRatio >= 0 && options.TriangleRatio <= 1) {
+		return fmt.Errorf("triangle ratio must be between 0 and 1: %f", options.TriangleRatio)
+	}
+	if options.Precision > MaxPrecision {
+		return fmt.Errorf("precision can't be more than %d decimal places: %d", MaxPrecision, options.Precision)
+	}
+
+	if options.PrintPrep != nil {
+		if err := options.PrintPrep.Validate(); err != nil {
+			return err
+		}
+	}
+
+	return options.Textures.validate()
+}
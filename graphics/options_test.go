@@ -0,0 +1,54 @@
+package graphics
+
+import (
+	"math"
+	"testing"
+)
+
+func TestOptionsValidate(t *testing.T) {
+
+	printPrep := DefaultPrintPrepOptions()
+	gearstack := DefaultGearstackOptions()
+	valid := []Options{
+		{},
+		{Precision: -1},
+		{Precision: MaxPrecision, SmoothingAngle: 180, TriangleRatio: 1, MaxTriangles: 100},
+		{CoordinateSystem: DestinyCoordinateSystem, Pivot: PivotGround},
+		{PrintPrep: &printPrep},
+		{Textures: TextureOptions{MaxSize: MaxTextureSize, Format: TextureFormatKTX2, Gearstack: &gearstack}},
+	}
+	for _, options := range valid {
+		if err := options.Validate(); err != nil {
+			t.Errorf("Expected %+v to be valid: %s", options, err.Error())
+		}
+	}
+
+	badGearstack := DefaultGearstackOptions()
+	badGearstack.MetalnessBits = 0
+	invalid := []Options{
+		{CoordinateSystem: CoordinateSystem{UpAxis: "X"}},
+		{CoordinateSystem: CoordinateSystem{Handedness: "up"}},
+		{CoordinateSystem: CoordinateSystem{UVOrigin: "middle"}},
+		{Pivot: "top"},
+		{SmoothingAngle: -1},
+		{SmoothingAngle: 181},
+		{SmoothingAngle: math.NaN()},
+		{MaxTriangles: -1},
+		{TriangleRatio: 1.5},
+		{Precision: 100000},
+		{PrintPrep: &PrintPrepOptions{MaxHoleEdges: MaxHoleEdges + 1}},
+		{PrintPrep: &PrintPrepOptions{MaxHoleEdges: -1}},
+		{PrintPrep: &PrintPrepOptions{MergeDistance: -1}},
+		{PrintPrep: &PrintPrepOptions{DecalThickness: math.Inf(1)}},
+		{PrintPrep: &PrintPrepOptions{DecalDistance: math.NaN()}},
+		{Textures: TextureOptions{MaxSize: -1}},
+		{Textures: TextureOptions{MaxSize: MaxTextureSize + 1}},
+		{Textures: TextureOptions{Format: "png"}},
+		{Textures: TextureOptions{Gearstack: &badGearstack}},
+	}
+	for _, options := range invalid {
+		if err := options.Validate(); err == nil {
+			t.Errorf("Expected %+v to be invalid", options)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package graphics
+
+// postProcess runs the stages shared by all of the writers once the Destiny geometry has been
+// decoded: cleaning up the normals, simplifying it, packing the textures into an atlas,
+// converting it into the output frame and moving the pivot. The bounding box of the finished
+// model is returned.
+func postProcess(processed *processedOutput, options Options, frame CoordinateSystem) BoundingBox {
+
+	processNormals(processed, options.SmoothingAngle)
+	simplify(processed, options)
+	if options.Atlas {
+		buildAtlas(processed)
+	}
+	convertCoordinateSystem(processed, DestinyCoordinateSystem, frame)
+
+	return placePivot(processed, options.Pivot, frame.UpAxis)
+}
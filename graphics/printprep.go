@@ -0,0 +1,440 @@
+package graphics
+
+import (
+	"fmt"
+	"math"
+)
+
+// PrintPrepOptions controls the repairs made to a model before it is written for 3D printing.
+// Only repairs that keep the surface where it is are made: thin walls are not thickened into
+// solids and the result is still written as STL, there is no 3MF output.
+type PrintPrepOptions struct {
+	// MergeDistance is how close two vertices need to be to be merged into one.
+	MergeDistance float64 `json:"mergeDistance"`
+	// MaxHoleEdges is the largest number of boundary edges around a hole that will be filled.
+	// Larger openings are usually intentional (barrels, vents) and are left alone.
+	MaxHoleEdges int `json:"maxHoleEdges"`
+	// DropDecals removes parts that are completely flat and lie on the surface of another part.
+	// These are decals floating above the surface of the model in game and can't be printed.
+	// Flat parts that aren't stuck to anything are kept.
+	DropDecals bool `json:"dropDecals"`
+	// DecalThickness is the largest distance from a part's plane that still counts as flat.
+	DecalThickness float64 `json:"decalThickness"`
+	// DecalDistance is the largest gap between a decal and the surface it sits on.
+	DecalDistance float64 `json:"decalDistance"`
+}
+
+// MaxHoleEdges is the largest MaxHoleEdges that can be requested. Openings this large are
+// never holes left by the exporter and a fan across them would cut through the model.
+const MaxHoleEdges = 1024
+
+// Validate returns an error if any of the options is out of range.
+func (options PrintPrepOptions) Validate() error {
+
+	distances := map[string]float64{
+		"merge distance":  options.MergeDistance,
+		"decal thickness": options.DecalThickness,
+		"decal distance":  options.DecalDistance,
+	}
+	for name, distance := range distances {
+		if !(distance >= 0) || math.IsInf(distance, 1) {
+			return fmt.Errorf("%s must be a non-negative number: %f", name, distance)
+		}
+	}
+	if options.MaxHoleEdges < 0 || options.MaxHoleEdges > MaxHoleEdges {
+		return fmt.Errorf("max hole edges must be between 0 and %d: %d", MaxHoleEdges, options.MaxHoleEdges)
+	}
+
+	return nil
+}
+
+// DefaultPrintPrepOptions returns the options that work for most Destiny items.
+func DefaultPrintPrepOptions() PrintPrepOptions {
+	return PrintPrepOptions{
+		MergeDistance:  1e-5,
+		MaxHoleEdges:   16,
+		DropDecals:     true,
+		DecalThickness: 1e-4,
+		DecalDistance:  5e-3,
+	}
+}
+
+// PrintReport summarizes what print preparation changed and what is still wrong with the mesh.
+type PrintReport struct {
+	MergedVertices   int `json:"mergedVertices"`
+	DegenerateFaces  int `json:"degenerateFaces"`
+	DuplicateFaces   int `json:"duplicateFaces"`
+	FilledHoles      int `json:"filledHoles"`
+	DroppedParts     int `json:"droppedParts"`
+	NonManifoldEdges int `json:"nonManifoldEdges"`
+	// BoundaryEdges are the edges left open after filling holes. A watertight mesh has none.
+	BoundaryEdges int `json:"boundaryEdges"`
+}
+
+func (r *PrintReport) add(other *PrintReport) {
+	r.MergedVertices += other.MergedVertices
+	r.DegenerateFaces += other.DegenerateFaces
+	r.DuplicateFaces += other.DuplicateFaces
+	r.FilledHoles += other.FilledHoles
+	r.DroppedParts += other.DroppedParts
+	r.NonManifoldEdges += other.NonManifoldEdges
+	r.BoundaryEdges += other.BoundaryEdges
+}
+
+type printMesh struct {
+	positions [][3]float64
+	faces     [][3]int
+}
+
+// prepareForPrinting merges all of the processed parts into a single mesh and repairs it for
+// printing. The repaired triangles are returned along with a report of the changes.
+func prepareForPrinting(processed *processedOutput, options PrintPrepOptions) ([][3][3]float64, *PrintReport) {
+
+	report := &PrintReport{}
+	mesh := &printMesh{}
+
+	// Vertices are snapped to a grid of MergeDistance sized cells, any that land in the same cell
+	// are merged.
+	cellSize := options.MergeDistance
+	if cellSize <= 0 {
+		cellSize = 1e-9
+	}
+	lookup := make(map[[3]int64]int)
+	vertexCount := 0
+
+	decals := map[int]bool{}
+	if options.DropDecals {
+		decals = findDecals(processed.positionVertices, options.DecalThickness, options.DecalDistance)
+	}
+
+	for part, positions := range processed.positionVertices {
+		if decals[part] {
+			report.DroppedParts++
+			continue
+		}
+
+		for i := 0; i+8 < len(positions); i += 9 {
+			face := [3]int{}
+			for k := 0; k < 3; k++ {
+				p := [3]float64{positions[i+k*3], positions[i+k*3+1], positions[i+k*3+2]}
+				key := [3]int64{
+					int64(math.Round(p[0] / cellSize)),
+					int64(math.Round(p[1] / cellSize)),
+					int64(math.Round(p[2] / cellSize)),
+				}
+
+				vertexCount++
+				index, ok := lookup[key]
+				if !ok {
+					index = len(mesh.positions)
+					lookup[key] = index
+					mesh.positions = append(mesh.positions, p)
+				}
+				face[k] = index
+			}
+			mesh.faces = append(mesh.faces, face)
+		}
+	}
+	report.MergedVertices = vertexCount - len(mesh.positions)
+
+	report.DegenerateFaces = mesh.removeDegenerateFaces(options.MergeDistance)
+	report.DuplicateFaces = mesh.removeDuplicateFaces()
+	report.FilledHoles = mesh.fillHoles(options.MaxHoleEdges)
+	report.NonManifoldEdges, report.BoundaryEdges = mesh.checkEdges()
+
+	triangles := make([][3][3]float64, 0, len(mesh.faces))
+	for _, face := range mesh.faces {
+		triangles = append(triangles, [3][3]float64{
+			mesh.positions[face[0]], mesh.positions[face[1]], mesh.positions[face[2]],
+		})
+	}
+
+	return triangles, report
+}
+
+// isFlatPart is true if every vertex of the part lies within thickness of the plane of its
+// largest triangle.
+func isFlatPart(positions []float64, thickness float64) bool {
+
+	origin, normal, ok := largestTrianglePlane(positions)
+	if !ok {
+		// Nothing but degenerate triangles
+		return true
+	}
+
+	for i := 0; i+2 < len(positions); i += 3 {
+		offset := [3]float64{positions[i] - origin[0], positions[i+1] - origin[1], positions[i+2] - origin[2]}
+		if math.Abs(dot(offset, normal)) > thickness {
+			return false
+		}
+	}
+
+	return true
+}
+
+// largestTrianglePlane returns a point on and the unit normal of the largest triangle in the
+// part, ok is false if every triangle is degenerate.
+func largestTrianglePlane(positions []float64) (origin, normal [3]float64, ok bool) {
+
+	largest := 0.0
+	for _, triangle := range appendTriangles(nil, positions) {
+		n := faceNormal(triangle[0], triangle[1], triangle[2])
+		if length := vectorLength(n); length > largest {
+			largest = length
+			origin = triangle[0]
+			normal = [3]float64{n[0] / length, n[1] / length, n[2] / length}
+		}
+	}
+
+	return origin, normal, largest > 0
+}
+
+// findDecals returns the indices of the parts that are decals: flat parts where every vertex is
+// within distance of the surface of a part that isn't flat. Flat parts on their own, like a fin
+// or a plate, are not decals. Parts made of nothing but degenerate triangles are included since
+// there is nothing in them to print.
+func findDecals(parts [][]float64, thickness, distance float64) map[int]bool {
+
+	decals := make(map[int]bool)
+	flat := make([]bool, len(parts))
+	for p, positions := range parts {
+		flat[p] = isFlatPart(positions, thickness)
+	}
+
+	for p, positions := range parts {
+		if !flat[p] {
+			continue
+		}
+		if _, _, ok := largestTrianglePlane(positions); !ok {
+			decals[p] = true
+			continue
+		}
+
+		// Only the triangles near the flat part can be the surface it sits on
+		reach := meshBounds(positions)
+		for axis := 0; axis < 3; axis++ {
+			reach.Min[axis] -= distance
+			reach.Max[axis] += distance
+		}
+		surface := make([][3][3]float64, 0, 64)
+		for other, otherPositions := range parts {
+			if other == p || flat[other] {
+				continue
+			}
+			for _, triangle := range appendTriangles(nil, otherPositions) {
+				if reach.overlapsTriangle(triangle) {
+					surface = append(surface, triangle)
+				}
+			}
+		}
+
+		decals[p] = len(surface) > 0
+		for i := 0; i+2 < len(positions) && decals[p]; i += 3 {
+			decals[p] = nearSurface([3]float64{positions[i], positions[i+1], positions[i+2]}, surface, distance)
+		}
+	}
+
+	return decals
+}
+
+func nearSurface(point [3]float64, surface [][3][3]float64, distance float64) bool {
+	for _, triangle := range surface {
+		if pointTriangleDistance(point, triangle) <= distance {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pointTriangleDistance is the distance from point to the closest point of the triangle, found
+// from the Voronoi region of the triangle the point falls into (Ericson, Real-Time Collision
+// Detection 5.1.5).
+func pointTriangleDistance(point [3]float64, triangle [3][3]float64) float64 {
+
+	sub := func(u, v [3]float64) [3]float64 { return [3]float64{u[0] - v[0], u[1] - v[1], u[2] - v[2]} }
+	along := func(origin, direction [3]float64, t float64) [3]float64 {
+		return [3]float64{origin[0] + direction[0]*t, origin[1] + direction[1]*t, origin[2] + direction[2]*t}
+	}
+	distanceTo := func(closest [3]float64) float64 { return vectorLength(sub(point, closest)) }
+
+	a, b, c := triangle[0], triangle[1], triangle[2]
+	ab, ac, ap := sub(b, a), sub(c, a), sub(point, a)
+
+	d1, d2 := dot(ab, ap), dot(ac, ap)
+	if d1 <= 0 && d2 <= 0 {
+		return distanceTo(a)
+	}
+
+	bp := sub(point, b)
+	d3, d4 := dot(ab, bp), dot(ac, bp)
+	if d3 >= 0 && d4 <= d3 {
+		return distanceTo(b)
+	}
+
+	vc := d1*d4 - d3*d2
+	if vc <= 0 && d1 >= 0 && d3 <= 0 {
+		return distanceTo(along(a, ab, d1/(d1-d3)))
+	}
+
+	cp := sub(point, c)
+	d5, d6 := dot(ab, cp), dot(ac, cp)
+	if d6 >= 0 && d5 <= d6 {
+		return distanceTo(c)
+	}
+
+	vb := d5*d2 - d1*d6
+	if vb <= 0 && d2 >= 0 && d6 <= 0 {
+		return distanceTo(along(a, ac, d2/(d2-d6)))
+	}
+
+	va := d3*d6 - d5*d4
+	if va <= 0 && d4-d3 >= 0 && d5-d6 >= 0 {
+		return distanceTo(along(b, sub(c, b), (d4-d3)/((d4-d3)+(d5-d6))))
+	}
+
+	denominator := 1 / (va + vb + vc)
+	v, w := vb*denominator, vc*denominator
+	closest := along(along(a, ab, v), ac, w)
+
+	return distanceTo(closest)
+}
+
+// removeDegenerateFaces removes faces that reuse a vertex or have (almost) no area.
+func (mesh *printMesh) removeDegenerateFaces(minEdge float64) int {
+
+	minArea := minEdge * minEdge / 2.0
+	kept := mesh.faces[:0]
+	removed := 0
+	for _, face := range mesh.faces {
+		area := vectorLength(faceNormal(mesh.positions[face[0]], mesh.positions[face[1]], mesh.positions[face[2]])) / 2.0
+		if face[0] == face[1] || face[1] == face[2] || face[0] == face[2] || area <= minArea {
+			removed++
+			continue
+		}
+		kept = append(kept, face)
+	}
+	mesh.faces = kept
+
+	return removed
+}
+
+// removeDuplicateFaces removes faces made of the same three vertices as an earlier face,
+// regardless of their winding.
+func (mesh *printMesh) removeDuplicateFaces() int {
+
+	seen := make(map[[3]int]bool, len(mesh.faces))
+	kept := mesh.faces[:0]
+	removed := 0
+	for _, face := range mesh.faces {
+		key := sortedFace(face)
+		if seen[key] {
+			removed++
+			continue
+		}
+		seen[key] = true
+		kept = append(kept, face)
+	}
+	mesh.faces = kept
+
+	return removed
+}
+
+func sortedFace(face [3]int) [3]int {
+	if face[0] > face[1] {
+		face[0], face[1] = face[1], face[0]
+	}
+	if face[1] > face[2] {
+		face[1], face[2] = face[2], face[1]
+	}
+	if face[0] > face[1] {
+		face[0], face[1] = face[1], face[0]
+	}
+
+	return face
+}
+
+// fillHoles closes every loop of boundary edges with at most maxEdges edges using a triangle
+// fan. The fan faces are wound so they match the orientation of the faces around the hole.
+func (mesh *printMesh) fillHoles(maxEdges int) int {
+
+	directed := make(map[[2]int]int, len(mesh.faces)*3)
+	for _, face := range mesh.faces {
+		for k := 0; k < 3; k++ {
+			directed[[2]int{face[k], face[(k+1)%3]}]++
+		}
+	}
+
+	// For a boundary edge a->b the fill face needs the edge b->a, so walk the holes backwards.
+	// Vertices touching more than one hole are ambiguous and those holes are left open.
+	next := make(map[int]int)
+	ambiguous := make(map[int]bool)
+	for edge := range directed {
+		if directed[[2]int{edge[1], edge[0]}] > 0 {
+			continue
+		}
+		if _, ok := next[edge[1]]; ok {
+			ambiguous[edge[1]] = true
+		}
+		next[edge[1]] = edge[0]
+	}
+
+	filled := 0
+	visited := make(map[int]bool)
+	for start := range next {
+		if visited[start] {
+			continue
+		}
+
+		loop := []int{start}
+		visited[start] = true
+		valid := !ambiguous[start]
+		for current := next[start]; current != start; current = next[current] {
+			if _, ok := next[current]; !ok || visited[current] || len(loop) > maxEdges {
+				valid = false
+				break
+			}
+			if ambiguous[current] {
+				valid = false
+			}
+			visited[current] = true
+			loop = append(loop, current)
+		}
+
+		if !valid || len(loop) < 3 || len(loop) > maxEdges {
+			continue
+		}
+
+		for i := 1; i+1 < len(loop); i++ {
+			mesh.faces = append(mesh.faces, [3]int{loop[0], loop[i], loop[i+1]})
+		}
+		filled++
+	}
+
+	return filled
+}
+
+// checkEdges counts the edges shared by more than two faces (or by two faces with opposite
+// orientations) and the edges only used by a single face.
+func (mesh *printMesh) checkEdges() (nonManifold, boundary int) {
+
+	undirected := make(map[[2]int]int, len(mesh.faces)*3)
+	directed := make(map[[2]int]int, len(mesh.faces)*3)
+	for _, face := range mesh.faces {
+		for k := 0; k < 3; k++ {
+			a, b := face[k], face[(k+1)%3]
+			undirected[edgeKey(a, b)]++
+			directed[[2]int{a, b}]++
+		}
+	}
+
+	for edge, uses := range undirected {
+		if uses == 1 {
+			boundary++
+		} else if uses > 2 || directed[edge] != 1 || directed[[2]int{edge[1], edge[0]}] != 1 {
+			nonManifold++
+		}
+	}
+
+	return nonManifold, boundary
+}
@@ -0,0 +1,191 @@
+package graphics
+
+import (
+	"math"
+	"testing"
+)
+
+// cubeFaces are the triangles of a unit cube with its corners numbered by their xyz bits, wound
+// counter clockwise when seen from outside.
+var cubeFaces = [][3]int{
+	{0, 2, 3}, {0, 3, 1}, // -z
+	{4, 5, 7}, {4, 7, 6}, // +z
+	{0, 1, 5}, {0, 5, 4}, // -y
+	{2, 6, 7}, {2, 7, 3}, // +y
+	{0, 4, 6}, {0, 6, 2}, // -x
+	{1, 3, 7}, {1, 7, 5}, // +x
+}
+
+func cubeCorner(i int, size float64) [3]float64 {
+	return [3]float64{float64(i&1) * size, float64(i>>1&1) * size, float64(i>>2&1) * size}
+}
+
+func cubeMesh() *printMesh {
+	mesh := &printMesh{faces: append([][3]int{}, cubeFaces...)}
+	for i := 0; i < 8; i++ {
+		mesh.positions = append(mesh.positions, cubeCorner(i, 1))
+	}
+
+	return mesh
+}
+
+func cubePositions(size float64) []float64 {
+	positions := make([]float64, 0, len(cubeFaces)*9)
+	for _, face := range cubeFaces {
+		for _, corner := range face {
+			p := cubeCorner(corner, size)
+			positions = append(positions, p[0], p[1], p[2])
+		}
+	}
+
+	return positions
+}
+
+// quadPositions is a square in the z plane at the given height, facing +z.
+func quadPositions(min, max, z float64) []float64 {
+	return []float64{
+		min, min, z, max, min, z, max, max, z,
+		min, min, z, max, max, z, min, max, z,
+	}
+}
+
+func TestCheckEdges(t *testing.T) {
+
+	nonManifold, boundary := cubeMesh().checkEdges()
+	if nonManifold != 0 || boundary != 0 {
+		t.Errorf("Expected a closed cube, got %d non-manifold and %d boundary edges", nonManifold, boundary)
+	}
+
+	open := cubeMesh()
+	open.faces = open.faces[2:]
+	if nonManifold, boundary := open.checkEdges(); nonManifold != 0 || boundary != 4 {
+		t.Errorf("Expected the missing face to leave 4 open edges, got %d non-manifold and %d boundary edges", nonManifold, boundary)
+	}
+
+	// A third face on the edge between 0 and 3, and the +z face wound the wrong way
+	broken := cubeMesh()
+	broken.positions = append(broken.positions, [3]float64{0.5, 0.5, -1})
+	broken.faces = append(broken.faces, [3]int{0, 3, 8})
+	broken.faces[2], broken.faces[3] = [3]int{4, 7, 5}, [3]int{4, 6, 7}
+	if nonManifold, _ := broken.checkEdges(); nonManifold != 5 {
+		t.Errorf("Expected 5 non-manifold edges, got %d", nonManifold)
+	}
+}
+
+func TestFillHoles(t *testing.T) {
+
+	mesh := cubeMesh()
+	mesh.faces = mesh.faces[2:]
+
+	if filled := mesh.fillHoles(16); filled != 1 {
+		t.Fatalf("Expected the missing face to be filled, filled %d holes", filled)
+	}
+	if nonManifold, boundary := mesh.checkEdges(); nonManifold != 0 || boundary != 0 {
+		t.Errorf("Expected a closed cube with consistent winding, got %d non-manifold and %d boundary edges", nonManifold, boundary)
+	}
+
+	// The filled face is the bottom of the cube, it has to face down
+	for _, face := range mesh.faces[len(mesh.faces)-2:] {
+		normal := faceNormal(mesh.positions[face[0]], mesh.positions[face[1]], mesh.positions[face[2]])
+		if normal[2] >= 0 {
+			t.Errorf("Expected the fill face %v to face -z, got %v", face, normal)
+		}
+	}
+}
+
+func TestFillHolesLeavesLargeOpenings(t *testing.T) {
+
+	mesh := cubeMesh()
+	mesh.faces = mesh.faces[2:]
+
+	if filled := mesh.fillHoles(3); filled != 0 {
+		t.Errorf("Expected a hole with 4 edges to be left open with a limit of 3, filled %d", filled)
+	}
+	if _, boundary := mesh.checkEdges(); boundary != 4 {
+		t.Errorf("Expected the hole to stay open, got %d boundary edges", boundary)
+	}
+}
+
+func TestIsFlatPart(t *testing.T) {
+
+	if !isFlatPart(quadPositions(0, 1, 0.5), 1e-4) {
+		t.Errorf("Expected a square to be flat")
+	}
+	if isFlatPart(cubePositions(1), 1e-4) {
+		t.Errorf("Expected a cube not to be flat")
+	}
+	if !isFlatPart([]float64{0, 0, 0, 1, 1, 1, 2, 2, 2}, 1e-4) {
+		t.Errorf("Expected a part with only degenerate triangles to count as flat")
+	}
+}
+
+func TestFindDecals(t *testing.T) {
+
+	parts := [][]float64{
+		cubePositions(1),
+		// Floating just above the top of the cube
+		quadPositions(0.25, 0.75, 1.001),
+		// Flat but away from the cube, like a fin
+		quadPositions(2, 3, 0.5),
+		// Just the degenerate triangles
+		{0, 0, 0, 1, 1, 1, 2, 2, 2},
+		// Partly hanging over the edge of the cube
+		quadPositions(0.5, 1.5, 1.001),
+	}
+
+	decals := findDecals(parts, 1e-4, 5e-3)
+	for part, expected := range []bool{false, true, false, true, false} {
+		if decals[part] != expected {
+			t.Errorf("Wrong decal for part %d: Expected=%t", part, expected)
+		}
+	}
+}
+
+func TestPointTriangleDistance(t *testing.T) {
+
+	triangle := [3][3]float64{{0, 0, 0}, {1, 0, 0}, {0, 1, 0}}
+	tests := []struct {
+		point    [3]float64
+		expected float64
+	}{
+		{[3]float64{0.25, 0.25, 2}, 2},
+		{[3]float64{-1, -1, 0}, math.Sqrt2},
+		{[3]float64{2, 0, 0}, 1},
+		{[3]float64{0.5, -1, 0}, 1},
+		{[3]float64{1, 1, 0}, math.Sqrt2 / 2},
+		{[3]float64{-1, 0.5, 1}, math.Sqrt2},
+	}
+
+	for _, test := range tests {
+		if distance := pointTriangleDistance(test.point, triangle); math.Abs(distance-test.expected) > 1e-9 {
+			t.Errorf("Wrong distance for %v: Expected=%f, Actual=%f", test.point, test.expected, distance)
+		}
+	}
+}
+
+func TestPrepareForPrinting(t *testing.T) {
+
+	// A cube without its bottom, with an extra copy of one of its faces and a decal on top
+	cube := cubePositions(1)
+	processed := &processedOutput{
+		positionVertices: [][]float64{
+			append(cube[18:], cube[18:27]...),
+			quadPositions(0.25, 0.75, 1.001),
+		},
+	}
+
+	triangles, report := prepareForPrinting(processed, DefaultPrintPrepOptions())
+
+	expected := PrintReport{
+		MergedVertices: (10+1)*3 - 8,
+		DuplicateFaces: 1,
+		FilledHoles:    1,
+		DroppedParts:   1,
+	}
+	if *report != expected {
+		t.Errorf("Wrong report: Expected=%+v, Actual=%+v", expected, *report)
+	}
+	if len(triangles) != 12 {
+		t.Errorf("Expected a closed cube, got %d triangles", len(triangles))
+	}
+}
@@ -0,0 +1,32 @@
+package graphics
+
+import (
+	"fmt"
+
+	"github.com/kpango/glg"
+)
+
+// A Reporter is told how far along writing a model is, and about the problems that were worked
+// around instead of failing the model, like parts that had to be skipped. The stages are
+// "geometry" (decoding each geometry), "writing" (the model file) and "textures".
+type Reporter interface {
+	Progress(stage string, done, total int)
+	Warn(message string)
+}
+
+// progress reports that done of the total steps of the stage have finished.
+func (output *processedOutput) progress(stage string, done, total int) {
+	if output.reporter != nil {
+		output.reporter.Progress(stage, done, total)
+	}
+}
+
+// warn logs the warning and passes it on to the reporter.
+func (output *processedOutput) warn(format string, args ...interface{}) {
+
+	message := fmt.Sprintf(format, args...)
+	glg.Warn(message)
+	if output.reporter != nil {
+		output.reporter.Warn(message)
+	}
+}
@@ -0,0 +1,54 @@
+package graphics
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+type recordingReporter struct {
+	progress []string
+	warnings []string
+}
+
+func (r *recordingReporter) Progress(stage string, done, total int) {
+	r.progress = append(r.progress, fmt.Sprintf("%s %d/%d", stage, done, total))
+}
+
+func (r *recordingReporter) Warn(message string) {
+	r.warnings = append(r.warnings, message)
+}
+
+func TestWriteTexturesReportsProgress(t *testing.T) {
+
+	reporter := &recordingReporter{}
+	processed := testProcessed()
+	processed.reporter = reporter
+
+	writeTextures(processed, NewMemoryTextureSink(), TextureOptions{})
+
+	expected := []string{"textures 1/6", "textures 2/6", "textures 3/6", "textures 4/6", "textures 5/6", "textures 6/6"}
+	if fmt.Sprint(reporter.progress) != fmt.Sprint(expected) {
+		t.Errorf("Wrong progress: Expected=%v, Actual=%v", expected, reporter.progress)
+	}
+	if len(reporter.warnings) != 0 {
+		t.Errorf("Unexpected warnings: %v", reporter.warnings)
+	}
+
+}
+
+func TestUnknownPrimitiveWarning(t *testing.T) {
+
+	reporter := &recordingReporter{}
+	processed := &processedOutput{reporter: reporter}
+
+	part := gjson.Parse(`{"start_index": 0, "index_count": 3, "primitive_type": 99}`).Map()
+	err := processPart(part, 2, []uint16{0, 1, 2}, nil, nil, nil, nil, [2]float64{}, [2]float64{}, processed)
+	if err != nil {
+		t.Fatalf("Expected the part to be skipped, got %s", err.Error())
+	}
+	if len(processed.positionVertices) != 0 || len(reporter.warnings) != 1 {
+		t.Errorf("Expected the part to be skipped with a warning, got %v", reporter.warnings)
+	}
+}
@@ -0,0 +1,496 @@
+package graphics
+
+import (
+	"container/heap"
+	"math"
+
+	"github.com/kpango/glg"
+)
+
+// quadric is the symmetric 4x4 error matrix from Garland and Heckbert's "Surface Simplification
+// Using Quadric Error Metrics", stored as the 10 unique values of the upper triangle.
+type quadric [10]float64
+
+func planeQuadric(a, b, c, d float64) quadric {
+	return quadric{
+		a * a, a * b, a * c, a * d,
+		b * b, b * c, b * d,
+		c * c, c * d,
+		d * d,
+	}
+}
+
+func (q quadric) add(other quadric) quadric {
+	for i := range q {
+		q[i] += other[i]
+	}
+
+	return q
+}
+
+// evaluate is the squared distance error of moving a vertex to p.
+func (q quadric) evaluate(p [3]float64) float64 {
+	x, y, z := p[0], p[1], p[2]
+
+	return q[0]*x*x + 2*q[1]*x*y + 2*q[2]*x*z + 2*q[3]*x +
+		q[4]*y*y + 2*q[5]*y*z + 2*q[6]*y +
+		q[7]*z*z + 2*q[8]*z +
+		q[9]
+}
+
+// simplifyVertex is a unique combination of vertex attributes in the mesh being simplified.
+type simplifyVertex struct {
+	position [3]float64
+	normal   [3]float64
+	texcoord [2]float32
+
+	quadric quadric
+	// locked vertices sit on an open boundary, a texture seam or a hard normal edge and are never
+	// moved so those features survive simplification.
+	locked    bool
+	version   int
+	triangles []int
+}
+
+type simplifyMesh struct {
+	vertices  []*simplifyVertex
+	triangles [][3]int
+	removed   []bool
+	live      int
+}
+
+// collapseCandidate is a half edge collapse, moving vertex from onto vertex to.
+type collapseCandidate struct {
+	from, to               int
+	fromVersion, toVersion int
+	cost                   float64
+}
+
+type collapseQueue []*collapseCandidate
+
+func (q collapseQueue) Len() int            { return len(q) }
+func (q collapseQueue) Less(i, j int) bool  { return q[i].cost < q[j].cost }
+func (q collapseQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *collapseQueue) Push(x interface{}) { *q = append(*q, x.(*collapseCandidate)) }
+func (q *collapseQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	*q = old[:n-1]
+	return item
+}
+
+// simplify reduces the triangle count of every mesh in the processed output according to the
+// MaxTriangles and TriangleRatio options. Each mesh is simplified on its own so material
+// boundaries between meshes are left untouched.
+func simplify(processed *processedOutput, options Options) {
+
+	total := 0
+	for _, positions := range processed.positionVertices {
+		total += len(positions) / 9
+	}
+
+	ratio := 1.0
+	if options.TriangleRatio > 0 && options.TriangleRatio < 1 {
+		ratio = options.TriangleRatio
+	}
+	if options.MaxTriangles > 0 && total > options.MaxTriangles {
+		ratio = math.Min(ratio, float64(options.MaxTriangles)/float64(total))
+	}
+	if ratio >= 1 || total == 0 {
+		return
+	}
+
+	simplified := 0
+	for i := range processed.positionVertices {
+		triangles := len(processed.positionVertices[i]) / 9
+		target := int(math.Ceil(float64(triangles) * ratio))
+
+		mesh := newSimplifyMesh(processed.positionVertices[i], processed.normalValues[i], processed.texcoords[i])
+		mesh.reduce(target)
+
+		processed.positionVertices[i], processed.normalValues[i], processed.texcoords[i] = mesh.flatten()
+		simplified += len(processed.positionVertices[i]) / 9
+	}
+
+	glg.Infof("Simplified model from %d to %d triangles", total, simplified)
+}
+
+// newSimplifyMesh welds the triangle soup used by the writers into an indexed mesh. Vertices are
+// only merged when all of their attributes match.
+func newSimplifyMesh(positions, normals []float64, texcoords []float32) *simplifyMesh {
+
+	type vertexKey struct {
+		position [3]float64
+		normal   [3]float64
+		texcoord [2]float32
+	}
+
+	vertexCount := len(positions) / 3
+	mesh := &simplifyMesh{
+		vertices:  make([]*simplifyVertex, 0, vertexCount),
+		triangles: make([][3]int, 0, vertexCount/3),
+	}
+
+	lookup := make(map[vertexKey]int, vertexCount)
+	for tri := 0; tri+2 < vertexCount; tri += 3 {
+		triangle := [3]int{}
+		for k := 0; k < 3; k++ {
+			v := tri + k
+			key := vertexKey{
+				position: [3]float64{positions[v*3], positions[v*3+1], positions[v*3+2]},
+			}
+			if v*3+2 < len(normals) {
+				key.normal = [3]float64{normals[v*3], normals[v*3+1], normals[v*3+2]}
+			}
+			if v*2+1 < len(texcoords) {
+				key.texcoord = [2]float32{texcoords[v*2], texcoords[v*2+1]}
+			}
+
+			index, ok := lookup[key]
+			if !ok {
+				index = len(mesh.vertices)
+				lookup[key] = index
+				mesh.vertices = append(mesh.vertices, &simplifyVertex{
+					position: key.position,
+					normal:   key.normal,
+					texcoord: key.texcoord,
+				})
+			}
+			triangle[k] = index
+		}
+
+		mesh.triangles = append(mesh.triangles, triangle)
+	}
+
+	mesh.removed = make([]bool, len(mesh.triangles))
+	mesh.live = len(mesh.triangles)
+
+	for t, triangle := range mesh.triangles {
+		if triangle[0] == triangle[1] || triangle[1] == triangle[2] || triangle[0] == triangle[2] {
+			mesh.removed[t] = true
+			mesh.live--
+			continue
+		}
+
+		q := mesh.triangleQuadric(triangle)
+		for _, v := range triangle {
+			vertex := mesh.vertices[v]
+			vertex.triangles = append(vertex.triangles, t)
+			vertex.quadric = vertex.quadric.add(q)
+		}
+	}
+
+	mesh.lockBoundaries()
+
+	return mesh
+}
+
+// triangleQuadric is the plane quadric of a triangle, weighted by its area so large faces
+// resist being moved more than slivers.
+func (mesh *simplifyMesh) triangleQuadric(triangle [3]int) quadric {
+	normal := faceNormal(mesh.vertices[triangle[0]].position, mesh.vertices[triangle[1]].position,
+		mesh.vertices[triangle[2]].position)
+	length := vectorLength(normal)
+	if length == 0 {
+		return quadric{}
+	}
+
+	a, b, c := normal[0]/length, normal[1]/length, normal[2]/length
+	p := mesh.vertices[triangle[0]].position
+	d := -(a*p[0] + b*p[1] + c*p[2])
+
+	q := planeQuadric(a, b, c, d)
+	area := length / 2.0
+	for i := range q {
+		q[i] *= area
+	}
+
+	return q
+}
+
+// lockBoundaries locks every vertex on an edge that is only used by a single triangle. Because
+// vertices are only welded when all their attributes match, this covers the open edges of the
+// mesh as well as texture seams and hard normal edges.
+func (mesh *simplifyMesh) lockBoundaries() {
+
+	edgeUses := make(map[[2]int]int, len(mesh.triangles)*3)
+	for t, triangle := range mesh.triangles {
+		if mesh.removed[t] {
+			continue
+		}
+		for k := 0; k < 3; k++ {
+			edgeUses[edgeKey(triangle[k], triangle[(k+1)%3])]++
+		}
+	}
+
+	for edge, uses := range edgeUses {
+		if uses == 1 {
+			mesh.vertices[edge[0]].locked = true
+			mesh.vertices[edge[1]].locked = true
+		}
+	}
+}
+
+func edgeKey(a, b int) [2]int {
+	if a < b {
+		return [2]int{a, b}
+	}
+
+	return [2]int{b, a}
+}
+
+// reduce collapses edges in order of increasing error until at most target triangles remain or
+// there are no collapses left that keep the surface intact.
+func (mesh *simplifyMesh) reduce(target int) {
+
+	queue := &collapseQueue{}
+	for v := range mesh.vertices {
+		mesh.pushCandidates(queue, v)
+	}
+	heap.Init(queue)
+
+	for mesh.live > target && queue.Len() > 0 {
+		candidate := heap.Pop(queue).(*collapseCandidate)
+		from := mesh.vertices[candidate.from]
+		to := mesh.vertices[candidate.to]
+		if from.version != candidate.fromVersion || to.version != candidate.toVersion {
+			// One of the vertices changed after this candidate was queued
+			continue
+		}
+
+		if !mesh.collapse(candidate.from, candidate.to) {
+			continue
+		}
+
+		mesh.pushCandidates(queue, candidate.to)
+	}
+}
+
+// pushCandidates queues the cheapest collapse for every edge around vertex v.
+func (mesh *simplifyMesh) pushCandidates(queue *collapseQueue, v int) {
+
+	for _, neighbor := range mesh.neighbors(v) {
+		a, b := mesh.vertices[v], mesh.vertices[neighbor]
+		if a.locked && b.locked {
+			continue
+		}
+
+		combined := a.quadric.add(b.quadric)
+		candidate := &collapseCandidate{cost: math.Inf(1)}
+		if !a.locked {
+			candidate = &collapseCandidate{from: v, to: neighbor, cost: combined.evaluate(b.position)}
+		}
+		if !b.locked {
+			if cost := combined.evaluate(a.position); cost < candidate.cost {
+				candidate = &collapseCandidate{from: neighbor, to: v, cost: cost}
+			}
+		}
+
+		candidate.fromVersion = mesh.vertices[candidate.from].version
+		candidate.toVersion = mesh.vertices[candidate.to].version
+		heap.Push(queue, candidate)
+	}
+}
+
+func (mesh *simplifyMesh) neighbors(v int) []int {
+	seen := map[int]bool{v: true}
+	result := make([]int, 0, 8)
+	for _, t := range mesh.vertices[v].triangles {
+		if mesh.removed[t] {
+			continue
+		}
+		for _, other := range mesh.triangles[t] {
+			if !seen[other] {
+				seen[other] = true
+				result = append(result, other)
+			}
+		}
+	}
+
+	return result
+}
+
+// collapse moves vertex from onto vertex to, removing the triangles that shared the edge. The
+// collapse is rejected if it would change the topology of the surface or flip or flatten any of
+// the remaining triangles.
+func (mesh *simplifyMesh) collapse(from, to int) bool {
+
+	source := mesh.vertices[from]
+	target := mesh.vertices[to]
+
+	if !mesh.satisfiesLink(from, to) || mesh.flipsTriangles(from, to) {
+		return false
+	}
+
+	for _, t := range source.triangles {
+		if mesh.removed[t] {
+			continue
+		}
+
+		if containsVertex(mesh.triangles[t], to) {
+			mesh.removed[t] = true
+			mesh.live--
+			continue
+		}
+
+		for k := range mesh.triangles[t] {
+			if mesh.triangles[t][k] == from {
+				mesh.triangles[t][k] = to
+			}
+		}
+		target.triangles = append(target.triangles, t)
+	}
+
+	target.quadric = target.quadric.add(source.quadric)
+	source.triangles = nil
+	// Only edges touching the two collapsed vertices changed cost, the caller queues new
+	// candidates for them.
+	source.version++
+	target.version++
+
+	return true
+}
+
+// satisfiesLink checks the link condition from Dey et al. for the edge between from and to: the
+// vertices connected to both ends of the edge must be exactly the opposite corners of the
+// triangles using the edge, and no edge may form a triangle with both of them. Collapsing an edge that fails the check would pinch the surface,
+// merging two sheets into one or creating duplicate faces, like folding a tetrahedron flat.
+func (mesh *simplifyMesh) satisfiesLink(from, to int) bool {
+
+	opposite := make(map[int]bool, 2)
+	for _, t := range mesh.vertices[from].triangles {
+		triangle := mesh.triangles[t]
+		if mesh.removed[t] || !containsVertex(triangle, to) {
+			continue
+		}
+		for _, v := range triangle {
+			if v != from && v != to {
+				opposite[v] = true
+			}
+		}
+	}
+
+	// The triangles moved onto to must not already exist around it
+	for _, t := range mesh.vertices[from].triangles {
+		triangle := mesh.triangles[t]
+		if mesh.removed[t] || containsVertex(triangle, to) {
+			continue
+		}
+		for _, other := range mesh.vertices[to].triangles {
+			if !mesh.removed[other] && sharesEdgeOpposite(triangle, from, mesh.triangles[other], to) {
+				return false
+			}
+		}
+	}
+
+	shared := 0
+	toNeighbors := make(map[int]bool)
+	for _, v := range mesh.neighbors(to) {
+		toNeighbors[v] = true
+	}
+	for _, v := range mesh.neighbors(from) {
+		if v == to || !toNeighbors[v] {
+			continue
+		}
+		if !opposite[v] {
+			return false
+		}
+		shared++
+	}
+
+	return shared == len(opposite)
+}
+
+// sharesEdgeOpposite is true if the edge of a opposite vertex u is also the edge of b opposite v.
+func sharesEdgeOpposite(a [3]int, u int, b [3]int, v int) bool {
+	for k := 0; k < 3; k++ {
+		if a[k] == u {
+			x, y := a[(k+1)%3], a[(k+2)%3]
+			return containsVertex(b, x) && containsVertex(b, y) && x != v && y != v
+		}
+	}
+
+	return false
+}
+
+// flipsTriangles is true if moving vertex from onto vertex to would turn any of the triangles
+// that survive the collapse over, or squash one down to a line.
+func (mesh *simplifyMesh) flipsTriangles(from, to int) bool {
+
+	position := mesh.vertices[to].position
+	for _, t := range mesh.vertices[from].triangles {
+		triangle := mesh.triangles[t]
+		if mesh.removed[t] || containsVertex(triangle, to) {
+			continue
+		}
+
+		before := mesh.triangleNormal(triangle, -1, [3]float64{})
+		after := mesh.triangleNormal(triangle, from, position)
+		if vectorLength(after) == 0 || dot(before, after) <= 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// triangleNormal is the unnormalized normal of a triangle, optionally with the vertex at index
+// replace moved to position.
+func (mesh *simplifyMesh) triangleNormal(triangle [3]int, replace int, position [3]float64) [3]float64 {
+	points := [3][3]float64{}
+	for k, v := range triangle {
+		points[k] = mesh.vertices[v].position
+		if v == replace {
+			points[k] = position
+		}
+	}
+
+	return faceNormal(points[0], points[1], points[2])
+}
+
+// flatten converts the simplified mesh back into the triangle soup used by the writers.
+func (mesh *simplifyMesh) flatten() ([]float64, []float64, []float32) {
+
+	positions := make([]float64, 0, mesh.live*9)
+	normals := make([]float64, 0, mesh.live*9)
+	texcoords := make([]float32, 0, mesh.live*6)
+
+	for t, triangle := range mesh.triangles {
+		if mesh.removed[t] {
+			continue
+		}
+
+		for _, v := range triangle {
+			vertex := mesh.vertices[v]
+			positions = append(positions, vertex.position[0], vertex.position[1], vertex.position[2])
+			normals = append(normals, vertex.normal[0], vertex.normal[1], vertex.normal[2])
+			texcoords = append(texcoords, vertex.texcoord[0], vertex.texcoord[1])
+		}
+	}
+
+	return positions, normals, texcoords
+}
+
+func containsVertex(triangle [3]int, v int) bool {
+	return triangle[0] == v || triangle[1] == v || triangle[2] == v
+}
+
+func faceNormal(a, b, c [3]float64) [3]float64 {
+	u := [3]float64{b[0] - a[0], b[1] - a[1], b[2] - a[2]}
+	v := [3]float64{c[0] - a[0], c[1] - a[1], c[2] - a[2]}
+
+	return [3]float64{
+		u[1]*v[2] - u[2]*v[1],
+		u[2]*v[0] - u[0]*v[2],
+		u[0]*v[1] - u[1]*v[0],
+	}
+}
+
+func dot(a, b [3]float64) float64 {
+	return a[0]*b[0] + a[1]*b[1] + a[2]*b[2]
+}
+
+func vectorLength(v [3]float64) float64 {
+	return math.Sqrt(dot(v, v))
+}
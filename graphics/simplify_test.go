@@ -0,0 +1,183 @@
+package graphics
+
+import (
+	"math"
+	"testing"
+)
+
+// gridPositions is a triangle soup of an n by n grid of quads over the unit square, with a gentle
+// bump in the middle so collapses have a cost. Every triangle faces +z.
+func gridPositions(n int) []float64 {
+
+	height := func(x, y float64) float64 {
+		return 0.05 * math.Sin(math.Pi*x) * math.Sin(math.Pi*y)
+	}
+	corner := func(i, j int) []float64 {
+		x, y := float64(i)/float64(n), float64(j)/float64(n)
+		return []float64{x, y, height(x, y)}
+	}
+
+	positions := make([]float64, 0, n*n*18)
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			a, b, c, d := corner(i, j), corner(i+1, j), corner(i+1, j+1), corner(i, j+1)
+			for _, p := range [][]float64{a, b, c, a, c, d} {
+				positions = append(positions, p...)
+			}
+		}
+	}
+
+	return positions
+}
+
+func soupTriangles(positions []float64) [][3][3]float64 {
+	triangles := make([][3][3]float64, 0, len(positions)/9)
+	for i := 0; i+8 < len(positions); i += 9 {
+		triangles = append(triangles, [3][3]float64{
+			{positions[i], positions[i+1], positions[i+2]},
+			{positions[i+3], positions[i+4], positions[i+5]},
+			{positions[i+6], positions[i+7], positions[i+8]},
+		})
+	}
+
+	return triangles
+}
+
+func TestSimplifyTriangleBudget(t *testing.T) {
+
+	positions := gridPositions(10)
+	processed := &processedOutput{
+		positionVertices: [][]float64{positions},
+		normalValues:     [][]float64{{}},
+		texcoords:        [][]float32{{}},
+	}
+
+	simplify(processed, Options{MaxTriangles: 60})
+
+	triangles := len(processed.positionVertices[0]) / 9
+	if triangles > 60 || triangles == 0 {
+		t.Errorf("Expected at most 60 triangles, got %d", triangles)
+	}
+	if len(processed.normalValues[0]) != triangles*9 || len(processed.texcoords[0]) != triangles*6 {
+		t.Errorf("Expected the attributes to match the positions: %d normals, %d texcoords for %d triangles",
+			len(processed.normalValues[0]), len(processed.texcoords[0]), triangles)
+	}
+
+	for i, triangle := range soupTriangles(processed.positionVertices[0]) {
+		if normal := faceNormal(triangle[0], triangle[1], triangle[2]); normal[2] <= 0 {
+			t.Errorf("Triangle %d was flipped: %v", i, triangle)
+		}
+	}
+}
+
+func TestSimplifyUnderBudget(t *testing.T) {
+
+	positions := gridPositions(2)
+	processed := &processedOutput{
+		positionVertices: [][]float64{positions},
+		normalValues:     [][]float64{{}},
+		texcoords:        [][]float32{{}},
+	}
+
+	simplify(processed, Options{MaxTriangles: 8, TriangleRatio: 1})
+	if len(processed.positionVertices[0]) != len(positions) {
+		t.Errorf("Expected a model under the budget to be left alone")
+	}
+}
+
+func TestSimplifyKeepsBoundaries(t *testing.T) {
+
+	const n = 8
+	mesh := newSimplifyMesh(gridPositions(n), nil, nil)
+	mesh.reduce(1)
+
+	positions, _, _ := mesh.flatten()
+	kept := make(map[[3]float64]bool)
+	for _, triangle := range soupTriangles(positions) {
+		for _, p := range triangle {
+			kept[p] = true
+		}
+	}
+
+	// Every vertex on the outline of the grid is locked and has to survive
+	for _, vertex := range mesh.vertices {
+		p := vertex.position
+		onBoundary := p[0] == 0 || p[0] == 1 || p[1] == 0 || p[1] == 1
+		if onBoundary != vertex.locked {
+			t.Errorf("Wrong lock for %v: Expected=%t", p, onBoundary)
+		}
+		if onBoundary && !kept[p] {
+			t.Errorf("Boundary vertex %v was removed", p)
+		}
+	}
+
+	// The open edges left over still trace the whole outline of the grid
+	edgeUses := make(map[[2][3]float64]int)
+	for _, triangle := range soupTriangles(positions) {
+		for k := 0; k < 3; k++ {
+			a, b := triangle[k], triangle[(k+1)%3]
+			if b[0] < a[0] || (b[0] == a[0] && b[1] < a[1]) {
+				a, b = b, a
+			}
+			edgeUses[[2][3]float64{a, b}]++
+		}
+	}
+	perimeter := 0.0
+	for edge, uses := range edgeUses {
+		if uses == 1 {
+			perimeter += math.Hypot(edge[1][0]-edge[0][0], edge[1][1]-edge[0][1])
+		}
+	}
+	if math.Abs(perimeter-4) > 1e-9 {
+		t.Errorf("Expected the outline to be kept, got a perimeter of %f", perimeter)
+	}
+	if triangles := len(positions) / 9; triangles >= 2*n*n {
+		t.Errorf("Expected the interior to be simplified, got %d triangles", triangles)
+	}
+}
+
+func TestSimplifyLinkCondition(t *testing.T) {
+
+	// A closed tetrahedron, every collapse would fold it into two faces on top of each other
+	a, b, c, d := []float64{0, 0, 0}, []float64{1, 0, 0}, []float64{0, 1, 0}, []float64{0, 0, 1}
+	positions := []float64{}
+	for _, p := range [][]float64{a, c, b, a, b, d, a, d, c, b, c, d} {
+		positions = append(positions, p...)
+	}
+
+	mesh := newSimplifyMesh(positions, nil, nil)
+	for from := range mesh.vertices {
+		for _, to := range mesh.neighbors(from) {
+			if mesh.satisfiesLink(from, to) {
+				t.Errorf("Expected the link condition to fail for %d -> %d", from, to)
+			}
+		}
+	}
+
+	mesh.reduce(1)
+	if mesh.live != 4 {
+		t.Errorf("Expected the tetrahedron to be left alone, got %d triangles", mesh.live)
+	}
+}
+
+func TestSimplifyRejectsFlips(t *testing.T) {
+
+	// A fan around an interior vertex with a dent in its outline, moving the center onto the
+	// corner at (2, 0) would turn the triangle in the dent over
+	center := []float64{0, 0, 0}
+	ring := [][]float64{{2, 0, 0}, {0.3, 0.3, 0}, {0, 2, 0}, {-1, -1, 0}}
+	positions := []float64{}
+	for i := range ring {
+		positions = append(positions, center...)
+		positions = append(positions, ring[i]...)
+		positions = append(positions, ring[(i+1)%len(ring)]...)
+	}
+
+	mesh := newSimplifyMesh(positions, nil, nil)
+	if !mesh.flipsTriangles(0, 1) {
+		t.Errorf("Expected moving the center onto (2, 0, 0) to flip the triangle in the dent")
+	}
+	if mesh.flipsTriangles(0, 4) {
+		t.Errorf("Expected moving the center onto (-1, -1, 0) to keep every triangle facing up")
+	}
+}
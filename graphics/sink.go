@@ -0,0 +1,115 @@
+package graphics
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// A TextureSink receives the texture files written alongside a model, so they can be written to
+// a directory, an archive or kept in memory.
+type TextureSink interface {
+	// Create returns a writer for the texture file with the given name. The writer is closed
+	// once the whole texture has been written.
+	Create(name string) (io.WriteCloser, error)
+}
+
+// DirTextureSink writes every texture as a file in the directory.
+type DirTextureSink string
+
+// Create creates (or truncates) the file for the texture in the directory.
+func (dir DirTextureSink) Create(name string) (io.WriteCloser, error) {
+	return os.OpenFile(filepath.Join(string(dir), name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+// ZipTextureSink adds every texture as a file in a zip archive. Like the zip.Writer, only one
+// texture can be written at a time.
+type ZipTextureSink struct {
+	Writer *zip.Writer
+
+	// Prefix is added to the name of every texture, for example a directory in the archive.
+	Prefix string
+}
+
+// Create starts the file for the texture in the archive.
+func (sink ZipTextureSink) Create(name string) (io.WriteCloser, error) {
+
+	w, err := sink.Writer.Create(sink.Prefix + name)
+	if err != nil {
+		return nil, err
+	}
+
+	return zipTexture{w}, nil
+}
+
+// zipTexture is a file in a zip archive, it is finished when the next file is created so there
+// is nothing to do when it is closed.
+type zipTexture struct {
+	io.Writer
+}
+
+func (zipTexture) Close() error {
+	return nil
+}
+
+// MemoryTextureSink keeps the texture files in memory, it is safe to use from several goroutines.
+type MemoryTextureSink struct {
+	mutex sync.Mutex
+	files map[string][]byte
+}
+
+// NewMemoryTextureSink returns an empty MemoryTextureSink.
+func NewMemoryTextureSink() *MemoryTextureSink {
+	return &MemoryTextureSink{files: make(map[string][]byte)}
+}
+
+// Create returns a buffer for the texture, the texture is only added to the sink when the buffer
+// is closed.
+func (sink *MemoryTextureSink) Create(name string) (io.WriteCloser, error) {
+	return &memoryTexture{sink: sink, name: name}, nil
+}
+
+// Names returns the names of all of the textures in the sink, sorted.
+func (sink *MemoryTextureSink) Names() []string {
+
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	names := make([]string, 0, len(sink.files))
+	for name := range sink.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// File returns the contents of the texture with the given name.
+func (sink *MemoryTextureSink) File(name string) ([]byte, bool) {
+
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	data, ok := sink.files[name]
+	return data, ok
+}
+
+type memoryTexture struct {
+	bytes.Buffer
+	sink *MemoryTextureSink
+	name string
+}
+
+func (texture *memoryTexture) Close() error {
+
+	texture.sink.mutex.Lock()
+	defer texture.sink.mutex.Unlock()
+
+	texture.sink.files[texture.name] = texture.Bytes()
+
+	return nil
+}
@@ -0,0 +1,114 @@
+package graphics
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SplitManifest describes the files written for a model in split mode, where every mesh is
+// written as its own model.
+type SplitManifest struct {
+	Format string         `json:"format"`
+	UpAxis Axis           `json:"upAxis"`
+	Parts  []PartManifest `json:"parts"`
+}
+
+// PartManifest describes a single part of a split model.
+type PartManifest struct {
+	Name      string      `json:"name"`
+	File      string      `json:"file"`
+	Material  string      `json:"material,omitempty"`
+	Texture   string      `json:"texture,omitempty"`
+	Triangles int         `json:"triangles"`
+	Bounds    BoundingBox `json:"bounds"`
+}
+
+// PartPath is the path of the model file for one part of a split model.
+func PartPath(modelPath string, index int) string {
+	ext := filepath.Ext(modelPath)
+	return fmt.Sprintf("%s-part%d%s", strings.TrimSuffix(modelPath, ext), index, ext)
+}
+
+// ManifestPath is the path of the manifest describing the parts of a split model.
+func ManifestPath(modelPath string) string {
+	return strings.TrimSuffix(modelPath, filepath.Ext(modelPath)) + "-manifest.json"
+}
+
+// splitProcessed separates every mesh of the processed output into its own output. All of the
+// parts share the texture plates of the original output.
+func splitProcessed(processed *processedOutput) []*processedOutput {
+
+	parts := make([]*processedOutput, 0, len(processed.positionVertices))
+	for i := range processed.positionVertices {
+		part := &processedOutput{
+			positionVertices:       [][]float64{processed.positionVertices[i]},
+			normalValues:           [][]float64{processed.normalValues[i]},
+			texcoords:              [][]float32{processed.texcoords[i]},
+			meshNames:              []string{fmt.Sprintf("part%d", i)},
+			texturePlates:          processed.texturePlates,
+			normalTexturePlates:    processed.normalTexturePlates,
+			gearstackTexturePlates: processed.gearstackTexturePlates,
+			pbrTextures:            processed.pbrTextures,
+		}
+		if i < len(processed.meshNames) {
+			part.meshNames[0] = processed.meshNames[i]
+		}
+		if i < len(processed.plateIndices) {
+			part.plateIndices = []int{processed.plateIndices[i]}
+		}
+
+		parts = append(parts, part)
+	}
+
+	return parts
+}
+
+// writeSplit writes every mesh of the processed output as its own model with writePart, and a
+// manifest describing all of the parts next to modelPath. Bounds are multiplied by scale to
+// match the units of the written positions.
+func writeSplit(processed *processedOutput, modelPath, format string, frame CoordinateSystem, scale float64,
+	writePart func(part *processedOutput, path string) (int, error)) error {
+
+	manifest := &SplitManifest{
+		Format: format,
+		UpAxis: frame.UpAxis,
+		Parts:  make([]PartManifest, 0, len(processed.positionVertices)),
+	}
+
+	for i, part := range splitProcessed(processed) {
+		path := PartPath(modelPath, i)
+		triangles, err := writePart(part, path)
+		if err != nil {
+			return err
+		}
+
+		entry := PartManifest{
+			Name:      part.meshNames[0],
+			File:      filepath.Base(path),
+			Triangles: triangles,
+			Bounds:    meshBounds(part.positionVertices[0]).scaled(scale).orZero(),
+		}
+		if len(part.plateIndices) > 0 {
+			if plate := part.texturePlates[part.plateIndices[0]]; plate != nil {
+				entry.Material = plate.libraryMaterialID
+				entry.Texture = plate.name
+			}
+		}
+
+		manifest.Parts = append(manifest.Parts, entry)
+	}
+
+	outF, err := os.OpenFile(ManifestPath(modelPath), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer outF.Close()
+
+	encoder := json.NewEncoder(outF)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(manifest)
+}
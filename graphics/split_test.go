@@ -0,0 +1,110 @@
+package graphics
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSplitPaths(t *testing.T) {
+
+	if path := PartPath("output/1234.stl", 2); path != "output/1234-part2.stl" {
+		t.Errorf("Wrong part path: %s", path)
+	}
+	if path := ManifestPath("output/1234.stl"); path != "output/1234-manifest.json" {
+		t.Errorf("Wrong manifest path: %s", path)
+	}
+}
+
+func TestWriteSplit(t *testing.T) {
+
+	processed := &processedOutput{
+		positionVertices: [][]float64{
+			{0, 0, 0, 1, 0, 0, 0, 1, 0},
+			{0, 0, 0, 2, 0, 0, 0, 0, 3, 0, 0, 0, 0, 0, 3, 0, 1, 0},
+		},
+		normalValues: [][]float64{{}, {}},
+		texcoords:    [][]float32{{}, {}},
+		meshNames:    []string{"geom0-mesh0-part0"},
+		plateIndices: []int{1, 0},
+	}
+	processed.texturePlates[1] = &texturePlate{name: "1234_diffuse.png", libraryMaterialID: "Material1"}
+
+	modelPath := filepath.Join(t.TempDir(), "1234.stl")
+	var written []string
+	err := writeSplit(processed, modelPath, "stl", defaultSTLCoordinateSystem, 10,
+		func(part *processedOutput, path string) (int, error) {
+			if len(part.positionVertices) != 1 || part.texturePlates != processed.texturePlates {
+				t.Errorf("Expected a single mesh sharing the texture plates in %s", path)
+			}
+			written = append(written, filepath.Base(path))
+			return len(part.positionVertices[0]) / 9, nil
+		})
+	if err != nil {
+		t.Fatalf("Failed to write the split model: %s", err.Error())
+	}
+
+	if !reflect.DeepEqual(written, []string{"1234-part0.stl", "1234-part1.stl"}) {
+		t.Errorf("Wrong parts written: %v", written)
+	}
+
+	contents, err := ioutil.ReadFile(ManifestPath(modelPath))
+	if err != nil {
+		t.Fatalf("Expected a manifest next to the model: %s", err.Error())
+	}
+	manifest := &SplitManifest{}
+	if err := json.Unmarshal(contents, manifest); err != nil {
+		t.Fatalf("Failed to parse the manifest: %s", err.Error())
+	}
+
+	expected := &SplitManifest{
+		Format: "stl",
+		UpAxis: ZUp,
+		Parts: []PartManifest{
+			{
+				Name:      "geom0-mesh0-part0",
+				File:      "1234-part0.stl",
+				Material:  "Material1",
+				Texture:   "1234_diffuse.png",
+				Triangles: 1,
+				Bounds:    BoundingBox{Min: [3]float64{0, 0, 0}, Max: [3]float64{10, 10, 0}},
+			},
+			{
+				// Unnamed meshes are named after their index, plates without a texture are left out
+				Name:      "part1",
+				File:      "1234-part1.stl",
+				Triangles: 2,
+				Bounds:    BoundingBox{Min: [3]float64{0, 0, 0}, Max: [3]float64{20, 10, 30}},
+			},
+		},
+	}
+	if !reflect.DeepEqual(manifest, expected) {
+		t.Errorf("Wrong manifest:\nExpected=%+v\nActual=%+v", expected, manifest)
+	}
+}
+
+func TestWriteSplitPartError(t *testing.T) {
+
+	processed := &processedOutput{
+		positionVertices: [][]float64{{0, 0, 0, 1, 0, 0, 0, 1, 0}},
+		normalValues:     [][]float64{{}},
+		texcoords:        [][]float32{{}},
+	}
+
+	modelPath := filepath.Join(t.TempDir(), "1234.dae")
+	failed := errors.New("disk full")
+	err := writeSplit(processed, modelPath, "dae", defaultDAECoordinateSystem, 1,
+		func(part *processedOutput, path string) (int, error) {
+			return 0, failed
+		})
+	if err != failed {
+		t.Errorf("Expected the part error to be returned, got %v", err)
+	}
+	if _, err := os.Stat(ManifestPath(modelPath)); err == nil {
+		t.Errorf("Expected no manifest when a part fails")
+	}
+}
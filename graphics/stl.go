@@ -2,12 +2,12 @@ package graphics
 
 import (
 	"bufio"
-	"bytes"
-	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 
+	"github.com/kpango/glg"
 	"github.com/rking788/destiny-gear-vendor/bungie"
 	"github.com/tidwall/gjson"
 )
@@ -15,13 +15,108 @@ import (
 // STLWriter is a type that wraps all the properties needed to write out an STL file
 // from a given Destiny item model.
 type STLWriter struct {
-	Path string
+	Path    string
+	Options Options
+
+	// Report describes the repairs made to the mesh when the PrintPrep option is set. It is
+	// filled in by WriteModels and WriteModelsTo.
+	Report *PrintReport
+
+	// Reporter is told how far along writing the model is and about any parts that
+	// had to be skipped. It can be nil.
+	Reporter Reporter
 }
 
 // WriteModels will write the provided DestinyGeomtry instances to an output STL file.
 func (stl *STLWriter) WriteModels(geoms []*bungie.DestinyGeometry) error {
 
-	geom := geoms[0]
+	processed, bounds, err := stl.process(geoms)
+	if err != nil {
+		return err
+	}
+
+	frame := stl.coordinateSystem()
+	triangleCount := 0
+	if stl.Options.Split {
+		err = writeSplit(processed, stl.Path, "stl", frame, 1,
+			func(part *processedOutput, path string) (int, error) {
+				triangles := stl.triangles(part)
+				triangleCount += len(triangles)
+				return len(triangles), stl.write(triangles, path)
+			})
+	} else {
+		triangles := stl.triangles(processed)
+		triangleCount = len(triangles)
+		err = stl.write(triangles, stl.Path)
+	}
+	if err != nil {
+		return err
+	}
+	processed.progress("writing", 1, 1)
+
+	if stl.Options.WriteMetadata {
+		metadata := newModelMetadata("stl", processed, frame, stl.Options.Pivot, bounds)
+		metadata.Triangles = triangleCount
+		return writeModelMetadata(stl.Path, metadata)
+	}
+
+	return nil
+}
+
+// WriteModelsTo writes the provided DestinyGeometry instances to w as a single STL solid, Path
+// is not used. The Split and WriteMetadata options need a path so they aren't supported.
+func (stl *STLWriter) WriteModelsTo(w io.Writer, geoms []*bungie.DestinyGeometry) error {
+
+	if stl.Options.Split {
+		return errors.New("Split models can only be written to a path")
+	}
+
+	processed, _, err := stl.process(geoms)
+	if err != nil {
+		return err
+	}
+
+	err = stl.writeTo(stl.triangles(processed), w)
+	if err != nil {
+		return err
+	}
+	processed.progress("writing", 1, 1)
+
+	return nil
+}
+
+// process reads and post-processes the geometries, returning the bounds of the model.
+func (stl *STLWriter) process(geoms []*bungie.DestinyGeometry) (*processedOutput, BoundingBox, error) {
+
+	processed := &processedOutput{
+		positionVertices: make([][]float64, 0, len(geoms)),
+		normalValues:     make([][]float64, 0, len(geoms)),
+		texcoords:        make([][]float32, 0, len(geoms)),
+	}
+
+	processed.reporter = stl.Reporter
+	for i, geom := range geoms {
+		err := stl.collectParts(geom, processed)
+		if err != nil {
+			return nil, BoundingBox{}, err
+		}
+		processed.progress("geometry", i+1, len(geoms))
+	}
+
+	bounds := postProcess(processed, stl.Options, stl.coordinateSystem())
+
+	return processed, bounds, nil
+}
+
+// coordinateSystem is the frame the model will be written in.
+func (stl *STLWriter) coordinateSystem() CoordinateSystem {
+	return stl.Options.CoordinateSystem.withDefaults(defaultSTLCoordinateSystem)
+}
+
+// collectParts reads the triangles of every stage part in the geometry. Only positions are
+// needed for STL so the normals and texture coordinates are left empty.
+func (stl *STLWriter) collectParts(geom *bungie.DestinyGeometry, processed *processedOutput) error {
+
 	result := gjson.Parse(string(geom.MeshesBytes))
 
 	meshes := result.Get("render_model.render_meshes")
@@ -34,6 +129,7 @@ func (stl *STLWriter) WriteModels(geoms []*bungie.DestinyGeometry) error {
 
 	for meshIndex, meshInterface := range meshes.Array() {
 		mesh := meshInterface.Map()
+		partCount := len(processed.positionVertices)
 		positions := [][]float64{}
 		normals := [][]float64{}
 		defVB := mesh["stage_part_vertex_stream_layout_definitions"].Array()[0].Map()["formats"].Array()
@@ -70,15 +166,7 @@ func (stl *STLWriter) WriteModels(geoms []*bungie.DestinyGeometry) error {
 		}
 
 		// Parse the index buffer
-		indexBuffer := make([]int16, 0)
-		indexBufferBytes := geom.GetFileByName(mesh["index_buffer"].Get("file_name").String()).Data
-
-		for i := 0; i < len(indexBufferBytes); i += 2 {
-
-			var index int16
-			binary.Read(bytes.NewBuffer(indexBufferBytes[i:i+2]), binary.LittleEndian, &index)
-			indexBuffer = append(indexBuffer, index)
-		}
+		indexBuffer := parseIndexBuffer(geom.GetFileByName(mesh["index_buffer"].Get("file_name").String()).Data)
 
 		parts := mesh["stage_part_list"].Array()
 
@@ -104,85 +192,111 @@ func (stl *STLWriter) WriteModels(geoms []*bungie.DestinyGeometry) error {
 				continue
 			}
 
-			primitiveType := int(part["primitive_type"].Float())
-			increment := 1
-
-			if primitiveType == 3 {
-				// Process indexBuffer in sets of 3
-				increment = 3
-			} else if primitiveType == 5 {
-				// Process indexBuffer as triangle strip
-				increment = 1
-				count -= 2
-			} else {
-				fmt.Println("Unknown primitive type, skipping this part...")
+			triangles, err := triangulate(indexBuffer, start, count, int(part["primitive_type"].Float()))
+			if err != nil {
+				processed.warn("%s, skipping part %d of mesh %d in %s", err.Error(), i, meshIndex, geom.Name)
 				continue
 			}
 
-			// We need to reverse the order of vertices every other iteration
-			flip := false
+			partPositions := make([]float64, 0, len(triangles)*9)
+			for _, triangle := range triangles {
+				for _, index := range triangle {
+					if int(index) >= len(positions) {
+						return errors.New("Index buffer value is outside the bounds of the positions array")
+					}
+					position := positions[index]
+					partPositions = append(partPositions, position[0], position[1], position[2])
+				}
+			}
 
-			// Construct and write this mesh header
-			meshName := fmt.Sprintf("%s_%d_%d", geom.Name, meshIndex, i)
+			processed.positionVertices = append(processed.positionVertices, partPositions)
+			processed.normalValues = append(processed.normalValues, []float64{})
+			processed.texcoords = append(processed.texcoords, []float32{})
+		}
 
-			// TODO: This should check if the file exists and remove it first probably
-			f, err := os.OpenFile(stl.Path, os.O_RDWR|os.O_CREATE, 0644)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
+		processed.nameParts(geom.Name, meshIndex, partCount)
+	}
 
-			bufferedWriter := bufio.NewWriter(f)
-			bufferedWriter.Write([]byte(fmt.Sprintf("solid %s\n", meshName)))
+	return nil
+}
 
-			for j := 0; j < count; j += increment {
+// triangles returns the triangles that will be written for the processed output, after they
+// have been repaired for printing if that was requested.
+func (stl *STLWriter) triangles(processed *processedOutput) [][3][3]float64 {
 
-				if (start + j + 2) >= len(indexBuffer) {
-					fmt.Println("Skipping j=", j)
-					continue
-				}
+	if stl.Options.PrintPrep == nil {
+		triangles := make([][3][3]float64, 0, 1024)
+		for _, positions := range processed.positionVertices {
+			triangles = appendTriangles(triangles, positions)
+		}
+		return triangles
+	}
 
-				// Skip if any two of the indexBuffer match (ignoring lines or points)
-				if indexBuffer[start+j+0] == indexBuffer[start+j+1] || indexBuffer[start+j+0] == indexBuffer[start+j+2] || indexBuffer[start+j+1] == indexBuffer[start+j+2] {
-					flip = !flip
-					continue
-				}
+	triangles, report := prepareForPrinting(processed, *stl.Options.PrintPrep)
+	glg.Infof("Print preparation: %+v", *report)
+	if stl.Report == nil {
+		stl.Report = &PrintReport{}
+	}
+	stl.Report.add(report)
+
+	return triangles
+}
 
-				// Write the normal and loop start to file
-				// the normal doesn't matter for this, the order of vertices does
-				bufferedWriter.Write([]byte("facet normal 0.0 0.0 0.0\n  outer loop\n"))
+// write writes the triangles to the output path as a single ASCII STL solid.
+func (stl *STLWriter) write(triangles [][3][3]float64, path string) error {
 
-				// flip the triangle only when using primitive_type 5
-				if flip && (primitiveType == 5) {
-					for k := 2; k >= 0; k-- {
-						v := [4]float64{}
-						for l := 0; l < 4; l++ {
-							v[l] = positions[indexBuffer[start+j+k]][l]
-						}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
 
-						bufferedWriter.Write([]byte(fmt.Sprintf("    vertex %.9f %.9f %.9f\n", v[0], v[1], v[2])))
-					}
-				} else {
-					// write the three vertices to the file in forward order
-					for k := 0; k < 3; k++ {
-						v := [4]float64{}
-						for l := 0; l < 4; l++ {
-							v[l] = positions[indexBuffer[start+j+k]][l]
-						}
-
-						bufferedWriter.Write([]byte(fmt.Sprintf("    vertex %.9f %.9f %.9f\n", v[0], v[1], v[2])))
-					}
-				}
+	err = stl.writeTo(triangles, f)
+	if err != nil {
+		return err
+	}
 
-				// Write the loop and normal end to file
-				bufferedWriter.Write([]byte("  endloop\nendfacet\n"))
+	return f.Close()
+}
 
-				flip = !flip
-			}
+// writeTo writes the triangles to w as a single ASCII STL solid.
+func (stl *STLWriter) writeTo(triangles [][3][3]float64, w io.Writer) error {
 
-			bufferedWriter.Flush()
+	bufferedWriter := bufio.NewWriterSize(w, writeBufferSize)
+	numbers := newNumberWriter(bufferedWriter, stl.Options.precision())
+	numbers.writeString("solid destiny\n")
+
+	for _, triangle := range triangles {
+		normal := faceNormal(triangle[0], triangle[1], triangle[2])
+		if length := vectorLength(normal); length > 0 {
+			normal = [3]float64{normal[0] / length, normal[1] / length, normal[2] / length}
+		}
+
+		numbers.writeString("facet normal ")
+		numbers.writeFloats(normal[:])
+		numbers.writeString("\n  outer loop\n")
+		for _, v := range triangle {
+			numbers.writeString("    vertex ")
+			numbers.writeFloats(v[:])
+			numbers.writeString("\n")
 		}
+		numbers.writeString("  endloop\nendfacet\n")
 	}
 
-	return nil
+	numbers.writeString("endsolid destiny\n")
+
+	return bufferedWriter.Flush()
+}
+
+// appendTriangles appends the triangles from a flat list of xyz positions.
+func appendTriangles(triangles [][3][3]float64, positions []float64) [][3][3]float64 {
+	for i := 0; i+8 < len(positions); i += 9 {
+		triangles = append(triangles, [3][3]float64{
+			{positions[i], positions[i+1], positions[i+2]},
+			{positions[i+3], positions[i+4], positions[i+5]},
+			{positions[i+6], positions[i+7], positions[i+8]},
+		})
+	}
+
+	return triangles
 }
@@ -0,0 +1,59 @@
+package graphics
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/kpango/glg"
+)
+
+func TestSTLWriteToPrecision(t *testing.T) {
+
+	triangles := [][3][3]float64{{{0, 0, 0}, {1.23456789, 0, 0}, {0, 1, 0}}}
+
+	expected := "solid destiny\n" +
+		"facet normal 0.000 0.000 1.000\n  outer loop\n" +
+		"    vertex 0.000 0.000 0.000\n" +
+		"    vertex 1.235 0.000 0.000\n" +
+		"    vertex 0.000 1.000 0.000\n" +
+		"  endloop\nendfacet\n" +
+		"endsolid destiny\n"
+
+	out := &bytes.Buffer{}
+	stl := &STLWriter{Options: Options{Precision: 3}}
+	if err := stl.writeTo(triangles, out); err != nil {
+		t.Fatalf("Failed to write STL: %s", err.Error())
+	}
+	if out.String() != expected {
+		t.Errorf("Wrong STL:\nExpected=%q\nActual=%q", expected, out.String())
+	}
+
+	out.Reset()
+	stl.Options.Precision = -1
+	if err := stl.writeTo(triangles, out); err != nil {
+		t.Fatalf("Failed to write STL: %s", err.Error())
+	}
+	if !bytes.Contains(out.Bytes(), []byte("    vertex 1.23456789 0 0\n")) {
+		t.Errorf("Expected the shortest exact representation, got %q", out.String())
+	}
+}
+
+func BenchmarkSTLWrite(b *testing.B) {
+
+	glg.Get().SetMode(glg.NONE)
+	defer glg.Get().SetMode(glg.STD)
+
+	path := filepath.Join(b.TempDir(), "model.stl")
+	stl := &STLWriter{Path: path}
+	triangles := stl.triangles(benchmarkModel())
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := stl.write(triangles, path)
+		if err != nil {
+			b.Fatalf("Failed to write STL: %s", err.Error())
+		}
+	}
+}
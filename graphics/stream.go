@@ -0,0 +1,87 @@
+package graphics
+
+import (
+	"bufio"
+	"strconv"
+)
+
+// DefaultPrecision is the number of decimal places floats are written with when the options
+// don't specify one, the same as the %f verb.
+const DefaultPrecision = 6
+
+// writeBufferSize is the size of the buffer models are streamed to their output through.
+const writeBufferSize = 64 * 1024
+
+// precision is the strconv precision to format floats with for the options.
+func (options Options) precision() int {
+	if options.Precision < 0 {
+		// Shortest representation that reads back to the same value
+		return -1
+	} else if options.Precision == 0 {
+		return DefaultPrecision
+	}
+
+	return options.Precision
+}
+
+// numberWriter formats numbers directly into a buffered writer. The formatting buffer is reused
+// so writing large vertex arrays doesn't allocate a string for every value. Write errors are
+// kept by the bufio.Writer and returned when it is flushed.
+type numberWriter struct {
+	w         *bufio.Writer
+	precision int
+	buf       []byte
+}
+
+func newNumberWriter(w *bufio.Writer, precision int) *numberWriter {
+	return &numberWriter{w: w, precision: precision, buf: make([]byte, 0, 32)}
+}
+
+func (nw *numberWriter) writeString(s string) {
+	nw.w.WriteString(s)
+}
+
+func (nw *numberWriter) writeInt(i int) {
+	nw.buf = strconv.AppendInt(nw.buf[:0], int64(i), 10)
+	nw.w.Write(nw.buf)
+}
+
+func (nw *numberWriter) writeFloat(f float64) {
+	nw.buf = strconv.AppendFloat(nw.buf[:0], f, 'f', nw.precision, 64)
+	nw.w.Write(nw.buf)
+}
+
+func (nw *numberWriter) writeFloat32(f float32) {
+	nw.buf = strconv.AppendFloat(nw.buf[:0], float64(f), 'f', nw.precision, 32)
+	nw.w.Write(nw.buf)
+}
+
+// writeFloats writes the values separated by spaces.
+func (nw *numberWriter) writeFloats(values []float64) {
+	for i, value := range values {
+		if i > 0 {
+			nw.w.WriteByte(' ')
+		}
+		nw.writeFloat(value)
+	}
+}
+
+// writeFloat32s writes the values separated by spaces.
+func (nw *numberWriter) writeFloat32s(values []float32) {
+	for i, value := range values {
+		if i > 0 {
+			nw.w.WriteByte(' ')
+		}
+		nw.writeFloat32(value)
+	}
+}
+
+// writeSequence writes the integers 0 to count-1 separated by sep.
+func (nw *numberWriter) writeSequence(count int, sep string) {
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			nw.w.WriteString(sep)
+		}
+		nw.writeInt(i)
+	}
+}
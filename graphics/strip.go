@@ -0,0 +1,90 @@
+package graphics
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Primitive types used by the stage parts of a render mesh.
+const (
+	primitiveTriangleList  = 3
+	primitiveTriangleStrip = 5
+)
+
+// stripRestartIndex ends the current triangle strip, the next index starts a new strip.
+const stripRestartIndex = 0xFFFF
+
+// errUnknownPrimitive is returned for stage parts that aren't made of triangles.
+var errUnknownPrimitive = errors.New("Unknown primitive type")
+
+// parseIndexBuffer decodes an index buffer of little endian, unsigned 16 bit indices.
+func parseIndexBuffer(data []byte) []uint16 {
+
+	indices := make([]uint16, len(data)/2)
+	for i := range indices {
+		indices[i] = binary.LittleEndian.Uint16(data[i*2:])
+	}
+
+	return indices
+}
+
+// triangulate converts the count indices starting at start into a list of triangles. The
+// corners of list triangles are reversed (2, 1, 0), matching the winding the models have always
+// been written with. Triangle strips are unrolled so every
+// triangle keeps the winding of the first one in its strip. Restart indices start a new strip
+// and degenerate triangles (used to stitch strips together) are dropped, though they still count
+// towards the alternating winding of the strip.
+func triangulate(indices []uint16, start, count, primitiveType int) ([][3]uint16, error) {
+
+	if start < 0 || count < 0 || start+count > len(indices) {
+		return nil, errors.New("Stage part indices are outside the bounds of the index buffer")
+	}
+	indices = indices[start : start+count]
+
+	switch primitiveType {
+	case primitiveTriangleList:
+		triangles := make([][3]uint16, 0, count/3)
+		for i := 0; i+2 < len(indices); i += 3 {
+			triangle := [3]uint16{indices[i+2], indices[i+1], indices[i]}
+			if !isDegenerate(triangle) {
+				triangles = append(triangles, triangle)
+			}
+		}
+
+		return triangles, nil
+	case primitiveTriangleStrip:
+		triangles := make([][3]uint16, 0, count)
+
+		// stripLength is the number of indices read since the start of the current strip
+		stripLength := 0
+		for i, index := range indices {
+			if index == stripRestartIndex {
+				stripLength = 0
+				continue
+			}
+
+			stripLength++
+			if stripLength < 3 {
+				continue
+			}
+
+			triangle := [3]uint16{indices[i-2], indices[i-1], index}
+			if stripLength%2 == 0 {
+				// Every other triangle in a strip is wound the opposite way
+				triangle[0], triangle[1] = triangle[1], triangle[0]
+			}
+			if !isDegenerate(triangle) {
+				triangles = append(triangles, triangle)
+			}
+		}
+
+		return triangles, nil
+	}
+
+	return nil, errUnknownPrimitive
+}
+
+// isDegenerate is true for triangles that reuse a vertex, these are lines or points.
+func isDegenerate(triangle [3]uint16) bool {
+	return triangle[0] == triangle[1] || triangle[1] == triangle[2] || triangle[0] == triangle[2]
+}
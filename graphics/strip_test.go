@@ -0,0 +1,167 @@
+package graphics
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseIndexBuffer(t *testing.T) {
+
+	indices := parseIndexBuffer([]byte{0x01, 0x00, 0xff, 0x7f, 0x00, 0x80, 0xff, 0xff})
+	expected := []uint16{1, 0x7fff, 0x8000, 0xffff}
+	if !reflect.DeepEqual(indices, expected) {
+		t.Errorf("Wrong indices: Expected=%v, Actual=%v", expected, indices)
+	}
+}
+
+func TestTriangulate(t *testing.T) {
+
+	tests := []struct {
+		name          string
+		indices       []uint16
+		start         int
+		count         int
+		primitiveType int
+		expected      [][3]uint16
+	}{
+		{
+			name:          "list",
+			indices:       []uint16{0, 1, 2, 2, 1, 3},
+			count:         6,
+			primitiveType: primitiveTriangleList,
+			expected:      [][3]uint16{{2, 1, 0}, {3, 1, 2}},
+		},
+		{
+			name:          "list skips degenerates",
+			indices:       []uint16{0, 1, 1, 2, 1, 3},
+			count:         6,
+			primitiveType: primitiveTriangleList,
+			expected:      [][3]uint16{{3, 1, 2}},
+		},
+		{
+			name:          "strip",
+			indices:       []uint16{0, 1, 2, 3, 4},
+			count:         5,
+			primitiveType: primitiveTriangleStrip,
+			expected:      [][3]uint16{{0, 1, 2}, {2, 1, 3}, {2, 3, 4}},
+		},
+		{
+			name:          "strip with offset",
+			indices:       []uint16{9, 9, 0, 1, 2, 3, 9},
+			start:         2,
+			count:         4,
+			primitiveType: primitiveTriangleStrip,
+			expected:      [][3]uint16{{0, 1, 2}, {2, 1, 3}},
+		},
+		{
+			// Degenerates stitching two strips together still flip the winding, so the
+			// second strip starts with the correct orientation.
+			name:          "strip with degenerates",
+			indices:       []uint16{0, 1, 2, 3, 3, 4, 4, 5, 6},
+			count:         9,
+			primitiveType: primitiveTriangleStrip,
+			expected:      [][3]uint16{{0, 1, 2}, {2, 1, 3}, {4, 5, 6}},
+		},
+		{
+			name:          "strip with odd degenerates",
+			indices:       []uint16{0, 1, 2, 2, 4, 5, 6},
+			count:         7,
+			primitiveType: primitiveTriangleStrip,
+			expected:      [][3]uint16{{0, 1, 2}, {4, 2, 5}, {4, 5, 6}},
+		},
+		{
+			name:          "strip with restart",
+			indices:       []uint16{0, 1, 2, 3, stripRestartIndex, 4, 5, 6, 7},
+			count:         9,
+			primitiveType: primitiveTriangleStrip,
+			expected:      [][3]uint16{{0, 1, 2}, {2, 1, 3}, {4, 5, 6}, {6, 5, 7}},
+		},
+		{
+			name:          "strip too short",
+			indices:       []uint16{0, 1, stripRestartIndex, 2, 3},
+			count:         5,
+			primitiveType: primitiveTriangleStrip,
+			expected:      [][3]uint16{},
+		},
+		{
+			name:          "indices above 32767",
+			indices:       []uint16{40000, 40001, 40002},
+			count:         3,
+			primitiveType: primitiveTriangleStrip,
+			expected:      [][3]uint16{{40000, 40001, 40002}},
+		},
+	}
+
+	for _, test := range tests {
+		triangles, err := triangulate(test.indices, test.start, test.count, test.primitiveType)
+		if err != nil {
+			t.Errorf("%s: Failed with error: %s", test.name, err.Error())
+			continue
+		}
+
+		if !reflect.DeepEqual(triangles, test.expected) {
+			t.Errorf("%s: Wrong triangles: Expected=%v, Actual=%v", test.name, test.expected, triangles)
+		}
+	}
+}
+
+func TestTriangulateErrors(t *testing.T) {
+
+	_, err := triangulate([]uint16{0, 1, 2}, 1, 3, primitiveTriangleStrip)
+	if err == nil {
+		t.Error("Expected an error for indices outside the index buffer")
+	}
+
+	_, err = triangulate([]uint16{0, 1, 2}, 0, 3, 1)
+	if err != errUnknownPrimitive {
+		t.Errorf("Expected unknown primitive error, Actual=%v", err)
+	}
+}
+
+// TestTriangulateStripOrientation checks that every triangle unrolled from a strip over a
+// flat grid faces the same way.
+func TestTriangulateStripOrientation(t *testing.T) {
+
+	// Two rows of vertices along x, zig-zagging between y=0 and y=1
+	positions := make([][3]float64, 0, 10)
+	indices := make([]uint16, 0, 10)
+	for i := 0; i < 5; i++ {
+		positions = append(positions, [3]float64{float64(i), 0, 0}, [3]float64{float64(i), 1, 0})
+		indices = append(indices, uint16(i*2), uint16(i*2+1))
+	}
+	// Stitch in a degenerate pair to make sure it doesn't break the parity
+	indices = append(indices[:6], append([]uint16{indices[5], indices[5]}, indices[6:]...)...)
+
+	triangles, err := triangulate(indices, 0, len(indices), primitiveTriangleStrip)
+	if err != nil {
+		t.Fatalf("Failed with error: %s", err.Error())
+	}
+	// The repeated index replaces the triangle (4, 5, 6)
+	if len(triangles) != 7 {
+		t.Errorf("Wrong triangle count: Expected=7, Actual=%d", len(triangles))
+	}
+
+	for _, triangle := range triangles {
+		normal := faceNormal(positions[triangle[0]], positions[triangle[1]], positions[triangle[2]])
+		if normal[2] >= 0 {
+			t.Errorf("Triangle %v is facing the wrong way: normal=%v", triangle, normal)
+		}
+	}
+}
+
+// TestTriangulateListWinding pins the winding of triangle lists, which are written with their
+// corners reversed so models keep facing the way they always have.
+func TestTriangulateListWinding(t *testing.T) {
+
+	positions := [][3]float64{{0, 0, 0}, {1, 0, 0}, {0, 1, 0}}
+	triangles, err := triangulate([]uint16{0, 1, 2}, 0, 3, primitiveTriangleList)
+	if err != nil || len(triangles) != 1 {
+		t.Fatalf("Expected one triangle, got %v (%v)", triangles, err)
+	}
+
+	triangle := triangles[0]
+	normal := faceNormal(positions[triangle[0]], positions[triangle[1]], positions[triangle[2]])
+	if normal[2] >= 0 {
+		t.Errorf("Expected the counter-clockwise list triangle to be reversed, got %v with normal %v", triangle, normal)
+	}
+}
@@ -0,0 +1,333 @@
+package graphics
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"path/filepath"
+	"strings"
+)
+
+// TextureOptions controls how the texture plates are written alongside a model.
+type TextureOptions struct {
+	// MaxSize is the largest width or height a texture will be written at, larger textures are
+	// scaled down keeping their aspect ratio. Zero writes the plates at their full size.
+	MaxSize int `json:"maxSize,omitempty"`
+	// PowerOfTwo scales every texture to the nearest power of two size, which some engines
+	// need for mipmapping and texture compression.
+	PowerOfTwo bool `json:"powerOfTwo,omitempty"`
+	// Grayscale writes the single channel ambient occlusion, metalness, roughness and emissive
+	// maps as grayscale PNGs instead of full RGBA images.
+	Grayscale bool `json:"grayscale,omitempty"`
+	// PackORM writes the ambient occlusion, roughness and metalness maps into the red, green and
+	// blue channels of a single ORM texture, as used by glTF, instead of three separate maps.
+	// DAE models always get separate maps since COLLADA can't select a channel of a texture.
+	PackORM bool `json:"packORM,omitempty"`
+	// Format is the file format the textures are written in, PNG and JPEG by default.
+	Format TextureFormat `json:"format,omitempty"`
+	// Gearstack describes how to decode the gearstack plates into the PBR maps. The
+	// DefaultGearstackOptions are used when it is nil.
+	Gearstack *GearstackOptions `json:"gearstack,omitempty"`
+}
+
+// validate returns an error if any of the options is out of range.
+func (options TextureOptions) validate() error {
+
+	if options.MaxSize < 0 || options.MaxSize > MaxTextureSize {
+		return fmt.Errorf("max texture size must be between 0 and %d: %d", MaxTextureSize, options.MaxSize)
+	}
+	if format, err := ParseTextureFormat(string(options.Format)); err != nil || format != options.Format {
+		return fmt.Errorf("Unknown texture format: %s", options.Format)
+	}
+	if options.Gearstack != nil {
+		return options.Gearstack.validate()
+	}
+
+	return nil
+}
+
+// fileName is the name a texture is written with, the extension is changed to match the
+// texture format. Textures written with anything other than the default options get a suffix
+// so variants written next to each other don't replace the textures of another model.
+func (options TextureOptions) fileName(name string) string {
+
+	ext := filepath.Ext(name)
+	if options.Format != TextureFormatSource {
+		ext = ".ktx2"
+	}
+
+	return strings.TrimSuffix(name, filepath.Ext(name)) + options.variant() + ext
+}
+
+// variant is the suffix added to the names of textures written with these options, it is empty
+// for the default options.
+func (options TextureOptions) variant() string {
+
+	encoded, _ := json.Marshal(options)
+	defaults, _ := json.Marshal(TextureOptions{})
+	if bytes.Equal(encoded, defaults) {
+		return ""
+	}
+
+	sum := sha1.Sum(encoded)
+	return fmt.Sprintf("-%x", sum[:4])
+}
+
+// pbrTextureNames are the file names of the textures exploded from a gearstack plate, and the
+// channel of each texture that holds the value.
+type pbrTextureNames struct {
+	ao, metalness, roughness, emissive string
+
+	// These are all "r" unless the maps are packed into a single ORM texture
+	aoChannel, roughnessChannel, metalnessChannel string
+}
+
+// pbrName is the file name of the texture of the given kind (AO, metalness, ...) exploded from
+// this gearstack plate.
+func (plate *texturePlate) pbrName(kind string, singleChannel bool) string {
+
+	name := strings.Replace(plate.name, "gearstack", kind, -1)
+	if singleChannel {
+		// JPEGs can't be written with a single channel
+		name = strings.TrimSuffix(name, filepath.Ext(name)) + ".png"
+	}
+
+	return name
+}
+
+// pbrTextureNames returns the names of all of the textures exploded from this gearstack plate.
+func (plate *texturePlate) pbrTextureNames(options TextureOptions) pbrTextureNames {
+
+	if options.PackORM {
+		orm := options.fileName(plate.pbrName("ORM", true))
+		return pbrTextureNames{
+			ao:               orm,
+			metalness:        orm,
+			roughness:        orm,
+			emissive:         options.fileName(plate.pbrName("emissive", options.Grayscale)),
+			aoChannel:        "r",
+			roughnessChannel: "g",
+			metalnessChannel: "b",
+		}
+	}
+
+	return pbrTextureNames{
+		ao:               options.fileName(plate.pbrName("AO", options.Grayscale)),
+		metalness:        options.fileName(plate.pbrName("metalness", options.Grayscale)),
+		roughness:        options.fileName(plate.pbrName("roughness", options.Grayscale)),
+		emissive:         options.fileName(plate.pbrName("emissive", options.Grayscale)),
+		aoChannel:        "r",
+		roughnessChannel: "r",
+		metalnessChannel: "r",
+	}
+}
+
+// textureSize is the size a width x height texture will be written at.
+func (options TextureOptions) textureSize(width, height int) (int, int) {
+
+	if options.MaxSize > 0 && (width > options.MaxSize || height > options.MaxSize) {
+		scale := float64(options.MaxSize) / math.Max(float64(width), float64(height))
+		width = int(math.Max(1, math.Round(float64(width)*scale)))
+		height = int(math.Max(1, math.Round(float64(height)*scale)))
+	}
+
+	if options.PowerOfTwo {
+		width = nearestPowerOfTwo(width, options.MaxSize)
+		height = nearestPowerOfTwo(height, options.MaxSize)
+	}
+
+	return width, height
+}
+
+// nearestPowerOfTwo rounds size to the closest power of two that is no larger than max (if set).
+func nearestPowerOfTwo(size, max int) int {
+
+	lower := 1
+	for lower*2 <= size {
+		lower *= 2
+	}
+
+	nearest := lower
+	if size-lower > lower*2-size {
+		nearest = lower * 2
+	}
+	for max > 0 && nearest > max && nearest > 1 {
+		nearest /= 2
+	}
+
+	return nearest
+}
+
+// prepareTexture resizes the texture as requested by the options. Images that are already the
+// right size are returned as they are.
+func prepareTexture(img image.Image, options TextureOptions) image.Image {
+
+	width, height := options.textureSize(img.Bounds().Dx(), img.Bounds().Dy())
+	if width == img.Bounds().Dx() && height == img.Bounds().Dy() {
+		return img
+	}
+
+	resized := resample(img, width, height)
+	if _, ok := img.(*image.Gray); ok {
+		return toGray(resized)
+	}
+
+	return resized
+}
+
+// mipmaps returns the full chain of mip levels for img, starting with img itself and halving the
+// size of each level down to 1x1.
+func mipmaps(img image.Image) []image.Image {
+
+	levels := []image.Image{img}
+	_, isGray := img.(*image.Gray)
+	for width, height := img.Bounds().Dx(), img.Bounds().Dy(); width > 1 || height > 1; {
+		width = int(math.Max(1, float64(width/2)))
+		height = int(math.Max(1, float64(height/2)))
+
+		var level image.Image = resample(levels[len(levels)-1], width, height)
+		if isGray {
+			level = toGray(level)
+		}
+		levels = append(levels, level)
+	}
+
+	return levels
+}
+
+// toGray converts img to a single channel image using the red channel. The PBR maps store the
+// same value in every channel so nothing is lost.
+func toGray(img image.Image) *image.Gray {
+
+	if gray, ok := img.(*image.Gray); ok {
+		return gray
+	}
+
+	b := img.Bounds()
+	gray := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			r, _, _, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			gray.Pix[y*gray.Stride+x] = uint8(r >> 8)
+		}
+	}
+
+	return gray
+}
+
+// PackORM combines the ambient occlusion, roughness and metalness maps into the red, green and
+// blue channels of a single texture.
+func PackORM(ao, roughness, metalness image.Image) *image.NRGBA {
+
+	b := ao.Bounds()
+	orm := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			r, _, _, _ := ao.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			g, _, _, _ := roughness.At(roughness.Bounds().Min.X+x, roughness.Bounds().Min.Y+y).RGBA()
+			bl, _, _, _ := metalness.At(metalness.Bounds().Min.X+x, metalness.Bounds().Min.Y+y).RGBA()
+			orm.SetNRGBA(x, y, color.NRGBA{uint8(r >> 8), uint8(g >> 8), uint8(bl >> 8), 255})
+		}
+	}
+
+	return orm
+}
+
+// resample scales img to width x height with a Catmull-Rom filter. The filter is stretched when
+// shrinking so every source pixel contributes and the result doesn't alias.
+func resample(img image.Image, width, height int) *image.NRGBA {
+
+	b := img.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+
+	// Resize horizontally into a float buffer then vertically into the result
+	columns := resampleWeights(b.Dx(), width)
+	horizontal := make([]float64, width*b.Dy()*4)
+	for y := 0; y < b.Dy(); y++ {
+		row := src.Pix[y*src.Stride:]
+		for x, weights := range columns {
+			out := horizontal[(y*width+x)*4:]
+			for _, w := range weights {
+				for c := 0; c < 4; c++ {
+					out[c] += float64(row[w.index*4+c]) * w.weight
+				}
+			}
+		}
+	}
+
+	rows := resampleWeights(b.Dy(), height)
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y, weights := range rows {
+		for x := 0; x < width; x++ {
+			var sum [4]float64
+			for _, w := range weights {
+				in := horizontal[(w.index*width+x)*4:]
+				for c := 0; c < 4; c++ {
+					sum[c] += in[c] * w.weight
+				}
+			}
+
+			out := dst.Pix[y*dst.Stride+x*4:]
+			for c := 0; c < 4; c++ {
+				out[c] = uint8(math.Max(0, math.Min(255, math.Round(sum[c]))))
+			}
+		}
+	}
+
+	return dst
+}
+
+type resampleWeight struct {
+	index  int
+	weight float64
+}
+
+// resampleWeights returns the source pixels, and how much each contributes, for every pixel
+// when resizing a row of srcSize pixels to dstSize pixels.
+func resampleWeights(srcSize, dstSize int) [][]resampleWeight {
+
+	scale := float64(srcSize) / float64(dstSize)
+	filterScale := math.Max(scale, 1)
+	support := 2 * filterScale
+
+	weights := make([][]resampleWeight, dstSize)
+	for i := range weights {
+		center := (float64(i)+0.5)*scale - 0.5
+		total := 0.0
+		for j := int(math.Ceil(center - support)); j <= int(math.Floor(center+support)); j++ {
+			w := catmullRom((float64(j) - center) / filterScale)
+			if w == 0 {
+				continue
+			}
+
+			// Clamp to the edge of the image
+			index := int(math.Max(0, math.Min(float64(srcSize-1), float64(j))))
+			weights[i] = append(weights[i], resampleWeight{index, w})
+			total += w
+		}
+
+		for j := range weights[i] {
+			weights[i][j].weight /= total
+		}
+	}
+
+	return weights
+}
+
+func catmullRom(x float64) float64 {
+
+	x = math.Abs(x)
+	if x < 1 {
+		return (1.5*x-2.5)*x*x + 1
+	} else if x < 2 {
+		return ((-0.5*x+2.5)*x-4)*x + 2
+	}
+
+	return 0
+}
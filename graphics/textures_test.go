@@ -0,0 +1,162 @@
+package graphics
+
+import (
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+func TestTextureFileName(t *testing.T) {
+
+	if name := (TextureOptions{}).fileName("1234_diffuse.jpg"); name != "1234_diffuse.jpg" {
+		t.Errorf("Expected the default options to keep the name, got %s", name)
+	}
+
+	variants := []TextureOptions{
+		{MaxSize: 512},
+		{MaxSize: 1024},
+		{MaxSize: 512, PowerOfTwo: true},
+		{Grayscale: true},
+		{Format: TextureFormatKTX2},
+		{Format: TextureFormatBasis},
+		{Gearstack: &GearstackOptions{InvertAO: true}},
+	}
+
+	seen := map[string]bool{"1234_diffuse.jpg": true}
+	for _, options := range variants {
+		name := options.fileName("1234_diffuse.jpg")
+		if seen[name] {
+			t.Errorf("Expected a unique name for %+v, got %s", options, name)
+		}
+		seen[name] = true
+
+		if !strings.HasPrefix(name, "1234_diffuse-") {
+			t.Errorf("Expected a suffix after the name for %+v, got %s", options, name)
+		}
+		if options.Format != TextureFormatSource && !strings.HasSuffix(name, ".ktx2") {
+			t.Errorf("Expected a KTX2 extension for %+v, got %s", options, name)
+		}
+	}
+
+	if (TextureOptions{MaxSize: 512}).fileName("a.png") != (TextureOptions{MaxSize: 512}).fileName("a.png") {
+		t.Errorf("Expected the same options to give the same name")
+	}
+}
+
+func TestPBRTextureNames(t *testing.T) {
+
+	plate := &texturePlate{name: "1234_gearstack.jpg"}
+
+	names := plate.pbrTextureNames(TextureOptions{})
+	if names.ao != "1234_AO.jpg" || names.metalness != "1234_metalness.jpg" || names.roughness != "1234_roughness.jpg" {
+		t.Errorf("Wrong default names: %+v", names)
+	}
+
+	options := TextureOptions{PackORM: true}
+	names = plate.pbrTextureNames(options)
+	orm := "1234_ORM" + options.variant() + ".png"
+	if names.ao != orm || names.roughness != orm || names.metalness != orm {
+		t.Errorf("Expected every map to point at %s: %+v", orm, names)
+	}
+	if names.aoChannel != "r" || names.roughnessChannel != "g" || names.metalnessChannel != "b" {
+		t.Errorf("Wrong ORM channels: %+v", names)
+	}
+}
+
+func TestTextureSize(t *testing.T) {
+
+	tests := []struct {
+		options              TextureOptions
+		width, height        int
+		expectedW, expectedH int
+	}{
+		{TextureOptions{}, 1000, 600, 1000, 600},
+		{TextureOptions{MaxSize: 500}, 1000, 600, 500, 300},
+		{TextureOptions{MaxSize: 2048}, 1000, 600, 1000, 600},
+		{TextureOptions{PowerOfTwo: true}, 1000, 600, 1024, 512},
+		{TextureOptions{MaxSize: 512, PowerOfTwo: true}, 1000, 600, 512, 256},
+	}
+
+	for _, test := range tests {
+		width, height := test.options.textureSize(test.width, test.height)
+		if width != test.expectedW || height != test.expectedH {
+			t.Errorf("Wrong size for %+v: Expected=%dx%d, Actual=%dx%d", test.options, test.expectedW, test.expectedH, width, height)
+		}
+	}
+}
+
+func TestPrepareTexture(t *testing.T) {
+
+	img := image.NewNRGBA(image.Rect(0, 0, 8, 4))
+	if prepareTexture(img, TextureOptions{MaxSize: 8}) != img {
+		t.Errorf("Expected a texture that is already small enough to be returned as it is")
+	}
+
+	resized := prepareTexture(img, TextureOptions{MaxSize: 4})
+	if resized.Bounds() != image.Rect(0, 0, 4, 2) {
+		t.Errorf("Wrong resized bounds: %v", resized.Bounds())
+	}
+
+	gray := image.NewGray(image.Rect(0, 0, 8, 8))
+	if _, ok := prepareTexture(gray, TextureOptions{MaxSize: 2}).(*image.Gray); !ok {
+		t.Errorf("Expected grayscale textures to stay grayscale")
+	}
+}
+
+func TestResample(t *testing.T) {
+
+	// A solid color has to stay the same color at any size
+	solid := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for i := 0; i < len(solid.Pix); i += 4 {
+		copy(solid.Pix[i:], []uint8{200, 100, 50, 255})
+	}
+	for _, size := range [][2]int{{4, 4}, {32, 8}, {1, 1}} {
+		resized := resample(solid, size[0], size[1])
+		if resized.Bounds() != image.Rect(0, 0, size[0], size[1]) {
+			t.Errorf("Wrong bounds: %v", resized.Bounds())
+		}
+		for i := 0; i < len(resized.Pix); i += 4 {
+			if c := resized.Pix[i : i+4]; c[0] != 200 || c[1] != 100 || c[2] != 50 || c[3] != 255 {
+				t.Fatalf("Wrong color when resizing to %v: %v", size, c)
+			}
+		}
+	}
+
+	// Halving black and white stripes averages them instead of picking one
+	stripes := image.NewGray(image.Rect(0, 0, 8, 1))
+	for x := 0; x < 8; x += 2 {
+		stripes.SetGray(x, 0, color.Gray{255})
+	}
+	resized := resample(stripes, 2, 1)
+	for x := 0; x < 2; x++ {
+		if r := resized.NRGBAAt(x, 0).R; r < 100 || r > 155 {
+			t.Errorf("Expected the stripes to average out at %d, got %d", x, r)
+		}
+	}
+}
+
+func TestPackORM(t *testing.T) {
+
+	bounds := image.Rect(0, 0, 2, 2)
+	ao := image.NewGray(bounds)
+	roughness := image.NewGray(bounds)
+	// The maps don't have to start at the origin
+	metalness := image.NewGray(image.Rect(5, 5, 7, 7))
+	for i := range ao.Pix {
+		ao.Pix[i] = uint8(10 + i)
+		roughness.Pix[i] = uint8(20 + i)
+		metalness.Pix[i] = uint8(30 + i)
+	}
+
+	orm := PackORM(ao, roughness, metalness)
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 2; x++ {
+			i := uint8(y*2 + x)
+			expected := color.NRGBA{10 + i, 20 + i, 30 + i, 255}
+			if c := orm.NRGBAAt(x, y); c != expected {
+				t.Errorf("Wrong ORM value at %d,%d: Expected=%v, Actual=%v", x, y, expected, c)
+			}
+		}
+	}
+}
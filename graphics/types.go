@@ -1,6 +1,8 @@
 package graphics
 
 import (
+	"errors"
+	"fmt"
 	"image/draw"
 	"math"
 )
@@ -49,6 +51,9 @@ type processedOutput struct {
 	normalValues     [][]float64
 	texcoords        [][]float32
 
+	// meshNames identifies where each processed mesh came from in the Destiny geometry.
+	meshNames []string
+
 	// These indices map a texture plate index for a geometry to
 	// an entry in the texturePlates array
 	plateIndices           []int
@@ -56,4 +61,31 @@ type processedOutput struct {
 	normalTexturePlates    [10]*texturePlate
 	gearstackTexturePlates [10]*texturePlate
 	pbrTextures            [10]*PBRTextureCollection
+
+	// textureDir is the directory the unpacked textures of the item are read from,
+	// DefaultTextureSourcePath when empty.
+	textureDir string
+
+	// reporter is told about the progress of the writer and any problems, it can be nil.
+	reporter Reporter
+}
+
+// nameParts names every mesh added since the output contained firstPart meshes after the
+// geometry and render mesh they were read from.
+func (output *processedOutput) nameParts(geomName string, meshIndex, firstPart int) {
+	for i := firstPart; i < len(output.positionVertices); i++ {
+		output.meshNames = append(output.meshNames, fmt.Sprintf("%s-%d-%d", geomName, meshIndex, i-firstPart))
+	}
+}
+
+// validate checks there is something to write and every mesh has all of its vertex data.
+func (output *processedOutput) validate() error {
+	if len(output.positionVertices) <= 0 {
+		return errors.New("Empty position vertices, nothing to do here")
+	} else if len(output.positionVertices) != len(output.normalValues) ||
+		len(output.positionVertices) != len(output.texcoords) {
+		return errors.New("Mismatched number of position, normals, or texcoords")
+	}
+
+	return nil
 }
@@ -1,11 +1,11 @@
 package graphics
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"io"
 	"os"
-	"strings"
 
 	"github.com/kpango/glg"
 	"github.com/rking788/destiny-gear-vendor/bungie"
@@ -26,13 +26,80 @@ const (
 type USDWriter struct {
 	Path        string
 	TexturePath string
-	output      io.Writer
+	Options     Options
+
+	// TextureSourcePath is the directory the textures unpacked from the texture files of the
+	// item are read from. DefaultTextureSourcePath is used when it is empty.
+	TextureSourcePath string
+
+	// TextureSink receives the textures used by the model. The textures are written to
+	// TexturePath when it is nil.
+	TextureSink TextureSink
+
+	// Reporter is told how far along writing the model is and about any parts or textures that
+	// had to be skipped. It can be nil.
+	Reporter Reporter
+
+	output *bufio.Writer
 }
 
 // WriteModel will take the provided Destiny geometries and write them to a new file
 // in the USD format.
 func (usd *USDWriter) WriteModel(geoms []*bungie.DestinyGeometry) error {
 
+	processed, bounds, err := usd.process(geoms)
+	if err != nil {
+		return err
+	}
+
+	if usd.Options.Split {
+		err = writeSplit(processed, usd.Path, "usd", usd.coordinateSystem(), PositionScaleConstant,
+			func(part *processedOutput, path string) (int, error) {
+				return len(part.positionVertices[0]) / 9, usd.write(part, path)
+			})
+	} else {
+		err = usd.write(processed, usd.Path)
+	}
+	if err != nil {
+		return err
+	}
+	processed.progress("writing", 1, 1)
+	writeTextures(processed, usd.textureSink(), usd.Options.Textures)
+
+	if usd.Options.WriteMetadata {
+		metadata := newModelMetadata("usd", processed, usd.coordinateSystem(), usd.Options.Pivot,
+			bounds.scaled(PositionScaleConstant))
+		return writeModelMetadata(usd.Path, metadata)
+	}
+
+	return nil
+}
+
+// WriteModelTo writes the provided Destiny geometries to w in the USD format, Path is not used.
+// The Split and WriteMetadata options need a path so they aren't supported.
+func (usd *USDWriter) WriteModelTo(w io.Writer, geoms []*bungie.DestinyGeometry) error {
+
+	if usd.Options.Split {
+		return errors.New("Split models can only be written to a path")
+	}
+
+	processed, _, err := usd.process(geoms)
+	if err != nil {
+		return err
+	}
+
+	err = usd.writeTo(processed, w)
+	if err != nil {
+		return err
+	}
+
+	processed.progress("writing", 1, 1)
+	return writeTextures(processed, usd.textureSink(), usd.Options.Textures)
+}
+
+// process decodes and post-processes the geometries, returning the bounds of the model.
+func (usd *USDWriter) process(geoms []*bungie.DestinyGeometry) (*processedOutput, BoundingBox, error) {
+
 	geomCount := len(geoms)
 	processed := &processedOutput{
 		positionVertices: make([][]float64, 0, geomCount),
@@ -45,64 +112,103 @@ func (usd *USDWriter) WriteModel(geoms []*bungie.DestinyGeometry) error {
 
 	glg.Infof("Writing models for %d geometries", len(geoms))
 
-	for _, geom := range geoms {
+	processed.reporter = usd.Reporter
+	processed.textureDir = usd.TextureSourcePath
+	for i, geom := range geoms {
 		err := processGeometry(geom, processed)
 		if err != nil {
 			glg.Errorf("Failed to process Bungie geometry object: %s", err.Error())
-			return err
+			return nil, BoundingBox{}, err
 		}
+		processed.progress("geometry", i+1, len(geoms))
 	}
 
 	glg.Warnf("Positions count = %d;;;Plate indices count = %d", len(processed.positionVertices), len(processed.plateIndices))
-	usd.write(processed)
-	writeTextures(processed, usd.TexturePath)
+	bounds := postProcess(processed, usd.Options, usd.coordinateSystem())
 
-	return nil
+	return processed, bounds, nil
+}
+
+// textureSink is where the textures of the model are written.
+func (usd *USDWriter) textureSink() TextureSink {
+	if usd.TextureSink != nil {
+		return usd.TextureSink
+	}
+
+	return DirTextureSink(usd.TexturePath)
 }
 
-func (usd *USDWriter) write(processed *processedOutput) error {
+func (usd *USDWriter) write(processed *processedOutput, path string) error {
+
+	// Check before creating the file so nothing is left behind
+	err := processed.validate()
+	if err != nil {
+		return err
+	}
+
+	outF, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer outF.Close()
 
-	if len(processed.positionVertices) <= 0 {
-		return errors.New("Empty position vertices, nothing to do here")
-	} else if len(processed.positionVertices) != len(processed.normalValues) ||
-		len(processed.positionVertices) != len(processed.texcoords) {
-		return errors.New("Mismatched number of position, normals, or texcoords")
+	err = usd.writeTo(processed, outF)
+	if err != nil {
+		return err
 	}
 
-	var err error
-	usd.output, err = NewUSDDoc(usd.Path)
+	return outF.Close()
+}
+
+func (usd *USDWriter) writeTo(processed *processedOutput, w io.Writer) error {
+
+	err := processed.validate()
 	if err != nil {
 		return err
 	}
 
+	// Everything is streamed through the buffer, meshes are never built up in memory
+	usd.output = bufio.NewWriterSize(w, writeBufferSize)
+	writeUSDHeader(usd.output, usd.coordinateSystem().UpAxis)
 	usd.writeMaterials(processed)
 	usd.writeXforms(processed)
 
-	return nil
+	return usd.output.Flush()
+}
+
+// coordinateSystem is the frame the model will be written in.
+func (usd *USDWriter) coordinateSystem() CoordinateSystem {
+	return usd.Options.CoordinateSystem.withDefaults(defaultUSDCoordinateSystem)
 }
 
 // NewUSDDoc is a helper method for opening an io.Writer that can be used
 // to write the contents of the USD file. This will also write the appropriate header metadata.
-func NewUSDDoc(path string) (io.Writer, error) {
+func NewUSDDoc(path string, upAxis Axis) (io.Writer, error) {
 
-	outF, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	outF, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = outF.Write([]byte(`#usda 1.0
+	return outF, writeUSDHeader(outF, upAxis)
+}
+
+// writeUSDHeader writes the layer metadata that starts every USD file.
+func writeUSDHeader(w io.Writer, upAxis Axis) error {
+
+	_, err := w.Write([]byte(`#usda 1.0
 (
     doc = """Generated from the Destiny Gear Vendor"""
 
     endTimeCode = 200
     startTimeCode = 1
     timeCodesPerSecond = 24
-    upAxis = "Z"
+    upAxis = "` + string(upAxis) + `"
 )
 
 `))
 
-	return outF, err
+	return err
 }
 
 func (usd *USDWriter) writeMaterials(processed *processedOutput) error {
@@ -117,16 +223,11 @@ func (usd *USDWriter) writeMaterials(processed *processedOutput) error {
 
 		glg.Infof("Reading pbr index: %d", i)
 		glg.Infof("Writing texture plate with name: %s", plate.name)
-		// TODO: These can be consolidated into a method on the gearstack texture plate type
-		gearstackName := processed.gearstackTexturePlates[i].name
-		aoName := strings.Replace(gearstackName, "gearstack", "AO", -1)
-		metalnessName := strings.Replace(gearstackName, "gearstack", "metalness", -1)
-		roughnessName := strings.Replace(gearstackName, "gearstack", "roughness", -1)
-		emissiveName := strings.Replace(gearstackName, "gearstack", "emissive", -1)
+		pbrNames := processed.gearstackTexturePlates[i].pbrTextureNames(usd.Options.Textures)
 
 		plate.libraryMaterialID = fmt.Sprintf("Material%d", i)
-		normalName := processed.normalTexturePlates[i].name
-		err = usd.writeMaterial(plate.libraryMaterialID, plate.name, normalName, aoName, metalnessName, roughnessName, emissiveName)
+		normalName := usd.Options.Textures.fileName(processed.normalTexturePlates[i].name)
+		err = usd.writeMaterial(plate.libraryMaterialID, usd.Options.Textures.fileName(plate.name), normalName, pbrNames)
 	}
 
 	_, err = usd.output.Write([]byte(`    def Material "lambert1"
@@ -140,7 +241,7 @@ func (usd *USDWriter) writeMaterials(processed *processedOutput) error {
 	return err
 }
 
-func (usd *USDWriter) writeMaterial(matID, albedoFilename, normalName, aoName, metalnessName, roughnessName, emissiveName string) error {
+func (usd *USDWriter) writeMaterial(matID, albedoFilename, normalName string, pbrNames pbrTextureNames) error {
 
 	_, err := usd.output.Write([]byte(`    def Material "` + matID + `"
 	{
@@ -157,11 +258,11 @@ func (usd *USDWriter) writeMaterial(matID, albedoFilename, normalName, aoName, m
 			float inputs:displacement = 0
 			color3f inputs:emissive.connect = </Materials/` + matID + `/emissive_map.outputs:r>
 			float inputs:ior = 1.5
-			float inputs:metallic.connect = </Materials/` + matID + `/metallic_map.outputs:r>
+			float inputs:metallic.connect = </Materials/` + matID + `/metallic_map.outputs:` + pbrNames.metalnessChannel + `>
 			normal3f inputs:normal.connect = </Materials/` + matID + `/normal_map.outputs:rgb>
-			float inputs:occlusion.connect = </Materials/` + matID + `/ao_map.outputs:r>
+			float inputs:occlusion.connect = </Materials/` + matID + `/ao_map.outputs:` + pbrNames.aoChannel + `>
 			float inputs:opacity = 1
-			float inputs:roughness.connect = </Materials/` + matID + `/roughness_map.outputs:r>
+			float inputs:roughness.connect = </Materials/` + matID + `/roughness_map.outputs:` + pbrNames.roughnessChannel + `>
 			color3f inputs:specularColor = (1, 1, 1)
 			int inputs:useSpecularWorkflow = 0
 			token outputs:displacement
@@ -209,40 +310,40 @@ func (usd *USDWriter) writeMaterial(matID, albedoFilename, normalName, aoName, m
         {
             uniform token info:id = "UsdUVTexture"
             float4 inputs:default = (0, 0, 0, 1)
-            asset inputs:file = @` + aoName + `@
+            asset inputs:file = @` + pbrNames.ao + `@
             float2 inputs:st.connect = </Materials/` + matID + `/Primvar.outputs:result>
             token inputs:wrapS = "repeat"
             token inputs:wrapT = "repeat"
-            float outputs:r
+            float outputs:` + pbrNames.aoChannel + `
         }
 
 		def Shader "metallic_map"
         {
             uniform token info:id = "UsdUVTexture"
             float4 inputs:default = (0, 0, 0, 1)
-            asset inputs:file = @` + metalnessName + `@
+            asset inputs:file = @` + pbrNames.metalness + `@
             float2 inputs:st.connect = </Materials/` + matID + `/Primvar.outputs:result>
             token inputs:wrapS = "repeat"
             token inputs:wrapT = "repeat"
-            float outputs:r
+            float outputs:` + pbrNames.metalnessChannel + `
         }
 
         def Shader "roughness_map"
         {
             uniform token info:id = "UsdUVTexture"
             float4 inputs:default = (0, 0, 0, 1)
-            asset inputs:file = @` + roughnessName + `@
+            asset inputs:file = @` + pbrNames.roughness + `@
             float2 inputs:st.connect = </Materials/` + matID + `/Primvar.outputs:result>
             token inputs:wrapS = "repeat"
             token inputs:wrapT = "repeat"
-            float outputs:r
+            float outputs:` + pbrNames.roughnessChannel + `
 		}
 		
 		def Shader "emissive_map"
 		{
 			uniform token info:id = "UsdUVTexture"
             float4 inputs:default = (0, 0, 0, 1)
-            asset inputs:file = @` + emissiveName + `@
+            asset inputs:file = @` + pbrNames.emissive + `@
             float2 inputs:st.connect = </Materials/` + matID + `/Primvar.outputs:result>
             token inputs:wrapS = "repeat"
             token inputs:wrapT = "repeat"
@@ -292,100 +393,121 @@ func (usd *USDWriter) writeMesh(meshIndex int, processed *processedOutput) error
 	}
 
 	glg.Infof("Triangle Count: %d", triangleCount)
-	faceVertexCounts := make([]string, 0, triangleCount)
-	for i := 0; i < triangleCount; i++ {
-		faceVertexCounts = append(faceVertexCounts, "3")
-	}
+
+	out := newNumberWriter(usd.output, usd.Options.precision())
 
 	/**
 	 * OPENING ITEM GEOM MESH + MATERIAL
 	 */
-	usd.output.Write([]byte(`
-    def Mesh "CrimsonPiece` + fmt.Sprintf("%d\"", meshIndex) + `
-    {
-`))
+	out.writeString("\n    def Mesh \"CrimsonPiece")
+	out.writeInt(meshIndex)
+	out.writeString("\"\n    {\n")
 
 	/**
 	 * FACE VERTEX COUNTS *
 	 */
-	faceVertexCountArray := strings.Join(faceVertexCounts, ", ")
-	usd.output.Write([]byte(fmt.Sprintf("        int[] faceVertexCounts = [%s]\n",
-		faceVertexCountArray)))
+	out.writeString("        int[] faceVertexCounts = [")
+	for i := 0; i < triangleCount; i++ {
+		if i > 0 {
+			out.writeString(", ")
+		}
+		out.writeString("3")
+	}
+	out.writeString("]\n")
 
 	/**
 	 * FACE VERTEX INDICES
 	 */
-	vertexIndices := make([]string, 0, len(currentPositions))
-	for i := 0; i < len(currentPositions)/3; i++ {
-		vertexIndices = append(vertexIndices, fmt.Sprintf("%d", i))
-	}
-	joinedVertexIndices := strings.Join(vertexIndices, ", ")
-	usd.output.Write([]byte(fmt.Sprintf("        int[] faceVertexIndices = [%s]\n",
-		joinedVertexIndices)))
+	out.writeString("        int[] faceVertexIndices = [")
+	out.writeSequence(positionCount/3, ", ")
+	out.writeString("]\n")
 
 	// TODO: Each mesh will end up having its own material reference from the Materials section
-	usd.output.Write([]byte(fmt.Sprintf("        rel material:binding = </Materials/%s>\n", materialID)))
+	out.writeString("        rel material:binding = </Materials/" + materialID + ">\n")
 
 	/**
 	 * POINTS
 	 */
-	pointsComponents := make([]string, 0, positionCount/3)
-	for i := 0; i < positionCount; i += 3 {
-		pointsComponents = append(pointsComponents, fmt.Sprintf("(%f, %f, %f)",
-			currentPositions[i]*PositionScaleConstant,
-			currentPositions[i+1]*PositionScaleConstant,
-			currentPositions[i+2]*PositionScaleConstant))
+	out.writeString("        point3f[] points = [")
+	for i := 0; i+2 < positionCount; i += 3 {
+		if i > 0 {
+			out.writeString(", ")
+		}
+		usd.writeTuple(out, currentPositions[i]*PositionScaleConstant, currentPositions[i+1]*PositionScaleConstant,
+			currentPositions[i+2]*PositionScaleConstant)
 	}
-	usd.output.Write([]byte(fmt.Sprintf("        point3f[] points = [%s]\n",
-		strings.Join(pointsComponents, ", "))))
+	out.writeString("]\n")
+
+	/**
+	 * EXTENT
+	 */
+	extent := meshBounds(currentPositions).scaled(PositionScaleConstant).orZero()
+	out.writeString("        float3[] extent = [")
+	usd.writeTuple(out, extent.Min[0], extent.Min[1], extent.Min[2])
+	out.writeString(", ")
+	usd.writeTuple(out, extent.Max[0], extent.Max[1], extent.Max[2])
+	out.writeString("]\n")
 
 	/**
 	 * NORMALS
 	 */
-	normalsComponents := make([]string, 0, normalCount/3)
-	for i := 0; i < normalCount; i += 3 {
-		normalsComponents = append(normalsComponents, fmt.Sprintf("(%f, %f, %f)", currentNormals[i], currentNormals[i+1], currentNormals[i+2]))
+	out.writeString("        normal3f[] primvars:normals = [")
+	for i := 0; i+2 < normalCount; i += 3 {
+		if i > 0 {
+			out.writeString(", ")
+		}
+		usd.writeTuple(out, currentNormals[i], currentNormals[i+1], currentNormals[i+2])
 	}
 	// If this ( is not after the normals, it won't render the file. it is required i guess
-	usd.output.Write([]byte(fmt.Sprintf("        normal3f[] primvars:normals = [%s] (\n            interpolation = \"vertex\"\n        )\n", strings.Join(normalsComponents, ", "))))
+	out.writeString("] (\n            interpolation = \"vertex\"\n        )\n")
 
 	/**
 	 * NORMAL INDICES
 	 */
-	normalIndices := make([]string, 0, len(currentNormals))
-	for i := 0; i < len(currentNormals)/3; i++ {
-		normalIndices = append(normalIndices, fmt.Sprintf("%d", i))
-	}
-	joinedNormalIndices := strings.Join(normalIndices, ", ")
-	usd.output.Write([]byte(fmt.Sprintf("        int[] primvars:normals:indices = [%s]\n",
-		joinedNormalIndices)))
+	out.writeString("        int[] primvars:normals:indices = [")
+	out.writeSequence(normalCount/3, ", ")
+	out.writeString("]\n")
 
 	/**
 	 * TEXTURE COORDINATES
 	 */
-	texcoordComponents := make([]string, 0, texcoordCount/2)
-	for i := 0; i < texcoordCount; i += 2 {
-		texcoordComponents = append(texcoordComponents, fmt.Sprintf("(%f, %f)", currentTexcoords[i], currentTexcoords[i+1]))
+	out.writeString("        float2[] primvars:Texture_uv = [")
+	for i := 0; i+1 < texcoordCount; i += 2 {
+		if i > 0 {
+			out.writeString(", ")
+		}
+		out.writeString("(")
+		out.writeFloat32(currentTexcoords[i])
+		out.writeString(", ")
+		out.writeFloat32(currentTexcoords[i+1])
+		out.writeString(")")
 	}
 	// If this ( is not after the normals, it won't render the file. it is required i guess
-	usd.output.Write([]byte(fmt.Sprintf("        float2[] primvars:Texture_uv = [%s] (\n            interpolation = \"faceVarying\"\n        )\n", strings.Join(texcoordComponents, ", "))))
+	out.writeString("] (\n            interpolation = \"faceVarying\"\n        )\n")
 
 	/**
 	 * TEXTURE COORDINATE INDICES
 	 */
-	texcoordIndices := make([]string, 0, len(currentTexcoords))
-	for i := 0; i < len(currentTexcoords)/2; i++ {
-		texcoordIndices = append(texcoordIndices, fmt.Sprintf("%d", i))
-	}
-	joinedTexcoordIndices := strings.Join(normalIndices, ", ")
-	usd.output.Write([]byte(fmt.Sprintf("        int[] primvars:Texture_uv:indices = [%s]\n",
-		joinedTexcoordIndices)))
+	out.writeString("        int[] primvars:Texture_uv:indices = [")
+	out.writeSequence(texcoordCount/2, ", ")
+	out.writeString("]\n")
 
 	/**
 	 * CLOSING MESH
 	 */
 	//usd.output.Write([]byte("    uniform token subdivisionScheme = \"none\"}\n"))
-	usd.output.Write([]byte("    }\n"))
+	out.writeString("    }\n")
 
 	return nil
 }
+
+// writeTuple writes the values as a USD tuple, "(x, y, z)".
+func (usd *USDWriter) writeTuple(out *numberWriter, x, y, z float64) {
+	out.writeString("(")
+	out.writeFloat(x)
+	out.writeString(", ")
+	out.writeFloat(y)
+	out.writeString(", ")
+	out.writeFloat(z)
+	out.writeString(")")
+}
@@ -0,0 +1,27 @@
+package graphics
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/kpango/glg"
+)
+
+func BenchmarkUSDWrite(b *testing.B) {
+
+	glg.Get().SetMode(glg.NONE)
+	defer glg.Get().SetMode(glg.STD)
+
+	processed := benchmarkModel()
+	path := filepath.Join(b.TempDir(), "model.usda")
+	usd := &USDWriter{Path: path}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := usd.write(processed, path)
+		if err != nil {
+			b.Fatalf("Failed to write USD: %s", err.Error())
+		}
+	}
+}
@@ -0,0 +1,263 @@
+// Package metrics keeps counters, gauges and histograms and writes them in the Prometheus text
+// exposition format, so the server can be scraped without pulling in the Prometheus client.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// labelSeparator joins the label values of a series into a map key, it can't appear in valid
+// UTF-8 label values.
+const labelSeparator = "\xff"
+
+// Collector is a metric that can be added to a Registry.
+type Collector interface {
+	write(w *bufio.Writer)
+}
+
+// Registry is a set of metrics written out together.
+type Registry struct {
+	mutex      sync.Mutex
+	collectors []Collector
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register adds the metrics to the registry, they are written in the order they were added.
+func (registry *Registry) Register(collectors ...Collector) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	registry.collectors = append(registry.collectors, collectors...)
+}
+
+// Write writes every metric in the registry to w in the text exposition format.
+func (registry *Registry) Write(w io.Writer) error {
+
+	registry.mutex.Lock()
+	collectors := append([]Collector(nil), registry.collectors...)
+	registry.mutex.Unlock()
+
+	buffered := bufio.NewWriter(w)
+	for _, collector := range collectors {
+		collector.write(buffered)
+	}
+
+	return buffered.Flush()
+}
+
+// desc is the name, help and label names shared by every type of metric.
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (d *desc) writeHeader(w *bufio.Writer, kind string) {
+	help := strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, help, d.name, kind)
+}
+
+// key joins the label values into the key of the series, panicking if the wrong number of values
+// is given since that is always a programming mistake.
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, labelSeparator)
+}
+
+// labelPairs formats the labels of a series, along with any extra name and value pairs.
+func (d *desc) labelPairs(key string, extra ...string) string {
+
+	pairs := make([]string, 0, len(d.labels)+len(extra)/2)
+	if len(d.labels) > 0 {
+		for i, value := range strings.Split(key, labelSeparator) {
+			pairs = append(pairs, fmt.Sprintf(`%s="%s"`, d.labels[i], escapeLabel(value)))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], escapeLabel(extra[i+1])))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Counter is a value per set of labels that only goes up.
+type Counter struct {
+	desc
+	mutex  sync.Mutex
+	values map[string]float64
+}
+
+// NewCounter creates a counter with the label names, a counter without labels starts out at zero.
+func NewCounter(name, help string, labels ...string) *Counter {
+	counter := &Counter{desc: desc{name, help, labels}, values: make(map[string]float64)}
+	if len(labels) == 0 {
+		counter.values[""] = 0
+	}
+	return counter
+}
+
+// Inc adds one to the counter with the label values.
+func (counter *Counter) Inc(labelValues ...string) {
+	counter.Add(1, labelValues...)
+}
+
+// Add adds value, which must not be negative, to the counter with the label values.
+func (counter *Counter) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		panic(fmt.Sprintf("metrics: %s can't be decreased", counter.name))
+	}
+
+	key := counter.key(labelValues)
+	counter.mutex.Lock()
+	counter.values[key] += value
+	counter.mutex.Unlock()
+}
+
+// Value is the current value of the counter with the label values.
+func (counter *Counter) Value(labelValues ...string) float64 {
+	key := counter.key(labelValues)
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+
+	return counter.values[key]
+}
+
+func (counter *Counter) write(w *bufio.Writer) {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+
+	counter.writeHeader(w, "counter")
+	for _, key := range sortedKeys(counter.values) {
+		fmt.Fprintf(w, "%s%s %s\n", counter.name, counter.labelPairs(key), formatValue(counter.values[key]))
+	}
+}
+
+// GaugeFunc is a gauge without labels whose value is read when the metrics are written.
+type GaugeFunc struct {
+	desc
+	value func() float64
+}
+
+// NewGaugeFunc creates a gauge reporting the value returned by fn.
+func NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	return &GaugeFunc{desc: desc{name: name, help: help}, value: fn}
+}
+
+func (gauge *GaugeFunc) write(w *bufio.Writer) {
+	gauge.writeHeader(w, "gauge")
+	fmt.Fprintf(w, "%s %s\n", gauge.name, formatValue(gauge.value()))
+}
+
+// Histogram counts observations per set of labels in buckets by their upper bounds, along with
+// their sum.
+type Histogram struct {
+	desc
+	buckets []float64
+
+	mutex  sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram creates a histogram with the bucket upper bounds, which must be sorted in
+// increasing order. The +Inf bucket is always added.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("metrics: the buckets of %s must be sorted", name))
+	}
+	return &Histogram{
+		desc:    desc{name, help, labels},
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+}
+
+// Observe adds the value to the histogram with the label values.
+func (histogram *Histogram) Observe(value float64, labelValues ...string) {
+
+	key := histogram.key(labelValues)
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+
+	series, ok := histogram.series[key]
+	if !ok {
+		series = &histogramSeries{counts: make([]uint64, len(histogram.buckets))}
+		histogram.series[key] = series
+	}
+
+	for i, bound := range histogram.buckets {
+		if value <= bound {
+			series.counts[i]++
+		}
+	}
+	series.count++
+	series.sum += value
+}
+
+func (histogram *Histogram) write(w *bufio.Writer) {
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+
+	keys := make([]string, 0, len(histogram.series))
+	for key := range histogram.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	histogram.writeHeader(w, "histogram")
+	for _, key := range keys {
+		series := histogram.series[key]
+		for i, bound := range histogram.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", histogram.name, histogram.labelPairs(key, "le", formatValue(bound)), series.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", histogram.name, histogram.labelPairs(key, "le", "+Inf"), series.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", histogram.name, histogram.labelPairs(key), formatValue(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", histogram.name, histogram.labelPairs(key), series.count)
+	}
+}
@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRegistryWrite(t *testing.T) {
+
+	conversions := NewCounter("conversions_total", "Conversions by format and result.", "format", "result")
+	conversions.Inc("stl", "success")
+	conversions.Inc("dae", "failure")
+	conversions.Add(2, "stl", "success")
+
+	downloads := NewCounter("downloads_total", "Downloads\nfrom the CDN.")
+	depth := NewGaugeFunc("queue_depth", "Waiting jobs.", func() float64 { return 3 })
+
+	durations := NewHistogram("duration_seconds", "How long it took.", []float64{0.5, 1}, "kind")
+	durations.Observe(0.25, `tex"ture`)
+	durations.Observe(0.75, `tex"ture`)
+	durations.Observe(2, `tex"ture`)
+
+	registry := NewRegistry()
+	registry.Register(conversions, downloads, depth, durations)
+
+	buffer := &bytes.Buffer{}
+	if err := registry.Write(buffer); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP conversions_total Conversions by format and result.
+# TYPE conversions_total counter
+conversions_total{format="dae",result="failure"} 1
+conversions_total{format="stl",result="success"} 3
+# HELP downloads_total Downloads\nfrom the CDN.
+# TYPE downloads_total counter
+downloads_total 0
+# HELP queue_depth Waiting jobs.
+# TYPE queue_depth gauge
+queue_depth 3
+# HELP duration_seconds How long it took.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{kind="tex\"ture",le="0.5"} 1
+duration_seconds_bucket{kind="tex\"ture",le="1"} 2
+duration_seconds_bucket{kind="tex\"ture",le="+Inf"} 3
+duration_seconds_sum{kind="tex\"ture"} 3
+duration_seconds_count{kind="tex\"ture"} 3
+`
+	if buffer.String() != expected {
+		t.Errorf("Unexpected metrics written:\n%s\nexpected:\n%s", buffer.String(), expected)
+	}
+
+	if conversions.Value("stl", "success") != 3 || conversions.Value("usdz", "success") != 0 {
+		t.Errorf("Wrong counter values")
+	}
+}